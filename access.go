@@ -0,0 +1,116 @@
+package gosp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Client IP access rules for a route or group
+type Access struct {
+	Allow    string `xml:"allow,attr"`
+	Deny     string `xml:"deny,attr"`
+	Status   int    `xml:"status,attr"`
+	Template string `xml:"template,attr"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// prepare parses the CIDR lists and defaults the rejection status to 403
+func (access *Access) prepare() error {
+	var err error
+	if access.allow, err = parseCIDRs(access.Allow); err != nil {
+		return fmt.Errorf("access allow: %v", err)
+	}
+	if access.deny, err = parseCIDRs(access.Deny); err != nil {
+		return fmt.Errorf("access deny: %v", err)
+	}
+
+	if access.Status == 0 {
+		access.Status = http.StatusForbidden
+	}
+	if access.Status < 400 || access.Status > 599 {
+		return fmt.Errorf("access status must be a 4xx or 5xx code, got %d", access.Status)
+	}
+
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs or single addresses
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// An address stands for itself, an IPv4-mapped one for its IPv4
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// permits reports whether ip may access the route. Allow rules win over
+// deny rules; with an allow list, addresses matching neither are rejected.
+func (access *Access) permits(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if matchesAny(access.allow, ip) {
+		return true
+	}
+	if matchesAny(access.deny, ip) {
+		return false
+	}
+	return len(access.allow) == 0
+}
+
+func matchesAny(networks []*net.IPNet, ip net.IP) bool {
+	// Compare IPv4-mapped IPv6 addresses as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func accessMiddleware(access *Access) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if access.permits(net.ParseIP(c.RealIP())) {
+				return next(c)
+			}
+
+			if access.Template != "" {
+				return renderTemplate(c, access.Template, access.Status)
+			}
+			return c.String(access.Status, http.StatusText(access.Status))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gosp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The access rules of a group hold for its pages reached through dot
+// segments too
+func TestAccessRulesWithDotSegments(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"ops/status.html": "ops status",
+		"ops/index.html":  "ops home",
+		"ops/deep/x.html": "ops deep",
+		"open/index.html": "open",
+		"open/inner.html": "inner",
+	}, `<routes><group prefix="/ops"><access allow="10.0.0.0/8" deny="0.0.0.0/0"/></group></routes>`)
+
+	// httptest requests come from 192.0.2.1
+	for _, path := range []string{
+		"/ops/status",
+		"/pub/../ops/status",
+		"/pub/%2e%2e/ops/status",
+		"/open/./../ops/deep/x",
+		"/pub/../ops/",
+		"//ops/status",
+	} {
+		if res, body := get(t, handler, http.MethodGet, path); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s from outside the allowed network: %d %q", path, res.StatusCode, body)
+		}
+	}
+	if res, body := get(t, handler, http.MethodGet, "/ops/../open/inner"); res.StatusCode != http.StatusOK || body != "inner" {
+		t.Errorf("/ops/../open/inner: %d %q", res.StatusCode, body)
+	}
+}
+
+// Addresses stand for themselves in access rules and --trusted-proxies,
+// IPv4-mapped ones for their IPv4 address alone
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs("10.0.0.0/8, 192.0.2.7,2001:db8::1,, ::ffff:198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"11.0.0.1":         false,
+		"192.0.2.7":        true,
+		"192.0.2.8":        false,
+		"2001:db8::1":      true,
+		"2001:db8::2":      false,
+		"198.51.100.1":     true,
+		"::ffff:1.2.3.4":   false,
+		"::ffff:192.0.2.7": true,
+	} {
+		contained := false
+		for _, network := range networks {
+			contained = contained || network.Contains(net.ParseIP(ip))
+		}
+		if contained != want {
+			t.Errorf("%s in the list: %v, want %v", ip, contained, want)
+		}
+	}
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/"} {
+		if _, err := parseCIDRs(list); err == nil {
+			t.Errorf("%q parsed", list)
+		}
+	}
+}
+
+// Forwarded addresses are believed from --trusted-proxies only
+func TestTrustedProxies(t *testing.T) {
+	pages := map[string]string{"ip.html": "<%= request.ip %>"}
+	for proxies, want := range map[string]string{
+		"":                 "192.0.2.1",
+		"192.0.2.1":        "203.0.113.9",
+		"192.0.2.0/24":     "203.0.113.9",
+		"::ffff:192.0.2.1": "203.0.113.9",
+		"198.51.100.0/24":  "192.0.2.1",
+	} {
+		handler, _ := newTestSite(t, pages, "<routes/>", Flag("trusted-proxies", proxies))
+		if _, body := get(t, handler, http.MethodGet, "/ip", "X-Forwarded-For", "203.0.113.9"); body != want {
+			t.Errorf("--trusted-proxies %q: client %q, want %q", proxies, body, want)
+		}
+	}
+	if _, err := New(Root(t.TempDir()), Flag("trusted-proxies", "10.0.0.0/99")); err == nil || !strings.Contains(err.Error(), "--trusted-proxies") {
+		t.Errorf("invalid --trusted-proxies: %v", err)
+	}
+}
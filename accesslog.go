@@ -0,0 +1,241 @@
+package gosp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// Context key of the template a request rendered, for the access log
+const templateNameKey = "gosp.templateName"
+
+// Fields of the access log, in the order of the json format
+var accessLogFields = []string{
+	"time", "id", "remote_ip", "peer_ip", "host", "method", "uri", "route", "template", "user_agent", "referer",
+	"status", "error", "latency", "latency_human", "bytes_in", "bytes_out", "api_key",
+}
+
+// Fields written as JSON numbers
+var numericLogFields = map[string]bool{"status": true, "latency": true, "bytes_in": true, "bytes_out": true}
+
+// accessLogSettings are set by the --access-log flags
+type accessLogSettings struct {
+	// json, or a template such as "${remote_ip} ${method} ${uri} ${status}"
+	Format string
+
+	// stdout, stderr or a file path
+	Output string
+
+	// Rotation of file output, unset keeps a single growing file
+	MaxSize    string
+	MaxAge     time.Duration
+	MaxBackups int
+
+	// Comma-separated paths that aren't logged, e.g. health checks
+	Exclude string
+
+	// Log requests for missing well-known files such as favicon.ico
+	MissingWellKnown bool
+}
+
+// accessLogger writes one line per request
+type accessLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	// Literal text and fields of a template format, nil for json
+	segments []logSegment
+	exclude  []string
+
+	// Set by --access-log-missing-well-known
+	missingWellKnown bool
+}
+
+type logSegment struct {
+	literal string
+	field   string
+}
+
+func newAccessLogger(settings accessLogSettings) (*accessLogger, error) {
+	logger := &accessLogger{exclude: splitList(settings.Exclude), missingWellKnown: settings.MissingWellKnown}
+
+	rotated := settings.MaxSize != "" || settings.MaxAge != 0 || settings.MaxBackups != 0
+	switch settings.Output {
+	case "", "stdout", "stderr":
+		if rotated {
+			return nil, fmt.Errorf("access log rotation needs a file --access-log")
+		}
+		logger.out = os.Stdout
+		if settings.Output == "stderr" {
+			logger.out = os.Stderr
+		}
+	default:
+		var maxSize int64
+		if settings.MaxSize != "" {
+			size, err := bytes.Parse(settings.MaxSize)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid --access-log-max-size %q", settings.MaxSize)
+			}
+			maxSize = size
+		}
+		if settings.MaxAge < 0 || settings.MaxBackups < 0 {
+			return nil, fmt.Errorf("--access-log-max-age and --access-log-max-backups can't be negative")
+		}
+		file, err := newRotatingFile(settings.Output, maxSize, settings.MaxAge, settings.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("opening access log: %v", err)
+		}
+		logger.out = file
+	}
+
+	if settings.Format != "" && settings.Format != "json" {
+		segments, err := parseLogFormat(settings.Format)
+		if err != nil {
+			return nil, err
+		}
+		logger.segments = segments
+	}
+	return logger, nil
+}
+
+// parseLogFormat splits a template format into literal text and ${field}s
+func parseLogFormat(format string) ([]logSegment, error) {
+	fieldRegex := regexp.MustCompile(`\$\{(\w+)\}`)
+
+	var segments []logSegment
+	last := 0
+	for _, loc := range fieldRegex.FindAllStringSubmatchIndex(format, -1) {
+		field := format[loc[2]:loc[3]]
+		if !containsString(accessLogFields, field) {
+			return nil, fmt.Errorf("unknown access log field ${%s}, expected one of %v", field, accessLogFields)
+		}
+		segments = append(segments, logSegment{literal: format[last:loc[0]], field: field})
+		last = loc[1]
+	}
+	segments = append(segments, logSegment{literal: format[last:]})
+	return append(segments, logSegment{literal: "\n"}), nil
+}
+
+// middleware logs requests after the error handler ran, so the status is
+// the one sent
+func (logger *accessLogger) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if excludedPath(c.Request().URL.Path, logger.exclude) {
+				return next(c)
+			}
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			if c.Get(wellKnownMissingKey) != nil && !logger.missingWellKnown {
+				return err
+			}
+			logger.write(c, start, err)
+			return err
+		}
+	}
+}
+
+func (logger *accessLogger) write(c echo.Context, start time.Time, err error) {
+	stop := time.Now()
+	var line []byte
+
+	if logger.segments != nil {
+		for _, segment := range logger.segments {
+			line = append(line, segment.literal...)
+			if segment.field != "" {
+				line = append(line, accessLogValue(c, segment.field, start, stop, err)...)
+			}
+		}
+	} else {
+		line = append(line, '{')
+		for _, field := range accessLogFields {
+			value := accessLogValue(c, field, start, stop, err)
+			if field == "api_key" && value == "" {
+				continue
+			}
+			if len(line) > 1 {
+				line = append(line, ',')
+			}
+			line = append(append(append(line, '"'), field...), `":`...)
+			if numericLogFields[field] {
+				line = append(line, value...)
+			} else {
+				encoded, _ := json.Marshal(value)
+				line = append(line, encoded...)
+			}
+		}
+		line = append(line, "}\n"...)
+	}
+
+	logger.mu.Lock()
+	logger.out.Write(line)
+	logger.mu.Unlock()
+}
+
+func accessLogValue(c echo.Context, field string, start, stop time.Time, err error) string {
+	req := c.Request()
+	res := c.Response()
+
+	switch field {
+	case "time":
+		return stop.Format(time.RFC3339Nano)
+	case "id":
+		if id := req.Header.Get(echo.HeaderXRequestID); id != "" {
+			return id
+		}
+		return res.Header().Get(echo.HeaderXRequestID)
+	case "remote_ip":
+		return c.RealIP()
+	case "peer_ip":
+		return peerIP(req)
+	case "host":
+		return req.Host
+	case "method":
+		return req.Method
+	case "uri":
+		return req.RequestURI
+	case "route":
+		return c.Path()
+	case "template":
+		name, _ := c.Get(templateNameKey).(string)
+		return name
+	case "user_agent":
+		return req.UserAgent()
+	case "referer":
+		return req.Referer()
+	case "status":
+		return strconv.Itoa(res.Status)
+	case "error":
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	case "latency":
+		return strconv.FormatInt(int64(stop.Sub(start)), 10)
+	case "latency_human":
+		return stop.Sub(start).String()
+	case "bytes_in":
+		if req.ContentLength > 0 {
+			return strconv.FormatInt(req.ContentLength, 10)
+		}
+		return "0"
+	case "bytes_out":
+		return strconv.FormatInt(res.Size, 10)
+	case "api_key":
+		name, _ := c.Get(apiKeyNameKey).(string)
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+package gosp
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminInfo is the JSON document of the admin endpoint
+type adminInfo struct {
+	Build     adminBuild      `json:"build"`
+	Routes    []adminRoute    `json:"routes"`
+	Templates []adminTemplate `json:"templates"`
+	Caches    adminCaches     `json:"caches"`
+	Watcher   adminWatcher    `json:"watcher"`
+}
+
+type adminBuild struct {
+	Mode      string    `json:"mode"`
+	GoVersion string    `json:"go_version"`
+	Module    string    `json:"module,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Revision  string    `json:"revision,omitempty"`
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+}
+
+type adminRoute struct {
+	Order    int      `json:"order"`
+	Methods  []string `json:"methods"`
+	Path     string   `json:"path"`
+	File     string   `json:"file"`
+	Priority int      `json:"priority,omitempty"`
+	AliasOf  string   `json:"alias_of,omitempty"`
+	Source   string   `json:"source,omitempty"`
+}
+
+type adminTemplate struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Embedded bool       `json:"embedded,omitempty"`
+
+	// Templates it includes directly
+	Includes []string `json:"includes,omitempty"`
+}
+
+type adminCaches struct {
+	Response adminCacheStats `json:"response"`
+}
+
+type adminCacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type adminWatcher struct {
+	Enabled     bool       `json:"enabled"`
+	Mode        string     `json:"mode,omitempty"`
+	Roots       []string   `json:"roots,omitempty"`
+	Dirs        int        `json:"dirs,omitempty"`
+	LastEvent   *time.Time `json:"last_event,omitempty"`
+	Dropped     uint64     `json:"dropped_changes,omitempty"`
+	Errors      uint64     `json:"errors,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Watched     []string   `json:"watched,omitempty"`
+}
+
+// adminState holds what the admin endpoint reports besides live counters
+type adminState struct {
+	mode      string
+	started   time.Time
+	routes    []adminRoute
+	templates func() []adminTemplate
+
+	// The response cache, nil when there is none
+	responses *responseCache
+
+	// The file watcher, nil when not watching
+	watcher *FileWatcher
+}
+
+// newAdminState captures the route table of a server's site
+func newAdminState(routes *RouteConfig, srv *server) *adminState {
+	options := srv.options
+	limit := parseIncludeLimit(routes.IncludeLimit)
+	state := &adminState{mode: "development", started: time.Now(), responses: srv.responses, templates: func() []adminTemplate {
+		return srv.fileTemplates(options.root, limit, options.embedded)
+	}}
+	if options.embedded {
+		state.mode = "compiled"
+	}
+	for i, route := range routes.effectiveRoutes() {
+		file := route.File
+		if file == "" {
+			file = "(file-based)"
+		} else if route.spa != nil {
+			file += " (spa)"
+		} else if route.static != nil {
+			file += " (static)"
+		}
+		source := route.source
+		if source == "" {
+			source = options.config
+		}
+		state.routes = append(state.routes, adminRoute{
+			Order:    i + 1,
+			Methods:  route.Methods,
+			Path:     route.Path,
+			File:     file,
+			Priority: route.Priority,
+			AliasOf:  route.aliasOf,
+			Source:   source,
+		})
+	}
+	return state
+}
+
+// fileTemplates lists the pages under root with their size, mtime and
+// includes, or for those embedded in compiled binaries without the mtime
+func (srv *server) fileTemplates(root string, limit int, embedded bool) []adminTemplate {
+	var templates []adminTemplate
+	graph := srv.includeGraph(root, limit)
+	for _, name := range srv.files.templateNames(root) {
+		info, err := srv.files.statRootFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			continue
+		}
+		template := adminTemplate{Name: name, Size: info.Size(), Embedded: embedded, Includes: graph[name]}
+		if !embedded {
+			modified := info.ModTime()
+			template.Modified = &modified
+		}
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+func (state *adminState) info() adminInfo {
+	info := adminInfo{
+		Build: adminBuild{
+			Mode:      state.mode,
+			GoVersion: runtime.Version(),
+			Started:   state.started,
+			Uptime:    time.Since(state.started).Round(time.Second).String(),
+		},
+		Routes:    state.routes,
+		Templates: state.templates(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info.Build.Module, info.Build.Version = build.Main.Path, build.Main.Version
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Build.Revision = setting.Value
+			}
+		}
+	}
+
+	if state.responses != nil {
+		stats := state.responses.entries.Stats()
+		info.Caches.Response = adminCacheStats{
+			Entries:   stats.Entries,
+			Bytes:     stats.Bytes,
+			Hits:      stats.Hits,
+			Misses:    stats.Misses,
+			Evictions: stats.Evictions,
+		}
+	}
+
+	if state.watcher != nil {
+		info.Watcher = state.watcher.status()
+		sort.Strings(info.Watcher.Watched)
+	}
+	return info
+}
+
+// adminAuth protects the admin endpoints with the --admin-auth users, or
+// leaves them to the --auth gate
+func adminAuth(users []string, gated bool, flag string) ([]echo.MiddlewareFunc, error) {
+	if len(users) == 0 {
+		if !gated {
+			return nil, fmt.Errorf("%s needs --admin-auth or --auth", flag)
+		}
+		return nil, nil
+	}
+	auth, err := basicAuthUsers(users, "gosp admin", "--admin-auth")
+	if err != nil {
+		return nil, err
+	}
+	return []echo.MiddlewareFunc{authMiddleware(auth)}, nil
+}
+
+// adminHandler answers with JSON, or an HTML page rendered by the template
+// engine for browsers
+func adminHandler(state *adminState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		info := state.info()
+		if c.QueryParam("format") == "json" || !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/html") {
+			return c.JSONPretty(http.StatusOK, info, "  ")
+		}
+
+		processor := &TemplateProcessor{data: adminPageData(info), ctx: c.Request().Context()}
+		page, err := processor.processTemplate(adminPage, c)
+		if err != nil {
+			return err
+		}
+		return c.HTML(http.StatusOK, page)
+	}
+}
+
+// adminPageData renders the tables of the HTML view, escaped here as the
+// page has no content type to escape output tags by
+func adminPageData(info adminInfo) map[string]interface{} {
+	var routes, templates strings.Builder
+	for _, route := range info.Routes {
+		path := route.Path
+		if route.AliasOf != "" {
+			path += " (alias of " + route.AliasOf + ")"
+		}
+		fmt.Fprintf(&routes, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			route.Order, html.EscapeString(strings.ToUpper(strings.Join(route.Methods, ","))), html.EscapeString(path),
+			html.EscapeString(route.File), route.Priority, html.EscapeString(route.Source))
+	}
+	for _, template := range info.Templates {
+		modified := "embedded"
+		if template.Modified != nil {
+			modified = template.Modified.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&templates, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td></tr>\n", html.EscapeString(template.Name), template.Size, modified,
+			html.EscapeString(strings.Join(template.Includes, ", ")))
+	}
+
+	return map[string]interface{}{
+		"admin.mode":       info.Build.Mode,
+		"admin.go":         info.Build.GoVersion,
+		"admin.version":    html.EscapeString(strings.TrimSpace(info.Build.Module + " " + info.Build.Version + " " + info.Build.Revision)),
+		"admin.uptime":     info.Build.Uptime,
+		"admin.routes":     routes.String(),
+		"admin.templates":  templates.String(),
+		"cache.entries":    info.Caches.Response.Entries,
+		"cache.bytes":      info.Caches.Response.Bytes,
+		"cache.hits":       info.Caches.Response.Hits,
+		"cache.misses":     info.Caches.Response.Misses,
+		"watcher.enabled":  info.Watcher.Enabled,
+		"watcher.watching": len(info.Watcher.Watched),
+		"watcher.roots":    html.EscapeString(strings.Join(info.Watcher.Roots, ", ")),
+		"watcher.mode":     info.Watcher.Mode,
+		"watcher.dirs":     info.Watcher.Dirs,
+		"watcher.last":     adminTime(info.Watcher.LastEvent),
+		"watcher.dropped":  info.Watcher.Dropped,
+		"watcher.errors":   info.Watcher.Errors,
+		"watcher.failing":  info.Watcher.Errors > 0,
+		"watcher.error":    html.EscapeString(info.Watcher.LastError),
+		"watcher.error_at": adminTime(info.Watcher.LastErrorAt),
+	}
+}
+
+// adminTime formats a time of the admin page, "never" for none
+func adminTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gosp admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>gosp admin</h1>
+<p><%= admin.mode %> mode, built with <%= admin.go %>, up <%= admin.uptime %></p>
+<p><%= admin.version %></p>
+<h2>Response cache</h2>
+<p><%= cache.entries %> entries, <%= cache.bytes %> bytes, <%= cache.hits %> hits, <%= cache.misses %> misses</p>
+<h2>Watcher</h2>
+<% if watcher.enabled %><p>Watching <%= watcher.watching %> paths, <%= watcher.dirs %> directories, under <%= watcher.roots %> with <%= watcher.mode %></p>
+<p>Last change <%= watcher.last %>, <%= watcher.dropped %> changes dropped by subscribers</p>
+<% if watcher.failing %><p><%= watcher.errors %> errors, the last at <%= watcher.error_at %>: <%= watcher.error %></p><% end %><% else %><p>Not watching</p><% end %>
+<h2>Routes</h2>
+<table>
+<tr><th>Order</th><th>Methods</th><th>Path</th><th>File</th><th>Priority</th><th>Source</th></tr>
+<%= admin.routes %></table>
+<h2>Templates</h2>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th><th>Includes</th></tr>
+<%= admin.templates %></table>
+</body>
+</html>
+`
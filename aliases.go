@@ -0,0 +1,102 @@
+package gosp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// withAliases returns the route mounted below prefix, followed by a copy of
+// it for each alias
+func (route Route) withAliases(prefix string) []Route {
+	route.Path = prefix + route.Path
+	primary := route.normalizeCase()
+	routes := []Route{primary}
+
+	for _, alias := range route.Aliases {
+		aliasRoute := route
+		aliasRoute.Path = prefix + strings.TrimSpace(alias)
+		aliasRoute.Aliases = nil
+		aliasRoute.aliasOf = primary.Path
+		routes = append(routes, aliasRoute.normalizeCase())
+	}
+	return routes
+}
+
+// validateAliases checks the alias paths, and that redirecting aliases can
+// fill in every parameter of the primary path
+func (route *Route) validateAliases() error {
+	switch route.RedirectAliases {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid redirectAliases %q, expected true or false", route.RedirectAliases)
+	}
+
+	for _, alias := range route.Aliases {
+		alias = strings.TrimSpace(alias)
+		if !strings.HasPrefix(alias, "/") {
+			return fmt.Errorf("alias %q must start with /", alias)
+		}
+		if route.RedirectAliases != "true" {
+			continue
+		}
+		for _, param := range pathParams(route.Path) {
+			if !containsString(pathParams(alias), param) {
+				return fmt.Errorf("alias %s redirects to %s but has no %s parameter", alias, route.Path, param)
+			}
+		}
+	}
+	return nil
+}
+
+// AliasRedirect returns the primary path an alias route redirects to, or
+// an empty string for primaries and aliases served in place
+func (route Route) AliasRedirect() string {
+	if route.RedirectAliases == "true" {
+		return route.aliasOf
+	}
+	return ""
+}
+
+func aliasRedirectHandler(primary string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return redirectPreservingQuery(c, expandRoutePath(primary, c))
+	}
+}
+
+// expandRoutePath fills the parameters and wildcard of a route path from
+// the values matched for the current request
+func expandRoutePath(routePath string, c echo.Context) string {
+	segments := strings.Split(routePath, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = url.PathEscape(c.Param(segment[1:]))
+		case segment == "*":
+			segments[i] = c.Param("*")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// pathParams lists the parameter and wildcard segments of a route path
+func pathParams(routePath string) []string {
+	var params []string
+	for _, segment := range strings.Split(routePath, "/") {
+		if strings.HasPrefix(segment, ":") || segment == "*" {
+			params = append(params, segment)
+		}
+	}
+	return params
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
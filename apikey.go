@@ -0,0 +1,252 @@
+package gosp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Context key of the name of the API key that authenticated the request
+	apiKeyNameKey = "gosp.apiKeyName"
+
+	// Set once a template read the key name, making the response personal
+	apiKeyNameUsedKey = "gosp.apiKeyNameUsed"
+)
+
+// apiKey is a named key, kept only as its SHA-256 digest
+type apiKey struct {
+	Name   string
+	Digest string
+}
+
+// apiKeyStore holds the keys of one auth block, replaced when the keys
+// file changes
+type apiKeyStore struct {
+	mu   sync.RWMutex
+	keys []apiKey
+}
+
+// prepareAPIKeys loads the keys of type="apikey". Relative keys files are
+// resolved against the config file directory, and read from files, again
+// as they change.
+func (auth *Auth) prepareAPIKeys(files *siteFS, baseDir string) error {
+	auth.files = files
+	if auth.Header == "" {
+		auth.Header = "X-API-Key"
+	}
+	if auth.KeysFile != "" {
+		auth.keysPath = auth.KeysFile
+		if !filepath.IsAbs(auth.keysPath) {
+			auth.keysPath = filepath.Join(baseDir, auth.keysPath)
+		}
+	}
+
+	keys, err := auth.loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	auth.apiKeys = &apiKeyStore{keys: keys}
+	return nil
+}
+
+func (auth *Auth) loadAPIKeys() ([]apiKey, error) {
+	var keys []apiKey
+	for _, entry := range strings.Split(auth.Keys, ",") {
+		key, err := parseAPIKey(entry)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+
+	if auth.keysPath != "" {
+		file, err := auth.files.openFile(auth.keysPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open keys file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, err := parseAPIKey(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", auth.KeysFile, err)
+			}
+			if key != nil {
+				keys = append(keys, *key)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read keys file: %v", err)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("apikey auth requires at least one key")
+	}
+	return keys, nil
+}
+
+// parseAPIKey reads name:key, or name:sha256:<hex digest> for hashed keys
+func parseAPIKey(entry string) (*apiKey, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil, nil
+	}
+
+	name, key, found := strings.Cut(entry, ":")
+	if !found || name == "" || key == "" {
+		// Never echo the entry itself, it holds the key
+		return nil, fmt.Errorf("malformed key entry, expected name:key")
+	}
+
+	if hashed := strings.TrimPrefix(key, "sha256:"); hashed != key {
+		digest, err := hex.DecodeString(hashed)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("malformed sha256 digest for key %q", name)
+		}
+		return &apiKey{Name: name, Digest: string(digest)}, nil
+	}
+
+	digest := sha256.Sum256([]byte(key))
+	return &apiKey{Name: name, Digest: string(digest[:])}, nil
+}
+
+// reloadAPIKeys rereads the keys file, keeping the current keys when it
+// can't be loaded
+func (auth *Auth) reloadAPIKeys() error {
+	keys, err := auth.loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	auth.apiKeys.mu.Lock()
+	auth.apiKeys.keys = keys
+	auth.apiKeys.mu.Unlock()
+	return nil
+}
+
+// apiKeyFiles returns the auth blocks reading a keys file
+func (config *RouteConfig) apiKeyFiles() []*Auth {
+	var auths []*Auth
+	seen := make(map[*Auth]bool)
+	for _, route := range config.effectiveRoutes() {
+		if route.Auth != nil && route.Auth.keysPath != "" && !seen[route.Auth] {
+			seen[route.Auth] = true
+			auths = append(auths, route.Auth)
+		}
+	}
+	return auths
+}
+
+// reloadAPIKeys applies a change of a keys file. Editors that replace the
+// file drop the watch, so it is added again.
+func (fw *FileWatcher) reloadAPIKeys(event fsnotify.Event, auths []*Auth) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if err := fw.watcher.Add(event.Name); err != nil {
+			watcherLog.Warn("Keys file is gone, keeping the loaded keys", "file", event.Name)
+			return
+		}
+	} else if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+		return
+	}
+
+	for _, auth := range auths {
+		if err := auth.reloadAPIKeys(); err != nil {
+			watcherLog.Warn("Could not reload keys file", "file", event.Name, "err", err)
+			return
+		}
+	}
+	watcherLog.Info("Reloaded API keys", "file", event.Name)
+}
+
+// APIKeys returns the key digests for embedding in compiled binaries
+func (auth *Auth) APIKeys() []apiKey {
+	return auth.apiKeys.keys
+}
+
+// match returns the name of the key. Every key is compared, so the time
+// taken doesn't tell which one came close.
+func (store *apiKeyStore) match(presented string) (string, bool) {
+	digest := sha256.Sum256([]byte(presented))
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	name, found := "", false
+	for _, key := range store.keys {
+		if subtle.ConstantTimeCompare(digest[:], []byte(key.Digest)) == 1 && !found {
+			name, found = key.Name, true
+		}
+	}
+	return name, found
+}
+
+// apiKeyMiddleware rejects requests without a known key in the header
+func apiKeyMiddleware(auth *Auth) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			presented := c.Request().Header.Get(auth.Header)
+			if presented == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "missing API key")
+			}
+
+			name, found := auth.apiKeys.match(presented)
+			if !found {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid API key")
+			}
+
+			c.Set(apiKeyNameKey, name)
+			return next(c)
+		}
+	}
+}
+
+// digestEntry returns the key as name:sha256:<hex digest>
+func (key apiKey) digestEntry() string {
+	return key.Name + ":sha256:" + hex.EncodeToString([]byte(key.Digest))
+}
+
+// Inline keys of the auth blocks of a config file
+var configKeysAttr = regexp.MustCompile(`(\bkeys\s*=\s*)("[^"]*"|'[^']*')`)
+
+// digestConfigKeys replaces the inline keys of a config file with their
+// digests, for gosp compile to embed it without them
+func digestConfigKeys(data []byte) ([]byte, error) {
+	var failed error
+	digested := configKeysAttr.ReplaceAllFunc(data, func(match []byte) []byte {
+		parts := configKeysAttr.FindSubmatch(match)
+		value := string(parts[2])
+		quote, entries := value[:1], html.UnescapeString(value[1:len(value)-1])
+		var keys []string
+		for _, entry := range strings.Split(entries, ",") {
+			key, err := parseAPIKey(entry)
+			if err != nil {
+				failed = err
+				return match
+			}
+			if key != nil {
+				keys = append(keys, html.EscapeString(key.digestEntry()))
+			}
+		}
+		return []byte(string(parts[1]) + quote + strings.Join(keys, ",") + quote)
+	})
+	return digested, failed
+}
@@ -0,0 +1,289 @@
+package gosp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Cache policies of fingerprinted files: for good under their hashed
+// names, which change with the content, and briefly under their own
+const (
+	hashedAssetCache   = "public, max-age=31536000, immutable"
+	unhashedAssetCache = "public, max-age=300"
+)
+
+// assetManifest maps the files of a static mount with fingerprint="true"
+// to names holding a hash of their content, app.css to app.3fa9c2c1.css,
+// and back
+type assetManifest struct {
+	mount string
+	dir   string
+
+	// Reads the files of the directory
+	source *siteFS
+
+	mu     sync.RWMutex
+	hashed map[string]string
+	files  map[string]string
+}
+
+func newAssetManifest(mount, dir string, source *siteFS) *assetManifest {
+	return &assetManifest{mount: mount, dir: dir, source: source, hashed: make(map[string]string), files: make(map[string]string)}
+}
+
+// fingerprintStatics hashes the files of the static mounts fingerprinting
+// them, read from files, and returns their manifests, which the routes of
+// the mounts share
+func (config *RouteConfig) fingerprintStatics(files *siteFS) ([]*assetManifest, error) {
+	var manifests []*assetManifest
+	add := func(static *Static, prefix string) error {
+		if static.Fingerprint != "true" {
+			return nil
+		}
+		assets := newAssetManifest(strings.TrimSuffix(prefix+static.Path, "/"), static.Dir, files)
+		if err := assets.load(); err != nil {
+			return fmt.Errorf("static %s: fingerprinting: %v", static.Path, err)
+		}
+		static.assets = assets
+		manifests = append(manifests, assets)
+		return nil
+	}
+	for i := range config.Statics {
+		if err := add(&config.Statics[i], ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range config.Groups {
+		for i := range group.Statics {
+			if err := add(&group.Statics[i], group.Prefix); err != nil {
+				return nil, fmt.Errorf("group %s: %v", group.Prefix, err)
+			}
+		}
+	}
+	return manifests, nil
+}
+
+// fingerprintedDirs returns the directories of the static mounts
+// fingerprinting their files
+func (config *RouteConfig) fingerprintedDirs() []string {
+	var dirs []string
+	statics := config.Statics
+	for _, group := range config.Groups {
+		statics = append(statics, group.Statics...)
+	}
+	for _, static := range statics {
+		if static.Fingerprint == "true" {
+			dirs = append(dirs, static.Dir)
+		}
+	}
+	return dirs
+}
+
+// hashedName puts the hash of a file's content before its extension
+func hashedName(name string, content io.Reader) (string, error) {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, content); err != nil {
+		return "", err
+	}
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum.Sum(nil))[:8] + ext, nil
+}
+
+// load hashes every file under the directory, dotfiles aside as they
+// aren't served
+func (assets *assetManifest) load() error {
+	return assets.source.walkRoot(assets.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && file != assets.dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			return assets.hash(file)
+		}
+		return nil
+	})
+}
+
+// name returns the slash-separated name of a file under the directory
+func (assets *assetManifest) name(file string) (string, bool) {
+	rel, err := filepath.Rel(assets.dir, file)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	name := filepath.ToSlash(rel)
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// hash adds a file under its hashed name, in place of the one it had
+func (assets *assetManifest) hash(file string) error {
+	name, ok := assets.name(file)
+	if !ok {
+		return nil
+	}
+	f, err := assets.source.openFile(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hashed, err := hashedName(name, f)
+	if err != nil {
+		return err
+	}
+
+	assets.mu.Lock()
+	defer assets.mu.Unlock()
+	delete(assets.files, assets.hashed[name])
+	assets.hashed[name] = hashed
+	assets.files[hashed] = name
+	return nil
+}
+
+// update hashes a file again after the watcher reported it changed, or
+// drops it, and the files below it, once it is gone
+func (assets *assetManifest) update(file string) {
+	name, ok := assets.name(file)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(file)
+	switch {
+	case err == nil && info.IsDir():
+		// Copied trees arrive without events for their files
+		filepath.WalkDir(file, func(below string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.Type().IsRegular() {
+				assets.hash(below)
+			}
+			return nil
+		})
+	case err == nil:
+		if err := assets.hash(file); err != nil {
+			watcherLog.Warn("Could not fingerprint file", "file", file, "err", err)
+		}
+	default:
+		assets.mu.Lock()
+		defer assets.mu.Unlock()
+		for held, hashed := range assets.hashed {
+			if held == name || strings.HasPrefix(held, name+"/") {
+				delete(assets.hashed, held)
+				delete(assets.files, hashed)
+			}
+		}
+	}
+}
+
+// url returns the URL path of a file under its hashed name
+func (assets *assetManifest) url(name string) (string, bool) {
+	assets.mu.RLock()
+	defer assets.mu.RUnlock()
+	hashed, ok := assets.hashed[name]
+	if !ok {
+		return "", false
+	}
+	return assets.mount + "/" + hashed, true
+}
+
+// original returns the file a hashed name stands for
+func (assets *assetManifest) original(hashed string) (string, bool) {
+	assets.mu.RLock()
+	defer assets.mu.RUnlock()
+	name, ok := assets.files[hashed]
+	return name, ok
+}
+
+// cacheControl returns the policy of a name requested under the mount and
+// the file it is for: the file itself, or the one a hashed name stands for
+func (assets *assetManifest) cacheControl(name string) (string, string) {
+	if assets == nil {
+		return name, ""
+	}
+	if original, ok := assets.original(name); ok {
+		return original, hashedAssetCache
+	}
+	if _, ok := assets.url(name); ok {
+		return name, unhashedAssetCache
+	}
+	return name, ""
+}
+
+// assetURL is asset() in templates: the URL path of a fingerprinted file,
+// by its name under the mount or its URL path, which is returned as it is
+// for files no mount fingerprints. The file becomes a dependency of the
+// response, so the response cache drops pages linking to its old name.
+func assetURL(c echo.Context, name string) string {
+	for _, assets := range siteOf(c).assets {
+		file := name
+		if strings.HasPrefix(name, "/") {
+			if !strings.HasPrefix(name, assets.mount+"/") {
+				continue
+			}
+			file = strings.TrimPrefix(name, assets.mount+"/")
+		}
+		if url, ok := assets.url(file); ok {
+			recordDependencies(c, filepath.Join(assets.dir, filepath.FromSlash(file)))
+			return url
+		}
+	}
+	return name
+}
+
+// assetArgument returns the quoted name of an asset("...") expression
+func assetArgument(expression string) (string, bool) {
+	if !strings.HasPrefix(expression, "asset(") || !strings.HasSuffix(expression, ")") {
+		return "", false
+	}
+	arg := strings.TrimSpace(expression[len("asset(") : len(expression)-1])
+	if len(arg) < 2 || arg[0] != arg[len(arg)-1] || arg[0] != '"' && arg[0] != '\'' {
+		return "", false
+	}
+	return arg[1 : len(arg)-1], true
+}
+
+// compiledAssets is a manifest as gosp compile embeds it
+type compiledAssets struct {
+	Mount  string
+	Hashed map[string]string
+}
+
+// compileAssets fingerprints the static mounts for gosp compile, which
+// embeds the manifests; the binaries serve the files from disk
+func compileAssets(routes *RouteConfig, files *siteFS) ([]compiledAssets, error) {
+	manifests, err := routes.fingerprintStatics(files)
+	if err != nil {
+		return nil, err
+	}
+	compiled := make([]compiledAssets, 0, len(manifests))
+	for _, assets := range manifests {
+		compiled = append(compiled, compiledAssets{Mount: assets.mount, Hashed: assets.hashed})
+	}
+	return compiled, nil
+}
+
+// syncAssets updates the manifests of the site served for a watcher event
+func (fw *FileWatcher) syncAssets(file string) {
+	if fw.reloader == nil || fw.reloader.sites == nil {
+		return
+	}
+	for _, assets := range fw.reloader.sites.active().assets {
+		assets.update(file)
+	}
+}
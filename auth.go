@@ -0,0 +1,169 @@
+package gosp
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication settings for a route or group
+type Auth struct {
+	Type      string `xml:"type,attr"`
+	Realm     string `xml:"realm,attr"`
+	Users     string `xml:"users,attr"`
+	UsersFile string `xml:"usersFile,attr"`
+
+	// type="jwt": the key is a secret (HS256), a PEM public key file or a
+	// JWKS URL (RS256). Tokens come from the Authorization header or the cookie.
+	Algorithm     string `xml:"algorithm,attr"`
+	Secret        string `xml:"secret,attr"`
+	PublicKeyFile string `xml:"publicKeyFile,attr"`
+	JWKSURL       string `xml:"jwksURL,attr"`
+	JWKSRefresh   string `xml:"jwksRefresh,attr"`
+	Cookie        string `xml:"cookie,attr"`
+	Issuer        string `xml:"issuer,attr"`
+	Audience      string `xml:"audience,attr"`
+	Leeway        string `xml:"leeway,attr"`
+	LoginURL      string `xml:"loginURL,attr"`
+
+	// type="apikey": name:key entries inline or one per line in the keys
+	// file, where the key may be given as sha256:<hex digest>
+	Header   string `xml:"header,attr"`
+	Keys     string `xml:"keys,attr"`
+	KeysFile string `xml:"keysFile,attr"`
+
+	// user name -> plaintext password or bcrypt hash
+	credentials map[string]string
+
+	publicKeyPEM string
+	jwt          *jwtVerifier
+
+	keysPath string
+	apiKeys  *apiKeyStore
+
+	// Where the keys file is read from as it changes
+	files *siteFS
+
+	// Resolved paths of the users and public key files, which gosp
+	// compile embeds
+	usersPath     string
+	publicKeyPath string
+}
+
+// loadCredentials parses the inline users list and the users file.
+// Relative users files are resolved against the config file directory.
+func (auth *Auth) loadCredentials(files *siteFS, baseDir string) error {
+	auth.Type = strings.ToLower(auth.Type)
+	switch auth.Type {
+	case "basic":
+	case "jwt":
+		return auth.prepareJWT(files, baseDir)
+	case "apikey":
+		return auth.prepareAPIKeys(files, baseDir)
+	default:
+		return fmt.Errorf("unsupported auth type %q", auth.Type)
+	}
+
+	auth.credentials = make(map[string]string)
+
+	for _, entry := range strings.Split(auth.Users, ",") {
+		if err := auth.addCredential(entry); err != nil {
+			return err
+		}
+	}
+
+	if auth.UsersFile != "" {
+		usersPath := auth.UsersFile
+		if !filepath.IsAbs(usersPath) {
+			usersPath = filepath.Join(baseDir, usersPath)
+		}
+
+		auth.usersPath = usersPath
+		file, err := files.openFile(usersPath)
+		if err != nil {
+			return fmt.Errorf("failed to open users file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := auth.addCredential(line); err != nil {
+				return fmt.Errorf("%s: %v", auth.UsersFile, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read users file: %v", err)
+		}
+	}
+
+	if len(auth.credentials) == 0 {
+		return fmt.Errorf("basic auth requires at least one user")
+	}
+
+	return nil
+}
+
+// Credentials returns the loaded credentials for embedding in compiled binaries
+func (auth *Auth) Credentials() map[string]string {
+	return auth.credentials
+}
+
+func (auth *Auth) addCredential(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+
+	user, password, found := strings.Cut(entry, ":")
+	if !found || user == "" {
+		// Never echo the entry itself, it may contain a password
+		return fmt.Errorf("malformed user entry, expected user:password")
+	}
+
+	auth.credentials[user] = password
+	return nil
+}
+
+func authMiddleware(auth *Auth) echo.MiddlewareFunc {
+	if auth.jwt != nil {
+		return jwtMiddleware(auth)
+	}
+	if auth.apiKeys != nil {
+		return apiKeyMiddleware(auth)
+	}
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: auth.Realm,
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			return checkCredential(auth.credentials, user, password), nil
+		},
+	})
+}
+
+func checkCredential(credentials map[string]string, user, password string) bool {
+	stored, exists := credentials[user]
+	if !exists {
+		// Compare anyway so unknown users take the same time
+		subtle.ConstantTimeCompare([]byte(password), []byte(password))
+		return false
+	}
+
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func isBcryptHash(value string) bool {
+	return strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$")
+}
@@ -0,0 +1,136 @@
+package gosp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// How often certificate expiry is checked, and how close to expiry a
+	// certificate has to be to count as a failed renewal. autocert renews
+	// 30 days ahead.
+	certExpiryCheckInterval = 12 * time.Hour
+	certExpiryWarning       = 14 * 24 * time.Hour
+)
+
+// autoTLS obtains and renews certificates from Let's Encrypt
+type autoTLS struct {
+	manager *autocert.Manager
+	domains []string
+	stop    chan struct{}
+}
+
+// newAutoTLS sets up the certificate manager for a comma-separated domain
+// list, creating the cache directory if needed
+func newAutoTLS(domainList, cacheDir string) (*autoTLS, error) {
+	var domains []string
+	for _, domain := range strings.Split(domainList, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("--auto-tls needs at least one domain in --domains")
+	}
+
+	if err := prepareCacheDir(cacheDir); err != nil {
+		return nil, err
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+
+	return &autoTLS{
+		manager: manager,
+		domains: domains,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// prepareCacheDir creates the certificate cache readable only by the
+// current user, warning about an existing directory that others can access
+func prepareCacheDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("--auto-tls needs a --cache-dir for certificates")
+	}
+
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("certificate cache %s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		tlsLog.Warn("Certificate cache is accessible by other users, consider chmod 700", "dir", dir, "mode", fmt.Sprintf("%#o", info.Mode().Perm()))
+	}
+	return nil
+}
+
+// tlsConfig returns the listener configuration, applying the version and
+// cipher options
+func (a *autoTLS) tlsConfig(options *TLS) (*tls.Config, error) {
+	config, err := options.options()
+	if err != nil {
+		return nil, err
+	}
+
+	managed := a.manager.TLSConfig()
+	config.NextProtos = managed.NextProtos
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := managed.GetCertificate(hello)
+		if err != nil && hello.ServerName != "" {
+			tlsLog.Warn("ACME: Could not get certificate", "domain", hello.ServerName, "err", err)
+		}
+		return cert, err
+	}
+	return config, nil
+}
+
+// start begins watching for renewals that don't happen. HTTP-01
+// challenges are answered by the redirect listener.
+func (a *autoTLS) start() {
+	go a.watchExpiry()
+}
+
+// watchExpiry logs prominently when a cached certificate gets close to
+// expiring, meaning renewal keeps failing. The old certificate is served
+// until then.
+func (a *autoTLS) watchExpiry() {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, domain := range a.domains {
+			cert, err := a.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+			if err != nil || cert.Leaf == nil {
+				continue
+			}
+			if remaining := time.Until(cert.Leaf.NotAfter); remaining < certExpiryWarning {
+				tlsLog.Warn("ACME: Certificate is expiring and has not been renewed, check that port 80 is reachable",
+					"domain", domain, "expires", cert.Leaf.NotAfter.Format(time.RFC3339), "remaining", remaining.Round(time.Hour).String())
+			}
+		}
+	}
+}
+
+func (a *autoTLS) close() {
+	close(a.stop)
+}
@@ -0,0 +1,78 @@
+package gosp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateBodyLimit(t *testing.T) {
+	for _, limit := range []string{"", "100", "100B", "512K", "512KB", "1.5M", "20M", "1G", "1m", "1KiB"} {
+		if err := validateBodyLimit(limit); err != nil {
+			t.Errorf("%q refused: %v", limit, err)
+		}
+	}
+	for _, limit := range []string{"0", "0K", "-1K", "abc", "10X", " 1M", "M"} {
+		if err := validateBodyLimit(limit); err == nil {
+			t.Errorf("%q accepted", limit)
+		}
+	}
+}
+
+// post sends a form body of size bytes, with its length known, or
+// streamed when chunked
+func post(t *testing.T, handler http.Handler, path string, size int, chunked bool) int {
+	t.Helper()
+	body := "x=" + strings.Repeat("a", size-2)
+	var reader io.Reader = strings.NewReader(body)
+	if chunked {
+		reader = io.MultiReader(reader)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, reader)
+	if chunked {
+		req.ContentLength = -1
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// Bodies up to the size of the limit's expression pass, larger ones are
+// refused, by the route's limit, the config's or the flag's
+func TestBodyLimitSizes(t *testing.T) {
+	config := `<routes bodyLimit="1K">
+  <route path="/upload" file="form.html" bodyLimit="1.5K"><methods>POST</methods></route>
+  <route path="/binary" file="form.html" bodyLimit="1KiB"><methods>POST</methods></route>
+  <route path="/form" file="form.html"><methods>POST</methods></route>
+</routes>`
+	pages := map[string]string{"form.html": `<%= form.x %>`}
+	configured, _ := newTestSite(t, pages, config, Flag("body-limit", "10K"))
+	flagged, _ := newTestSite(t, pages, `<routes><route path="/form" file="form.html"><methods>POST</methods></route></routes>`, Flag("body-limit", "2K"))
+
+	for _, test := range []struct {
+		handler http.Handler
+		path    string
+		limit   int
+	}{
+		{configured, "/upload", 1500},
+		{configured, "/binary", 1024},
+		{configured, "/form", 1000},
+		{flagged, "/form", 2000},
+	} {
+		if status := post(t, test.handler, test.path, test.limit, false); status != http.StatusOK {
+			t.Errorf("%s: %d bytes got %d", test.path, test.limit, status)
+		}
+		if status := post(t, test.handler, test.path, test.limit+1, false); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: %d bytes got %d, want 413", test.path, test.limit+1, status)
+		}
+		if status := post(t, test.handler, test.path, test.limit, true); status != http.StatusOK {
+			t.Errorf("%s: %d bytes streamed got %d", test.path, test.limit, status)
+		}
+		if status := post(t, test.handler, test.path, test.limit+1, true); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: %d bytes streamed got %d, want 413", test.path, test.limit+1, status)
+		}
+	}
+}
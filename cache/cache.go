@@ -0,0 +1,198 @@
+// Package cache is the bounded LRU cache behind the response and template
+// caches of gosp. It depends on the standard library only, as compiled
+// binaries build it from source.
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache holds values by key, evicting the least recently used once it
+// holds more than its entries or bytes. Values may expire. It is safe for
+// concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List
+	entries    map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// Stats are the contents of a cache and what happened to it so far
+type Stats struct {
+	Entries int
+	Bytes   int64
+
+	// Lookups that found a value, and those that didn't, found an expired
+	// one or had the value rejected
+	Hits   uint64
+	Misses uint64
+
+	// Values dropped to stay within the bounds
+	Evictions uint64
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// New makes a cache of at most maxEntries values and maxBytes of their
+// sizes
+func New(maxEntries int, maxBytes int64) (*Cache, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("entries must be positive, got %d", maxEntries)
+	}
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("size must be positive, got %d", maxBytes)
+	}
+
+	return &Cache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}, nil
+}
+
+// MaxBytes returns the size bound of the cache
+func (c *Cache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+// Get returns the value of a key unless it expired or valid, when not nil,
+// rejects it, either of which removes it. valid is called without the
+// lock held, so it may be slow, as stat calls are.
+func (c *Cache) Get(key string, valid func(value interface{}) bool) (interface{}, bool) {
+	c.mu.Lock()
+	element, exists := c.entries[key]
+	if !exists {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.remove(element)
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	c.mu.Unlock()
+
+	if valid != nil && !valid(e.value) {
+		c.mu.Lock()
+		// Unless another Put replaced it meanwhile
+		if element, exists := c.entries[key]; exists && element.Value == e {
+			c.remove(element)
+		}
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return e.value, true
+}
+
+// Put stores the value of a key, replacing the one it has, counting size
+// bytes against the bound for ttl, 0 being until evicted. A value larger
+// than the cache isn't stored, which Put reports.
+func (c *Cache) Put(key string, value interface{}, size int64, ttl time.Duration) bool {
+	if size > c.maxBytes {
+		return false
+	}
+	e := &entry{key: key, value: value, size: size}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(e)
+	c.bytes += size
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	return true
+}
+
+// Remove drops the value of a key, reporting whether there was one
+func (c *Cache) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if exists {
+		c.remove(element)
+	}
+	return exists
+}
+
+// RemoveIf drops the values match reports and returns how many. match
+// is called with the cache locked, so it mustn't use the cache.
+func (c *Cache) RemoveIf(match func(key string, value interface{}) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if e := element.Value.(*entry); match(e.key, e.value) {
+			c.remove(element)
+			count++
+		}
+		element = next
+	}
+	return count
+}
+
+// Clear drops every value and returns how many
+func (c *Cache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.order.Len()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+	return count
+}
+
+// Stats returns the contents and counters of the cache
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Entries:   c.order.Len(),
+		Bytes:     c.bytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	e := element.Value.(*entry)
+	c.order.Remove(element)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
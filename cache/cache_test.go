@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newCache(t *testing.T, maxEntries int, maxBytes int64) *Cache {
+	t.Helper()
+	c, err := New(maxEntries, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewRejectsBounds(t *testing.T) {
+	for _, bounds := range [][2]int64{{0, 1}, {1, 0}, {-1, 1}, {1, -1}} {
+		if _, err := New(int(bounds[0]), bounds[1]); err == nil {
+			t.Errorf("New(%d, %d) accepted", bounds[0], bounds[1])
+		}
+	}
+}
+
+func TestGetPut(t *testing.T) {
+	c := newCache(t, 10, 100)
+	if _, ok := c.Get("a", nil); ok {
+		t.Fatal("empty cache has a")
+	}
+	if !c.Put("a", "one", 3, 0) {
+		t.Fatal("a not stored")
+	}
+	if value, ok := c.Get("a", nil); !ok || value != "one" {
+		t.Fatalf("a = %v, %v", value, ok)
+	}
+	c.Put("a", "two", 5, 0)
+	if value, _ := c.Get("a", nil); value != "two" {
+		t.Fatalf("a = %v after replacing it", value)
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Bytes != 5 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// The least recently used go first, by entries or by bytes
+func TestEviction(t *testing.T) {
+	c := newCache(t, 3, 100)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Put(key, key, 1, 0)
+	}
+	c.Get("a", nil)
+	c.Put("d", "d", 1, 0)
+	if _, ok := c.Get("b", nil); ok {
+		t.Error("b kept, though used least recently")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key, nil); !ok {
+			t.Errorf("%s evicted", key)
+		}
+	}
+
+	c = newCache(t, 10, 10)
+	c.Put("a", "a", 6, 0)
+	c.Put("b", "b", 6, 0)
+	if _, ok := c.Get("a", nil); ok {
+		t.Error("a kept over the byte bound")
+	}
+	if stats := c.Stats(); stats.Bytes != 6 || stats.Evictions != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// A value larger than the whole cache isn't stored, and leaves the others
+func TestPutTooLarge(t *testing.T) {
+	c := newCache(t, 10, 10)
+	c.Put("a", "a", 4, 0)
+	if c.Put("big", "big", 11, 0) {
+		t.Error("value over the bound stored")
+	}
+	if _, ok := c.Get("a", nil); !ok {
+		t.Error("a evicted by a value not stored")
+	}
+	if !c.Put("exact", "exact", 10, 0) {
+		t.Error("value of the bound not stored")
+	}
+}
+
+// Zero-size values count against the entries only
+func TestZeroSizeEntries(t *testing.T) {
+	c := newCache(t, 3, 1)
+	for i := 0; i < 5; i++ {
+		if !c.Put(strconv.Itoa(i), i, 0, 0) {
+			t.Fatalf("%d not stored", i)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 3 || stats.Bytes != 0 || stats.Evictions != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if value, ok := c.Get("4", nil); !ok || value != 4 {
+		t.Errorf("4 = %v, %v", value, ok)
+	}
+	c.Remove("4")
+	c.Put("one", 1, 1, 0)
+	if stats := c.Stats(); stats.Entries != 3 || stats.Bytes != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := newCache(t, 10, 100)
+	c.Put("short", "short", 1, 20*time.Millisecond)
+	c.Put("forever", "forever", 1, 0)
+	if _, ok := c.Get("short", nil); !ok {
+		t.Fatal("short gone before it expired")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("short", nil); ok {
+		t.Error("short served after it expired")
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Bytes != 1 {
+		t.Errorf("expired value kept: %+v", stats)
+	}
+	if _, ok := c.Get("forever", nil); !ok {
+		t.Error("value without ttl expired")
+	}
+}
+
+// A value valid rejects is removed, unless it was replaced meanwhile
+func TestGetValid(t *testing.T) {
+	c := newCache(t, 10, 100)
+	c.Put("a", "old", 1, 0)
+	if _, ok := c.Get("a", func(interface{}) bool { return false }); ok {
+		t.Fatal("rejected value returned")
+	}
+	if _, ok := c.Get("a", nil); ok {
+		t.Fatal("rejected value kept")
+	}
+
+	c.Put("a", "old", 1, 0)
+	_, ok := c.Get("a", func(interface{}) bool {
+		c.Put("a", "new", 1, 0)
+		return false
+	})
+	if ok {
+		t.Fatal("rejected value returned")
+	}
+	if value, ok := c.Get("a", nil); !ok || value != "new" {
+		t.Errorf("a = %v, %v: the replacement was removed", value, ok)
+	}
+}
+
+func TestRemoveIfAndClear(t *testing.T) {
+	c := newCache(t, 10, 100)
+	for i := 0; i < 6; i++ {
+		c.Put(strconv.Itoa(i), i, 2, 0)
+	}
+	if removed := c.RemoveIf(func(_ string, value interface{}) bool { return value.(int)%2 == 0 }); removed != 3 {
+		t.Errorf("RemoveIf removed %d, want 3", removed)
+	}
+	if stats := c.Stats(); stats.Entries != 3 || stats.Bytes != 6 {
+		t.Errorf("stats %+v", stats)
+	}
+	if !c.Remove("1") || c.Remove("1") {
+		t.Error("Remove didn't report the value once")
+	}
+	if cleared := c.Clear(); cleared != 2 {
+		t.Errorf("Clear removed %d, want 2", cleared)
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// Values expiring while others read, write and evict keep the counts
+// right. Run with -race.
+func TestExpiryRace(t *testing.T) {
+	c := newCache(t, 50, 1000)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := strconv.Itoa(i % 80)
+				switch i % 4 {
+				case 0:
+					c.Put(key, i, int64(i%20), time.Duration(i%3)*time.Millisecond)
+				case 1:
+					c.Get(key, func(interface{}) bool { return i%7 != 0 })
+				case 2:
+					c.Get(key, nil)
+				case 3:
+					if w == 0 && i%100 == 3 {
+						c.RemoveIf(func(_ string, value interface{}) bool { return value.(int)%2 == 0 })
+					} else {
+						c.Remove(key)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.Entries > 50 || stats.Bytes > 1000 || stats.Bytes < 0 {
+		t.Fatalf("bounds broken: %+v", stats)
+	}
+	total := 0
+	c.RemoveIf(func(string, interface{}) bool {
+		total++
+		return false
+	})
+	if total != stats.Entries {
+		t.Errorf("%d values, stats say %d", total, stats.Entries)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 80; i++ {
+		c.Get(strconv.Itoa(i), nil)
+	}
+	if cleared := c.Clear(); c.Stats().Bytes != 0 || cleared > 50 {
+		t.Errorf("cleared %d, bytes left %d", cleared, c.Stats().Bytes)
+	}
+}
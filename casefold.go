@@ -0,0 +1,154 @@
+package gosp
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Case-insensitive matching mode for a path prefix
+type caseScope struct {
+	Prefix string
+	Mode   string
+}
+
+func (settings RouteSettings) isCaseInsensitive() bool {
+	return settings.CaseInsensitive == "true" || settings.CaseInsensitive == "redirect"
+}
+
+// caseScopes lists the case matching mode of the site and of every group,
+// longest prefix first, or nil when nothing is case-insensitive
+func (config *RouteConfig) caseScopes() []caseScope {
+	global := config.RouteSettings.inherit(RouteSettings{})
+	scopes := []caseScope{{Prefix: "", Mode: global.CaseInsensitive}}
+	enabled := global.isCaseInsensitive()
+
+	for _, group := range config.Groups {
+		settings := group.inherit(global)
+		scopes = append(scopes, caseScope{
+			Prefix: strings.ToLower(strings.TrimSuffix(group.Prefix, "/")),
+			Mode:   settings.CaseInsensitive,
+		})
+		enabled = enabled || settings.isCaseInsensitive()
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	sort.SliceStable(scopes, func(i, j int) bool {
+		return len(scopes[i].Prefix) > len(scopes[j].Prefix)
+	})
+	return scopes
+}
+
+// caseInsensitiveMiddleware lowercases request paths inside case-insensitive
+// scopes before routing, or redirects to the lowercase URL in redirect mode
+func caseInsensitiveMiddleware(scopes []caseScope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			lower := strings.ToLower(req.URL.Path)
+			if lower == req.URL.Path {
+				return next(c)
+			}
+
+			for _, scope := range scopes {
+				if scope.Prefix != "" && lower != scope.Prefix && !strings.HasPrefix(lower, scope.Prefix+"/") {
+					continue
+				}
+
+				switch scope.Mode {
+				case "true":
+					req.URL.Path = lower
+					req.URL.RawPath = ""
+				case "redirect":
+					return redirectPreservingQuery(c, lower)
+				}
+				break
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// lowerStaticSegments lowercases a route path, keeping parameter names intact
+func lowerStaticSegments(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			segments[i] = strings.ToLower(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// findFoldedPath resolves a slash-separated name under a root, matching
+// each segment case-insensitively. Exact matches win over folded ones.
+func (f *siteFS) findFoldedPath(root, name string) (string, bool) {
+	dir := root
+	var resolved []string
+
+	for _, segment := range strings.Split(name, "/") {
+		entries, err := f.readDir(dir)
+		if err != nil {
+			return "", false
+		}
+
+		match := ""
+		for _, entry := range entries {
+			if entry.Name() == segment {
+				match = segment
+				break
+			}
+			if match == "" && strings.EqualFold(entry.Name(), segment) {
+				match = entry.Name()
+			}
+		}
+		if match == "" {
+			return "", false
+		}
+
+		resolved = append(resolved, match)
+		dir = filepath.Join(dir, match)
+	}
+
+	if info, err := f.statFile(dir); err != nil || info.IsDir() {
+		return "", false
+	}
+	return strings.Join(resolved, "/"), true
+}
+
+// warnCaseCollisions logs template names that only differ by case, since
+// case-insensitive lookup can serve only one of them
+func warnCaseCollisions(names []string) {
+	seen := make(map[string]string)
+	sort.Strings(names)
+
+	for _, name := range names {
+		folded := strings.ToLower(name)
+		if other, exists := seen[folded]; exists {
+			serverLog.Warn("Templates differ only by case", "template", name, "other", other)
+			continue
+		}
+		seen[folded] = name
+	}
+}
+
+// templateNames lists every page file under root, relative and slash-separated
+func (f *siteFS) templateNames(root string) []string {
+	var names []string
+	f.walkRoot(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && f.isPageFile(path) {
+			if relPath, err := filepath.Rel(root, path); err == nil {
+				names = append(names, filepath.ToSlash(relPath))
+			}
+		}
+		return nil
+	})
+	return names
+}
@@ -0,0 +1,161 @@
+package gosp
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Context key of the charset a route answers text in
+const charsetKey = "gosp.charset"
+
+// Source encoding a template declares with <%@page pageEncoding="..." %>,
+// found in the raw bytes as the directive itself is ASCII
+var pageEncodingRegex = regexp.MustCompile(`<%@page\s+[^%]*pageEncoding="([^"]*)"`)
+
+// Encoding problems already logged, by file and problem, so pages read on
+// every request warn once
+var encodingWarnings sync.Map
+
+// lookupEncoding finds an encoding by IANA name or alias, nil for UTF-8
+// which needs no conversion
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported charset %q", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+func validateCharset(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := lookupEncoding(name)
+	return err
+}
+
+func warnEncoding(file, problem string) {
+	if _, warned := encodingWarnings.LoadOrStore(file+"\x00"+problem, true); !warned {
+		renderLog.Warn(problem, "template", file)
+	}
+}
+
+// decodeTemplate converts the contents of a template or include to UTF-8
+// from the pageEncoding it declares. Contents that don't look like the
+// declared encoding are logged and converted all the same, except invalid
+// UTF-8, which is passed on as it is.
+func decodeTemplate(file string, content []byte) string {
+	declared := ""
+	if matches := pageEncodingRegex.FindSubmatch(content); matches != nil {
+		declared = string(matches[1])
+	}
+	if declared == "" {
+		if !utf8.Valid(content) {
+			warnEncoding(file, "not valid UTF-8, declare its encoding with <%@page pageEncoding=\"...\" %>")
+		}
+		return string(content)
+	}
+	enc, err := lookupEncoding(declared)
+	if err != nil {
+		warnEncoding(file, fmt.Sprintf("pageEncoding: %v, reading it as UTF-8", err))
+		return string(content)
+	}
+	if enc == nil {
+		if !utf8.Valid(content) {
+			warnEncoding(file, fmt.Sprintf("declares pageEncoding %s but is not valid UTF-8", declared))
+		}
+		return string(content)
+	}
+
+	// Text in a legacy charset is rarely valid UTF-8 beyond plain ASCII
+	if utf8.Valid(content) && !isASCII(content) {
+		warnEncoding(file, fmt.Sprintf("declares pageEncoding %s but looks like UTF-8", declared))
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		warnEncoding(file, fmt.Sprintf("not valid %s: %v", declared, err))
+		return string(content)
+	}
+	return string(decoded)
+}
+
+func isASCII(content []byte) bool {
+	for _, b := range content {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// charsetMiddleware records the charset of a route
+func charsetMiddleware(charset string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(charsetKey, charset)
+			return next(c)
+		}
+	}
+}
+
+// responseEncoding returns the content type a rendered page goes out with
+// and the encoder converting it to its charset, nil for UTF-8. Text types
+// without a charset parameter get the page's charset, else the route's,
+// else --charset. Characters the charset lacks become character references
+// in HTML and XML, and the charset's substitute character elsewhere.
+func responseEncoding(c echo.Context, contentType, pageCharset string) (string, *encoding.Encoder) {
+	if contentType == "" {
+		contentType = echo.MIMETextHTML
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType, nil
+	}
+
+	charset, declared := params["charset"]
+	if !declared && strings.HasPrefix(mediaType, "text/") {
+		charset = pageCharset
+		if charset == "" {
+			charset, _ = c.Get(charsetKey).(string)
+		}
+		if charset == "" {
+			charset = siteOf(c).options.defaultCharset
+		}
+		if charset != "" {
+			contentType += "; charset=" + charset
+		}
+	}
+	if charset == "" {
+		return contentType, nil
+	}
+
+	enc, err := lookupEncoding(charset)
+	if err != nil {
+		name, _ := c.Get(templateNameKey).(string)
+		warnEncoding(name, fmt.Sprintf("%v, sending UTF-8", err))
+		return contentType, nil
+	}
+	if enc == nil {
+		return contentType, nil
+	}
+	encoder := encoding.ReplaceUnsupported(enc.NewEncoder())
+	if mediaType == "text/html" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "xml") {
+		encoder = encoding.HTMLEscapeUnsupported(enc.NewEncoder())
+	}
+	return contentType, encoder
+}
@@ -0,0 +1,38 @@
+package gosp
+
+import (
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cleanPathMiddleware resolves "." and ".." segments and repeated slashes
+// in request paths before routing. The file handlers clean the paths they
+// join to the root, so "/pub/../ops/dash" would otherwise miss the /ops
+// group, its auth and access rules, and be served as ops/dash.html.
+func cleanPathMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if cleaned, changed := cleanURLPath(req.URL.Path); changed {
+				req.URL.Path = cleaned
+				req.URL.RawPath = ""
+			}
+			return next(c)
+		}
+	}
+}
+
+// cleanURLPath returns a request path without dot segments or repeated
+// slashes, keeping a trailing slash, and whether that changed it
+func cleanURLPath(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, "/") {
+		return urlPath, false
+	}
+	cleaned := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, cleaned != urlPath
+}
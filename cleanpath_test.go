@@ -0,0 +1,38 @@
+package gosp
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+// Dot segments and repeated slashes can't route a request around the auth
+// of the group whose page it is served
+func TestDotSegmentsKeepGroupAuth(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"pub/index.html": "public",
+		"ops/dash.html":  "secret ops page",
+	}, `<routes><group prefix="/ops"><auth type="basic" users="ops:secret"/></group></routes>`)
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("ops:secret"))
+
+	for _, path := range []string{
+		"/ops/dash",
+		"/pub/../ops/dash",
+		"/pub/%2e%2e/ops/dash",
+		"/./ops/dash",
+		"/ops/./dash",
+		"//ops/dash",
+		"/ops//dash",
+		"/missing/../../ops/dash",
+	} {
+		if res, body := get(t, handler, http.MethodGet, path); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s without auth: %d %q", path, res.StatusCode, body)
+		}
+		if res, body := get(t, handler, http.MethodGet, path, "Authorization", credentials); res.StatusCode != http.StatusOK || body != "secret ops page" {
+			t.Errorf("%s with auth: %d %q", path, res.StatusCode, body)
+		}
+	}
+	if res, body := get(t, handler, http.MethodGet, "/ops/../pub/"); res.StatusCode != http.StatusOK || body != "public" {
+		t.Errorf("/ops/../pub/: %d %q", res.StatusCode, body)
+	}
+}
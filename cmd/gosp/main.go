@@ -0,0 +1,8 @@
+// Command gosp serves a gosp site, or compiles it into a standalone binary
+package main
+
+import "gosp"
+
+func main() {
+	gosp.Main()
+}
@@ -0,0 +1,190 @@
+package gosp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"gosp/engine"
+)
+
+// Flags of the server compiled binaries have. The others are about files
+// they don't read from disk, the watcher, or what is settled at compile
+// time, and are ignored in their server config.
+var compiledFlags = []string{
+	"port", "body-limit", "timeout", "include-limit",
+	"mode", "error-details", "caching", "log-level", "log-format",
+	"tls-cert", "tls-key", "tls-min-version", "tls-ciphers", "auto-tls", "domains", "cache-dir",
+	"h2c", "redirect-http", "http-port", "hsts-max-age",
+	"host", "bind", "listen", "socket-mode", "socket-owner", "trusted-proxies",
+	"shutdown-timeout", "upgrade-timeout", "response-cache-entries", "response-cache-size",
+	"max-concurrent-renders", "render-queue-timeout",
+	"metrics-path", "health-path", "ready-path", "pprof", "pprof-addr", "tracing",
+	"compress", "compress-min-size", "gzip-level", "brotli-level",
+	"read-timeout", "read-header-timeout", "write-timeout", "idle-timeout",
+	"auth", "auth-exclude",
+	"access-log", "access-log-format", "access-log-max-size", "access-log-max-age", "access-log-max-backups", "access-log-exclude", "access-log-missing-well-known",
+	"well-known-cache", "charset", "minify", "server-config",
+}
+
+// Flags compiled binaries have with compile --admin
+var compiledAdminFlags = []string{"admin-path", "admin-auth"}
+
+// Usage of the flags that differ in compiled binaries
+var compiledUsage = map[string]string{
+	"mode":       "dev or prod, setting the defaults of --error-details and --caching (also from GOSP_MODE)",
+	"log-level":  "Application log level: debug, info, warn or error; debug also traces every template tag",
+	"admin-auth": "Basic Auth user for --admin-path as user:password or user:bcrypt-hash, repeatable (default the --auth users)",
+}
+
+// compiledTemplate is a template gosp compile parsed, with the state of
+// the files it was parsed from
+type compiledTemplate struct {
+	file   string
+	parsed *engine.Template
+	stamps []fileStamp
+}
+
+// RunCompiled runs the server of a binary gosp compile built, on the
+// files it embeds: the embedded directory of its project, as laid out by
+// compile. It serves the site as gosp --mode prod would, from memory.
+func RunCompiled(files fs.FS) {
+	index, mounts, preparsed, err := mountEmbedded(files)
+	if err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	if err := compiledCommand(&serverOptions{}, index, mounts, preparsed).Execute(); err != nil {
+		fatal(serverLog, err.Error())
+	}
+}
+
+// compiledCommand is the command of compiled binaries: the server's with
+// the flags they have, and "config print". The settings given at compile
+// time are those of the index, and the site is served from the mounts.
+func compiledCommand(options *serverOptions, index *embeddedIndex, mounts []*rootMount, preparsed []compiledTemplate) *cobra.Command {
+	server := serverCommand(options).Flags()
+	options.root, options.config = index.Root, index.Config
+	options.embedded, options.preparsed = true, preparsed
+	options.mounts, options.configExpanded = mounts, true
+	rootCmd := &cobra.Command{
+		Use:   "compiled-webframework",
+		Short: "Compiled GoLang Web Framework",
+		Run: func(cmd *cobra.Command, args []string) {
+			runServer(cmd, options)
+		},
+	}
+
+	kept := compiledFlags
+	if index.Admin {
+		kept = append(kept, compiledAdminFlags...)
+	}
+	have := make(map[string]bool)
+	for _, name := range kept {
+		flag := server.Lookup(name)
+		if usage, ok := compiledUsage[name]; ok {
+			flag.Usage = usage
+		}
+		rootCmd.Flags().AddFlag(flag)
+		have[name] = true
+	}
+
+	// Compiled binaries are for production
+	mode := rootCmd.Flags().Lookup("mode")
+	mode.Value.Set("prod")
+	mode.DefValue = "prod"
+	rootCmd.Flags().Lookup("log-level").DefValue = "info"
+
+	options.ignoredSettings = make(map[string]bool)
+	server.VisitAll(func(flag *pflag.Flag) {
+		if !have[flag.Name] {
+			options.ignoredSettings[flag.Name] = true
+		}
+	})
+	options.noFileRouting, options.securityHeaders = index.NoFileRouting, index.SecurityHeaders
+	options.templateExts, options.staticExts, options.wellKnownRoot = index.TemplateExts, index.StaticExts, index.WellKnownDir
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server configuration",
+	}
+	configPrintCmd := &cobra.Command{
+		Use:   "print",
+		Short: "Print the effective settings from flags, GOSP_* variables, the server config and defaults",
+		Run:   printServerConfig(options),
+	}
+	configPrintCmd.Flags().AddFlagSet(rootCmd.Flags())
+	configCmd.AddCommand(configPrintCmd)
+	rootCmd.AddCommand(configCmd)
+	return rootCmd
+}
+
+// mountEmbedded reads the index of the files a compiled binary embeds,
+// returning it, the mounts serving the files in place of the directories
+// they were read from, and the templates parsed at compile time
+func mountEmbedded(files fs.FS) (*embeddedIndex, []*rootMount, []compiledTemplate, error) {
+	data, err := fs.ReadFile(files, "embedded/index.json")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var index embeddedIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, nil, fmt.Errorf("embedded/index.json: %v", err)
+	}
+
+	var mounts []*rootMount
+	for i, mount := range index.Mounts {
+		fsys := newEmbeddedFS()
+		for _, dir := range mount.Dirs {
+			fsys.addDir(dir.Name, time.Unix(0, dir.ModTime))
+		}
+		for j, file := range mount.Files {
+			content, err := fs.ReadFile(files, path.Join("embedded", strconv.Itoa(i), strconv.Itoa(j)))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			fsys.add(file.Name, content, time.Unix(0, file.ModTime))
+		}
+		mounts = append(mounts, &rootMount{dir: mount.Dir, fsys: fsys, partial: mount.Partial})
+	}
+
+	var preparsed []compiledTemplate
+	for i, template := range index.Preparsed {
+		content, err := fs.ReadFile(files, path.Join("embedded", "preparsed", strconv.Itoa(i)))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// Left to parse on first use, as without a parse embedded
+		compiled := compiledTemplate{file: template.File, parsed: &engine.Template{}}
+		if err := compiled.parsed.UnmarshalBinary(content); err != nil {
+			serverLog.Warn("Could not read the template parsed at compile time, parsing it on first use", "file", template.File, "err", err)
+			continue
+		}
+		for _, stamp := range template.Stamps {
+			compiled.stamps = append(compiled.stamps, stamp.fileStamp())
+		}
+		preparsed = append(preparsed, compiled)
+	}
+	return &index, mounts, preparsed, nil
+}
+
+// seedTemplates puts the templates parsed at compile time in the template
+// cache, those whose files are as they were then, so pages render from
+// the first request without parsing
+func (srv *server) seedTemplates(preparsed []compiledTemplate) {
+	root := srv.options.root
+	for _, compiled := range preparsed {
+		current := true
+		for _, stamp := range compiled.stamps {
+			current = current && stamp.current(srv.files)
+		}
+		if current {
+			srv.templates.put(templateKey(compiled.file, []string{root}), compiled.parsed, compiled.stamps)
+		}
+	}
+}
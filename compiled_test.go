@@ -0,0 +1,324 @@
+package gosp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gosp/engine"
+)
+
+// compileSite embeds the site of a root and config as gosp compile does,
+// writing the embedded directory under the returned one
+func compileSite(t testing.TB, root, config string) string {
+	t.Helper()
+	site := collectSite(t, root, config)
+	out := t.TempDir()
+	if err := site.write(filepath.Join(out, "embedded")); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// collectSite reads what compile embeds of a site
+func collectSite(t testing.TB, root, config string) *compiledSite {
+	t.Helper()
+	files := newSiteFS(&serverOptions{})
+	site := newCompiledSite(root, files, false)
+	templates, err := scanTemplates(site, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := loadRouteConfig(files, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collectStaticFiles(site, routes, root, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.collect(routes, templates); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.preparse(templates); err != nil {
+		t.Fatal(err)
+	}
+	site.index.Root, site.index.Config = root, config
+	return site
+}
+
+// embedded serves New's site from the mounts and templates of a compiled
+// binary
+func embedded(mounts []*rootMount, preparsed []compiledTemplate) Option {
+	return func(o *siteOptions) error {
+		o.mounts, o.configExpanded, o.preparsed = mounts, true, preparsed
+		return nil
+	}
+}
+
+// A compiled site serves its pages, includes, static files and auth from
+// the files it embeds, with the sources gone from disk
+func TestCompiledSiteServesWithoutSources(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root_http")
+	writeFiles(t, dir, map[string]string{
+		"root_http/index.html":      `<%@include file="inc/head.html" %><p><%= query.name %></p>`,
+		"root_http/inc/head.html":   `<h1>Head</h1>`,
+		"root_http/plain.html":      `no tags`,
+		"root_http/robots.txt":      "User-agent: *\n",
+		"root_http/api/secret.html": `secret for <%= apikey.name %>`,
+		"public/css/app.css":        "body{}",
+		"keys.txt":                  "# keys\nfile:file-key\n",
+		"routes.xml": `<routes>
+  <header name="X-Greeting" value="${GOSP_TEST_GREETING}"/>
+  <static path="/assets" dir="public"/>
+  <route path="/api/secret" file="api/secret.html">
+    <methods>GET</methods>
+    <auth type="apikey" keys="inline:inline-key" keysFile="keys.txt"/>
+  </route>
+</routes>`,
+	})
+	t.Setenv("GOSP_TEST_GREETING", "hello $USER")
+	out := compileSite(t, root, filepath.Join(dir, "routes.xml"))
+
+	// Nothing of the site is left to read from disk
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("GOSP_TEST_GREETING")
+	index, mounts, preparsed, err := mountEmbedded(os.DirFS(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preparsed) != 4 {
+		t.Errorf("%d templates preparsed, want 4", len(preparsed))
+	}
+
+	handler, err := New(Root(index.Root), ConfigFile(index.Config), Mode("prod"), embedded(mounts, preparsed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := get(t, handler, http.MethodGet, "/?name=jo")
+	if res.StatusCode != http.StatusOK || body != "<h1>Head</h1><p>jo</p>" {
+		t.Errorf("index: %d %q", res.StatusCode, body)
+	}
+	if greeting := res.Header.Get("X-Greeting"); greeting != "hello $USER" {
+		t.Errorf("X-Greeting %q, want the value at compile time", greeting)
+	}
+	if _, body := get(t, handler, http.MethodGet, "/assets/css/app.css"); body != "body{}" {
+		t.Errorf("static file: %q", body)
+	}
+	if _, body := get(t, handler, http.MethodGet, "/robots.txt"); body != "User-agent: *\n" {
+		t.Errorf("robots.txt: %q", body)
+	}
+	for key, name := range map[string]string{"inline-key": "inline", "file-key": "file"} {
+		res, body := get(t, handler, http.MethodGet, "/api/secret", "X-API-Key", key)
+		if res.StatusCode != http.StatusOK || body != "secret for "+name {
+			t.Errorf("key %s: %d %q", key, res.StatusCode, body)
+		}
+	}
+	if res, _ := get(t, handler, http.MethodGet, "/api/secret", "X-API-Key", "wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d", res.StatusCode)
+	}
+}
+
+// Compiled binaries embed API keys only as their digests
+func TestCompiledSiteEmbedsKeyDigests(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"root_http/index.html": "home",
+		"keys.txt":             "file:file-key\n",
+		"routes.xml": `<routes>
+  <route path="/" file="index.html">
+    <methods>GET</methods>
+    <auth type="apikey" keys="inline:inline-key" keysFile="keys.txt"/>
+  </route>
+</routes>`,
+	})
+	out := compileSite(t, filepath.Join(dir, "root_http"), filepath.Join(dir, "routes.xml"))
+
+	err := filepath.Walk(out, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		for _, key := range []string{"inline-key", "file-key"} {
+			if strings.Contains(string(data), key) {
+				t.Errorf("%s holds the key %s", file, key)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDigestConfigKeys(t *testing.T) {
+	digest := sha256.Sum256([]byte("s3cr&t"))
+	hashed := hex.EncodeToString(digest[:])
+	config := `<auth type="apikey" keys="a:s3cr&amp;t, b:sha256:` + hashed + `"/><auth keys = 'c:x'/>`
+	got, err := digestConfigKeys([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sha256.Sum256([]byte("x"))
+	want := `<auth type="apikey" keys="a:sha256:` + hashed + `,b:sha256:` + hashed + `"/><auth keys = 'c:sha256:` + hex.EncodeToString(other[:]) + `'/>`
+	if string(got) != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	if _, err := digestConfigKeys([]byte(`<auth keys="nokey"/>`)); err == nil {
+		t.Error("malformed entry accepted")
+	}
+}
+
+// Templates parsed at compile time are used until one of their files
+// changes
+func TestSeedTemplatesChecksStamps(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root_http")
+	writeFiles(t, dir, map[string]string{
+		"root_http/a.html":   `<%@include file="inc.html" %>`,
+		"root_http/inc.html": "one",
+		"routes.xml":         "<routes/>",
+	})
+	out := compileSite(t, root, filepath.Join(dir, "routes.xml"))
+	_, mounts, preparsed, err := mountEmbedded(os.DirFS(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(&serverOptions{root: root, mounts: mounts})
+	if srv.templates, err = newTemplateCache(100, 1<<20, srv.files); err != nil {
+		t.Fatal(err)
+	}
+	key := templateKey(filepath.Join(root, "a.html"), []string{root})
+	srv.seedTemplates(preparsed)
+	if srv.templates.lookup(key) == nil {
+		t.Fatal("preparsed template not cached")
+	}
+
+	// The include changed since compile time
+	srv.templates.flush()
+	fsys, name := srv.files.mountFor(filepath.Join(root, "inc.html"))
+	fsys.(*embeddedFS).add(name, []byte("two"), time.Now())
+	srv.seedTemplates(preparsed)
+	if srv.templates.lookup(key) != nil {
+		t.Error("template cached though its include changed")
+	}
+}
+
+// A template encoded by another engine.FormatVersion is left out with a
+// warning, the page parsing it on first use
+func TestPreparsedVersionMismatch(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root_http")
+	writeFiles(t, dir, map[string]string{
+		"root_http/index.html": `<p><%= query.name %></p>`,
+		"routes.xml":           "<routes/>",
+	})
+	out := compileSite(t, root, filepath.Join(dir, "routes.xml"))
+	file := filepath.Join(out, "embedded", "preparsed", "0")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = engine.FormatVersion + 1
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t, slog.LevelWarn)
+	index, mounts, preparsed, err := mountEmbedded(os.DirFS(out))
+	if err != nil {
+		t.Fatalf("mountEmbedded: %v", err)
+	}
+	if len(preparsed) != 0 {
+		t.Errorf("%d templates preparsed, want the mismatched one left out", len(preparsed))
+	}
+	if !strings.Contains(logs.String(), "parsing it on first use") || !strings.Contains(logs.String(), "index.html") {
+		t.Errorf("no warning naming the template: %s", logs)
+	}
+	handler, err := New(Root(index.Root), ConfigFile(index.Config), Mode("prod"), embedded(mounts, preparsed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(t, handler, http.MethodGet, "/?name=jo"); body != "<p>jo</p>" {
+		t.Errorf("index: %q", body)
+	}
+}
+
+// BenchmarkCompiledFirstRender compares the first render of a large page
+// with many includes in a compiled binary, parsing its templates or
+// decoding those parsed at compile time
+func BenchmarkCompiledFirstRender(b *testing.B) {
+	dir := b.TempDir()
+	root := filepath.Join(dir, "root_http")
+	pages := map[string]string{"routes.xml": "<routes/>"}
+	var page strings.Builder
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("inc/part%d.html", i)
+		page.WriteString(`<%@include file="` + name + `" %>`)
+		pages["root_http/"+name] = strings.Repeat(`<li class="item">Item <%= query.name %> <% if (query.n) { %>more<% } %></li>`+"\n", 120)
+	}
+	pages["root_http/index.html"] = page.String()
+	writeFiles(b, dir, pages)
+	out := compileSite(b, root, filepath.Join(dir, "routes.xml"))
+	index, mounts, preparsed, err := mountEmbedded(os.DirFS(out))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name      string
+		preparsed []compiledTemplate
+	}{{"interpreted", nil}, {"preparsed", preparsed}} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				handler, err := New(Root(index.Root), ConfigFile(index.Config), Mode("prod"), embedded(mounts, bench.preparsed))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if res, _ := get(b, handler, http.MethodGet, "/?name=jo"); res.StatusCode != http.StatusOK {
+					b.Fatalf("status %d", res.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+// Compiled binaries have the server flags about serving, in prod mode by
+// default, ignoring the others in their server config
+func TestCompiledCommandFlags(t *testing.T) {
+	for _, admin := range []bool{false, true} {
+		options := &serverOptions{}
+		flags := compiledCommand(options, &embeddedIndex{Root: "root_http", Config: "routes.xml", Admin: admin}, nil, nil).Flags()
+		for _, name := range []string{"port", "mode", "tls-cert", "response-cache-size"} {
+			if flags.Lookup(name) == nil {
+				t.Errorf("admin %v: no --%s", admin, name)
+			}
+		}
+		for _, name := range []string{"root", "config", "watch"} {
+			if flags.Lookup(name) != nil {
+				t.Errorf("admin %v: --%s kept", admin, name)
+			}
+			if !options.ignoredSettings[name] {
+				t.Errorf("admin %v: %s not ignored in the server config", admin, name)
+			}
+		}
+		if mode := flags.Lookup("mode"); mode.DefValue != "prod" || mode.Value.String() != "prod" {
+			t.Errorf("admin %v: mode defaults to %q", admin, mode.Value)
+		}
+		if (flags.Lookup("admin-path") != nil) != admin || options.ignoredSettings["admin-path"] == admin {
+			t.Errorf("admin %v: --admin-path %v", admin, flags.Lookup("admin-path") != nil)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package gosp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// Content types that are compressed already
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-brotli", "application/x-7z-compressed", "application/x-rar-compressed",
+}
+
+// encoder is implemented by both gzip.Writer and brotli.Writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compression holds the encoder pools for the negotiated encodings
+type compression struct {
+	minSize int
+	pools   map[string]*sync.Pool
+}
+
+func newCompression(gzipLevel, brotliLevel int, minSize int64) (*compression, error) {
+	if gzipLevel < gzip.BestSpeed || gzipLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip level must be between 1 and 9, got %d", gzipLevel)
+	}
+	if brotliLevel < brotli.BestSpeed || brotliLevel > brotli.BestCompression {
+		return nil, fmt.Errorf("brotli level must be between 0 and 11, got %d", brotliLevel)
+	}
+
+	return &compression{
+		minSize: int(minSize),
+		pools: map[string]*sync.Pool{
+			"gzip": {New: func() interface{} {
+				w, _ := gzip.NewWriterLevel(io.Discard, gzipLevel)
+				return w
+			}},
+			"br": {New: func() interface{} {
+				return brotli.NewWriterLevel(io.Discard, brotliLevel)
+			}},
+		},
+	}, nil
+}
+
+// negotiateEncoding picks brotli or gzip from Accept-Encoding, preferring
+// brotli when the client weighs both the same. Returns "" for neither.
+func negotiateEncoding(accept string) string {
+	if accepted := acceptedEncodings(accept); len(accepted) > 0 {
+		return accepted[0]
+	}
+	return ""
+}
+
+// acceptedEncodings lists brotli and gzip as far as Accept-Encoding allows
+// them, the preferred one first
+func acceptedEncodings(accept string) []string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+		weights[name] = weight
+	}
+
+	var accepted []string
+	for _, encoding := range []string{"br", "gzip"} {
+		weight, listed := weights[encoding]
+		if !listed {
+			weight = weights["*"]
+			weights[encoding] = weight
+		}
+		if weight > 0 {
+			accepted = append(accepted, encoding)
+		}
+	}
+	if len(accepted) == 2 && weights["gzip"] > weights["br"] {
+		accepted[0], accepted[1] = accepted[1], accepted[0]
+	}
+	return accepted
+}
+
+func compressibleType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) && !strings.HasPrefix(contentType, "image/svg") {
+			return false
+		}
+	}
+	return true
+}
+
+func compressMiddleware(comp *compression) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			encoding := negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			// HEAD goes through too, for the headers of the GET
+			if encoding == "" {
+				return next(c)
+			}
+
+			writer := &compressWriter{ResponseWriter: res.Writer, encoding: encoding, pool: comp.pools[encoding], minSize: comp.minSize}
+			res.Writer = writer
+			err := next(c)
+			res.Writer = writer.ResponseWriter
+
+			if err != nil && !res.Committed {
+				// The error handler answers uncompressed
+				return err
+			}
+			writer.close()
+			return err
+		}
+	}
+}
+
+// compressWriter holds back the response until minSize bytes are written
+// or it is flushed, then either compresses it or passes it through
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	pool     *sync.Pool
+	minSize  int
+
+	encoder     encoder
+	buffer      []byte
+	status      int
+	wroteHeader bool
+	passthrough bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status == http.StatusNotModified {
+		// Matches the tag of the compressed 200
+		weakenETag(header)
+	}
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusPartialContent ||
+		status == http.StatusNotModified || header.Get(echo.HeaderContentEncoding) != "" ||
+		header.Get("Content-Range") != "" {
+		w.passThrough()
+		return
+	}
+	if contentType := header.Get(echo.HeaderContentType); contentType != "" && !compressibleType(contentType) {
+		w.passThrough()
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+
+	if w.Header().Get(echo.HeaderContentType) == "" {
+		contentType := http.DetectContentType(b)
+		w.Header().Set(echo.HeaderContentType, contentType)
+		if !compressibleType(contentType) {
+			w.passThrough()
+			return w.ResponseWriter.Write(b)
+		}
+	}
+
+	w.buffer = append(w.buffer, b...)
+	if len(w.buffer) >= w.minSize {
+		if err := w.startEncoding(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush compresses right away, since more data may follow at any time
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passthrough {
+		if w.encoder == nil {
+			w.startEncoding()
+		}
+		w.encoder.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *compressWriter) passThrough() {
+	w.passthrough = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) startEncoding() error {
+	header := w.Header()
+	header.Set(echo.HeaderContentEncoding, w.encoding)
+	header.Del(echo.HeaderContentLength)
+	weakenETag(header)
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.encoder = w.pool.Get().(encoder)
+	w.encoder.Reset(w.ResponseWriter)
+	_, err := w.encoder.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
+
+// close finishes the compressed stream, or writes out a response that
+// stayed under the minimum size as is
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.encoder.Reset(io.Discard)
+		w.pool.Put(w.encoder)
+		return
+	}
+
+	if !w.passthrough && w.wroteHeader {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buffer)
+	}
+}
@@ -0,0 +1,225 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Variables named GOSP_ and the flag in upper case with underscores, e.g.
+// GOSP_TLS_CERT, set flags not given on the command line
+const settingEnvPrefix = "GOSP_"
+
+// Flags with variables of their own: GOSP_AUTH adds users to --auth
+// instead of replacing them
+var ownEnvSettings = map[string]bool{"auth": true}
+
+// Flags whose values "config print" hides
+var secretSettings = map[string]bool{"auth": true, "admin-auth": true}
+
+// serverSetting is a flag value read from the server config file
+type serverSetting struct {
+	flag   *pflag.Flag
+	values []string
+
+	// Position of the key, for errors
+	line, column int
+}
+
+func settingEnvName(flag string) string {
+	return settingEnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// loadServerConfig sets the flags not given on the command line from GOSP_
+// variables and the --server-config file, the variables taking precedence,
+// recording in the options where each got its value
+func loadServerConfig(cmd *cobra.Command, options *serverOptions) error {
+	flags := cmd.Flags()
+	given := make(map[string]bool)
+	flags.Visit(func(flag *pflag.Flag) {
+		given[flag.Name] = true
+		options.sources[flag.Name] = "command line"
+	})
+
+	path := options.serverConfigPath
+	if env := os.Getenv(settingEnvName("server-config")); env != "" && !given["server-config"] {
+		path = env
+	}
+	if path != "" {
+		settings, err := readServerConfig(path, flags, options.ignoredSettings)
+		if err != nil {
+			return err
+		}
+		for _, setting := range settings {
+			if given[setting.flag.Name] {
+				continue
+			}
+			if err := setFlag(setting.flag, setting.values); err != nil {
+				return fmt.Errorf("%s:%d:%d: %s: %v", path, setting.line, setting.column, setting.flag.Name, err)
+			}
+			options.sources[setting.flag.Name] = path
+		}
+		options.serverConfigLoaded = path
+	}
+
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || given[flag.Name] || ownEnvSettings[flag.Name] || flag.Name == "server-config" {
+			return
+		}
+		name := settingEnvName(flag.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, slice := flag.Value.(pflag.SliceValue); slice {
+			values = splitList(value)
+		}
+		if setErr := setFlag(flag, values); setErr != nil {
+			err = fmt.Errorf("%s: %v", name, setErr)
+			return
+		}
+		options.sources[flag.Name] = "$" + name
+	})
+	return err
+}
+
+// setFlag replaces the value of a flag, joining several values with commas
+// unless it is repeatable
+func setFlag(flag *pflag.Flag, values []string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(values); err != nil {
+			return err
+		}
+	} else if err := flag.Value.Set(strings.Join(values, ",")); err != nil {
+		return err
+	}
+	flag.Changed = true
+	return nil
+}
+
+// readServerConfig parses a YAML server config. Keys are flag names, and
+// nested sections join theirs with a dash, so tls: {cert: FILE} sets
+// --tls-cert. A list sets a repeatable flag or a comma-separated one. Keys
+// of the ignored flags are skipped.
+func readServerConfig(path string, flags *pflag.FlagSet, ignored map[string]bool) ([]serverSetting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	var settings []serverSetting
+	seen := make(map[string]int)
+	var collect func(node *yaml.Node, prefix, display string) error
+	collect = func(node *yaml.Node, prefix, display string) error {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s:%d:%d: expected settings as key: value", path, node.Line, node.Column)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			name, shown := prefix+key.Value, display+key.Value
+			if value.Kind == yaml.MappingNode {
+				if err := collect(value, name+"-", shown+"."); err != nil {
+					return err
+				}
+				continue
+			}
+
+			flag := flags.Lookup(name)
+			if flag == nil || name == "server-config" {
+				if ignored[name] {
+					continue
+				}
+				return fmt.Errorf("%s:%d:%d: unknown setting %q", path, key.Line, key.Column, shown)
+			}
+			if line, exists := seen[name]; exists {
+				return fmt.Errorf("%s:%d:%d: %q is set already on line %d", path, key.Line, key.Column, shown, line)
+			}
+			seen[name] = key.Line
+
+			setting := serverSetting{flag: flag, line: key.Line, column: key.Column}
+			switch value.Kind {
+			case yaml.ScalarNode:
+				setting.values = []string{value.Value}
+			case yaml.SequenceNode:
+				for _, item := range value.Content {
+					if item.Kind != yaml.ScalarNode {
+						return fmt.Errorf("%s:%d:%d: %q takes a list of values", path, item.Line, item.Column, shown)
+					}
+					setting.values = append(setting.values, item.Value)
+				}
+			default:
+				return fmt.Errorf("%s:%d:%d: unsupported value for %q", path, value.Line, value.Column, shown)
+			}
+			settings = append(settings, setting)
+		}
+		return nil
+	}
+	return settings, collect(doc.Content[0], "", "")
+}
+
+// printServerConfig writes the effective settings as a server config, each
+// commented with where its value came from, as the command of the options
+// reads them
+func printServerConfig(options *serverOptions) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		writeServerConfig(cmd, options)
+	}
+}
+
+func writeServerConfig(cmd *cobra.Command, options *serverOptions) {
+	if err := loadServerConfig(cmd, options); err != nil {
+		fatal(serverLog, "Invalid settings", "err", err)
+	}
+	if err := applyMode(cmd, options); err != nil {
+		fatal(serverLog, "Invalid settings", "err", err)
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "server-config" || flag.Name == "help" {
+			return
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: flag.Name}
+		var value *yaml.Node
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			value = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, item := range slice.GetSlice() {
+				if secretSettings[flag.Name] {
+					item = "(hidden)"
+				}
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		} else {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Value: flag.Value.String()}
+			if flag.Value.Type() == "string" {
+				value.Tag = "!!str"
+			}
+		}
+		source, ok := options.sources[flag.Name]
+		if !ok {
+			source = "default"
+		}
+		value.LineComment = source
+		root.Content = append(root.Content, key, value)
+	})
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		fatal(serverLog, "Could not write the settings", "err", err)
+	}
+	encoder.Close()
+}
@@ -0,0 +1,257 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Cross-origin resource sharing policy of the site or a group. Unset
+// attributes are inherited, enabled="false" turns CORS off.
+type CORS struct {
+	Enabled       string `xml:"enabled,attr"`
+	Origins       string `xml:"origins,attr"`
+	Methods       string `xml:"methods,attr"`
+	Headers       string `xml:"headers,attr"`
+	ExposeHeaders string `xml:"exposeHeaders,attr"`
+	Credentials   string `xml:"credentials,attr"`
+	MaxAge        string `xml:"maxAge,attr"`
+}
+
+// Without a <cors> block any origin may make simple requests, as before
+var defaultCORS = CORS{Enabled: "true", Origins: "*"}
+
+// Policy for the routes under a path prefix
+type corsScope struct {
+	Prefix string
+	Policy *CORS
+}
+
+func (cors *CORS) prepare() error {
+	switch cors.Enabled {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid cors enabled %q: expected true or false", cors.Enabled)
+	}
+
+	switch cors.Credentials {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid cors credentials %q: expected true or false", cors.Credentials)
+	}
+
+	for _, origin := range splitList(cors.Origins) {
+		if origin == "*" || !strings.Contains(origin, "*") {
+			continue
+		}
+		if prefix, _, _ := strings.Cut(origin, "*."); strings.Count(origin, "*") != 1 || !strings.HasSuffix(prefix, "://") {
+			return fmt.Errorf("invalid cors origin %q: wildcards must stand for whole subdomains, e.g. https://*.example.com", origin)
+		}
+	}
+
+	if err := validateTimeout(cors.MaxAge); err != nil {
+		return fmt.Errorf("invalid cors maxAge: %v", err)
+	}
+
+	return nil
+}
+
+// merge fills the unset attributes from the parent, or from the defaults at
+// the top level
+func (cors *CORS) merge(parent *CORS) *CORS {
+	if parent == nil {
+		parent = &defaultCORS
+	}
+
+	merged := *cors
+	if merged.Enabled == "" {
+		merged.Enabled = parent.Enabled
+	}
+	if merged.Origins == "" {
+		merged.Origins = parent.Origins
+	}
+	if merged.Methods == "" {
+		merged.Methods = parent.Methods
+	}
+	if merged.Headers == "" {
+		merged.Headers = parent.Headers
+	}
+	if merged.ExposeHeaders == "" {
+		merged.ExposeHeaders = parent.ExposeHeaders
+	}
+	if merged.Credentials == "" {
+		merged.Credentials = parent.Credentials
+	}
+	if merged.MaxAge == "" {
+		merged.MaxAge = parent.MaxAge
+	}
+	return &merged
+}
+
+// IsEnabled reports whether cross-origin requests are answered at all
+func (cors *CORS) IsEnabled() bool {
+	return cors.Enabled != "false"
+}
+
+func (cors *CORS) OriginList() []string {
+	return splitList(cors.Origins)
+}
+
+func (cors *CORS) MethodList() []string {
+	var methods []string
+	for _, method := range splitList(cors.Methods) {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	return methods
+}
+
+func (cors *CORS) HeaderList() []string {
+	return splitList(cors.Headers)
+}
+
+func (cors *CORS) ExposeHeaderList() []string {
+	return splitList(cors.ExposeHeaders)
+}
+
+func (cors *CORS) AllowCredentials() bool {
+	return cors.Credentials == "true"
+}
+
+// MaxAgeSeconds is how long browsers may cache preflight results
+func (cors *CORS) MaxAgeSeconds() int {
+	maxAge, _ := time.ParseDuration(cors.MaxAge)
+	return int(maxAge / time.Second)
+}
+
+// corsScopes lists the CORS policy of the site and of every group with its
+// own block, longest prefix first
+func (config *RouteConfig) corsScopes() ([]corsScope, error) {
+	global := &defaultCORS
+	if config.CORS != nil {
+		global = config.CORS.merge(nil)
+	}
+	scopes := []corsScope{{Prefix: "", Policy: global}}
+
+	for _, group := range config.Groups {
+		if group.CORS != nil {
+			scopes = append(scopes, corsScope{
+				Prefix: strings.TrimSuffix(group.Prefix, "/"),
+				Policy: group.CORS.merge(global),
+			})
+		}
+	}
+
+	// Checked once merged, a group may allow credentials under a site-wide "*"
+	for _, scope := range scopes {
+		if scope.Policy.IsEnabled() && scope.Policy.AllowCredentials() && containsString(scope.Policy.OriginList(), "*") {
+			return nil, fmt.Errorf("cors of %s/: credentials can't be allowed for any origin, list the origins", scope.Prefix)
+		}
+	}
+
+	sort.SliceStable(scopes, func(i, j int) bool {
+		return len(scopes[i].Prefix) > len(scopes[j].Prefix)
+	})
+	return scopes, nil
+}
+
+// corsMiddleware answers preflight requests and sets the CORS headers with
+// the policy of the longest matching prefix
+func corsMiddleware(scopes []corsScope) echo.MiddlewareFunc {
+	policies := make([]echo.MiddlewareFunc, len(scopes))
+	for i, scope := range scopes {
+		if scope.Policy.IsEnabled() {
+			policies[i] = middleware.CORSWithConfig(corsConfig(scope.Policy))
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		handlers := make([]echo.HandlerFunc, len(policies))
+		for i, policy := range policies {
+			handlers[i] = next
+			if policy != nil {
+				handlers[i] = policy(next)
+			}
+		}
+
+		return func(c echo.Context) error {
+			// OPTIONS without Access-Control-Request-Method isn't a preflight,
+			// the route answers it with its Allow header
+			req := c.Request()
+			if req.Method == http.MethodOptions && req.Header.Get(echo.HeaderAccessControlRequestMethod) == "" {
+				return next(c)
+			}
+
+			path := req.URL.Path
+			for i, scope := range scopes {
+				if scope.Prefix == "" || path == scope.Prefix || strings.HasPrefix(path, scope.Prefix+"/") {
+					return handlers[i](c)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+func corsConfig(cors *CORS) middleware.CORSConfig {
+	config := middleware.CORSConfig{
+		AllowMethods:     cors.MethodList(),
+		AllowHeaders:     cors.HeaderList(),
+		ExposeHeaders:    cors.ExposeHeaderList(),
+		AllowCredentials: cors.AllowCredentials(),
+		MaxAge:           cors.MaxAgeSeconds(),
+	}
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = middleware.DefaultCORSConfig.AllowMethods
+	}
+
+	origins := cors.OriginList()
+	if containsString(origins, "*") {
+		config.AllowOrigins = []string{"*"}
+		return config
+	}
+	config.AllowOriginFunc = func(origin string) (bool, error) {
+		return matchesOrigin(origins, origin), nil
+	}
+	return config
+}
+
+// matchesOrigin compares an Origin header with the allowed origins, where
+// "*." matches one or more subdomain labels, e.g. https://*.example.com
+func matchesOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		prefix, suffix, wildcard := strings.Cut(pattern, "*.")
+		if !wildcard {
+			if origin == pattern {
+				return true
+			}
+			continue
+		}
+
+		if len(origin) <= len(prefix)+len(suffix)+1 || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, "."+suffix) {
+			continue
+		}
+		labels := origin[len(prefix) : len(origin)-len(suffix)-1]
+		if labels != "" && !strings.ContainsAny(labels, "/:@?#") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated attribute, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,100 @@
+package gosp
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// eventQueue coalesces the events of each path. Saving in an editor fires
+// a burst of writes, chmods and renames; they are merged into one event
+// holding all their ops, due once the path has been quiet for the window.
+// It belongs to the goroutine reading the watcher's events.
+type eventQueue struct {
+	window time.Duration
+	events map[string]*queuedEvent
+	timer  *time.Timer
+
+	// Events are handled in the order their paths first changed
+	seq int
+}
+
+type queuedEvent struct {
+	event fsnotify.Event
+	due   time.Time
+	seq   int
+}
+
+func newEventQueue(window time.Duration) *eventQueue {
+	return &eventQueue{window: window, events: make(map[string]*queuedEvent)}
+}
+
+// add queues an event, merged into the one pending for its path, and puts
+// that one's handling off for another window
+func (q *eventQueue) add(event fsnotify.Event) {
+	due := time.Now().Add(q.window)
+	if queued, exists := q.events[event.Name]; exists {
+		queued.event.Op |= event.Op
+		queued.due = due
+	} else {
+		q.seq++
+		q.events[event.Name] = &queuedEvent{event: event, due: due, seq: q.seq}
+	}
+	q.schedule()
+}
+
+// ready returns a channel receiving once events are due, nil when none are
+// pending
+func (q *eventQueue) ready() <-chan time.Time {
+	if q.timer == nil || len(q.events) == 0 {
+		return nil
+	}
+	return q.timer.C
+}
+
+// due returns the events due and drops them from the queue
+func (q *eventQueue) due() []fsnotify.Event {
+	now := time.Now()
+	var due []*queuedEvent
+	for name, queued := range q.events {
+		if !queued.due.After(now) {
+			due = append(due, queued)
+			delete(q.events, name)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].seq < due[j].seq })
+
+	events := make([]fsnotify.Event, len(due))
+	for i, queued := range due {
+		events[i] = queued.event
+	}
+	q.schedule()
+	return events
+}
+
+// schedule sets the timer to the earliest event due
+func (q *eventQueue) schedule() {
+	var next time.Time
+	for _, queued := range q.events {
+		if next.IsZero() || queued.due.Before(next) {
+			next = queued.due
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	wait := time.Until(next)
+	if q.timer == nil {
+		q.timer = time.NewTimer(wait)
+		return
+	}
+	if !q.timer.Stop() {
+		// Drained unless it fired unseen
+		select {
+		case <-q.timer.C:
+		default:
+		}
+	}
+	q.timer.Reset(wait)
+}
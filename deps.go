@@ -0,0 +1,130 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// includeGraph parses the templates under root, through the template cache,
+// and returns the files each file includes directly, by name under root.
+// Static pages and templates too large to render include nothing.
+func (srv *server) includeGraph(root string, limit int) map[string][]string {
+	graph := make(map[string][]string)
+	for _, name := range srv.files.templateNames(root) {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if srv.files.isStaticFile(file) {
+			continue
+		}
+		if info, err := srv.files.statRootFile(file); err != nil || !srv.largeTemplates.processes(info.Size()) {
+			continue
+		}
+		tp := &TemplateProcessor{roots: []string{root}, files: srv.files, templates: srv.templates, ctx: context.Background(), includeLimit: limit}
+		parsed, err := tp.loadTemplate(file, name)
+		if err != nil {
+			continue
+		}
+		// Includes resolve the same way from every page, so a file's are
+		// taken from the first page including it
+		for from, includes := range parsed.Graph {
+			from = nameUnder(root, from)
+			if _, done := graph[from]; done {
+				continue
+			}
+			for _, include := range includes {
+				graph[from] = append(graph[from], nameUnder(root, include))
+			}
+		}
+	}
+	return graph
+}
+
+// nameUnder names a file by its path relative to root, with slashes
+func nameUnder(root, file string) string {
+	if rel, err := filepath.Rel(root, file); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return file
+}
+
+// printDeps prints the include tree of templates under root, all of them
+// when none are named. Reversed, it prints the templates depending on each
+// file instead, through other includes too.
+func printDeps(root string, names []string, reverse bool) {
+	srv := newServer(&serverOptions{root: root})
+	graph := srv.includeGraph(root, 0)
+	if reverse {
+		printDependents(graph, names)
+		return
+	}
+
+	if len(names) == 0 {
+		for _, name := range srv.files.templateNames(root) {
+			if !srv.files.isStaticFile(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		printIncludes(root, graph, name, nil)
+	}
+}
+
+// printIncludes prints a file and, indented below it, what it includes
+func printIncludes(root string, graph map[string][]string, name string, stack []string) {
+	note := ""
+	if containsString(stack, name) {
+		note = " (cycle)"
+	} else if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+		note = " (missing)"
+	}
+	fmt.Printf("%s%s%s\n", strings.Repeat("  ", len(stack)), name, note)
+	if note != "" {
+		return
+	}
+	for _, include := range graph[name] {
+		printIncludes(root, graph, include, append(stack, name))
+	}
+}
+
+// printDependents prints each file with the templates that include it,
+// directly or not, every included file when none are named
+func printDependents(graph map[string][]string, names []string) {
+	includedBy := make(map[string][]string)
+	for from, includes := range graph {
+		for _, include := range includes {
+			includedBy[include] = append(includedBy[include], from)
+		}
+	}
+	if len(names) == 0 {
+		for name := range includedBy {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+		seen := map[string]bool{name: true}
+		queue := []string{name}
+		var dependents []string
+		for len(queue) > 0 {
+			for _, from := range includedBy[queue[0]] {
+				if !seen[from] {
+					seen[from] = true
+					dependents = append(dependents, from)
+					queue = append(queue, from)
+				}
+			}
+			queue = queue[1:]
+		}
+		sort.Strings(dependents)
+		for _, dependent := range dependents {
+			fmt.Printf("  %s\n", dependent)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package gosp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+)
+
+// embeddedIndex describes what compiled binaries embed with //go:embed,
+// under embedded/: the settings the site was compiled with, its files by
+// the directories they were read from, and its templates parsed. Files
+// are kept by their position, embedded/<mount>/<file>, so they take any
+// name, which go:embed would refuse for some, and the generated main.go
+// stays the same whatever the site holds.
+type embeddedIndex struct {
+	Root            string `json:"root"`
+	Config          string `json:"config"`
+	Admin           bool   `json:"admin,omitempty"`
+	NoFileRouting   bool   `json:"no_file_routing,omitempty"`
+	SecurityHeaders bool   `json:"security_headers,omitempty"`
+	TemplateExts    string `json:"ext"`
+	StaticExts      string `json:"static_ext"`
+	WellKnownDir    string `json:"well_known_dir,omitempty"`
+
+	Mounts    []embeddedMount     `json:"mounts"`
+	Preparsed []preparsedTemplate `json:"preparsed"`
+}
+
+// embeddedMount is a directory the binary serves from memory: whole, for
+// the root and the static mounts, or only for the files it holds, for the
+// directories of the config and the well-known files
+type embeddedMount struct {
+	Dir     string          `json:"dir"`
+	Partial bool            `json:"partial,omitempty"`
+	Dirs    []embeddedEntry `json:"dirs,omitempty"`
+	Files   []embeddedEntry `json:"files"`
+}
+
+// embeddedEntry is a file or directory of a mount, by its slash-separated
+// name
+type embeddedEntry struct {
+	Name    string `json:"name"`
+	ModTime int64  `json:"mod_time"`
+}
+
+// preparsedTemplate is a template parsed at compile time, kept under
+// embedded/preparsed/, with the state of the files it was parsed from,
+// which the binary checks before using it
+type preparsedTemplate struct {
+	File   string          `json:"file"`
+	Stamps []embeddedStamp `json:"stamps"`
+}
+
+type embeddedStamp struct {
+	Path    string `json:"path"`
+	Exists  bool   `json:"exists,omitempty"`
+	ModTime int64  `json:"mod_time,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+}
+
+func newEmbeddedStamp(stamp fileStamp) embeddedStamp {
+	embedded := embeddedStamp{Path: stamp.path}
+	if stamp.exists {
+		embedded.Exists, embedded.ModTime, embedded.Size = true, stamp.modTime.UnixNano(), stamp.size
+	}
+	return embedded
+}
+
+func (stamp embeddedStamp) fileStamp() fileStamp {
+	if !stamp.Exists {
+		return fileStamp{path: stamp.Path}
+	}
+	return fileStamp{path: stamp.Path, exists: true, modTime: time.Unix(0, stamp.ModTime), size: stamp.Size}
+}
+
+// compiledSite is what gosp compile embeds: the files read, by the path
+// they were read from, the directories embedded whole and those below
+// them, and the templates parsed
+type compiledSite struct {
+	root string
+
+	// Reads the files of the site as its server does, and leaves those
+	// over the limit out with --skip-large
+	source    *siteFS
+	skipLarge bool
+
+	index     embeddedIndex
+	whole     []string
+	dirs      map[string]time.Time
+	files     map[string]compiledFile
+	preparsed [][]byte
+}
+
+type compiledFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newCompiledSite(root string, source *siteFS, skipLarge bool) *compiledSite {
+	return &compiledSite{root: root, source: source, skipLarge: skipLarge, whole: []string{filepath.Clean(root)}, dirs: make(map[string]time.Time), files: make(map[string]compiledFile)}
+}
+
+func (site *compiledSite) add(file string, data []byte, modTime time.Time) {
+	site.files[filepath.Clean(file)] = compiledFile{data: data, modTime: modTime}
+}
+
+func (site *compiledSite) addDir(dir string, modTime time.Time) {
+	site.dirs[filepath.Clean(dir)] = modTime
+}
+
+// scanTemplates embeds the page files under the root, over limit only
+// with a warning unless --skip-large, and returns them by name in UTF-8,
+// whatever pageEncoding they are in, for compile to check
+func scanTemplates(site *compiledSite, limit int64) (map[string]string, error) {
+	templates := make(map[string]string)
+	err := site.source.walkRoot(site.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			site.addDir(path, info.ModTime())
+			return nil
+		}
+		if site.source.isPageFile(path) {
+			// Get relative path from root
+			relPath, err := filepath.Rel(site.root, path)
+			if err != nil {
+				return err
+			}
+
+			// Convert to forward slashes for consistency
+			relPath = filepath.ToSlash(relPath)
+
+			// The binary holds every file in memory
+			if limit > 0 && info.Size() > limit {
+				if site.skipLarge {
+					compileLog.Warn("Skipped file over --max-embed-size", "template", relPath, "size", info.Size())
+					return nil
+				}
+				compileLog.Warn("Embedding file over --max-embed-size", "template", relPath, "size", info.Size())
+			}
+
+			// Read file content
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			// Embedded as it is, and checked in UTF-8, whatever
+			// pageEncoding the file is in
+			site.add(path, content, info.ModTime())
+			templates[relPath] = decodeTemplate(relPath, content)
+			compileLog.Info("Added template", "template", relPath)
+		}
+
+		return nil
+	})
+	return templates, err
+}
+
+// readFile embeds a file as it is on disk
+func (site *compiledSite) readFile(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	site.add(file, data, info.ModTime())
+	return nil
+}
+
+// collect embeds the files the route config reads besides the pages: the
+// config and its imports with their variables expanded, the users and
+// public key files, the keys files as digests, the well-known files and
+// the fresh sidecars of the static pages
+func (site *compiledSite) collect(routes *RouteConfig, templates map[string]string) error {
+	for _, file := range routes.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err == nil {
+			data, err = expandConfigEnv(data)
+		}
+		if err == nil {
+			data, err = digestConfigKeys(data)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		site.add(file, data, info.ModTime())
+		compileLog.Info("Added config", "file", file)
+	}
+
+	seen := make(map[*Auth]bool)
+	for _, route := range routes.effectiveRoutes() {
+		auth := route.Auth
+		if auth == nil || seen[auth] {
+			continue
+		}
+		seen[auth] = true
+		for _, file := range []string{auth.usersPath, auth.publicKeyPath} {
+			if file == "" {
+				continue
+			}
+			if err := site.readFile(file); err != nil {
+				return err
+			}
+			compileLog.Info("Added auth file", "file", file)
+		}
+		if auth.keysPath != "" {
+			if err := site.addKeysFile(auth.keysPath); err != nil {
+				return err
+			}
+			compileLog.Info("Added keys file as digests", "file", auth.keysPath)
+		}
+	}
+
+	wellKnownDir := site.index.WellKnownDir
+	if wellKnownDir == "" {
+		wellKnownDir = site.root
+	}
+	if err := collectWellKnown(site, wellKnownDir); err != nil {
+		return fmt.Errorf("reading well-known files: %v", err)
+	}
+	if err := collectSidecars(site, templates); err != nil {
+		return fmt.Errorf("reading precompressed sidecars: %v", err)
+	}
+	return nil
+}
+
+// addKeysFile embeds a keys file with the digests of its keys in their
+// place, so the binary holds none of them
+func (site *compiledSite) addKeysFile(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var digested []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseAPIKey(line)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		digested = append(digested, key.digestEntry())
+	}
+	site.add(file, []byte(strings.Join(digested, "\n")+"\n"), info.ModTime())
+	return nil
+}
+
+// preparse parses the templates with their includes as the binary's
+// server would, for it to start with them parsed, noting the state of the
+// files each was parsed from. Templates holding no tags are counted, as
+// the binary sends them as they are.
+func (site *compiledSite) preparse(templates map[string]string) error {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		if !site.source.isStaticFile(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	plain := 0
+	for _, name := range names {
+		file := filepath.Join(site.root, filepath.FromSlash(name))
+		processor := &TemplateProcessor{roots: []string{site.root}, files: site.source, ctx: context.Background()}
+		parsed, err := processor.loadCached(nil, file, name)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", name, err)
+		}
+		data, err := parsed.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("encoding %s: %v", name, err)
+		}
+		preparsed := preparsedTemplate{File: file}
+		for _, stamp := range processor.stamps {
+			preparsed.Stamps = append(preparsed.Stamps, newEmbeddedStamp(stamp))
+		}
+		site.index.Preparsed = append(site.index.Preparsed, preparsed)
+		site.preparsed = append(site.preparsed, data)
+		if _, ok := parsed.Text(); ok {
+			plain++
+		}
+	}
+	if plain > 0 {
+		compileLog.Info("Templates without tags, sent as they are", "count", plain)
+	}
+	return nil
+}
+
+// write writes the embedded files under dir, with the index naming them.
+// Files below a directory embedded whole go to its mount, the most
+// specific one, and the others to a partial mount of their directory.
+func (site *compiledSite) write(dir string) error {
+	index := site.index
+	mounts := make(map[string]*embeddedMount)
+	mountOf := func(file string) (*embeddedMount, string) {
+		best := ""
+		for _, whole := range site.whole {
+			if _, ok := mountName(whole, file); ok && len(whole) >= len(best) {
+				best = whole
+			}
+		}
+		partial := best == ""
+		if partial {
+			best = filepath.Dir(file)
+		}
+		if mounts[best] == nil {
+			mounts[best] = &embeddedMount{Dir: best, Partial: partial}
+		}
+		name, _ := mountName(best, file)
+		return mounts[best], name
+	}
+	for _, whole := range site.whole {
+		mountOf(whole)
+	}
+	for _, sub := range sortedKeys(site.dirs) {
+		if mount, name := mountOf(sub); !mount.Partial {
+			mount.Dirs = append(mount.Dirs, embeddedEntry{Name: name, ModTime: site.dirs[sub].UnixNano()})
+		}
+	}
+	files := make(map[*embeddedMount][]string)
+	for _, file := range sortedKeys(site.files) {
+		mount, name := mountOf(file)
+		mount.Files = append(mount.Files, embeddedEntry{Name: name, ModTime: site.files[file].modTime.UnixNano()})
+		files[mount] = append(files[mount], file)
+	}
+
+	for i, mountDir := range sortedKeys(mounts) {
+		mount := mounts[mountDir]
+		sub := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			return err
+		}
+		for j, file := range files[mount] {
+			if err := os.WriteFile(filepath.Join(sub, strconv.Itoa(j)), site.files[file].data, 0644); err != nil {
+				return err
+			}
+		}
+		index.Mounts = append(index.Mounts, *mount)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "preparsed"), 0755); err != nil {
+		return err
+	}
+	for i, data := range site.preparsed {
+		if err := os.WriteFile(filepath.Join(dir, "preparsed", strconv.Itoa(i)), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+}
+
+// collectStaticFiles embeds the directories of the static mounts whole,
+// and the files of the single-page apps that aren't pages, for compiled
+// binaries to serve. Dotfiles, which static mounts never serve, are left
+// out, as are sidecars older than their file, and files over limit with
+// --skip-large.
+func collectStaticFiles(site *compiledSite, config *RouteConfig, root string, limit int64) error {
+	seen := make(map[string]bool)
+	all := config.Statics
+	for _, group := range config.Groups {
+		all = append(all, group.Statics...)
+	}
+	for _, static := range all {
+		if seen[static.Dir] {
+			continue
+		}
+		seen[static.Dir] = true
+		site.whole = append(site.whole, filepath.Clean(static.Dir))
+		if err := addStaticFiles(site, static.Dir, "", false, limit); err != nil {
+			return err
+		}
+		compileLog.Info("Added static directory", "dir", static.Dir, "mount", static.Path)
+	}
+
+	for _, route := range config.effectiveRoutes() {
+		if route.spa == nil {
+			continue
+		}
+		mount := strings.Trim(strings.TrimSuffix(route.Path, "/*"), "/")
+		if seen[root+"/"+mount] {
+			continue
+		}
+		seen[root+"/"+mount] = true
+		if err := addStaticFiles(site, root, mount, true, limit); err != nil {
+			return err
+		}
+		compileLog.Info("Added single-page app assets", "dir", filepath.Join(root, filepath.FromSlash(mount)))
+	}
+	return nil
+}
+
+// addStaticFiles embeds the files below sub of dir, leaving out the pages
+// embedded as templates when pages is set
+func addStaticFiles(site *compiledSite, dir, sub string, pages bool, limit int64) error {
+	start := filepath.Join(dir, filepath.FromSlash(sub))
+	if _, err := os.Stat(start); pages && os.IsNotExist(err) {
+		return nil
+	}
+	return site.source.walkRoot(start, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && strings.HasPrefix(path.Base(rel), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			site.addDir(file, info.ModTime())
+			return nil
+		}
+		if !info.Mode().IsRegular() || pages && site.source.isPageFile(rel) {
+			return nil
+		}
+		if limit > 0 && info.Size() > limit {
+			if site.skipLarge {
+				compileLog.Warn("Skipped file over --max-embed-size", "file", file, "size", info.Size())
+				return nil
+			}
+			compileLog.Warn("Embedding file over --max-embed-size", "file", file, "size", info.Size())
+		}
+		for _, suffix := range sidecarSuffixes {
+			original, err := os.Stat(strings.TrimSuffix(file, suffix))
+			if strings.HasSuffix(file, suffix) && err == nil && info.ModTime().Before(original.ModTime()) {
+				compileLog.Warn("Skipped sidecar older than its file", "file", file)
+				return nil
+			}
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		site.add(file, content, info.ModTime())
+		return nil
+	})
+}
+
+// reportEmbedded logs the files embedded and their size by extension,
+// largest first, so files embedded by mistake stand out
+func reportEmbedded(site *compiledSite) {
+	type extension struct {
+		ext   string
+		files int
+		size  int64
+	}
+	byExt := make(map[string]*extension)
+	for name, file := range site.files {
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext == "" {
+			ext = "(none)"
+		}
+		if byExt[ext] == nil {
+			byExt[ext] = &extension{ext: ext}
+		}
+		byExt[ext].files++
+		byExt[ext].size += int64(len(file.data))
+	}
+
+	report := make([]*extension, 0, len(byExt))
+	for _, ext := range byExt {
+		report = append(report, ext)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].size != report[j].size {
+			return report[i].size > report[j].size
+		}
+		return report[i].ext < report[j].ext
+	})
+	for _, ext := range report {
+		compileLog.Info("Embedded", "ext", ext.ext, "files", ext.files, "size", bytes.Format(ext.size))
+	}
+}
@@ -0,0 +1,172 @@
+package gosp
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/engine"
+)
+
+// parseTemplate parses a template for the processor's roots, file being
+// its path for include cycles, "" for built-in pages. Includes are read
+// from the first root having them and traced as child spans; nil is
+// returned once the request is done.
+func (tp *TemplateProcessor) parseTemplate(file, content string) *engine.Template {
+	t, err := engine.Parse(content, engine.Options{
+		File:    file,
+		Load:    tp.loadInclude,
+		Include: tp.traceInclude,
+		Context: tp.ctx,
+		MaxSize: tp.includeLimit,
+	})
+	if err != nil {
+		tp.err = err
+	}
+	return t
+}
+
+// traceInclude makes an include a child span of the one including it
+func (tp *TemplateProcessor) traceInclude(name string, size int) func() {
+	parent := tp.ctx
+	ctx, span := startSpan(parent, "include "+name)
+	span.setAttr("template.path", name)
+	span.setAttr("template.size", size)
+	tp.ctx = ctx
+	return func() {
+		tp.ctx = parent
+		span.finish(nil)
+	}
+}
+
+// loadInclude reads an include from the first root having it, in UTF-8,
+// stamping the roots it looked in
+func (tp *TemplateProcessor) loadInclude(name string) (string, string, error) {
+	// A cancelled render reads nothing more, stopping the parse
+	if tp.interrupted() {
+		return name, "", tp.err
+	}
+	file := ""
+	for _, root := range tp.roots {
+		candidate, ok := tp.files.rootFile(root, name)
+		stamp, info := tp.files.stampFile(candidate)
+		tp.stamps = append(tp.stamps, stamp)
+		if ok && info != nil {
+			file = candidate
+			break
+		}
+	}
+	if file == "" {
+		var ok bool
+		if file, ok = tp.includePath(name); !ok {
+			return file, "", &fs.PathError{Op: "open", Path: file, Err: syscall.ENOENT}
+		}
+	}
+	content, err := tp.files.readRootFile(file)
+	if err != nil {
+		return file, "", err
+	}
+	return file, decodeTemplate(name, content), nil
+}
+
+// processTemplate parses a built-in page and evaluates it for the request
+func (tp *TemplateProcessor) processTemplate(content string, c echo.Context) (string, error) {
+	t := tp.parseTemplate("", content)
+	if t == nil {
+		return "", tp.err
+	}
+	return tp.execute(t, c)
+}
+
+// execute evaluates a parsed template into a string
+func (tp *TemplateProcessor) execute(t *engine.Template, c echo.Context) (string, error) {
+	var output strings.Builder
+	tp.run(t, c)
+	tp.writeOutput(&output, c)
+	if tp.err != nil {
+		return "", tp.err
+	}
+	return output.String(), nil
+}
+
+// run applies the directives of a parsed template and runs its code,
+// keeping the output of the branches taken for writeOutput
+func (tp *TemplateProcessor) run(t *engine.Template, c echo.Context) {
+	if t.ContentType != "" {
+		// Page directive wins over the route configuration
+		tp.contentType = t.ContentType
+	}
+	if t.Charset != "" {
+		tp.charset = t.Charset
+	}
+	tp.minify = minifies(c, t.Minify)
+	// Template headers override route, group and global headers
+	for _, header := range t.Headers {
+		c.Response().Header().Set(header.Name, header.Value)
+	}
+	tp.includes = append(tp.includes, t.Includes...)
+	tp.evaluator = tagEvaluator{tp, c}
+	if err := t.Run(&tp.evaluator, &tp.active); err != nil {
+		tp.err = err
+	}
+}
+
+// writeOutput writes what run kept to w, escaped for the content type,
+// flushing w at flush tags when it can be. It stops at the first failed
+// write, recording its error.
+func (tp *TemplateProcessor) writeOutput(w io.Writer, c echo.Context) error {
+	tp.evaluator = tagEvaluator{tp, c}
+	if err := tp.active.Write(w, &tp.evaluator, engine.Escaper(tp.contentType)); err != nil {
+		tp.err = err
+	}
+	return tp.err
+}
+
+// tagEvaluator resolves the tags of a template for the request
+type tagEvaluator struct {
+	tp *TemplateProcessor
+	c  echo.Context
+}
+
+func (ev tagEvaluator) Output(expression string) string {
+	return ev.tp.evaluateOutput(expression, ev.c)
+}
+
+// Operand keeps claims typed, for contains on arrays
+func (ev tagEvaluator) Operand(name string) (interface{}, bool) {
+	if strings.HasPrefix(name, "jwt.") {
+		value, _ := lookupClaim(ev.c, strings.TrimPrefix(name, "jwt."))
+		return value, true
+	}
+	value, exists := ev.tp.data[name]
+	return value, exists
+}
+
+// Tracing is checked before traceTag, whose arguments would be allocated
+// for every tag otherwise
+func (ev tagEvaluator) Code(code string) {
+	if traceTags {
+		traceTag(ev.c, "Code tag", "tag", code)
+	}
+	ev.tp.runCode(code, ev.c)
+}
+
+func (ev tagEvaluator) Err() error {
+	ev.tp.interrupted()
+	return ev.tp.err
+}
+
+func (ev tagEvaluator) TraceBranch(tag string, taken bool) {
+	if traceTags {
+		traceTag(ev.c, "Condition tag", "tag", tag, "active", taken)
+	}
+}
+
+func (ev tagEvaluator) TraceOutput(expression, value string) {
+	if traceTags {
+		traceTag(ev.c, "Output tag", "tag", expression, "value", value)
+	}
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FormatVersion is the version of the encoding MarshalBinary writes. It
+// changes with the shape of parsed templates, and UnmarshalBinary reads
+// only its own.
+const FormatVersion = 2
+
+var errTruncated = errors.New("truncated template encoding")
+
+// MarshalBinary encodes a parsed template, so it can be stored and run
+// later without parsing it again, as compiled binaries do. The first byte
+// is the FormatVersion; strings are length-prefixed, so decoding only
+// slices them out of the data.
+func (t *Template) MarshalBinary() ([]byte, error) {
+	e := &encoder{buf: []byte{FormatVersion}}
+	e.string(t.ContentType)
+	e.string(t.Charset)
+	e.string(t.Minify)
+	e.int(len(t.Headers))
+	for _, header := range t.Headers {
+		e.string(header.Name)
+		e.string(header.Value)
+	}
+	e.strings(t.Includes)
+	files := make([]string, 0, len(t.Graph))
+	for file := range t.Graph {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	e.int(len(files))
+	for _, file := range files {
+		e.string(file)
+		e.strings(t.Graph[file])
+	}
+	e.int(t.Size)
+	if err, ok := t.err.(*SyntaxError); ok {
+		e.int(1)
+		e.string(err.Message)
+		e.string(err.File)
+		e.string(err.Source)
+		e.int(err.Offset)
+	} else {
+		e.int(0)
+	}
+	e.nodes(t.nodes)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a template MarshalBinary encoded, failing for
+// another FormatVersion
+func (t *Template) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errTruncated
+	}
+	if version := int(data[0]); version != FormatVersion {
+		return fmt.Errorf("template encoded in format %d, expected %d", version, FormatVersion)
+	}
+	d := &decoder{data: string(data[1:])}
+	decoded := Template{ContentType: d.string(), Charset: d.string(), Minify: d.string()}
+	for i, n := 0, d.int(); i < n && d.err == nil; i++ {
+		decoded.Headers = append(decoded.Headers, Header{Name: d.string(), Value: d.string()})
+	}
+	decoded.Includes = d.strings()
+	if n := d.int(); n > 0 {
+		decoded.Graph = make(map[string][]string, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			file := d.string()
+			decoded.Graph[file] = d.strings()
+		}
+	}
+	decoded.Size = d.int()
+	if d.int() == 1 {
+		decoded.err = &SyntaxError{Message: d.string(), File: d.string(), Source: d.string(), Offset: d.int()}
+	}
+	decoded.nodes = d.nodes()
+	if d.err != nil {
+		return d.err
+	}
+	*t = decoded
+	return nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int(n int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(n))
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) strings(list []string) {
+	e.int(len(list))
+	for _, s := range list {
+		e.string(s)
+	}
+}
+
+func (e *encoder) nodes(nodes []node) {
+	e.int(len(nodes))
+	for _, n := range nodes {
+		e.int(int(n.kind))
+		e.string(n.text)
+		e.int(len(n.branches))
+		for _, b := range n.branches {
+			e.string(b.keyword)
+			e.string(b.condition)
+			e.string(b.tag)
+			e.nodes(b.nodes)
+		}
+	}
+}
+
+// decoder reads what encoder wrote, keeping the first error
+type decoder struct {
+	data string
+	pos  int
+	err  error
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	var n uint64
+	var shift uint
+	for {
+		if d.pos >= len(d.data) || shift > 63 {
+			d.err = errTruncated
+			return 0
+		}
+		b := d.data[d.pos]
+		d.pos++
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+		shift += 7
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.int()
+	if d.err != nil {
+		return ""
+	}
+	if n > len(d.data)-d.pos {
+		d.err = errTruncated
+		return ""
+	}
+	s := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return s
+}
+
+func (d *decoder) strings() []string {
+	n := d.int()
+	if n == 0 || n > len(d.data)-d.pos {
+		if n > 0 {
+			d.err = errTruncated
+		}
+		return nil
+	}
+	list := make([]string, n)
+	for i := range list {
+		list[i] = d.string()
+	}
+	return list
+}
+
+func (d *decoder) nodes() []node {
+	n := d.int()
+	if n == 0 || n > len(d.data)-d.pos {
+		if n > 0 {
+			d.err = errTruncated
+		}
+		return nil
+	}
+	nodes := make([]node, n)
+	for i := range nodes {
+		nodes[i] = node{kind: nodeKind(d.int()), text: d.string()}
+		if count := d.int(); count > 0 && count <= len(d.data)-d.pos {
+			nodes[i].branches = make([]branch, count)
+			for j := range nodes[i].branches {
+				nodes[i].branches[j] = branch{keyword: d.string(), condition: d.string(), tag: d.string(), nodes: d.nodes()}
+			}
+		} else if count > 0 {
+			d.err = errTruncated
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A template decoded from its encoding is the template parsed: the same
+// directives, includes and graph, and the same output
+func TestMarshalRoundTrip(t *testing.T) {
+	source := `<%@page contentType="text/html" charset="utf-8" minify="true" %><%@header name="Vary" value="Cookie" %>` +
+		`<%@include file="head.html" %><% if user %><p><%= user %></p><% else if guest %>guest<% else %>nobody<% end %><% flush %>`
+	tmpl, err := Parse(source, Options{File: "page.html", Load: loader(map[string]string{"head.html": "<h1><%= title %></h1>"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := tmpl.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Template
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, tmpl) {
+		t.Errorf("decoded %+v, want %+v", decoded, *tmpl)
+	}
+	for _, values := range []map[string]interface{}{
+		{"title": "T", "user": "<alice>"},
+		{"title": "T", "guest": "yes"},
+		{},
+	} {
+		if got, want := render(t, &decoded, copyData(values)), render(t, tmpl, copyData(values)); got != want {
+			t.Errorf("decoded renders %q, parsed %q", got, want)
+		}
+	}
+}
+
+func copyData(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for name, value := range data {
+		copied[name] = value
+	}
+	return copied
+}
+
+// The block error of a template survives its encoding
+func TestMarshalKeepsSyntaxError(t *testing.T) {
+	tmpl, err := Parse("a<% end %>", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := tmpl.MarshalBinary()
+	var decoded Template
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	var syntax *SyntaxError
+	if !errors.As(decoded.Err(), &syntax) || syntax.Message != "end without if" || syntax.Offset != 1 {
+		t.Errorf("decoded error %#v", decoded.Err())
+	}
+}
+
+// Encodings of another FormatVersion, and cut short ones, are refused,
+// leaving the template as it was
+func TestUnmarshalRefuses(t *testing.T) {
+	tmpl, err := Parse(`<%@include file="a.html" %><%= x %>`, Options{Load: loader(map[string]string{"a.html": "a"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := tmpl.MarshalBinary()
+
+	other := append([]byte{FormatVersion + 1}, data[1:]...)
+	var decoded Template
+	err = decoded.UnmarshalBinary(other)
+	if err == nil || !strings.Contains(err.Error(), "format") {
+		t.Errorf("other version: %v", err)
+	}
+	for n := 0; n < len(data); n++ {
+		if err := decoded.UnmarshalBinary(data[:n]); !errors.Is(err, errTruncated) {
+			t.Errorf("cut at %d of %d: %v", n, len(data), err)
+		}
+	}
+	if !reflect.DeepEqual(decoded, Template{}) {
+		t.Errorf("refused encodings changed the template: %+v", decoded)
+	}
+}
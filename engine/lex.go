@@ -0,0 +1,143 @@
+// Package engine parses and renders gosp templates: text with <% code %>,
+// <%= output %> and <%@ directive %> tags, if blocks, includes and page
+// and header directives. It depends on the standard library only, so the
+// templates of a gosp site can be rendered from any Go program.
+//
+// A template is parsed once with Parse and rendered any number of times,
+// concurrently too, with Render or, to resolve tags some other way, with
+// Run and an Evaluator.
+package engine
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Directives of the template syntax, matched against a whole directive tag
+var (
+	IncludePattern = regexp.MustCompile(`<%@include\s+file="([^"]+)"\s*%>`)
+	PagePattern    = regexp.MustCompile(`<%@page\s+([^%]*)%>`)
+	AttrPattern    = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	HeaderPattern  = regexp.MustCompile(`<%@header\s+name="([^"]+)"\s+value="([^"]*)"\s*%>`)
+)
+
+// TokenKind is the kind of a stretch of template source
+type TokenKind int
+
+const (
+	TextToken      TokenKind = iota
+	OutputToken              // <%= expression %>
+	CodeToken                // <% code %>
+	DirectiveToken           // <%@ directive %>
+	UnclosedToken            // <% without its %>, kept as text
+)
+
+// Token is a stretch of a template source. The Body of a tag is its
+// trimmed content, without the delimiters and the = or @ marker; that of
+// text is the text itself. Start and End are byte offsets in the source.
+type Token struct {
+	Kind  TokenKind
+	Body  string
+	Start int
+	End   int
+}
+
+// Lex splits a template into text and tags in one pass. A tag ends at the
+// first %> outside double quotes, so strings may hold % and %>. Should its
+// quotes not pair up, it ends at its first %> instead. A tag running into
+// another <% is left unclosed, as text.
+func Lex(source string) []Token {
+	var tokens []Token
+	text := 0
+	for offset := 0; ; {
+		start := strings.Index(source[offset:], "<%")
+		if start < 0 {
+			break
+		}
+		start += offset
+		tokens = appendText(tokens, source, text, start)
+
+		end := scanTag(source, start+len("<%"), true)
+		if end < 0 {
+			end = scanTag(source, start+len("<%"), false)
+		}
+		if end < 0 {
+			end = len(source)
+			if next := strings.Index(source[start+len("<%"):], "<%"); next >= 0 {
+				end = start + len("<%") + next
+			}
+			tokens = append(tokens, Token{Kind: UnclosedToken, Body: source[start:end], Start: start, End: end})
+		} else {
+			tokens = append(tokens, tagToken(source, start, end))
+		}
+		text, offset = end, end
+	}
+	return appendText(tokens, source, text, len(source))
+}
+
+// scanTag returns the offset past the %> closing the tag whose content
+// starts at from, or -1 when the source or another <% comes first
+func scanTag(source string, from int, quotes bool) int {
+	quoted := false
+	for i := from; i+1 < len(source); i++ {
+		switch {
+		case quotes && source[i] == '"':
+			quoted = !quoted
+		case quoted:
+		case source[i] == '%' && source[i+1] == '>':
+			return i + 2
+		case source[i] == '<' && source[i+1] == '%':
+			return -1
+		}
+	}
+	return -1
+}
+
+func tagToken(source string, start, end int) Token {
+	body := source[start+len("<%") : end-len("%>")]
+	kind := CodeToken
+	switch {
+	case strings.HasPrefix(body, "="):
+		kind, body = OutputToken, body[1:]
+	case strings.HasPrefix(body, "@"):
+		kind, body = DirectiveToken, body[1:]
+	}
+	return Token{Kind: kind, Body: strings.TrimSpace(body), Start: start, End: end}
+}
+
+func appendText(tokens []Token, source string, start, end int) []Token {
+	if start < end {
+		tokens = append(tokens, Token{Kind: TextToken, Body: source[start:end], Start: start, End: end})
+	}
+	return tokens
+}
+
+// ControlTag recognizes the code of the control tags of if blocks,
+// returning "if", "else if", "else" or "end" and the condition. Both the
+// plain form (if COND, else if COND, else, end) and the brace form
+// (if (COND) {, } else if (COND) {, } else {, }) are accepted.
+func ControlTag(code string) (keyword, condition string, ok bool) {
+	closing := strings.HasPrefix(code, "}")
+	code = strings.TrimSpace(strings.TrimPrefix(code, "}"))
+	code = strings.TrimSpace(strings.TrimSuffix(code, "{"))
+
+	switch {
+	case code == "end" || (closing && code == ""):
+		return "end", "", true
+	case code == "else":
+		return "else", "", true
+	case strings.HasPrefix(code, "else if ") || strings.HasPrefix(code, "else if("):
+		return "else if", trimParens(code[len("else if"):]), true
+	case strings.HasPrefix(code, "if ") || strings.HasPrefix(code, "if("):
+		return "if", trimParens(code[len("if"):]), true
+	}
+	return "", "", false
+}
+
+func trimParens(condition string) string {
+	condition = strings.TrimSpace(condition)
+	if strings.HasPrefix(condition, "(") && strings.HasSuffix(condition, ")") {
+		return strings.TrimSpace(condition[1 : len(condition)-1])
+	}
+	return condition
+}
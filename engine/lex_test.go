@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Lex splits text from tags, trimming tag bodies of their delimiters,
+// markers and spaces, with the offsets of each token in the source
+func TestLex(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		want   []Token
+	}{
+		{"", nil},
+		{"plain text", []Token{{TextToken, "plain text", 0, 10}}},
+		{"a<%= name %>b", []Token{
+			{TextToken, "a", 0, 1},
+			{OutputToken, "name", 1, 12},
+			{TextToken, "b", 12, 13},
+		}},
+		{`<% x = "1" %><%@include file="inc.html" %>`, []Token{
+			{CodeToken, `x = "1"`, 0, 13},
+			{DirectiveToken, `include file="inc.html"`, 13, 42},
+		}},
+		// %> inside a string doesn't close the tag
+		{`<%= "50%>" %>!`, []Token{
+			{OutputToken, `"50%>"`, 0, 13},
+			{TextToken, "!", 13, 14},
+		}},
+		// Unpaired quotes end the tag at its first %>
+		{`<%= "a %>b`, []Token{
+			{OutputToken, `"a`, 0, 9},
+			{TextToken, "b", 9, 10},
+		}},
+		{"a <% b", []Token{
+			{TextToken, "a ", 0, 2},
+			{UnclosedToken, "<% b", 2, 6},
+		}},
+		{"<% a <%= b %>", []Token{
+			{UnclosedToken, "<% a ", 0, 5},
+			{OutputToken, "b", 5, 13},
+		}},
+	} {
+		if got := Lex(test.source); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Lex(%q) = %+v, want %+v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestControlTag(t *testing.T) {
+	for _, test := range []struct {
+		code, keyword, condition string
+		ok                       bool
+	}{
+		{"if a == b", "if", "a == b", true},
+		{"if (a) {", "if", "a", true},
+		{"if(a)", "if", "a", true},
+		{"else if x", "else if", "x", true},
+		{"} else if (x) {", "else if", "x", true},
+		{"else", "else", "", true},
+		{"} else {", "else", "", true},
+		{"end", "end", "", true},
+		{"}", "end", "", true},
+		{"iffy = 1", "", "", false},
+		{`x = "if"`, "", "", false},
+	} {
+		keyword, condition, ok := ControlTag(test.code)
+		if keyword != test.keyword || condition != test.condition || ok != test.ok {
+			t.Errorf("ControlTag(%q) = %q, %q, %v, want %q, %q, %v", test.code, keyword, condition, ok, test.keyword, test.condition, test.ok)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+)
+
+// Elements whose content is copied as it is, whitespace being part of it
+var rawElements = []string{"pre", "textarea", "script", "style"}
+
+// Minifier is a writer minifying the HTML written to it on its way to
+// another writer. Runs of whitespace between tags and in text collapse to
+// one space, or a newline when they held one, and comments are dropped,
+// conditional comments aside. Tags and the content of pre, textarea,
+// script and style elements are kept as they are. HTML may be written in
+// pieces split anywhere, as a page streams: what can't be minified yet is
+// held back until the next Write or Close.
+type Minifier struct {
+	w   io.Writer
+	out []byte
+
+	// Input held back, a tag or comment broken off by the end of a Write
+	held []byte
+
+	// Whitespace collapsed, written before what follows it: ' ', '\n' or
+	// 0 for none. None is written before the first output.
+	space   byte
+	started bool
+
+	// Element whose content is being copied, "" outside of one
+	raw string
+	err error
+}
+
+// NewMinifier returns a minifier writing to w
+func NewMinifier(w io.Writer) *Minifier {
+	return &Minifier{w: w}
+}
+
+// MinifyHTML returns the minified HTML, as a Minifier writes it
+func MinifyHTML(html []byte) []byte {
+	m := &Minifier{out: make([]byte, 0, len(html))}
+	m.minify(html, true)
+	return m.out
+}
+
+func (m *Minifier) Write(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	data := p
+	if len(m.held) > 0 {
+		m.held = append(m.held, p...)
+		data = m.held
+	}
+	rest := m.minify(data, false)
+	m.held = append(m.held[:0], rest...)
+	m.send()
+	return len(p), m.err
+}
+
+// Close writes what was held back, trailing whitespace aside, and closes
+// the writer if it is an io.Closer
+func (m *Minifier) Close() error {
+	if m.err != nil {
+		return m.err
+	}
+	m.minify(m.held, true)
+	m.held = m.held[:0]
+	m.send()
+	if closer, ok := m.w.(io.Closer); ok && m.err == nil {
+		m.err = closer.Close()
+	}
+	return m.err
+}
+
+func (m *Minifier) send() {
+	if len(m.out) > 0 && m.err == nil {
+		_, m.err = m.w.Write(m.out)
+	}
+	m.out = m.out[:0]
+}
+
+// minify appends the minified data to the output and returns what it
+// couldn't minify without more input, nothing when the input is final
+func (m *Minifier) minify(data []byte, final bool) []byte {
+	for len(data) > 0 {
+		if m.raw != "" {
+			end, found := closingTag(data, m.raw, final)
+			if !found {
+				// The closing tag may start in what was kept
+				keep := len(m.raw) + 2
+				if final || len(data) <= keep {
+					if final {
+						m.out = append(m.out, data...)
+						return nil
+					}
+					return data
+				}
+				m.out = append(m.out, data[:len(data)-keep]...)
+				return data[len(data)-keep:]
+			}
+			m.out = append(m.out, data[:end]...)
+			data = data[end:]
+			m.raw = ""
+			continue
+		}
+
+		switch c := data[0]; {
+		case isHTMLSpace(c):
+			if m.started && (c == '\n' || m.space == 0) {
+				m.space = c
+				if c != '\n' {
+					m.space = ' '
+				}
+			}
+			data = data[1:]
+		case c == '<':
+			n, complete := markupLength(data)
+			if !complete {
+				if final {
+					m.text(data)
+					return nil
+				}
+				return data
+			}
+			if n == 0 {
+				m.text(data[:1])
+				data = data[1:]
+				continue
+			}
+			if !isDroppedComment(data[:n]) {
+				m.text(data[:n])
+				m.raw = rawElement(data[:n])
+			}
+			data = data[n:]
+		default:
+			n := 1
+			for n < len(data) && data[n] != '<' && !isHTMLSpace(data[n]) {
+				n++
+			}
+			m.text(data[:n])
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// text appends output, after the whitespace collapsed before it
+func (m *Minifier) text(b []byte) {
+	if m.space != 0 {
+		m.out = append(m.out, m.space)
+		m.space = 0
+	}
+	m.out = append(m.out, b...)
+	m.started = true
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// markupLength returns the length of the tag, comment or declaration data
+// starts with, 0 for a '<' that starts none, and whether data held enough
+// to tell
+func markupLength(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+	switch {
+	case data[1] == '/':
+		if len(data) < 3 {
+			return 0, false
+		}
+		if !isLetter(data[2]) {
+			return 0, true
+		}
+	case data[1] == '!':
+		if len(data) < 4 {
+			if !bytes.HasPrefix([]byte("<!--"), data) {
+				break
+			}
+			return 0, false
+		}
+		if bytes.HasPrefix(data, []byte("<!--")) {
+			end := bytes.Index(data[4:], []byte("-->"))
+			if end < 0 {
+				return 0, false
+			}
+			return 4 + end + 3, true
+		}
+	case data[1] == '?' || isLetter(data[1]):
+	default:
+		return 0, true
+	}
+
+	// Up to the '>' outside of attribute values
+	var quote, last byte
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '>':
+			return i + 1, true
+		case (c == '"' || c == '\'') && last == '=':
+			quote = c
+		}
+		if !isHTMLSpace(c) {
+			last = c
+		}
+	}
+	return 0, false
+}
+
+// isDroppedComment reports whether markup is a comment to drop: any but
+// the conditional comments of old browsers
+func isDroppedComment(markup []byte) bool {
+	if !bytes.HasPrefix(markup, []byte("<!--")) {
+		return false
+	}
+	rest := markup[4:]
+	return !bytes.HasPrefix(rest, []byte("[")) && !bytes.HasPrefix(rest, []byte("<!"))
+}
+
+// rawElement returns the element an opening tag starts whose content is
+// kept as it is, "" for other tags
+func rawElement(tag []byte) string {
+	if len(tag) < 2 || !isLetter(tag[1]) || bytes.HasSuffix(tag, []byte("/>")) {
+		return ""
+	}
+	end := 1
+	for end < len(tag) && (isLetter(tag[end]) || '0' <= tag[end] && tag[end] <= '9' || tag[end] == '-') {
+		end++
+	}
+	for _, name := range rawElements {
+		if bytes.EqualFold(tag[1:end], []byte(name)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// closingTag finds the closing tag of an element in data. A tag name ending
+// data closes the element only when the input is final.
+func closingTag(data []byte, name string, final bool) (int, bool) {
+	for from := 0; ; {
+		i := bytes.Index(data[from:], []byte("</"))
+		if i < 0 {
+			return 0, false
+		}
+		start := from + i
+		end := start + 2 + len(name)
+		if end > len(data) {
+			return 0, false
+		}
+		if bytes.EqualFold(data[start+2:end], []byte(name)) {
+			if end == len(data) {
+				return start, final
+			}
+			if c := data[end]; c == '>' || c == '/' || isHTMLSpace(c) {
+				return start, true
+			}
+		}
+		from = start + 2
+	}
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+// Whitespace collapses to a space, or a newline when it held one, and
+// comments go, those of old browsers' conditions aside
+func TestMinifyHTML(t *testing.T) {
+	for _, test := range []struct {
+		html, want string
+	}{
+		{"", ""},
+		{"  <p>  a   b  </p>  ", "<p> a b </p>"},
+		{"<ul>\n  <li>a</li>\n\n  <li>b</li>\n</ul>\n", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>"},
+		{"a<!-- note -->b", "ab"},
+		{"<!--[if IE]><p>old</p><![endif]-->", "<!--[if IE]><p>old</p><![endif]-->"},
+		{`<a title="x   y"  href="/">  link </a>`, `<a title="x   y"  href="/"> link </a>`},
+		{"1 < 2\t\tand 3 > 2", "1 < 2 and 3 > 2"},
+	} {
+		if got := string(MinifyHTML([]byte(test.html))); got != test.want {
+			t.Errorf("MinifyHTML(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+// closeRecorder is a writer recording whether it was closed
+type closeRecorder struct {
+	strings.Builder
+	closed bool
+}
+
+func (w *closeRecorder) Close() error {
+	w.closed = true
+	return nil
+}
+
+// A Minifier writes what MinifyHTML returns, whatever the pieces the HTML
+// arrives in, and closes its writer
+func TestMinifier(t *testing.T) {
+	html := "<html>\n  <!-- a comment -->\n  <body class=\"a  b\">\n    <p>Hello,   world</p>\n  </body>\n</html>\n"
+	want := string(MinifyHTML([]byte(html)))
+	for size := 1; size <= len(html); size++ {
+		var w closeRecorder
+		m := NewMinifier(&w)
+		for i := 0; i < len(html); i += size {
+			end := min(i+size, len(html))
+			if n, err := m.Write([]byte(html[i:end])); n != end-i || err != nil {
+				t.Fatalf("Write: %d, %v", n, err)
+			}
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.String() != want || !w.closed {
+			t.Errorf("in pieces of %d: %q, closed %v, want %q", size, w.String(), w.closed, want)
+		}
+	}
+}
+
+// The content of pre, textarea, script and style is kept as it is, up to
+// its closing tag in any case, however the HTML is split
+func TestMinifierKeepsRawElements(t *testing.T) {
+	for _, test := range []struct {
+		html, want string
+	}{
+		{"<pre>\n  a   b\n</pre>  <p>  c  </p>", "<pre>\n  a   b\n</pre> <p> c </p>"},
+		{"<PRE class=x>  a  </PRE>  b", "<PRE class=x>  a  </PRE> b"},
+		{"<textarea name=t>  line one\n\n  line two  </textarea>", "<textarea name=t>  line one\n\n  line two  </textarea>"},
+		{"<script>\n  if (a  <  b) { x = '<!-- y -->' }\n</script>\n\n<p> z </p>", "<script>\n  if (a  <  b) { x = '<!-- y -->' }\n</script>\n<p> z </p>"},
+		{"<script>var s = '</scripts>  kept';</script>", "<script>var s = '</scripts>  kept';</script>"},
+		{"<style>\n  p  {  color : red }\n</style >  x", "<style>\n  p  {  color : red }\n</style > x"},
+		{"<pre/>  a  <b>", "<pre/> a <b>"},
+		// Unclosed, to the end of the page
+		{"<pre>  a  ", "<pre>  a  "},
+	} {
+		if got := string(MinifyHTML([]byte(test.html))); got != test.want {
+			t.Errorf("MinifyHTML(%q) = %q, want %q", test.html, got, test.want)
+		}
+		for size := 1; size < len(test.html); size++ {
+			var w strings.Builder
+			m := NewMinifier(&w)
+			for i := 0; i < len(test.html); i += size {
+				m.Write([]byte(test.html[i:min(i+size, len(test.html))]))
+			}
+			m.Close()
+			if w.String() != test.want {
+				t.Errorf("%q in pieces of %d: %q, want %q", test.html, size, w.String(), test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type nodeKind int
+
+const (
+	textNode nodeKind = iota
+	outputNode
+	codeNode
+	ifNode
+	flushNode
+)
+
+// node is an element of a parsed template: text, the expression of an
+// output tag, the code of a code tag, an if block and its branches, or a
+// flush tag
+type node struct {
+	kind     nodeKind
+	text     string
+	branches []branch
+}
+
+// branch is the if, else if or else part of an if block
+type branch struct {
+	keyword   string
+	condition string
+	tag       string
+	nodes     []node
+}
+
+// Header is a response header set by a header directive
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Template is a template with its includes parsed in, and what its
+// directives declare. It depends on the files only, so it can be run for
+// any number of requests.
+type Template struct {
+	// Declared by the page directive, "" when it doesn't
+	ContentType string
+	Charset     string
+
+	// Whether the page directive asks for the output minified or not,
+	// "true" or "false", "" when it doesn't say
+	Minify string
+
+	// Header directives, in order
+	Headers []Header
+
+	// Paths of the files included, missing ones too
+	Includes []string
+
+	// Paths of the files each file includes directly, in the order first
+	// included, by the path of the file: Options.File for the template
+	Graph map[string][]string
+
+	// Bytes of source the template and its includes hold
+	Size int
+
+	nodes []node
+	err   error
+}
+
+// Text returns the output of a template holding no tags, the same for any
+// request, and whether it holds none, so it needn't be run. Includes and
+// directives declaring a content type, charset or header count as tags.
+func (t *Template) Text() (string, bool) {
+	if t.err != nil || t.ContentType != "" || t.Charset != "" || len(t.Headers) > 0 || len(t.Includes) > 0 {
+		return "", false
+	}
+	switch {
+	case len(t.nodes) == 0:
+		return "", true
+	case len(t.nodes) == 1 && t.nodes[0].kind == textNode:
+		return t.nodes[0].text, true
+	}
+	var text strings.Builder
+	for _, n := range t.nodes {
+		if n.kind != textNode {
+			return "", false
+		}
+		text.WriteString(n.text)
+	}
+	return text.String(), true
+}
+
+// Err returns the first unbalanced if block of the template, which Run
+// reports as well
+func (t *Template) Err() error {
+	return t.err
+}
+
+// SyntaxError is an if block without its if or end, at a tag of the
+// template or of one of its includes
+type SyntaxError struct {
+	Message string
+
+	// Include holding the tag, "" for the template itself
+	File string
+
+	// Content of that file, and where the tag starts in it
+	Source string
+	Offset int
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Message
+}
+
+// SizeError is a template holding more source than Options.MaxSize once
+// its includes are parsed in
+type SizeError struct {
+	Size  int
+	Limit int
+
+	// Include whose content passed the limit, "" for the template itself
+	// or a template parsed before
+	File string
+}
+
+func (e *SizeError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("template passes the include limit of %d bytes at include %s", e.Limit, e.File)
+	}
+	return fmt.Sprintf("template holds %d bytes with its includes, over the include limit of %d", e.Size, e.Limit)
+}
+
+// CancelledError is a render, or the parse of a template, stopped once its
+// context was done. It wraps the context's error, so errors.Is tells a
+// deadline that passed from a cancelled request.
+type CancelledError struct {
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return "render cancelled: " + e.Err.Error()
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// Options are how Parse reads includes and reports progress
+type Options struct {
+	// Path of the template, which includes can't cycle back to
+	File string
+
+	// Load reads an include by the name its directive gives, returning
+	// its path, also when it can't be read, and its content in UTF-8.
+	// Includes fail without it. A *CancelledError stops parsing instead of
+	// failing the include.
+	Load func(name string) (path string, content string, err error)
+
+	// Include, when set, is called when parsing an include starts, and
+	// the function it returns once the include and its own includes are
+	// parsed, e.g. for tracing
+	Include func(name string, size int) (done func())
+
+	// Parsing stops once Context is done, Parse returning a
+	// *CancelledError
+	Context context.Context
+
+	// Parsing stops once the template and the includes parsed in hold more
+	// than MaxSize bytes of source, Parse returning a *SizeError. An
+	// include parsed in several times counts each time. 0 is no limit.
+	MaxSize int
+}
+
+var errNoLoader = errors.New("no loader for includes")
+
+// openBlock is an if block whose end tag the parser hasn't reached
+type openBlock struct {
+	node node
+	at   SyntaxError
+}
+
+// parser builds the tree of a template, parsing includes where they
+// appear, so a block may open in one file and end in another
+type parser struct {
+	opts Options
+	t    *Template
+	open []openBlock
+	err  error
+}
+
+// Parse parses a template and its includes into a tree. Problems with if
+// blocks are reported by Err and Run; missing includes and include cycles
+// become <!-- Include error --> comments in the output. The only errors
+// are a *CancelledError, for a Context done before parsing finished, and
+// a *SizeError.
+func Parse(source string, opts Options) (*Template, error) {
+	p := &parser{opts: opts, t: &Template{}}
+	p.parse("", source, []string{opts.File})
+	if p.err != nil {
+		return nil, p.err
+	}
+	if n := len(p.open); n > 0 {
+		at := p.open[n-1].at
+		p.fail("if block without end", at.File, at.Source, at.Offset)
+	}
+	return p.t, nil
+}
+
+// stopped reports whether the context is done, recording why
+func (p *parser) stopped() bool {
+	if p.err == nil && p.opts.Context != nil {
+		if err := p.opts.Context.Err(); err != nil {
+			p.err = &CancelledError{Err: err}
+		}
+	}
+	return p.err != nil
+}
+
+// parse adds the nodes of a source, name being the include it was read
+// from, "" for the template itself
+func (p *parser) parse(name, source string, stack []string) {
+	p.t.Size += len(source)
+	if max := p.opts.MaxSize; max > 0 && p.t.Size > max {
+		p.err = &SizeError{Size: p.t.Size, Limit: max, File: name}
+		return
+	}
+	for _, tok := range Lex(source) {
+		if p.stopped() {
+			return
+		}
+		switch tok.Kind {
+		case TextToken, UnclosedToken:
+			p.add(node{kind: textNode, text: tok.Body})
+		case OutputToken:
+			p.add(node{kind: outputNode, text: tok.Body})
+		case CodeToken:
+			p.code(name, source, tok)
+		case DirectiveToken:
+			p.directive(source[tok.Start:tok.End], stack)
+		}
+	}
+}
+
+// add appends a node to the innermost open branch
+func (p *parser) add(n node) {
+	if depth := len(p.open); depth > 0 {
+		branches := p.open[depth-1].node.branches
+		b := &branches[len(branches)-1]
+		b.nodes = append(b.nodes, n)
+		return
+	}
+	p.t.nodes = append(p.t.nodes, n)
+}
+
+// fail records the first block problem, at a tag of a source
+func (p *parser) fail(message, name, source string, offset int) {
+	if p.t.err == nil {
+		p.t.err = &SyntaxError{Message: message, File: name, Source: source, Offset: offset}
+	}
+}
+
+func (p *parser) code(name, source string, tok Token) {
+	if tok.Body == "flush" {
+		p.add(node{kind: flushNode})
+		return
+	}
+	keyword, condition, ok := ControlTag(tok.Body)
+	if !ok {
+		p.add(node{kind: codeNode, text: tok.Body})
+		return
+	}
+	b := branch{keyword: keyword, condition: condition, tag: tok.Body}
+	if keyword == "if" {
+		n := node{kind: ifNode, branches: []branch{b}}
+		p.open = append(p.open, openBlock{node: n, at: SyntaxError{File: name, Source: source, Offset: tok.Start}})
+		return
+	}
+	depth := len(p.open)
+	if depth == 0 {
+		p.fail(keyword+" without if", name, source, tok.Start)
+		return
+	}
+	if keyword == "end" {
+		block := p.open[depth-1]
+		p.open = p.open[:depth-1]
+		p.add(block.node)
+		return
+	}
+	p.open[depth-1].node.branches = append(p.open[depth-1].node.branches, b)
+}
+
+// directive applies a page or header directive, or parses an include in.
+// Anything else is dropped.
+func (p *parser) directive(tag string, stack []string) {
+	if matches := IncludePattern.FindStringSubmatch(tag); matches != nil {
+		p.include(matches[1], stack)
+		return
+	}
+	if matches := PagePattern.FindStringSubmatch(tag); matches != nil {
+		for _, attr := range AttrPattern.FindAllStringSubmatch(matches[1], -1) {
+			switch attr[1] {
+			case "contentType":
+				p.t.ContentType = attr[2]
+			case "charset":
+				p.t.Charset = attr[2]
+			case "minify":
+				p.t.Minify = attr[2]
+			}
+		}
+		return
+	}
+	if matches := HeaderPattern.FindStringSubmatch(tag); matches != nil {
+		p.t.Headers = append(p.t.Headers, Header{Name: matches[1], Value: matches[2]})
+	}
+}
+
+func (p *parser) include(name string, stack []string) {
+	file, content, err := name, "", errNoLoader
+	if p.opts.Load != nil {
+		file, content, err = p.opts.Load(name)
+	}
+	var cancelled *CancelledError
+	if errors.As(err, &cancelled) {
+		p.err = cancelled
+		return
+	}
+	p.t.Includes = append(p.t.Includes, file)
+	p.edge(stack[len(stack)-1], file)
+	if err != nil {
+		p.add(node{kind: textNode, text: fmt.Sprintf("<!-- Include error: %v -->", err)})
+		return
+	}
+	if containsString(stack, file) {
+		p.add(node{kind: textNode, text: fmt.Sprintf("<!-- Include error: include cycle through %s -->", name)})
+		return
+	}
+
+	if p.opts.Include != nil {
+		defer p.opts.Include(name, len(content))()
+	}
+	p.parse(name, content, append(stack, file))
+}
+
+// edge records that a file includes another, once
+func (p *parser) edge(from, to string) {
+	if containsString(p.t.Graph[from], to) {
+		return
+	}
+	if p.t.Graph == nil {
+		p.t.Graph = make(map[string][]string)
+	}
+	p.t.Graph[from] = append(p.t.Graph[from], to)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
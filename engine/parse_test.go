@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loader reads includes from a map, by their name
+func loader(files map[string]string) func(string) (string, string, error) {
+	return func(name string) (string, string, error) {
+		content, ok := files[name]
+		if !ok {
+			return name, "", os.ErrNotExist
+		}
+		return name, content, nil
+	}
+}
+
+// render renders a template against data, failing the test on errors
+func render(t *testing.T, tmpl *Template, data map[string]interface{}) string {
+	t.Helper()
+	var out strings.Builder
+	if err := tmpl.Render(&out, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// Parse reads the directives of a template and parses its includes in,
+// recording which file includes which
+func TestParse(t *testing.T) {
+	tmpl, err := Parse(`<%@page contentType="text/plain" charset="utf-8" minify="false" %><%@header name="X-A" value="1" %>`+
+		`<%@include file="head.html" %>body<%@include file="missing.html" %><%@other %>`, Options{
+		File: "page.html",
+		Load: loader(map[string]string{
+			"head.html":  `[<%@include file="title.html" %>]`,
+			"title.html": `<%= title %>`,
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.ContentType != "text/plain" || tmpl.Charset != "utf-8" || tmpl.Minify != "false" {
+		t.Errorf("page directive: %q %q %q", tmpl.ContentType, tmpl.Charset, tmpl.Minify)
+	}
+	if want := []Header{{"X-A", "1"}}; !reflect.DeepEqual(tmpl.Headers, want) {
+		t.Errorf("headers %v, want %v", tmpl.Headers, want)
+	}
+	if want := []string{"head.html", "title.html", "missing.html"}; !reflect.DeepEqual(tmpl.Includes, want) {
+		t.Errorf("includes %v, want %v", tmpl.Includes, want)
+	}
+	if want := map[string][]string{"page.html": {"head.html", "missing.html"}, "head.html": {"title.html"}}; !reflect.DeepEqual(tmpl.Graph, want) {
+		t.Errorf("graph %v, want %v", tmpl.Graph, want)
+	}
+	if got, want := render(t, tmpl, map[string]interface{}{"title": "T"}), "[T]body<!-- Include error: file does not exist -->"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
+
+// An include reached again through its own includes isn't parsed in again
+func TestParseIncludeCycle(t *testing.T) {
+	tmpl, err := Parse(`<%@include file="a.html" %>`, Options{
+		File: "page.html",
+		Load: loader(map[string]string{
+			"a.html": `a<%@include file="b.html" %>`,
+			"b.html": `b<%@include file="a.html" %>`,
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := render(t, tmpl, nil), "ab<!-- Include error: include cycle through a.html -->"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
+
+// Unbalanced if blocks are reported with the tag and file they're at, and
+// fail the run
+func TestParseBlockErrors(t *testing.T) {
+	for _, test := range []struct {
+		source, include string
+		message, file   string
+		offset          int
+	}{
+		{source: "a<% end %>", message: "end without if", offset: 1},
+		{source: "<% if x %>ab<% else %>", message: "if block without end"},
+		{source: `<%@include file="inc.html" %>`, include: "x<% else %>", message: "else without if", file: "inc.html", offset: 1},
+	} {
+		tmpl, err := Parse(test.source, Options{Load: loader(map[string]string{"inc.html": test.include})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var syntax *SyntaxError
+		if !errors.As(tmpl.Err(), &syntax) || syntax.Message != test.message || syntax.File != test.file || syntax.Offset != test.offset {
+			t.Errorf("%q: error %#v, want %q in %q at %d", test.source, tmpl.Err(), test.message, test.file, test.offset)
+			continue
+		}
+		if err := tmpl.Run(&dataEvaluator{}, &Output{}); err != tmpl.Err() {
+			t.Errorf("%q: Run returned %v", test.source, err)
+		}
+	}
+}
+
+// Parsing stops at MaxSize, counting the includes, and once its context
+// is done
+func TestParseLimits(t *testing.T) {
+	files := map[string]string{"big.html": strings.Repeat("x", 100)}
+	_, err := Parse(`<%@include file="big.html" %>`, Options{Load: loader(files), MaxSize: 100})
+	var size *SizeError
+	if !errors.As(err, &size) || size.File != "big.html" || size.Limit != 100 {
+		t.Errorf("over MaxSize: %v", err)
+	}
+	if _, err := Parse(`<%@include file="big.html" %>`, Options{Load: loader(files), MaxSize: 200}); err != nil {
+		t.Errorf("under MaxSize: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Parse("a<%= b %>", Options{Context: ctx})
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: %v", err)
+	}
+}
+
+func TestTemplateText(t *testing.T) {
+	for _, test := range []struct {
+		source string
+		text   string
+		ok     bool
+	}{
+		{"", "", true},
+		{"plain", "plain", true},
+		{"a<%= b %>", "", false},
+		{`<%@page contentType="text/plain" %>plain`, "", false},
+		{`<%@include file="x.html" %>`, "", false},
+	} {
+		tmpl, err := Parse(test.source, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text, ok := tmpl.Text(); text != test.text || ok != test.ok {
+			t.Errorf("Text of %q = %q, %v", test.source, text, ok)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Funcs are the functions output tags call, as name()
+type Funcs map[string]func() string
+
+// Render runs a template against data and writes its output to w, escaped
+// for the content type the template declares. Output tags print the data
+// value they name or call one of funcs; anything else is printed as it
+// is, like gosp does for expressions it doesn't know. Code tags assign
+// strings into data, so it must not be shared between concurrent renders.
+func (t *Template) Render(w io.Writer, data map[string]interface{}, funcs Funcs) error {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	ev := &dataEvaluator{data: data, funcs: funcs}
+	var out Output
+	if err := t.Run(ev, &out); err != nil {
+		return err
+	}
+	return out.Write(w, ev, Escaper(t.ContentType))
+}
+
+// dataEvaluator resolves tags against a data map and funcs, for Render
+type dataEvaluator struct {
+	data  map[string]interface{}
+	funcs Funcs
+}
+
+func (ev *dataEvaluator) Output(expression string) string {
+	if value, exists := ev.data[expression]; exists {
+		if s, ok := value.(string); ok {
+			return s
+		}
+		return fmt.Sprintf("%v", value)
+	}
+	if name, ok := strings.CutSuffix(expression, "()"); ok {
+		if fn, exists := ev.funcs[name]; exists {
+			return fn()
+		}
+	}
+	return expression
+}
+
+func (ev *dataEvaluator) Operand(name string) (interface{}, bool) {
+	value, exists := ev.data[name]
+	return value, exists
+}
+
+func (ev *dataEvaluator) Code(code string) {
+	if name, value, ok := Assignment(code); ok {
+		ev.data[name] = value
+	}
+}
+
+func (ev *dataEvaluator) Err() error {
+	return nil
+}
@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Evaluator gives the tags of a template their meaning while it runs
+type Evaluator interface {
+	// Output returns the value of an output tag's expression, unescaped
+	Output(expression string) string
+
+	// Operand returns the value a name in a condition stands for, if it
+	// has a typed one: a string, or a float64, bool, []interface{} or
+	// map[string]interface{} for JSON values. Names it doesn't know are
+	// compared as literals, or evaluated with Output.
+	Operand(name string) (interface{}, bool)
+
+	// Code runs a code tag other than the tags of if blocks and flush
+	Code(code string)
+
+	// Err is checked between tags, stopping the run with its error
+	Err() error
+}
+
+// Tracer is implemented by Evaluators that follow a run tag by tag: the
+// branches of if blocks as they are taken or not, and the values output
+// tags print
+type Tracer interface {
+	TraceBranch(tag string, taken bool)
+	TraceOutput(expression, value string)
+}
+
+// Output is the text and the output tags of the branches a run took, in
+// order, to be written once all the code ran. It can be reused.
+type Output struct {
+	nodes []*node
+}
+
+// Reset empties the output, keeping its capacity but not the template
+func (o *Output) Reset() {
+	clear(o.nodes)
+	o.nodes = o.nodes[:0]
+}
+
+// Run runs the code tags and conditions of a template in order, filling
+// out with the output of the branches taken. Output tags are evaluated
+// when out is written, so an include may print a value the page sets
+// further down.
+func (t *Template) Run(ev Evaluator, out *Output) error {
+	out.Reset()
+	if t.err != nil {
+		return t.err
+	}
+	out.nodes = runNodes(t.nodes, ev, out.nodes)
+	return ev.Err()
+}
+
+func runNodes(nodes []node, ev Evaluator, active []*node) []*node {
+	tracer, _ := ev.(Tracer)
+	for i := range nodes {
+		if ev.Err() != nil {
+			return active
+		}
+		n := &nodes[i]
+		switch n.kind {
+		case textNode, outputNode, flushNode:
+			active = append(active, n)
+		case codeNode:
+			ev.Code(n.text)
+		case ifNode:
+			for _, b := range n.branches {
+				taken := b.keyword == "else" || Condition(b.condition, ev)
+				if tracer != nil {
+					tracer.TraceBranch(b.tag, taken)
+				}
+				if taken {
+					active = runNodes(b.nodes, ev, active)
+					break
+				}
+			}
+		}
+	}
+	return active
+}
+
+// Write writes the output to w, evaluating the output tags and escaping
+// their values with escape. Flush tags flush w if it has a Flush method.
+// It stops at the first failed write or error of ev, which is checked
+// between nodes.
+func (o *Output) Write(w io.Writer, ev Evaluator, escape func(string) string) error {
+	tracer, _ := ev.(Tracer)
+	for _, n := range o.nodes {
+		if err := ev.Err(); err != nil {
+			return err
+		}
+		var err error
+		switch n.kind {
+		case textNode:
+			_, err = io.WriteString(w, n.text)
+		case flushNode:
+			if flusher, ok := w.(interface{ Flush() }); ok {
+				flusher.Flush()
+			}
+		case outputNode:
+			value := ev.Output(n.text)
+			if tracer != nil {
+				tracer.TraceOutput(n.text, value)
+			}
+			_, err = io.WriteString(w, escape(value))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ev.Err()
+}
+
+// Condition evaluates the condition of an if tag: !COND, A == B, A != B,
+// A contains B or plain truthiness. contains tests membership for arrays
+// and substrings otherwise. A bare value is true unless it's empty,
+// false or 0.
+func Condition(condition string, ev Evaluator) bool {
+	condition = strings.TrimSpace(condition)
+	if strings.HasPrefix(condition, "!") && !strings.HasPrefix(condition, "!=") {
+		return !Condition(condition[1:], ev)
+	}
+
+	for _, operator := range []string{"==", "!=", " contains "} {
+		index := indexOutsideQuotes(condition, operator)
+		if index < 0 {
+			continue
+		}
+		left := operand(condition[:index], ev)
+		right := FormatValue(operand(condition[index+len(operator):], ev))
+
+		switch operator {
+		case "==":
+			return FormatValue(left) == right
+		case "!=":
+			return FormatValue(left) != right
+		default:
+			if list, ok := left.([]interface{}); ok {
+				return containsString(valueStrings(list), right)
+			}
+			return strings.Contains(FormatValue(left), right)
+		}
+	}
+
+	return truthy(operand(condition, ev))
+}
+
+// operand evaluates one side of a condition: a string literal, a name
+// with a typed value, a literal, or an output expression. Unknown names
+// are empty.
+func operand(s string, ev Evaluator) interface{} {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
+		return s[1 : len(s)-1]
+	}
+	if value, ok := ev.Operand(s); ok {
+		return value
+	}
+	if s == "true" || s == "false" {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	if value := ev.Output(s); value != s {
+		return value
+	}
+	return ""
+}
+
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != "" && value != "false" && value != "0"
+	case []interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+// indexOutsideQuotes finds the operator, ignoring it inside string literals
+func indexOutsideQuotes(s, operator string) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' {
+			quoted = !quoted
+		} else if !quoted && strings.HasPrefix(s[i:], operator) {
+			return i
+		}
+	}
+	return -1
+}
+
+// FormatValue renders a JSON value for output: arrays comma-separated,
+// objects as JSON
+func FormatValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []interface{}:
+		return strings.Join(valueStrings(value), ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	return fmt.Sprint(value)
+}
+
+func valueStrings(list []interface{}) []string {
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		values = append(values, FormatValue(item))
+	}
+	return values
+}
+
+// Assignment recognizes the code of an assignment tag, name = "value" or
+// name = value, returning the name and the unquoted value
+func Assignment(code string) (name, value string, ok bool) {
+	name, value, ok = strings.Cut(code, "=")
+	if !ok {
+		return "", "", false
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		value = value[1 : len(value)-1]
+	}
+	return name, value, true
+}
+
+// Escapers by content type, which would be parsed on every render
+var escapers sync.Map
+
+// Escaper picks the output escaping for a declared content type: HTML
+// for HTML, string escaping for JSON and XML escaping for XML types.
+// Values are output as they are for other types, or none.
+func Escaper(contentType string) func(string) string {
+	if escape, ok := escapers.Load(contentType); ok {
+		return escape.(func(string) string)
+	}
+	escape := newEscaper(contentType)
+	escapers.Store(contentType, escape)
+	return escape
+}
+
+func newEscaper(contentType string) func(string) string {
+	if contentType == "" {
+		return func(value string) string { return value }
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return html.EscapeString
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return escapeJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return escapeXML
+	default:
+		return func(value string) string { return value }
+	}
+}
+
+// escapeJSON escapes a value for a JSON string, returning printable ASCII
+// without the characters json escapes as it is
+func escapeJSON(value string) string {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c >= 0x80 || strings.IndexByte(`"\<>&`, c) >= 0 {
+			encoded, _ := json.Marshal(value)
+			return string(encoded[1 : len(encoded)-1])
+		}
+	}
+	return value
+}
+
+// escapeXML escapes a value for XML text, returning printable ASCII
+// without markup characters as it is
+func escapeXML(value string) string {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c >= 0x80 || strings.IndexByte(`"'&<>`, c) >= 0 {
+			var b strings.Builder
+			xml.EscapeText(&b, []byte(value))
+			return b.String()
+		}
+	}
+	return value
+}
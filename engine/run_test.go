@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"testing"
+)
+
+// recorder is an Evaluator keeping the code it runs and a typed value per
+// name, failing once it runs the code "fail"
+type recorder struct {
+	values map[string]interface{}
+	ran    []string
+	err    error
+}
+
+func (r *recorder) Output(expression string) string {
+	if value, ok := r.values[expression]; ok {
+		return FormatValue(value)
+	}
+	return expression
+}
+
+func (r *recorder) Operand(name string) (interface{}, bool) {
+	value, ok := r.values[name]
+	return value, ok
+}
+
+func (r *recorder) Code(code string) {
+	r.ran = append(r.ran, code)
+	if code == "fail" {
+		r.err = errors.New("failed")
+		return
+	}
+	if name, value, ok := Assignment(code); ok {
+		r.values[name] = value
+	}
+}
+
+func (r *recorder) Err() error {
+	return r.err
+}
+
+// flushRecorder is a writer counting its flushes
+type flushRecorder struct {
+	strings.Builder
+	flushes []int
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushes = append(w.flushes, w.Len())
+}
+
+// Run runs the code of the branches taken; output tags are evaluated as
+// the output is written, so a value set further down is printed, escaped,
+// and flush tags flush the writer
+func TestRunAndWrite(t *testing.T) {
+	tmpl, err := Parse(`<h1><%= title %></h1><% flush %>`+
+		`<% if show %><% shown = "yes" %>shown<% else %><% skipped = "yes" %>hidden<% end %>`+
+		`<% title = "<Fish & Chips>" %>`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &recorder{values: map[string]interface{}{"show": true}}
+	var out Output
+	if err := tmpl.Run(ev, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`shown = "yes"`, `title = "<Fish & Chips>"`}; strings.Join(ev.ran, ";") != strings.Join(want, ";") {
+		t.Errorf("ran %q, want %q", ev.ran, want)
+	}
+
+	var w flushRecorder
+	if err := out.Write(&w, ev, html.EscapeString); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.String(), "<h1>&lt;Fish &amp; Chips&gt;</h1>shown"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+	if len(w.flushes) != 1 || w.flushes[0] != len("<h1>&lt;Fish &amp; Chips&gt;</h1>") {
+		t.Errorf("flushed at %v", w.flushes)
+	}
+
+	// Run resets the output it fills
+	ev.values["show"] = false
+	if err := tmpl.Run(ev, &out); err != nil {
+		t.Fatal(err)
+	}
+	w = flushRecorder{}
+	if err := out.Write(&w, ev, html.EscapeString); err != nil || w.String() != "<h1>&lt;Fish &amp; Chips&gt;</h1>hidden" {
+		t.Errorf("second run wrote %q, %v", w.String(), err)
+	}
+}
+
+// An error of the evaluator stops the run at the next tag, and a failed
+// write stops writing
+func TestRunStops(t *testing.T) {
+	tmpl, err := Parse(`a<% fail %><% after = "1" %>b`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &recorder{values: map[string]interface{}{}}
+	if err := tmpl.Run(ev, &Output{}); err == nil || err.Error() != "failed" {
+		t.Errorf("Run returned %v", err)
+	}
+	if _, ran := ev.values["after"]; ran {
+		t.Error("code after the error ran")
+	}
+
+	tmpl, err = Parse("a<%= b %>c", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = &recorder{values: map[string]interface{}{}}
+	var out Output
+	if err := tmpl.Run(ev, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Write(failingWriter{}, ev, html.EscapeString); !errors.Is(err, errWrite) {
+		t.Errorf("Write returned %v", err)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWrite
+}
+
+// Conditions compare typed values, literals and outputs; names the
+// evaluator knows nothing of are empty
+func TestCondition(t *testing.T) {
+	ev := &recorder{values: map[string]interface{}{
+		"name":  "alice",
+		"zero":  float64(0),
+		"count": float64(3),
+		"off":   false,
+		"tags":  []interface{}{"a", "b"},
+		"none":  []interface{}{},
+		"empty": "",
+	}}
+	for condition, want := range map[string]bool{
+		"name":                 true,
+		"empty":                false,
+		"unknown":              false,
+		"zero":                 false,
+		"count":                true,
+		"off":                  false,
+		"!off":                 true,
+		"tags":                 true,
+		"none":                 false,
+		`name == "alice"`:      true,
+		`name != "alice"`:      false,
+		"name == alice":        false,
+		"count == 3":           true,
+		`"a == b" == "a == b"`: true,
+		`tags contains "b"`:    true,
+		`tags contains "c"`:    false,
+		`name contains "lic"`:  true,
+		`!name contains "bob"`: true,
+		`name == ""`:           false,
+		`empty == ""`:          true,
+		"0":                    false,
+		"1":                    true,
+		"false":                false,
+	} {
+		if got := Condition(condition, ev); got != want {
+			t.Errorf("Condition(%q) = %v, want %v", condition, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// benchmarkPage is a page of code, output tags and an include, as a
+// template processor parses and runs it on every request without the
+// template cache
+const benchmarkPage = `<%@include file="inc/head.html" %>
+<% title = "Products" %>
+<h1><%= title %></h1>
+<% if query.page != "" %><p>Page <%= query.page %></p><% end %>
+<ul>
+  <li><%= query.q %></li>
+  <li><%= request.method %></li>
+  <li><%= 1 + 2 %></li>
+</ul>`
+
+func BenchmarkProcessTemplate(b *testing.B) {
+	root := b.TempDir()
+	writeFiles(b, root, map[string]string{"inc/head.html": `<title><%= query.q %></title>`})
+	srv := newServer(&serverOptions{root: root})
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/?q=shoes&page=2", nil)
+	process := func() string {
+		c := e.NewContext(req, httptest.NewRecorder())
+		tp := srv.newProcessor(context.Background())
+		defer tp.recycle()
+		tp.roots = []string{root}
+		page, err := tp.processTemplate(benchmarkPage, c)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return page
+	}
+	for _, want := range []string{"<title>shoes</title>", "<h1>Products</h1>", "<p>Page 2</p>", "<li>GET</li>", "<li>3</li>"} {
+		assertContains(b, process(), want)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		process()
+	}
+}
+
+// BenchmarkRenderPage serves a representative page through the handler,
+// its template cached: 50 output tags over query parameters, the request
+// path, code and sums, and 3 includes
+func BenchmarkRenderPage(b *testing.B) {
+	var page strings.Builder
+	page.WriteString(`<%@include file="inc/head.html" %>` + "\n")
+	for i := 0; i < 50; i++ {
+		switch i % 5 {
+		case 0:
+			fmt.Fprintf(&page, "<li><%%= query.q %%> %d</li>\n", i)
+		case 1:
+			fmt.Fprintf(&page, "<li><%%= query.page %%></li>\n")
+		case 2:
+			fmt.Fprintf(&page, "<%% item = \"item %d\" %%><li><%%= item %%></li>\n", i)
+		case 3:
+			fmt.Fprintf(&page, "<li><%%= %d + 1 %%></li>\n", i)
+		case 4:
+			fmt.Fprintf(&page, "<li><%%= request.originalpath %%></li>\n")
+		}
+		if i == 24 {
+			page.WriteString(`<%@include file="inc/nav.html" %>` + "\n")
+		}
+	}
+	page.WriteString(`<%@include file="inc/foot.html" %>`)
+
+	handler, _ := newTestSite(b, map[string]string{
+		"index.html":    page.String(),
+		"inc/head.html": `<title><%= query.q %></title>`,
+		"inc/nav.html":  `<nav>page <%= query.page %></nav>`,
+		"inc/foot.html": `<footer>&copy; shop</footer>`,
+	}, "<routes/>")
+	req := httptest.NewRequest(http.MethodGet, "/?q=shoes&page=2", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		b.Fatalf("status %d: %q", rec.Code, body)
+	}
+	for _, want := range []string{"<title>shoes</title>", "<li>shoes 45</li>", "<li>item 47</li>", "<li>49</li>", "<nav>page 2</nav>", "<footer>"} {
+		assertContains(b, body, want)
+	}
+	if paths := strings.Count(body, "<li>/</li>"); paths != 10 {
+		b.Fatalf("%d request paths rendered, want 10", paths)
+	}
+	if tags := strings.Count(body, "<li>"); tags != 50 {
+		b.Fatalf("%d items rendered, want 50", tags)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
@@ -0,0 +1,35 @@
+package gosp
+
+import "testing"
+
+func TestExpandConfigEnv(t *testing.T) {
+	t.Setenv("GOSP_TEST_SET", "pages/<set>.html")
+	t.Setenv("GOSP_TEST_EMPTY", "")
+
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{`<route file="${GOSP_TEST_SET}"/>`, `<route file="pages/&lt;set&gt;.html"/>`},
+		{`<route file="${GOSP_TEST_SET:-other.html}"/>`, `<route file="pages/&lt;set&gt;.html"/>`},
+		{`<route file="${GOSP_TEST_UNSET:-other.html}"/>`, `<route file="other.html"/>`},
+		{`<route file="${GOSP_TEST_EMPTY:-other.html}"/>`, `<route file="other.html"/>`},
+		{`<route file="${GOSP_TEST_EMPTY}"/>`, `<route file=""/>`},
+		{`<route file="${GOSP_TEST_UNSET:-}"/>`, `<route file=""/>`},
+		{`<!-- ${GOSP_TEST_UNSET} --><route/>`, `<!-- ${GOSP_TEST_UNSET} --><route/>`},
+	}
+	for _, test := range tests {
+		got, err := expandConfigEnv([]byte(test.config))
+		if err != nil {
+			t.Errorf("%s: %v", test.config, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.config, got, test.want)
+		}
+	}
+
+	if _, err := expandConfigEnv([]byte(`<route file="${GOSP_TEST_UNSET}"/>`)); err == nil {
+		t.Error("unset variable without a default expanded")
+	}
+}
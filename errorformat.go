@@ -0,0 +1,145 @@
+package gosp
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Error format of the route handling a request, set before its other
+// middleware so rejections are answered in it too
+const errorFormatKey = "gosp.errorFormat"
+
+// Error format of a path prefix, for requests no route matched: "json",
+// "html", or "auto" to follow the Accept header
+type errorScope struct {
+	Prefix string
+	Format string
+}
+
+// errorResponse is the body of errors answered as JSON
+type errorResponse struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	Path      string `json:"path"`
+	RequestID string `json:"requestId"`
+}
+
+// errorFormat is the format a route answers errors in. JSON routes default
+// to JSON.
+func (route Route) errorFormat() string {
+	if route.Errors == "" && route.Type == "json" {
+		return "json"
+	}
+	return route.Errors
+}
+
+// errorScopes lists the error format of the site and of every group,
+// longest prefix first
+func (config *RouteConfig) errorScopes() []errorScope {
+	global := config.RouteSettings.inherit(RouteSettings{})
+	scopes := []errorScope{{Prefix: "", Format: global.Errors}}
+	for _, group := range config.Groups {
+		scopes = append(scopes, errorScope{
+			Prefix: strings.TrimSuffix(group.Prefix, "/"),
+			Format: group.inherit(global).Errors,
+		})
+	}
+	sort.SliceStable(scopes, func(i, j int) bool {
+		return len(scopes[i].Prefix) > len(scopes[j].Prefix)
+	})
+	return scopes
+}
+
+// errorFormatMiddleware records the error format of a route
+func errorFormatMiddleware(format string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(errorFormatKey, format)
+			return next(c)
+		}
+	}
+}
+
+// wantsJSONError reports whether errors are answered as JSON: as the route
+// or the longest matching prefix says, or when the client prefers JSON to
+// HTML
+func wantsJSONError(c echo.Context) bool {
+	format, matched := c.Get(errorFormatKey).(string)
+	if !matched {
+		urlPath := c.Request().URL.Path
+		for _, scope := range siteOf(c).errorScopes {
+			if scope.Prefix == "" || urlPath == scope.Prefix || strings.HasPrefix(urlPath, scope.Prefix+"/") {
+				format = scope.Format
+				break
+			}
+		}
+	}
+	switch format {
+	case "json":
+		return true
+	case "html":
+		return false
+	}
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	quality := acceptQuality(accept, echo.MIMEApplicationJSON)
+	return quality > 0 && quality > acceptQuality(accept, echo.MIMETextHTML)
+}
+
+// acceptQuality returns the q-value an Accept header gives a media type,
+// taken from its most specific matching range
+func acceptQuality(accept, mediaType string) float64 {
+	group := strings.SplitN(mediaType, "/", 2)[0] + "/*"
+	best, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		var rank int
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mediaType:
+			rank = 2
+		case group:
+			rank = 1
+		case "*/*":
+			rank = 0
+		default:
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+		}
+		if rank > specificity || rank == specificity && q > best {
+			best, specificity = q, rank
+		}
+	}
+	return best
+}
+
+// jsonError answers an error as JSON, with the path and request ID to find
+// it in the logs
+func jsonError(c echo.Context, status int, message string) error {
+	id := requestID(c)
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, errorResponse{
+		Error:     message,
+		Status:    status,
+		Path:      c.Request().URL.Path,
+		RequestID: id,
+	})
+}
+
+// notFound answers a 404 as JSON or as plain text
+func notFound(c echo.Context, message string) error {
+	if wantsJSONError(c) {
+		return jsonError(c, http.StatusNotFound, message)
+	}
+	return c.String(http.StatusNotFound, message)
+}
@@ -0,0 +1,257 @@
+package gosp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/engine"
+)
+
+// Set while the error template renders, so its own failure falls back to
+// the built-in page
+const errorPageKey = "gosp.errorPage"
+
+// Lines shown around the failing tag
+const excerptContext = 3
+
+// errorReport is what went wrong while handling a request
+type errorReport struct {
+	message  string
+	err      error
+	template string
+	includes []string
+	stack    []byte
+}
+
+// requestID returns the X-Request-ID of the request, or one generated and
+// sent back so the access log and error page show the same ID
+func requestID(c echo.Context) string {
+	if id := c.Request().Header.Get(echo.HeaderXRequestID); id != "" {
+		return id
+	}
+	res := c.Response()
+	if id := res.Header().Get(echo.HeaderXRequestID); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	res.Header().Set(echo.HeaderXRequestID, id)
+	return id
+}
+
+// showDevErrors reports whether error pages may show details. The dev page
+// is never served in prod mode, whatever the other flags.
+func showDevErrors(options *serverOptions) bool {
+	return options.runMode == "dev" && options.errorDetails
+}
+
+// serveError logs the error and answers with a 500: JSON for API clients,
+// the dev page with its context in dev mode, otherwise the error template or
+// a generic page with only the request ID. An *echo.HTTPError, as providers
+// return, picks the status and the message instead.
+func serveError(c echo.Context, report errorReport) error {
+	message := errorMessage(c, report.message, report.err)
+	status := http.StatusInternalServerError
+	if he, ok := report.err.(*echo.HTTPError); ok {
+		status, message = he.Code, fmt.Sprint(he.Message)
+	}
+	if report.stack != nil {
+		renderLog.Error("Panic stack trace", "request_id", requestID(c), "stack", string(report.stack))
+	}
+	if c.Response().Committed {
+		return nil
+	}
+
+	// The failed page may have picked another content type
+	c.Response().Header().Del(echo.HeaderContentType)
+	id := requestID(c)
+
+	if wantsJSONError(c) {
+		return jsonError(c, status, message)
+	}
+
+	if showDevErrors(siteOf(c).options) {
+		processor := &TemplateProcessor{data: devErrorData(c, report, id), ctx: c.Request().Context()}
+		page, err := processor.processTemplate(devErrorPage, c)
+		if err == nil {
+			return c.HTML(status, page)
+		}
+	}
+
+	if errorTemplate := siteOf(c).errorTemplate; errorTemplate != "" && c.Get(errorPageKey) == nil {
+		c.Set(errorPageKey, true)
+		return renderTemplate(c, errorTemplate, status)
+	}
+
+	return c.HTML(status, fmt.Sprintf(genericErrorPage, html.EscapeString(message), html.EscapeString(id)))
+}
+
+// recoverMiddleware turns panics into error pages with the stack trace
+func recoverMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (returnErr error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				// Aborting the response is how handlers drop a connection
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+				err, ok := r.(error)
+				if !ok {
+					err = fmt.Errorf("%v", r)
+				}
+				report := errorReport{message: "Panic", err: err, stack: debug.Stack()}
+				if name, ok := c.Get(templateNameKey).(string); ok {
+					report.template = name
+				}
+				returnErr = serveError(c, report)
+			}()
+			return next(c)
+		}
+	}
+}
+
+// errorHandler renders errors returned by handlers like processing errors,
+// leaving HTTP errors such as 404s to Echo unless they are answered as JSON
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if he, ok := err.(*echo.HTTPError); ok && !c.Response().Committed && wantsJSONError(c) {
+			jsonError(c, he.Code, fmt.Sprint(he.Message))
+			return
+		}
+		if _, ok := err.(*echo.HTTPError); ok || isInterruption(err) || c.Response().Committed {
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+		serveError(c, errorReport{message: "Handler error", err: err})
+	}
+}
+
+// devErrorData renders the sections of the dev page, escaped here as the
+// page has no content type to escape output tags by
+func devErrorData(c echo.Context, report errorReport, id string) map[string]interface{} {
+	req := c.Request()
+	data := map[string]interface{}{
+		"error.message":  html.EscapeString(report.message),
+		"error.detail":   html.EscapeString(report.err.Error()),
+		"error.id":       html.EscapeString(id),
+		"error.template": html.EscapeString(report.template),
+		"error.stack":    html.EscapeString(string(report.stack)),
+	}
+
+	var excerpt strings.Builder
+	if tagErr, ok := report.err.(*engine.SyntaxError); ok {
+		data["error.source"] = html.EscapeString(report.template)
+		if tagErr.File != "" {
+			data["error.source"] = html.EscapeString(tagErr.File)
+		}
+		lines := strings.Split(tagErr.Source, "\n")
+		failing := strings.Count(tagErr.Source[:tagErr.Offset], "\n")
+		first, last := failing-excerptContext, failing+excerptContext
+		if first < 0 {
+			first = 0
+		}
+		if last >= len(lines) {
+			last = len(lines) - 1
+		}
+		for i := first; i <= last; i++ {
+			marker := "  "
+			if i == failing {
+				marker = "> "
+			}
+			fmt.Fprintf(&excerpt, "%s%4d | %s\n", marker, i+1, html.EscapeString(lines[i]))
+		}
+	}
+	data["error.excerpt"] = excerpt.String()
+
+	var includes strings.Builder
+	for _, include := range report.includes {
+		for _, root := range siteOf(c).templateRoots(c) {
+			if rel, err := filepath.Rel(root, include); err == nil && !strings.HasPrefix(rel, "..") {
+				include = filepath.ToSlash(rel)
+				break
+			}
+		}
+		fmt.Fprintf(&includes, "<li>%s</li>\n", html.EscapeString(include))
+	}
+	data["error.includes"] = includes.String()
+
+	var request strings.Builder
+	row := func(name, value string) {
+		fmt.Fprintf(&request, "<tr><th>%s</th><td>%s</td></tr>\n", html.EscapeString(name), html.EscapeString(value))
+	}
+	row("Method", req.Method)
+	row("URI", req.RequestURI)
+	row("Route", c.Path())
+	row("Remote IP", c.RealIP())
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		switch name {
+		case echo.HeaderAuthorization, echo.HeaderCookie, "Proxy-Authorization", "X-Api-Key":
+			value = "(hidden)"
+		}
+		row(name, value)
+	}
+	data["error.request"] = request.String()
+	return data
+}
+
+const genericErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Internal Server Error</title></head>
+<body>
+<h1>%s</h1>
+<p>Request ID: %s</p>
+</body>
+</html>
+`
+
+const devErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title><%= error.message %></title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f6f6f6; padding: 1em; overflow-x: auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1><%= error.message %></h1>
+<pre><%= error.detail %></pre>
+<% if error.template %><p>Template: <%= error.template %></p><% end %>
+<% if error.excerpt %><h2>Source</h2>
+<p>In <%= error.source %></p>
+<pre><%= error.excerpt %></pre><% end %>
+<% if error.includes %><h2>Includes</h2>
+<ul>
+<%= error.includes %></ul><% end %>
+<% if error.stack %><h2>Stack</h2>
+<pre><%= error.stack %></pre><% end %>
+<h2>Request</h2>
+<table>
+<%= error.request %></table>
+<p>Request ID: <%= error.id %>. This page is only shown in dev mode.</p>
+</body>
+</html>
+`
@@ -0,0 +1,172 @@
+package gosp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// etagMiddleware holds back successful GET and HEAD responses, tags them
+// with a strong ETag over the rendered bytes and answers matching
+// conditional requests with 304 Not Modified
+func etagMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				return next(c)
+			}
+
+			res := c.Response()
+			writer := &etagWriter{ResponseWriter: res.Writer}
+			res.Writer = writer
+			err := next(c)
+			res.Writer = writer.ResponseWriter
+
+			if err != nil && !res.Committed {
+				return err
+			}
+			writer.finish(req)
+			return err
+		}
+	}
+}
+
+// etagWriter buffers a 200 response until the handler is done. Other
+// statuses and flushed responses pass through untagged.
+type etagWriter struct {
+	http.ResponseWriter
+	buffer      []byte
+	status      int
+	wroteHeader bool
+	passthrough bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	w.status = status
+	w.wroteHeader = true
+	if status != http.StatusOK {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buffer = append(w.buffer, b...)
+	return len(b), nil
+}
+
+// Flush gives up on the ETag, a streamed response is sent as it comes
+func (w *etagWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passthrough {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buffer)
+		w.buffer = nil
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *etagWriter) finish(req *http.Request) {
+	if w.passthrough || !w.wroteHeader {
+		return
+	}
+
+	header := w.Header()
+	if header.Get("ETag") == "" {
+		header.Set("ETag", bodyETag(w.buffer))
+	}
+
+	if notModified(req, header) {
+		header.Del(echo.HeaderContentType)
+		header.Del(echo.HeaderContentLength)
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set(echo.HeaderContentLength, strconv.Itoa(len(w.buffer)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buffer)
+}
+
+// bodyETag is the strong ETag of a response body
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// servePlain sends the output of a template holding no tags as it is, or
+// minified, tagged with its ETag when it is a 200, answering conditional
+// requests with 304 Not Modified. It sends nothing, returning false, for a
+// response that needs its charset converted.
+func servePlain(c echo.Context, status int, page *plainPage) (bool, error) {
+	contentType, encoder := responseEncoding(c, c.Response().Header().Get(echo.HeaderContentType), "")
+	if encoder != nil {
+		return false, nil
+	}
+	if isHTML(contentType) && minifies(c, page.minify) {
+		page = page.minifiedPage()
+	}
+
+	req := c.Request()
+	header := c.Response().Header()
+	if status == http.StatusOK && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		header.Set("ETag", page.etag)
+		if notModified(req, header) {
+			return true, c.NoContent(http.StatusNotModified)
+		}
+	}
+	header.Set(echo.HeaderContentLength, strconv.Itoa(len(page.body)))
+	return true, c.Blob(status, contentType, page.body)
+}
+
+// notModified evaluates If-None-Match against the ETag, or If-Modified-Since
+// against Last-Modified when the client sent no If-None-Match
+func notModified(req *http.Request, header http.Header) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, header.Get("ETag"))
+	}
+
+	since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get(echo.HeaderLastModified))
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches uses the weak comparison, so compressed variants tagged
+// W/"..." still match
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// weakenETag marks a strong ETag weak once the bytes it describes get
+// re-encoded
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
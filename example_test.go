@@ -0,0 +1,31 @@
+package gosp_test
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing/fstest"
+
+	"gosp"
+)
+
+func ExampleNew() {
+	root := fstest.MapFS{
+		"index.html": {Data: []byte(`<p>Hello <%= query.name %></p>`)},
+	}
+	handler, err := gosp.New(gosp.RootFS(root), gosp.Config([]byte(`<routes/>`)), gosp.Mode("prod"))
+	if err != nil {
+		panic(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "/?name=gopher")
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	fmt.Println(res.StatusCode, string(body))
+	// Output: 200 <p>Hello gopher</p>
+}
@@ -0,0 +1,59 @@
+package gosp
+
+import (
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// parseExtensions splits a comma-separated extension list, adding missing
+// leading dots and dropping duplicates
+func parseExtensions(list string) []string {
+	var extensions []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !containsString(extensions, ext) {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// pageExtensions lists the extensions file-based routing tries for
+// extensionless URLs: templates first, then static pages
+func (f *siteFS) pageExtensions() []string {
+	return append(append([]string(nil), f.templateExts...), f.staticExts...)
+}
+
+// isPageFile reports whether a file is a template or a static page
+func (f *siteFS) isPageFile(name string) bool {
+	ext := path.Ext(name)
+	return containsString(f.templateExts, ext) || containsString(f.staticExts, ext)
+}
+
+func (f *siteFS) isStaticFile(name string) bool {
+	return containsString(f.staticExts, path.Ext(name))
+}
+
+// servePage renders a template, or sends a static page as-is
+func servePage(c echo.Context, filename string) error {
+	files := siteOf(c).files
+	if !files.isStaticFile(filename) {
+		return processTemplate(c, filename)
+	}
+
+	fullPath, ok := templatePath(c, filename)
+	info, err := files.statFile(fullPath)
+	if !ok || err != nil || info.IsDir() {
+		return notFound(c, "File not found: "+filename)
+	}
+	recordDependencies(c, fullPath)
+	return serveFile(c, fullPath, info)
+}
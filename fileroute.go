@@ -0,0 +1,46 @@
+package gosp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// fileRoutingEnabled reports whether unmatched paths fall through to
+// file-based routing
+func (settings RouteSettings) fileRoutingEnabled() bool {
+	return settings.FileRouting != "false"
+}
+
+// ExcludePatterns returns the paths and glob patterns file-based routing never serves
+func (settings RouteSettings) ExcludePatterns() []string {
+	var patterns []string
+	for _, pattern := range strings.Split(settings.Exclude, ",") {
+		if pattern = strings.Trim(strings.TrimSpace(pattern), "/"); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func validateExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// isExcluded reports whether a template matches a pattern, or lies in a
+// directory matching one
+func isExcluded(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		for dir := name; dir != "." && dir != ""; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Comma-separated user:password entries added to --auth, keeping them out
+// of the shell history
+const authEnvVar = "GOSP_AUTH"
+
+// globalAuth gates the whole instance behind Basic Auth when --auth or
+// GOSP_AUTH name users. It returns nil when there are none.
+func globalAuth(users []string, exclude string) (echo.MiddlewareFunc, error) {
+	entries := append([]string(nil), users...)
+	if env := os.Getenv(authEnvVar); env != "" {
+		entries = append(entries, strings.Split(env, ",")...)
+	}
+
+	auth, err := basicAuthUsers(entries, "Restricted", "--auth")
+	if err != nil {
+		return nil, err
+	}
+	if len(auth.credentials) == 0 {
+		return nil, nil
+	}
+
+	excluded := splitList(exclude)
+	basic := authMiddleware(auth)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		protected := basic(next)
+		return func(c echo.Context) error {
+			if excludedPath(c.Request().URL.Path, excluded) {
+				return next(c)
+			}
+			return protected(c)
+		}
+	}, nil
+}
+
+// basicAuthUsers builds a Basic Auth block from user:password or
+// user:bcrypt-hash entries given to flag
+func basicAuthUsers(entries []string, realm, flag string) (*Auth, error) {
+	auth := &Auth{Type: "basic", Realm: realm, credentials: make(map[string]string)}
+	for _, entry := range entries {
+		if err := auth.addCredential(entry); err != nil {
+			return nil, fmt.Errorf("%s: %v", flag, err)
+		}
+	}
+	return auth, nil
+}
+
+// excludedPath matches the paths and everything below them, comparing
+// the path cleaned of dot segments, so "/healthz/../secret" isn't below
+// "/healthz"
+func excludedPath(path string, excluded []string) bool {
+	path, _ = cleanURLPath(path)
+	for _, prefix := range excluded {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
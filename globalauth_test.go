@@ -0,0 +1,50 @@
+package gosp
+
+import (
+	"net/http"
+	"testing"
+)
+
+// --auth-exclude lets through the paths below an excluded one only, not
+// those dot segments lead out of it
+func TestAuthExcludeDotSegments(t *testing.T) {
+	ts := newTestServer(t, map[string]string{
+		"status.html": "ok",
+		"secret.html": "secret page",
+	}, "<routes/>", "--auth", "admin:secret", "--auth-exclude", "/status")
+	var err error
+	if ts.gate, err = globalAuth(ts.options.authUsers, ts.options.authExclude); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := loadRouteConfig(ts.files, ts.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, err := ts.build(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.sites.swap(site)
+
+	if res, body := get(t, ts.sites, http.MethodGet, "/status"); res.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("/status: %d %q", res.StatusCode, body)
+	}
+	for _, path := range []string{"/secret", "/status/../secret", "/status/%2e%2e/secret", "/status/./../secret.html"} {
+		if res, body := get(t, ts.sites, http.MethodGet, path); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s without auth: %d %q", path, res.StatusCode, body)
+		}
+	}
+
+	for path, want := range map[string]bool{
+		"/healthz":            true,
+		"/healthz/live":       true,
+		"/healthz/./live":     true,
+		"/healthzz":           false,
+		"/healthz/../secret":  false,
+		"/a/../healthz/ready": true,
+	} {
+		if got := excludedPath(path, []string{"/healthz"}); got != want {
+			t.Errorf("excludedPath(%q) = %v", path, got)
+		}
+	}
+}
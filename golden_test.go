@@ -0,0 +1,49 @@
+package gosp
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the example site")
+
+// The example site renders as its golden files in testdata/golden. Run
+// with -update to rewrite them after a change to its output.
+func TestExampleGolden(t *testing.T) {
+	handler, err := New(Root("example/root_http"), ConfigFile("example/routes.xml"), Mode("prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, golden := range map[string]string{
+		"/":          "index.html",
+		"/?name=Jo":  "index-name.html",
+		"/htest":     "htest.html",
+		"/home/test": "htest.html",
+	} {
+		res, body := get(t, handler, http.MethodGet, path)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", path, res.StatusCode)
+			continue
+		}
+		file := filepath.Join("testdata", "golden", golden)
+		if *update {
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, []byte(body), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != string(want) {
+			t.Errorf("%s differs from %s:\n%s", path, file, body)
+		}
+	}
+}
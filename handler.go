@@ -0,0 +1,234 @@
+package gosp
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/pflag"
+)
+
+// Option is a setting of the site New serves
+type Option func(*siteOptions) error
+
+// siteOptions are the settings of New: the server flags, and what the
+// route config would set otherwise
+type siteOptions struct {
+	flags   *pflag.FlagSet
+	config  []byte
+	session *Session
+
+	// Directories served from an fs.FS rather than disk, and the root's
+	mounts []*rootMount
+	rootFS fs.FS
+
+	// The route config had its variables expanded by gosp compile
+	configExpanded bool
+
+	// Templates parsed by gosp compile
+	preparsed []compiledTemplate
+
+	// Routes added with Handle
+	handled []Route
+
+	// Render hooks added with Hooks
+	hooks []interface{}
+
+	// Set by Watch, notify called with the changes handled
+	watch  bool
+	notify func(ChangeEvent)
+}
+
+// Root serves the site from a directory, ./root_http by default
+func Root(dir string) Option {
+	return Flag("root", dir)
+}
+
+// RootFS serves the site from an fs.FS, such as an embed.FS, instead of
+// the root directory. Its names are those under the root, so the files
+// of an embedded root_http are fs.Sub(files, "root_http").
+func RootFS(fsys fs.FS) Option {
+	return func(o *siteOptions) error {
+		o.rootFS = fsys
+		return nil
+	}
+}
+
+// ConfigFile reads the route config from a file, routes.xml by default.
+// Without a file there are only file-based routes.
+func ConfigFile(path string) Option {
+	return Flag("config", path)
+}
+
+// Config takes the route config as the XML a routes.xml holds, instead of
+// reading a file. Imports and directories in it are relative to the
+// working directory.
+func Config(xml []byte) Option {
+	return func(o *siteOptions) error {
+		o.config = xml
+		return nil
+	}
+}
+
+// Mode sets the mode, dev or prod, and with it the defaults of error
+// details and caching. As with the command, it is dev unless set.
+func Mode(mode string) Option {
+	return Flag("mode", mode)
+}
+
+// Caching honors Cache-Control policies and the response cache, which dev
+// mode turns off
+func Caching(enabled bool) Option {
+	return Flag("caching", strconv.FormatBool(enabled))
+}
+
+// Sessions enables sessions as a <session> element does, replacing the
+// one of the route config
+func Sessions(session Session) Option {
+	return func(o *siteOptions) error {
+		o.session = &session
+		return nil
+	}
+}
+
+// Watch watches the files of the site as --watch does, flushing the
+// templates and responses built from them as they change, and calls
+// notify, when not nil, with each change handled, as Subscribe hands them
+// to a program running Main. Settings of the watcher such as
+// Flag("watch-ignore", "*.tmp") apply. Changes of the route config aren't
+// applied, the handler is made again for those.
+func Watch(notify func(ChangeEvent)) Option {
+	return func(o *siteOptions) error {
+		o.watch, o.notify = true, notify
+		return nil
+	}
+}
+
+// Flag sets a server setting by the name of its flag, such as
+// Flag("ext", ".html,.gsp"). Flags of listeners, logs, probes and the
+// instance endpoints have no effect on the handler.
+func Flag(name, value string) Option {
+	return func(o *siteOptions) error {
+		if err := o.flags.Set(name, value); err != nil {
+			return fmt.Errorf("option %s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+// New makes the handler of a site, to mount in another server or run
+// behind a serverless adapter. It serves the pages, routes and static
+// files the command would, but doesn't listen, log requests or handle
+// signals, leaving those to the program around it, and watches files only
+// with the Watch option.
+//
+// Each handler has its own root, route config, settings, caches, render
+// limit and session store, so several sites can be served side by side.
+// It reports no metrics or readiness checks, and doesn't remove expired
+// sessions of a file store, which gosp sessions purge does.
+func New(options ...Option) (http.Handler, error) {
+	opts := &serverOptions{}
+	cmd := serverCommand(opts)
+	site := &siteOptions{flags: cmd.Flags()}
+	for _, option := range options {
+		if err := option(site); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyMode(cmd, opts); err != nil {
+		return nil, err
+	}
+	opts.mounts, opts.configExpanded, opts.preparsed = site.mounts, site.configExpanded, site.preparsed
+	if site.rootFS != nil {
+		opts.mounts = append(opts.mounts, &rootMount{dir: opts.root, fsys: site.rootFS})
+	}
+
+	srv := newServer(opts)
+	routes, err := site.routes(srv.files, opts.config)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.setupShared(routes); err != nil {
+		return nil, err
+	}
+	srv.seedTemplates(opts.preparsed)
+	e := echo.New()
+	if _, err := srv.setupSite(e, routes); err != nil {
+		return nil, err
+	}
+	if site.watch {
+		if err := srv.watchSite(routes, site.notify); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// watchSite starts the file watcher of a site made by New, its changes
+// handed to notify in order
+func (srv *server) watchSite(routes *RouteConfig, notify func(ChangeEvent)) error {
+	options := srv.options
+	ignore, err := parseWatchIgnore(options.watchIgnore)
+	if err == nil {
+		err = checkWatchMode(options)
+	}
+	var extra []string
+	if err == nil {
+		extra, err = parseWatchDirs(options.watchDirs, []string{options.root, options.tenantsDir})
+	}
+	if err != nil {
+		return err
+	}
+	watcher, err := srv.setupFileWatcher(routes, ignore, extra)
+	if err != nil {
+		return err
+	}
+	srv.watcher = watcher
+	if notify != nil {
+		changes := srv.changes.subscribe()
+		go func() {
+			for change := range changes {
+				notify(change)
+			}
+		}()
+	}
+	go watcher.watchFiles()
+	return nil
+}
+
+// routes reads the route config from configFile, like the command does
+func (o *siteOptions) routes(files *siteFS, configFile string) (*RouteConfig, error) {
+	var routes *RouteConfig
+	var err error
+	if o.config != nil {
+		routes, err = parseRouteConfig(files, "routes.xml", o.config)
+	} else if routes, err = loadRouteConfig(files, configFile); os.IsNotExist(err) {
+		routes, err = &RouteConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if o.session != nil {
+		if err := o.session.prepare("."); err != nil {
+			return nil, err
+		}
+		routes.Session = o.session
+	}
+	routes.hooks = append(append([]interface{}(nil), o.hooks...), routes.hooks...)
+	if len(o.handled) > 0 {
+		for i := range o.handled {
+			if err := o.handled[i].prepare(files, "."); err != nil {
+				return nil, fmt.Errorf("route %s: %v", o.handled[i].Path, err)
+			}
+		}
+		routes.Routes = append(routes.Routes, o.handled...)
+		if err := routes.checkDuplicates(); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,116 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Two sites made with New serve their own roots with their own settings,
+// side by side and at the same time
+func TestSitesSideBySide(t *testing.T) {
+	first, _ := newTestSite(t, map[string]string{
+		"index.html": `first <%= query.n %>`,
+		"page.gsp":   `page <%= query.n %>`,
+	}, "<routes/>")
+	second, _ := newTestSite(t, map[string]string{
+		"index.gsp": `second <%= query.n %>`,
+		"page.html": `page <%= query.n %>`,
+	}, "<routes/>", Flag("ext", ".gsp"), Caching(true))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, site := range []struct {
+				name    string
+				handler http.Handler
+				page    string
+			}{{"first", first, "/page.gsp"}, {"second", second, "/page.html"}} {
+				path := fmt.Sprintf("/?n=%d", i)
+				if res, body := get(t, site.handler, http.MethodGet, path); res.StatusCode != http.StatusOK || body != fmt.Sprintf("%s %d", site.name, i) {
+					t.Errorf("%s %s: %d %q", site.name, path, res.StatusCode, body)
+				}
+				// The other site's template extension isn't a page
+				if _, body := get(t, site.handler, http.MethodGet, site.page+"?n=1"); body == "page 1" {
+					t.Errorf("%s %s rendered as a page", site.name, site.page)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// A site made with New keeps its session store to itself, and making
+// another doesn't register metrics or replace it
+func TestNewKeepsSiteState(t *testing.T) {
+	pages := map[string]string{
+		"set.html": `<% session.user = "alice" %>set`,
+		"get.html": `user=<%= session.user %>`,
+	}
+	dir := filepath.Join(t.TempDir(), "sessions")
+	withSessions, _ := newTestSite(t, pages, `<routes><session store="file" dir="`+dir+`"/></routes>`)
+	res, _ := get(t, withSessions, http.MethodGet, "/set")
+	token := cookieOf(res, "gosp_session")
+
+	metricsMu.Lock()
+	registered := len(metrics)
+	metricsMu.Unlock()
+	without, _ := newTestSite(t, pages, "<routes/>", Flag("max-concurrent-renders", "1"))
+	metricsMu.Lock()
+	if len(metrics) != registered {
+		t.Errorf("New registered %d metrics", len(metrics)-registered)
+	}
+	metricsMu.Unlock()
+
+	if _, body := get(t, withSessions, http.MethodGet, "/get", "Cookie", "gosp_session="+token); body != "user=alice" {
+		t.Errorf("session of the first site reads %q after New", body)
+	}
+	if _, body := get(t, without, http.MethodGet, "/get", "Cookie", "gosp_session="+token); body != "user=" {
+		t.Errorf("site without sessions reads %q", body)
+	}
+}
+
+// A site made with New and the Watch option flushes what it built from a
+// file as it changes, and hands the change to its own notify alone
+func TestNewWatchesSite(t *testing.T) {
+	watched, other := make(chan ChangeEvent, 16), make(chan ChangeEvent, 16)
+	global := Subscribe()
+	handler, root := newTestSite(t, map[string]string{"index.html": "before"}, "<routes/>", Watch(func(change ChangeEvent) {
+		watched <- change
+	}))
+	newTestSite(t, map[string]string{"index.html": "other"}, "<routes/>", Watch(func(change ChangeEvent) {
+		other <- change
+	}))
+	if _, body := get(t, handler, http.MethodGet, "/"); body != "before" {
+		t.Fatalf("before the edit: %q", body)
+	}
+
+	file := filepath.Join(root, "index.html")
+	if err := os.WriteFile(file, []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-watched:
+		if want, _ := filepath.Abs(file); change.Path != want || change.Kind != ChangeModified {
+			t.Errorf("change %s %s, want %s modified", change.Path, change.Kind, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+	}
+	if _, body := get(t, handler, http.MethodGet, "/"); body != "after" {
+		t.Errorf("after the edit: %q", body)
+	}
+	select {
+	case change := <-other:
+		t.Errorf("other site notified of %s", change.Path)
+	case change := <-global:
+		t.Errorf("Subscribe sent %s of a site made by New", change.Path)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,68 @@
+package gosp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHeadMatchesGet checks a HEAD reports the headers of the GET of the
+// same URL, and that a response it caches is the one the GET gets
+func TestHeadMatchesGet(t *testing.T) {
+	example, err := os.ReadFile(filepath.Join("example", "root_http", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := map[string]string{
+		"index.html":  string(example),
+		"method.html": "Method <%= request.method %>",
+	}
+	config := `<routes>
+		<route path="/method" file="method.html" responseCache="1m"/>
+	</routes>`
+	handler, _ := newTestSite(t, pages, config, Flag("compress", "true"), Flag("compress-min-size", "64"))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request := func(method, path string, headers ...string) (*http.Response, int64) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		// Compressed responses are compared as sent
+		transport := &http.Transport{DisableCompression: true}
+		defer transport.CloseIdleConnections()
+		res, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		length, _ := io.Copy(io.Discard, res.Body)
+		return res, length
+	}
+
+	for _, encoding := range []string{"", "gzip"} {
+		head, _ := request(http.MethodHead, "/", "Accept-Encoding", encoding)
+		res, length := request(http.MethodGet, "/", "Accept-Encoding", encoding)
+		if head.ContentLength != length || res.ContentLength != length {
+			t.Errorf("encoding %q: HEAD Content-Length %d, GET %d, GET body %d", encoding, head.ContentLength, res.ContentLength, length)
+		}
+		if got, want := head.Header.Get("Content-Encoding"), res.Header.Get("Content-Encoding"); got != want || got != encoding {
+			t.Errorf("encoding %q: HEAD Content-Encoding %q, GET %q", encoding, got, want)
+		}
+	}
+
+	request(http.MethodHead, "/method")
+	res, _ := get(t, handler, http.MethodGet, "/method")
+	_, body := get(t, handler, http.MethodGet, "/method")
+	if res.StatusCode != http.StatusOK || body != "Method GET" {
+		t.Errorf("GET after a HEAD got %d %q, want the GET rendering", res.StatusCode, body)
+	}
+}
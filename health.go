@@ -0,0 +1,80 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// healthChecks backs the readiness endpoint
+type healthChecks struct {
+	mu sync.RWMutex
+
+	// Why the instance isn't ready, empty once it is
+	reason string
+
+	// Backends that must answer before requests are sent our way
+	checks []healthCheck
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// newHealthChecks returns the readiness of a server, not ready until its
+// routes are set up
+func newHealthChecks() *healthChecks {
+	return &healthChecks{reason: "starting"}
+}
+
+// setReady marks the instance ready, or not ready for the reason
+func (h *healthChecks) setReady(reason string) {
+	h.mu.Lock()
+	h.reason = reason
+	h.mu.Unlock()
+}
+
+// addCheck adds a backend such as a session store to readiness
+func (h *healthChecks) addCheck(name string, check func() error) {
+	h.mu.Lock()
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+	h.mu.Unlock()
+}
+
+func (h *healthChecks) readiness() error {
+	h.mu.RLock()
+	reason, checks := h.reason, h.checks
+	h.mu.RUnlock()
+
+	if reason != "" {
+		return fmt.Errorf("%s", reason)
+	}
+	for _, check := range checks {
+		if err := check.check(); err != nil {
+			return fmt.Errorf("%s: %v", check.name, err)
+		}
+	}
+	return nil
+}
+
+// healthMiddleware answers the liveness and readiness probes ahead of
+// auth, sessions and templates. An empty path disables the probe.
+func healthMiddleware(health *healthChecks, livePath, readyPath string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch path := c.Request().URL.Path; {
+			case livePath != "" && path == livePath:
+				return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+			case readyPath != "" && path == readyPath:
+				if err := health.readiness(); err != nil {
+					return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "reason": err.Error()})
+				}
+				return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+			}
+			return next(c)
+		}
+	}
+}
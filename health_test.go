@@ -0,0 +1,29 @@
+package gosp
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Each server has its readiness to itself: the checks added to one, as its
+// session store or warm-up would, don't hold the other back
+func TestReadinessPerServer(t *testing.T) {
+	pages := map[string]string{"index.html": "home"}
+	first := newTestServer(t, pages, "<routes/>")
+	second := newTestServer(t, pages, "<routes/>")
+	if res, body := get(t, first.sites, http.MethodGet, "/readyz"); res.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "starting") {
+		t.Errorf("before being ready: %d %s", res.StatusCode, body)
+	}
+
+	first.health.setReady("")
+	second.health.setReady("")
+	first.health.addCheck("session store", func() error { return errors.New("unreachable") })
+	if res, body := get(t, first.sites, http.MethodGet, "/readyz"); res.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "session store: unreachable") {
+		t.Errorf("server with a failing check: %d %s", res.StatusCode, body)
+	}
+	if res, body := get(t, second.sites, http.MethodGet, "/readyz"); res.StatusCode != http.StatusOK {
+		t.Errorf("other server: %d %s", res.StatusCode, body)
+	}
+}
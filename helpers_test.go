@@ -0,0 +1,125 @@
+package gosp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files under dir by their slash-separated names
+func writeFiles(t testing.TB, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestSite serves a root of the given pages with New, from a directory
+// the test removes when done
+func newTestSite(t testing.TB, pages map[string]string, config string, options ...Option) (http.Handler, string) {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root_http")
+	writeFiles(t, root, pages)
+	options = append([]Option{Root(root), Mode("prod")}, options...)
+	if config != "" {
+		options = append(options, Config([]byte(config)))
+	} else {
+		options = append(options, ConfigFile(filepath.Join(dir, "routes.xml")))
+	}
+	handler, err := New(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, root
+}
+
+// get requests a path of a handler, with the given headers as name, value
+// pairs
+func get(t testing.TB, handler http.Handler, method, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	res := rec.Result()
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+// cookieOf returns the value a response sets a cookie to
+func cookieOf(res *http.Response, name string) string {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func assertContains(t testing.TB, body, want string) {
+	t.Helper()
+	if !strings.Contains(body, want) {
+		t.Fatalf("body %q doesn't contain %q", body, want)
+	}
+}
+
+// testServer is a server as the command runs it, on a root of the given
+// pages and a routes.xml holding config, without listening
+type testServer struct {
+	*server
+	sites  *siteHandler
+	root   string
+	config string
+}
+
+// newTestServer sets up a server as runServer does, with the command's
+// flags as args
+func newTestServer(t testing.TB, pages map[string]string, config string, args ...string) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	ts := &testServer{root: filepath.Join(dir, "root_http"), config: filepath.Join(dir, "routes.xml")}
+	writeFiles(t, ts.root, pages)
+	writeFiles(t, dir, map[string]string{"routes.xml": config})
+
+	options := &serverOptions{}
+	cmd := serverCommand(options)
+	args = append([]string{"--root", ts.root, "--config", ts.config, "--mode", "prod", "--access-log", filepath.Join(dir, "access.log")}, args...)
+	if err := cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMode(cmd, options); err != nil {
+		t.Fatal(err)
+	}
+	ts.server = newServer(options)
+	routes, err := loadRouteConfig(ts.files, options.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.logger, err = newAccessLogger(options.accessLog); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.setupShared(routes); err != nil {
+		t.Fatal(err)
+	}
+	ts.reloader = &reloader{server: ts.server}
+	first, err := ts.build(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.sites = newSiteHandler(first)
+	ts.reloader.sites = ts.sites
+	return ts
+}
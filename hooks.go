@@ -0,0 +1,105 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+)
+
+// BeforeRender is a render hook run before a page's template, with the
+// data it renders. It may add to or change the data; an error aborts the
+// render with an error page, as a provider's error does.
+type BeforeRender interface {
+	BeforeRender(ctx context.Context, template string, data map[string]interface{}) error
+}
+
+// AfterRender is a render hook run on the output of a page before it is
+// sent, returning the output to send instead. An error aborts the render
+// with an error page. Pages don't stream while there are AfterRender
+// hooks, as their whole output is needed, and the output is reused once
+// the page is sent, so a hook copies what it keeps.
+type AfterRender interface {
+	AfterRender(ctx context.Context, template string, output []byte) ([]byte, error)
+}
+
+// Hook names a registered render hook in the config, <hook name="..."/>
+type Hook struct {
+	Name string `xml:"name,attr"`
+}
+
+// Render hooks by name, for the config
+var renderHooks = map[string]interface{}{}
+
+// RegisterHook names a render hook for the <hook> elements of the config.
+// The hook implements BeforeRender, AfterRender or both. Hooks are
+// registered before New or Main reads the config.
+func RegisterHook(name string, hook interface{}) {
+	if !isRenderHook(hook) {
+		panic(fmt.Sprintf("gosp: hook %s implements neither BeforeRender nor AfterRender", name))
+	}
+	renderHooks[name] = hook
+}
+
+// Hooks adds render hooks to the site New makes, run in order before
+// those of the config
+func Hooks(hooks ...interface{}) Option {
+	return func(o *siteOptions) error {
+		for _, hook := range hooks {
+			if !isRenderHook(hook) {
+				return fmt.Errorf("hook %T implements neither BeforeRender nor AfterRender", hook)
+			}
+		}
+		o.hooks = append(o.hooks, hooks...)
+		return nil
+	}
+}
+
+func isRenderHook(hook interface{}) bool {
+	_, before := hook.(BeforeRender)
+	_, after := hook.(AfterRender)
+	return before || after
+}
+
+// prepareHooks looks up the hooks the config names
+func (config *RouteConfig) prepareHooks() error {
+	for _, ref := range config.Hooks {
+		hook, exists := renderHooks[ref.Name]
+		if !exists {
+			return fmt.Errorf("unknown hook %q", ref.Name)
+		}
+		config.hooks = append(config.hooks, hook)
+	}
+	return nil
+}
+
+// setupHooks makes the hooks of a config those the renders of the site run
+func (s *site) setupHooks(hooks []interface{}) {
+	for _, hook := range hooks {
+		if before, ok := hook.(BeforeRender); ok {
+			s.beforeHooks = append(s.beforeHooks, before)
+		}
+		if after, ok := hook.(AfterRender); ok {
+			s.afterHooks = append(s.afterHooks, after)
+		}
+	}
+}
+
+// beforeRender runs the BeforeRender hooks on the data of a render
+func (s *site) beforeRender(ctx context.Context, template string, data map[string]interface{}) error {
+	for _, hook := range s.beforeHooks {
+		if err := hook.BeforeRender(ctx, template, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterRender runs the AfterRender hooks on the output of a render
+func (s *site) afterRender(ctx context.Context, template string, output []byte) ([]byte, error) {
+	for _, hook := range s.afterHooks {
+		var err error
+		if output, err = hook.AfterRender(ctx, template, output); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
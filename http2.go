@@ -0,0 +1,15 @@
+package gosp
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// enableHTTP2 offers HTTP/2 over TLS through ALPN. Configured cipher suites
+// that HTTP/2 forbids keep the server on HTTP/1.1.
+func enableHTTP2(server *http.Server) {
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		serverLog.Warn("HTTP/2 disabled", "err", err)
+	}
+}
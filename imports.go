@@ -0,0 +1,119 @@
+package gosp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Import pulls the routes, groups, SPAs and rewrites of other config files into
+// the importing one
+type Import struct {
+	File string `xml:"file,attr"`
+}
+
+// resolveImports loads every file referenced by the config's imports,
+// relative to the importing file, and merges them into config. visited
+// holds the absolute paths already loaded to break import cycles.
+func (config *RouteConfig) resolveImports(files *siteFS, configPath string, visited map[string]bool) error {
+	baseDir := filepath.Dir(configPath)
+
+	for _, imp := range config.Imports {
+		pattern := imp.File
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: import %q: %v", configPath, imp.File, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(imp.File, "*?[") {
+			return fmt.Errorf("%s: import %q: file not found", configPath, imp.File)
+		}
+
+		for _, match := range matches {
+			absPath, err := filepath.Abs(match)
+			if err != nil {
+				return err
+			}
+			if visited[absPath] {
+				continue
+			}
+
+			imported, err := loadConfigFile(files, match, visited)
+			if err != nil {
+				return fmt.Errorf("%s: import %q: %v", configPath, imp.File, err)
+			}
+
+			config.Rewrites = append(config.Rewrites, imported.Rewrites...)
+			config.Groups = append(config.Groups, imported.Groups...)
+			config.Routes = append(config.Routes, imported.Routes...)
+			config.SPAs = append(config.SPAs, imported.SPAs...)
+			config.Statics = append(config.Statics, imported.Statics...)
+			config.files = append(config.files, imported.files...)
+		}
+	}
+
+	return nil
+}
+
+// tagSource records which config file defined each route
+func (config *RouteConfig) tagSource(configPath string) {
+	for i := range config.Routes {
+		config.Routes[i].source = configPath
+	}
+	for i := range config.SPAs {
+		config.SPAs[i].source = configPath
+	}
+	for i := range config.Statics {
+		config.Statics[i].source = configPath
+	}
+	for i := range config.Groups {
+		for j := range config.Groups[i].Routes {
+			config.Groups[i].Routes[j].source = configPath
+		}
+		for j := range config.Groups[i].SPAs {
+			config.Groups[i].SPAs[j].source = configPath
+		}
+		for j := range config.Groups[i].Statics {
+			config.Groups[i].Statics[j].source = configPath
+		}
+	}
+}
+
+// checkDuplicates reports routes from different files that share a path and
+// method without a priority to tell them apart
+func (config *RouteConfig) checkDuplicates() error {
+	routes := config.resolveRoutes()
+
+	for i, a := range routes {
+		for _, b := range routes[i+1:] {
+			if a.File == "" || b.File == "" || a.source == b.source || a.Path != b.Path || a.Priority != b.Priority {
+				continue
+			}
+			if method := overlappingMethod(a.Methods, b.Methods); method != "" {
+				return fmt.Errorf("duplicate route %s %s defined in %s and %s", method, a.Path, a.source, b.source)
+			}
+		}
+	}
+
+	return nil
+}
+
+func overlappingMethod(a, b []string) string {
+	for _, methodA := range a {
+		for _, methodB := range b {
+			methodA, methodB = strings.ToUpper(methodA), strings.ToUpper(methodB)
+			switch {
+			case methodA == methodB:
+				return methodA
+			case methodA == "ANY":
+				return methodB
+			case methodB == "ANY":
+				return methodA
+			}
+		}
+	}
+	return ""
+}
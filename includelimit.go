@@ -0,0 +1,51 @@
+package gosp
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+
+	"gosp/engine"
+)
+
+// Holds the include limit of the request's route, in bytes
+const includeLimitKey = "gosp.includeLimit"
+
+// parseIncludeLimit parses an includeLimit checked by the config, "" being
+// no limit
+func parseIncludeLimit(limit string) int {
+	if limit == "" {
+		return 0
+	}
+	size, _ := bytes.Parse(limit)
+	return int(size)
+}
+
+// includeLimitMiddleware bounds the source the pages of a route expand to
+// once their includes are parsed in, so nested or repeated includes of a
+// large fragment fail with an error page instead of exhausting memory
+func includeLimitMiddleware(limit int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(includeLimitKey, limit)
+			return next(c)
+		}
+	}
+}
+
+// loadErrorMessage names what failed when loading a template, for its log
+// line and error page
+func loadErrorMessage(err error) string {
+	if _, ok := err.(*engine.SizeError); ok {
+		return "Template too large"
+	}
+	return "Error reading file"
+}
+
+// includeLimitOf returns the include limit of a request: its route's, or
+// the site's for pages rendered outside of routes
+func includeLimitOf(c echo.Context) int {
+	if limit, ok := c.Get(includeLimitKey).(int); ok {
+		return limit
+	}
+	return siteOf(c).includeLimit
+}
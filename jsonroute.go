@@ -0,0 +1,94 @@
+package gosp
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/engine"
+)
+
+// Template data provided by the server rather than assigned by the template
+var internalDataKeys = []string{"request", "params", "query", "form"}
+
+// renderJSON runs a template's code blocks and responds with the data they
+// assigned, marshaled as JSON
+func renderJSON(c echo.Context, filename string) error {
+	defer renderAsGet(c)()
+	fullPath, ok := templatePath(c, filename)
+	if !ok {
+		return jsonError(c, http.StatusNotFound, "File not found: "+filename)
+	}
+	ctx, span := startSpan(c.Request().Context(), "render "+filename)
+	span.setAttr("template.path", filename)
+
+	s := siteOf(c)
+	processor := s.newProcessor(ctx)
+	defer processor.recycle()
+	processor.roots = s.templateRoots(c)
+	processor.includeLimit = includeLimitOf(c)
+	processor.data["request"] = c.Request()
+	processor.data["params"] = c.ParamValues()
+	processor.data["query"] = c.QueryParams()
+	processor.data["form"] = c.Request().Form
+	if values, ok := c.Get(templateValuesKey).(map[string]interface{}); ok {
+		for key, value := range values {
+			processor.data[key] = value
+		}
+	}
+
+	parsed, err := processor.loadTemplate(fullPath, filename)
+	if err != nil {
+		span.finish(err)
+		if isInterruption(err) {
+			logCancelled(c, filename, err)
+			return err
+		}
+		if os.IsNotExist(err) {
+			return jsonError(c, http.StatusNotFound, "File not found: "+filename)
+		}
+		return jsonError(c, http.StatusInternalServerError, errorMessage(c, loadErrorMessage(err), err))
+	}
+	span.setAttr("template.size", parsed.Size)
+
+	data, err := processor.processData(parsed, c)
+	span.finish(err)
+	recordDependencies(c, append([]string{fullPath}, processor.includes...)...)
+	if isInterruption(err) {
+		logCancelled(c, filename, err)
+		return err
+	}
+	if err != nil {
+		return jsonError(c, http.StatusInternalServerError, errorMessage(c, "Template processing error", err))
+	}
+
+	return c.JSON(http.StatusOK, data)
+}
+
+// processData runs includes, header directives and code blocks, returning the
+// data assigned by the template. Output tags and markup are discarded.
+func (tp *TemplateProcessor) processData(parsed *engine.Template, c echo.Context) (map[string]interface{}, error) {
+	tp.run(parsed, c)
+	if tp.err != nil {
+		return nil, tp.err
+	}
+
+	data := make(map[string]interface{})
+	for key, value := range tp.data {
+		if !isInternalDataKey(key) {
+			data[key] = value
+		}
+	}
+	return data, nil
+}
+
+func isInternalDataKey(key string) bool {
+	for _, name := range internalDataKeys {
+		if key == name || strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package gosp
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Unknown key ids trigger a refetch at most this often
+	jwksMinRefetch = time.Minute
+
+	// Retry interval while no keys could be loaded at all
+	jwksRetry = time.Second
+)
+
+// jwksCache holds the RSA keys published at a JWKS URL, refreshed
+// periodically and whenever a token names an unknown key
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	once    sync.Once
+
+	// Closed by stop, ending the refreshes
+	done chan struct{}
+	stop func()
+
+	mu      sync.RWMutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string, refresh time.Duration) *jwksCache {
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	return &jwksCache{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]*rsa.PublicKey),
+		done:    done,
+		stop:    func() { stopOnce.Do(func() { close(done) }) },
+	}
+}
+
+// start fetches the keys and keeps them fresh in the background until
+// stop is called, as the site using them is swapped out by a reload.
+// Tokens checked after that still fetch unknown keys.
+func (cache *jwksCache) start() {
+	cache.once.Do(func() {
+		if err := cache.fetch(); err != nil {
+			serverLog.Warn("Could not fetch JWKS", "url", cache.url, "err", err)
+		}
+		go func() {
+			ticker := time.NewTicker(cache.refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-cache.done:
+					return
+				case <-ticker.C:
+				}
+				if err := cache.fetch(); err != nil {
+					serverLog.Warn("Could not refresh JWKS", "url", cache.url, "err", err)
+				}
+			}
+		}()
+	})
+}
+
+// jwksCaches returns the JWKS caches of the routes' JWT auth
+func (config *RouteConfig) jwksCaches() []*jwksCache {
+	var caches []*jwksCache
+	seen := make(map[*jwksCache]bool)
+	for _, route := range config.effectiveRoutes() {
+		if route.Auth == nil || route.Auth.jwt == nil || route.Auth.jwt.jwks == nil {
+			continue
+		}
+		if cache := route.Auth.jwt.jwks; !seen[cache] {
+			seen[cache] = true
+			caches = append(caches, cache)
+		}
+	}
+	return caches
+}
+
+func (cache *jwksCache) fetch() error {
+	cache.mu.Lock()
+	cache.fetched = time.Now()
+	cache.mu.Unlock()
+
+	res, err := cache.client.Get(cache.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", cache.url, res.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("%s: %v", cache.url, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		e, errE := base64.RawURLEncoding.DecodeString(key.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no RSA signing keys", cache.url)
+	}
+
+	cache.mu.Lock()
+	cache.keys = keys
+	cache.mu.Unlock()
+	return nil
+}
+
+// key returns the key with the id, or the only key for tokens without one
+func (cache *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	if key := cache.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	cache.mu.RLock()
+	since := time.Since(cache.fetched)
+	stale := since > jwksMinRefetch || (len(cache.keys) == 0 && since > jwksRetry)
+	cache.mu.RUnlock()
+	if stale {
+		if err := cache.fetch(); err != nil {
+			return nil, err
+		}
+		if key := cache.lookup(kid); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (cache *jwksCache) lookup(kid string) *rsa.PublicKey {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	if key, exists := cache.keys[kid]; exists {
+		return key
+	}
+	if kid == "" && len(cache.keys) == 1 {
+		for _, key := range cache.keys {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package gosp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestJWKSRefreshStopsWithSite checks the refreshes of a site's JWKS stop
+// once a reload swaps in another site
+func TestJWKSRefreshStopsWithSite(t *testing.T) {
+	var fetches atomic.Int64
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte(`{"keys":[{"kty":"RSA","kid":"1","n":"sXchDaQebHnPiGvyDOAT4saGEUetSyo9MKLOoWFsueri23bOdgWp4Dy1WlUzewbgBHod5pcM9H95GQRV3JDXboIRROSBigeC5yjU1hGzHHyXss8UDprecbAYxknTcQkhslANGRUZmdTOQ5qTRsLAt6BTYuyvVRdhS8exSZEy_c4gs_7svlJJQ4H9_NxsiIoLwAEk7-Q3UXERGYw_75IDrGA84-lA_-Ct4eTlXHBIY2EaV7t7LjJaynVJCpkv4LKjTTAumiGUIuQhrNhZLuF_RJLqHpM2kgWFLU7-VTdL1VbC2tejvcI2BlMkEpk1BzBZI0KQB0GaDWFLN-aEAw3vRw","e":"AQAB"}]}`))
+	}))
+	defer jwks.Close()
+
+	routes, err := parseRouteConfig(newSiteFS(&serverOptions{}), "routes.xml", []byte(`<routes>
+		<group prefix="/app">
+			<auth type="jwt" jwksURL="`+jwks.URL+`" jwksRefresh="10ms"/>
+		</group>
+	</routes>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := routes.jwksCaches()
+	if len(caches) != 1 {
+		t.Fatalf("%d JWKS caches, want 1", len(caches))
+	}
+	caches[0].start()
+	if _, err := caches[0].key("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	sites := newSiteHandler(&site{routes: routes})
+	for deadline := time.Now().Add(5 * time.Second); fetches.Load() < 3; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("JWKS not refreshed")
+		}
+	}
+	sites.swap(&site{routes: &RouteConfig{}})
+
+	// A fetch running as the site was swapped out may still finish
+	time.Sleep(50 * time.Millisecond)
+	stopped := fetches.Load()
+	time.Sleep(100 * time.Millisecond)
+	if fetches.Load() != stopped {
+		t.Fatalf("JWKS refreshed %d times after the site was swapped out", fetches.Load()-stopped)
+	}
+	if _, err := caches[0].key("1"); err != nil {
+		t.Fatalf("keys gone after the refreshes stopped: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package gosp
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/engine"
+)
+
+const (
+	// Context key of the verified JWT claims
+	jwtClaimsKey = "gosp.jwtClaims"
+
+	// Set once a template read the claims, making the response personal
+	jwtClaimsUsedKey = "gosp.jwtClaimsUsed"
+)
+
+// jwtVerifier checks token signatures and the registered claims
+type jwtVerifier struct {
+	algorithm string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwks      *jwksCache
+	issuer    string
+	audience  string
+	leeway    time.Duration
+}
+
+// prepareJWT loads the key material of type="jwt". Relative key files are
+// resolved against the config file directory.
+func (auth *Auth) prepareJWT(files *siteFS, baseDir string) error {
+	if auth.Cookie == "" {
+		auth.Cookie = "jwt"
+	}
+	if auth.Leeway == "" {
+		auth.Leeway = "30s"
+	}
+	if auth.JWKSRefresh == "" {
+		auth.JWKSRefresh = "1h"
+	}
+	leeway, err := time.ParseDuration(auth.Leeway)
+	if err != nil || leeway < 0 {
+		return fmt.Errorf("invalid jwt leeway %q", auth.Leeway)
+	}
+	if err := validateTimeout(auth.JWKSRefresh); err != nil {
+		return fmt.Errorf("invalid jwt jwksRefresh: %v", err)
+	}
+
+	verifier := &jwtVerifier{
+		algorithm: strings.ToUpper(auth.Algorithm),
+		issuer:    auth.Issuer,
+		audience:  auth.Audience,
+		leeway:    leeway,
+	}
+
+	switch {
+	case auth.JWKSURL != "":
+		if verifier.algorithm == "" {
+			verifier.algorithm = "RS256"
+		}
+		if _, err := url.ParseRequestURI(auth.JWKSURL); err != nil {
+			return fmt.Errorf("invalid jwt jwksURL: %v", err)
+		}
+		refresh, _ := time.ParseDuration(auth.JWKSRefresh)
+		verifier.jwks = newJWKSCache(auth.JWKSURL, refresh)
+	case auth.PublicKeyFile != "":
+		if verifier.algorithm == "" {
+			verifier.algorithm = "RS256"
+		}
+		keyPath := auth.PublicKeyFile
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(baseDir, keyPath)
+		}
+		auth.publicKeyPath = keyPath
+		data, err := files.readFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read jwt public key: %v", err)
+		}
+		if verifier.publicKey, err = parseRSAPublicKey(data); err != nil {
+			return fmt.Errorf("%s: %v", auth.PublicKeyFile, err)
+		}
+		auth.publicKeyPEM = string(data)
+	case auth.Secret != "":
+		if verifier.algorithm == "" {
+			verifier.algorithm = "HS256"
+		}
+		verifier.secret = []byte(auth.Secret)
+	default:
+		return fmt.Errorf("jwt auth requires a secret, publicKeyFile or jwksURL")
+	}
+
+	switch {
+	case verifier.algorithm == "HS256" && verifier.secret == nil,
+		verifier.algorithm == "RS256" && verifier.secret != nil,
+		verifier.algorithm != "HS256" && verifier.algorithm != "RS256":
+		return fmt.Errorf("jwt algorithm %q doesn't fit the configured key, expected HS256 with a secret or RS256 with a public key", auth.Algorithm)
+	}
+
+	auth.Algorithm = verifier.algorithm
+	auth.jwt = verifier
+	return nil
+}
+
+// PublicKeyPEM returns the loaded public key for embedding in compiled binaries
+func (auth *Auth) PublicKeyPEM() string {
+	return auth.publicKeyPEM
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, errors.New("certificate doesn't hold an RSA key")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return key, nil
+}
+
+// verify checks the signature and time claims of a compact JWT and returns
+// its claims
+func (verifier *jwtVerifier) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	// Never let the token pick the algorithm
+	if header.Alg != verifier.algorithm {
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, verifier.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	case "RS256":
+		key := verifier.publicKey
+		if verifier.jwks != nil {
+			if key, err = verifier.jwks.key(header.Kid); err != nil {
+				return nil, err
+			}
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	if err := verifier.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (verifier *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(verifier.leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(verifier.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(verifier.leeway).Before(time.Unix(int64(iat), 0)) {
+		return errors.New("token issued in the future")
+	}
+
+	if verifier.issuer != "" && claims["iss"] != verifier.issuer {
+		return errors.New("unexpected issuer")
+	}
+	if verifier.audience != "" && !containsString(claimStrings(claims["aud"]), verifier.audience) {
+		return errors.New("unexpected audience")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings returns a string or array claim as a list
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			values = append(values, engine.FormatValue(item))
+		}
+		return values
+	}
+	return nil
+}
+
+// lookupClaim resolves a dotted path such as address.city in the claims
+// of the request
+func lookupClaim(c echo.Context, path string) (interface{}, bool) {
+	claims, ok := c.Get(jwtClaimsKey).(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	c.Set(jwtClaimsUsedKey, true)
+
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// jwtMiddleware rejects requests without a valid token in the Authorization
+// header or the cookie, redirecting to the login URL when there is one
+func jwtMiddleware(auth *Auth) echo.MiddlewareFunc {
+	verifier := auth.jwt
+	if verifier.jwks != nil {
+		verifier.jwks.start()
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := ""
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+				token = header[7:]
+			} else if cookie, err := c.Cookie(auth.Cookie); err == nil {
+				token = cookie.Value
+			}
+
+			if token != "" {
+				claims, err := verifier.verify(token, time.Now())
+				if err == nil {
+					c.Set(jwtClaimsKey, claims)
+					return next(c)
+				}
+				serverLog.Debug("Rejected JWT", "path", c.Request().URL.Path, "request_id", requestID(c), "err", err)
+			}
+
+			req := c.Request()
+			if auth.LoginURL != "" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+				return c.Redirect(http.StatusFound, strings.ReplaceAll(auth.LoginURL, "{url}", url.QueryEscape(req.URL.RequestURI())))
+			}
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.ErrUnauthorized
+		}
+	}
+}
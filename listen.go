@@ -0,0 +1,68 @@
+package gosp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// listenAddress resolves --listen, or --host and --port, into a network
+// and address. listen is either unix:/path or host:port, with IPv6
+// literals in brackets.
+func listenAddress(listen, host, port string) (string, string, error) {
+	if socketPath := strings.TrimPrefix(listen, "unix:"); socketPath != listen {
+		if socketPath == "" {
+			return "", "", fmt.Errorf("invalid --listen %q, missing socket path", listen)
+		}
+		return "unix", socketPath, nil
+	}
+
+	if listen != "" {
+		var err error
+		host, port, err = net.SplitHostPort(listen)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid --listen %q, expected host:port or unix:/path/to/socket", listen)
+		}
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// listenOn opens the listener for a network and address from listenAddress,
+// or takes the one handed over by an upgrade. Unix domain sockets get the
+// permissions and owner given.
+func listenOn(network, address, socketMode, socketOwner string) (net.Listener, error) {
+	if listener := takeInherited(network, address); listener != nil {
+		registerListener(network, address, listener)
+		return listener, nil
+	}
+
+	var listener net.Listener
+	var err error
+	if network == "unix" {
+		listener, err = listenUnix(address, socketMode, socketOwner)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+
+	if err != nil {
+		// The address is part of the message already
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			err = opErr.Err
+		}
+		return nil, fmt.Errorf("cannot listen on %s: %v", displayAddress(network, address), err)
+	}
+	registerListener(network, address, listener)
+	return listener, nil
+}
+
+// displayAddress formats a listener address for logs
+func displayAddress(network, address string) string {
+	if network == "unix" {
+		return "unix:" + address
+	}
+	return address
+}
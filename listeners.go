@@ -0,0 +1,276 @@
+package gosp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listenSpec is one --listen address
+type listenSpec struct {
+	network string
+	address string
+
+	// "http" or "https" when the address has a scheme; without one, HTTPS
+	// follows the TLS settings
+	scheme string
+
+	// Certificate pair of an https:// listener, instead of the TLS settings
+	cert, key string
+}
+
+// parseListen reads a --listen value: host:port or unix:/path, optionally
+// prefixed with http:// or https://. https:// takes its own certificate
+// as ?cert=FILE&key=FILE.
+func parseListen(listen, host, port string) (listenSpec, error) {
+	var spec listenSpec
+	address := listen
+	for _, scheme := range []string{"http", "https"} {
+		if strings.HasPrefix(listen, scheme+"://") {
+			spec.scheme, address = scheme, strings.TrimPrefix(listen, scheme+"://")
+		}
+	}
+
+	if spec.scheme != "" {
+		var query string
+		address, query, _ = strings.Cut(address, "?")
+		if address == "" {
+			return spec, fmt.Errorf("invalid --listen %q, missing address", listen)
+		}
+		if query != "" {
+			values, err := url.ParseQuery(query)
+			if err != nil || spec.scheme != "https" {
+				return spec, fmt.Errorf("invalid --listen %q, only https:// takes ?cert=FILE&key=FILE", listen)
+			}
+			for name := range values {
+				if name != "cert" && name != "key" {
+					return spec, fmt.Errorf("invalid --listen %q, unknown option %q", listen, name)
+				}
+			}
+			spec.cert, spec.key = values.Get("cert"), values.Get("key")
+			if spec.cert == "" || spec.key == "" {
+				return spec, fmt.Errorf("invalid --listen %q, TLS needs both a certificate and a key", listen)
+			}
+		}
+	}
+
+	var err error
+	spec.network, spec.address, err = listenAddress(address, host, port)
+	return spec, err
+}
+
+// Request context key of the Unix socket a request arrived on, as
+// "unix:/path"
+type socketPeerKey struct{}
+
+// boundServer serves one listener
+type boundServer struct {
+	server   *http.Server
+	listener net.Listener
+	network  string
+	address  string
+	scheme   string
+
+	// Closed once Serve returned
+	stopped chan struct{}
+
+	// Connections accepted that haven't sent a request yet
+	fresh sync.Map
+}
+
+// serverGroup runs the servers of every listener on one handler, so they
+// share routes and caches. The first server to fail stops the others,
+// and shutdown drains all of them.
+type serverGroup struct {
+	// Echo instance whose servers hold the shutdown hooks, and the handler
+	// serving the site
+	e       *echo.Echo
+	handler http.Handler
+	servers []*boundServer
+
+	// Options with the connection timeouts and socket settings
+	options *serverOptions
+
+	// Set once an upgraded process serves the listeners, which keeps the
+	// socket files
+	upgraded bool
+
+	// Set as the listeners are closed for the upgraded process, which
+	// stops the servers without an error
+	handingOver atomic.Bool
+}
+
+// bind opens a listener, serving HTTPS with a non-nil tlsConfig and
+// cleartext HTTP/2 as well with h2cEnabled otherwise
+func (g *serverGroup) bind(spec listenSpec, tlsConfig *tls.Config, h2cEnabled bool) error {
+	listener, err := listenOn(spec.network, spec.address, g.options.socketMode, g.options.socketOwner)
+	if err != nil {
+		return err
+	}
+	g.attach(listener, spec.network, spec.address, tlsConfig, h2cEnabled)
+	return nil
+}
+
+// attach serves a listener opened already, like bind
+func (g *serverGroup) attach(listener net.Listener, network, address string, tlsConfig *tls.Config, h2cEnabled bool) {
+	bound := &boundServer{
+		server:   &http.Server{Handler: g.handler, ErrorLog: g.e.StdLogger},
+		listener: listener,
+		network:  network,
+		address:  address,
+		scheme:   "HTTP",
+		stopped:  make(chan struct{}),
+	}
+	bound.server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			bound.fresh.Store(conn, true)
+		} else {
+			bound.fresh.Delete(conn)
+		}
+	}
+	g.options.timeouts.apply(bound.server)
+	if network == "unix" {
+		peer := "unix:" + address
+		bound.server.BaseContext = func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), socketPeerKey{}, peer)
+		}
+	} else {
+		// Report the port picked for :0
+		bound.address = listener.Addr().String()
+	}
+
+	if tlsConfig != nil {
+		bound.server.TLSConfig = tlsConfig.Clone()
+		enableHTTP2(bound.server)
+		bound.listener = tls.NewListener(listener, bound.server.TLSConfig)
+		bound.scheme = "HTTPS"
+	} else if h2cEnabled {
+		bound.server.Handler = h2c.NewHandler(g.handler, &http2.Server{})
+		bound.scheme = "HTTP, h2c"
+	}
+
+	g.servers = append(g.servers, bound)
+}
+
+// firstTLS returns the first HTTPS server, nil without one
+func (g *serverGroup) firstTLS() *boundServer {
+	for _, bound := range g.servers {
+		if bound.server.TLSConfig != nil {
+			return bound
+		}
+	}
+	return nil
+}
+
+// serve runs every server until they are shut down, returning the first
+// error of one that failed
+func (g *serverGroup) serve() error {
+	errs := make(chan error, len(g.servers))
+	for _, bound := range g.servers {
+		go func(bound *boundServer) {
+			err := bound.server.Serve(bound.listener)
+			close(bound.stopped)
+			if err == http.ErrServerClosed || g.handingOver.Load() {
+				err = nil
+			} else if err != nil {
+				err = fmt.Errorf("%s: %v", displayAddress(bound.network, bound.address), err)
+			}
+			errs <- err
+		}(bound)
+	}
+
+	for range g.servers {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown stops accepting connections on every listener and waits for the
+// in-flight requests of all of them
+func (g *serverGroup) shutdown(ctx context.Context) error {
+	if g.upgraded {
+		g.handOver(ctx)
+	}
+	errs := make(chan error, len(g.servers)+1)
+	for _, bound := range g.servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(bound.server)
+	}
+	// Runs the hooks registered on Echo's own servers, such as stopping the
+	// pprof and redirect listeners
+	go func() {
+		errs <- g.e.Shutdown(ctx)
+	}()
+
+	var first error
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// handOver leaves the listeners to the upgraded process, which accepts on
+// them already, and waits for the connections accepted before to send
+// their requests. Shutdown would close those unanswered. Like Shutdown, it
+// gives up on connections silent for 5 seconds.
+func (g *serverGroup) handOver(ctx context.Context) {
+	g.handingOver.Store(true)
+	for _, bound := range g.servers {
+		bound.listener.Close()
+	}
+	deadline := time.After(5 * time.Second)
+	for _, bound := range g.servers {
+		select {
+		case <-bound.stopped:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			fresh := false
+			bound.fresh.Range(func(_, _ interface{}) bool {
+				fresh = true
+				return false
+			})
+			if !fresh {
+				break
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// removeSockets deletes the socket files of Unix listeners, unless systemd
+// owns them
+func (g *serverGroup) removeSockets() {
+	if g.upgraded || socketActivated {
+		return
+	}
+	for _, bound := range g.servers {
+		if bound.network == "unix" {
+			os.Remove(bound.address)
+		}
+	}
+}
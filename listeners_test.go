@@ -0,0 +1,123 @@
+package gosp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/http2"
+)
+
+// gatedValue prints once the test lets it, holding the render after the
+// flush before it
+type gatedValue chan struct{}
+
+func (v gatedValue) String() string {
+	<-v
+	return "gated"
+}
+
+// Gate of the page streamed over h2c, made by the test
+var h2cGate gatedValue
+
+func init() {
+	RegisterProvider("test-h2c-gate", func(c echo.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"gated": h2cGate}, nil
+	})
+}
+
+// serveGroup serves a test server on a loopback port as runServer does,
+// with h2c as given, returning its address
+func serveGroup(t *testing.T, ts *testServer, h2cEnabled bool) string {
+	t.Helper()
+	group := &serverGroup{e: echo.New(), handler: ts.sites, options: ts.options}
+	if err := group.bind(listenSpec{network: "tcp", address: "127.0.0.1:0"}, nil, h2cEnabled); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- group.serve() }()
+	t.Cleanup(func() {
+		group.shutdown(context.Background())
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return group.servers[0].address
+}
+
+// h2cClient speaks cleartext HTTP/2 from the first request, as proxies
+// multiplexing to backends do
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+// With --h2c a plain listener answers HTTP/2 requests, streaming what a
+// flush tag sends before the rest of the page renders, and still answers
+// HTTP/1.1
+func TestH2C(t *testing.T) {
+	h2cGate = make(gatedValue)
+	ts := newTestServer(t, map[string]string{
+		"index.html":  `hello <%= query.name %>`,
+		"stream.html": `head<% flush %><%= gated %> tail`,
+	}, `<routes><route path="/stream" file="stream.html" provider="test-h2c-gate"><methods>GET</methods></route></routes>`, "--h2c")
+	url := "http://" + serveGroup(t, ts, ts.options.h2cEnabled)
+	release := sync.OnceFunc(func() { close(h2cGate) })
+	t.Cleanup(release)
+	client := h2cClient()
+
+	res, err := client.Get(url + "/?name=proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 || res.StatusCode != http.StatusOK || string(body) != "hello proxy" {
+		t.Errorf("h2c GET: %s %d %q", res.Proto, res.StatusCode, body)
+	}
+
+	// The flushed head arrives while the page waits on the gate
+	res, err = client.Get(url + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	head := make([]byte, len("head"))
+	if _, err := io.ReadFull(res.Body, head); err != nil || string(head) != "head" {
+		t.Fatalf("h2c stream head: %q %v", head, err)
+	}
+	release()
+	rest, _ := io.ReadAll(res.Body)
+	if res.ProtoMajor != 2 || string(rest) != "gated tail" {
+		t.Errorf("h2c stream: %s %q", res.Proto, rest)
+	}
+
+	res, err = http.Get(url + "/?name=browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 1 || string(body) != "hello browser" {
+		t.Errorf("HTTP/1.1 GET: %s %q", res.Proto, body)
+	}
+}
+
+// Without --h2c a plain listener refuses cleartext HTTP/2
+func TestWithoutH2C(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"index.html": `hello`}, "<routes/>")
+	url := "http://" + serveGroup(t, ts, ts.options.h2cEnabled)
+	if res, err := h2cClient().Get(url + "/"); err == nil {
+		res.Body.Close()
+		t.Errorf("h2c GET without --h2c: %s %d", res.Proto, res.StatusCode)
+	}
+}
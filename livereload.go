@@ -0,0 +1,281 @@
+package gosp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+)
+
+// Paths of the live reload event stream and of the script pages load it with
+const (
+	liveReloadPath   = "/_gosp/livereload"
+	liveReloadScript = "/_gosp/livereload.js"
+)
+
+// The tag put before </body> of HTML pages
+var liveReloadTag = []byte(`<script src="` + liveReloadScript + `"></script>`)
+
+// liveReloadJS follows the event stream: reload events reload the page, css
+// events load its stylesheets again. A server started again since the page
+// connected says hello with another instance, and the page reloads too.
+const liveReloadJS = `(function () {
+	var source = new EventSource("` + liveReloadPath + `"), instance = null;
+	source.addEventListener("hello", function (e) {
+		if (instance !== null && e.data !== instance) location.reload();
+		instance = e.data;
+	});
+	source.addEventListener("reload", function () { location.reload(); });
+	source.addEventListener("css", function () {
+		var links = document.querySelectorAll('link[rel~="stylesheet"]'), swapped = 0;
+		for (var i = 0; i < links.length; i++) {
+			var url = new URL(links[i].href, location.href);
+			if (url.origin !== location.origin) continue;
+			url.searchParams.set("gosp-reload", Date.now());
+			links[i].href = url.href;
+			swapped++;
+		}
+		if (swapped === 0) location.reload();
+	});
+})();
+`
+
+// liveReloads holds the event streams of the browsers connected
+type liveReloads struct {
+	instance string
+
+	mu      sync.Mutex
+	clients map[chan string]bool
+	closed  bool
+}
+
+func newLiveReloads() *liveReloads {
+	return &liveReloads{
+		instance: strconv.FormatInt(time.Now().UnixNano(), 36),
+		clients:  make(map[chan string]bool),
+	}
+}
+
+// broadcast sends an event to every browser. One waiting to be sent
+// already stands for the next.
+func (lr *liveReloads) broadcast(event string) int {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for client := range lr.clients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+	return len(lr.clients)
+}
+
+// close ends the event streams, so shutdown doesn't wait for them
+func (lr *liveReloads) close() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.closed = true
+	for client := range lr.clients {
+		close(client)
+		delete(lr.clients, client)
+	}
+}
+
+func (lr *liveReloads) subscribe() (chan string, bool) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.closed {
+		return nil, false
+	}
+	client := make(chan string, 1)
+	lr.clients[client] = true
+	return client, true
+}
+
+func (lr *liveReloads) unsubscribe(client chan string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.clients[client] {
+		delete(lr.clients, client)
+		close(client)
+	}
+}
+
+// serve streams the events to a browser until it goes or the server stops,
+// with a comment now and then so dead connections are noticed
+func (lr *liveReloads) serve(c echo.Context) error {
+	client, ok := lr.subscribe()
+	if !ok {
+		return c.NoContent(http.StatusServiceUnavailable)
+	}
+	defer lr.unsubscribe(client)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-store")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "event: hello\ndata: %s\n\n", lr.instance)
+	res.Flush()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event, open := <-client:
+			if !open {
+				return nil
+			}
+			fmt.Fprintf(res, "event: %s\ndata:\n\n", event)
+		case <-ping.C:
+			fmt.Fprint(res, ": ping\n\n")
+		}
+		res.Flush()
+	}
+}
+
+// setupLiveReload registers the event stream and the script on a site,
+// and puts the script tag in its HTML pages
+func setupLiveReload(e *echo.Echo, browsers *liveReloads) {
+	e.GET(liveReloadPath, browsers.serve)
+	e.GET(liveReloadScript, func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+		return c.Blob(http.StatusOK, "text/javascript; charset=utf-8", []byte(liveReloadJS))
+	})
+	e.Use(liveReloadMiddleware())
+}
+
+// liveReloadMiddleware puts the script tag before </body> of HTML pages.
+// Inside compression, so it sees the page as rendered, and outside the
+// route caches, which keep pages without it.
+func liveReloadMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			writer := &liveReloadWriter{ResponseWriter: res.Writer}
+			res.Writer = writer
+			err := next(c)
+			res.Writer = writer.ResponseWriter
+			writer.close()
+			return err
+		}
+	}
+}
+
+// liveReloadWriter looks for </body> in an HTML page on its way out,
+// holding back what may be the start of it at the end of a write
+type liveReloadWriter struct {
+	http.ResponseWriter
+	inject      bool
+	held        []byte
+	wroteHeader bool
+}
+
+func (w *liveReloadWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	header := w.Header()
+	w.inject = status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		status != http.StatusPartialContent && isHTML(header.Get(echo.HeaderContentType)) &&
+		header.Get(echo.HeaderContentEncoding) == "" && header.Get("Content-Range") == ""
+	if w.inject {
+		header.Del(echo.HeaderContentLength)
+		weakenETag(header)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *liveReloadWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.inject {
+		return w.ResponseWriter.Write(b)
+	}
+
+	data := b
+	if len(w.held) > 0 {
+		data = append(w.held, b...)
+		w.held = nil
+	}
+	if i := bytes.Index(bytes.ToLower(data), []byte("</body")); i >= 0 {
+		w.inject = false
+		out := make([]byte, 0, len(data)+len(liveReloadTag))
+		out = append(append(append(out, data[:i]...), liveReloadTag...), data[i:]...)
+		if _, err := w.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	keep := len("</body") - 1
+	if keep > len(data) {
+		keep = len(data)
+	}
+	w.held = append([]byte(nil), data[len(data)-keep:]...)
+	if _, err := w.ResponseWriter.Write(data[:len(data)-keep]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush sends what was held back, a tag split by it being missed
+func (w *liveReloadWriter) Flush() {
+	w.sendHeld()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *liveReloadWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// close sends what was held back. Pages without </body>, such as the
+// fragments of partial updates, go without the script.
+func (w *liveReloadWriter) close() {
+	w.sendHeld()
+}
+
+func (w *liveReloadWriter) sendHeld() {
+	if len(w.held) > 0 {
+		w.ResponseWriter.Write(w.held)
+		w.held = nil
+	}
+}
+
+// refreshBrowsers tells the browsers of changes the watcher handled: css
+// when only stylesheets were written, which pages swap in place, reload
+// for anything else
+func (fw *FileWatcher) refreshBrowsers(events []fsnotify.Event) {
+	browsers := fw.server.browsers
+	if browsers == nil {
+		return
+	}
+	event := ""
+	for _, changed := range events {
+		if changed.Op == fsnotify.Chmod {
+			continue
+		}
+		if filepath.Ext(changed.Name) == ".css" && changed.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+			if event == "" {
+				event = "css"
+			}
+			continue
+		}
+		event = "reload"
+		break
+	}
+	if event != "" {
+		clients := browsers.broadcast(event)
+		watcherLog.Debug("Refreshing browsers", "event", event, "clients", clients)
+	}
+}
@@ -0,0 +1,84 @@
+package gosp
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Loggers of the parts of gosp, tagging records with their component.
+// setupLogging makes them again once the flags are known. They write
+// through slog.Default, so they are the process's as it is, shared by the
+// sites made by New.
+var (
+	serverLog  = componentLog("server")
+	watcherLog = componentLog("watcher")
+	compileLog = componentLog("compile")
+	renderLog  = componentLog("render")
+	sessionLog = componentLog("session")
+	tlsLog     = componentLog("tls")
+)
+
+// Whether every template tag evaluated is logged, with --log-level debug
+var traceTags bool
+
+func componentLog(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// setupLogging installs the --log-level and --log-format logger for the
+// application logs, which the log package of libraries writes through as
+// well. Without --log-level, --verbose logs debug messages, but not the
+// tag traces an explicit debug level adds.
+func setupLogging(level, format string, verbose bool) error {
+	var min slog.Level
+	switch level {
+	case "":
+		min = slog.LevelInfo
+		if verbose {
+			min = slog.LevelDebug
+		}
+	case "debug", "info", "warn", "error":
+		min.UnmarshalText([]byte(level))
+	default:
+		return fmt.Errorf("invalid --log-level %q, expected debug, info, warn or error", level)
+	}
+	traceTags = level == "debug"
+
+	options := &slog.HandlerOptions{Level: min}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid --log-format %q, expected text or json", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	serverLog = componentLog("server")
+	watcherLog = componentLog("watcher")
+	compileLog = componentLog("compile")
+	renderLog = componentLog("render")
+	sessionLog = componentLog("session")
+	tlsLog = componentLog("tls")
+	return nil
+}
+
+// fatal logs the error that keeps gosp from going on and exits
+func fatal(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// traceTag logs the evaluation of one template tag, with --log-level debug
+func traceTag(c echo.Context, msg string, args ...interface{}) {
+	if !traceTags {
+		return
+	}
+	name, _ := c.Get(templateNameKey).(string)
+	renderLog.Debug(msg, append([]interface{}{"template", name, "route", c.Path()}, args...)...)
+}
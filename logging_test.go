@@ -0,0 +1,61 @@
+package gosp
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the component loggers to a JSON handler at level for
+// the rest of the test
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	serverLog, renderLog, sessionLog = componentLog("server"), componentLog("render"), componentLog("session")
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		serverLog, renderLog, sessionLog = componentLog("server"), componentLog("render"), componentLog("session")
+	})
+	return &buf
+}
+
+// Request-time warnings go through slog, in --log-format and at --log-level,
+// with their component and request ID
+func TestRequestLogsUseSlog(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"page.html": `<% session.user = "alice" %>page`,
+	}, `<routes><group prefix="/api"><auth type="jwt" secret="0123456789abcdef0123456789abcdef"/></group></routes>`)
+
+	logs := captureLogs(t, slog.LevelDebug)
+	get(t, handler, http.MethodGet, "/page")
+	get(t, handler, http.MethodGet, "/api/x", "Authorization", "Bearer not-a-token")
+
+	want := map[string]string{
+		"Template uses the session without a <session> block": "session",
+		"Rejected JWT": "server",
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("not a slog JSON record: %q", line)
+		}
+		msg, _ := record["msg"].(string)
+		if component, ok := want[msg]; ok && record["component"] == component && record["request_id"] != "" {
+			delete(want, msg)
+		}
+	}
+	for msg := range want {
+		t.Errorf("no %q record in\n%s", msg, logs)
+	}
+
+	// Below the level, nothing is written
+	logs = captureLogs(t, slog.LevelError)
+	get(t, handler, http.MethodGet, "/page")
+	if logs.Len() != 0 {
+		t.Errorf("warnings logged at error level: %s", logs)
+	}
+}
@@ -1,10 +1,15 @@
-package main
+package gosp
 
 import (
+	"context"
+	"crypto/tls"
+	"embed"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io/fs"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -12,321 +17,2017 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
 	"github.com/spf13/cobra"
+
+	"gosp/engine"
 )
 
 // Route configuration structure
 type RouteConfig struct {
-	XMLName xml.Name `xml:"routes"`
+	XMLName  xml.Name   `xml:"routes"`
+	Imports  []Import   `xml:"import"`
+	Rewrites []*Rewrite `xml:"rewrite"`
+	Groups   []Group    `xml:"group"`
+	Routes   []Route    `xml:"route"`
+	SPAs     []SPA      `xml:"spa"`
+	Statics  []Static   `xml:"static"`
+	TLS      *TLS       `xml:"tls"`
+	CORS     *CORS      `xml:"cors"`
+	Session  *Session   `xml:"session"`
+	Hooks    []Hook     `xml:"hook"`
+	RouteSettings
+
+	// Page rendered for 500 errors outside dev mode
+	ErrorTemplate string `xml:"errorTemplate,attr"`
+
+	// Render hooks of the site, resolved from Hooks
+	hooks []interface{}
+
+	// Config files this config was loaded from, including imports
+	files []string
+}
+
+// Group applies shared settings to the routes nested under a path prefix
+type Group struct {
+	Prefix  string   `xml:"prefix,attr"`
 	Routes  []Route  `xml:"route"`
+	SPAs    []SPA    `xml:"spa"`
+	Statics []Static `xml:"static"`
+	CORS    *CORS    `xml:"cors"`
+	RouteSettings
 }
 
 type Route struct {
-	Path    string   `xml:"path,attr"`
-	File    string   `xml:"file,attr"`
-	Methods []string `xml:"methods"`
+	Path     string   `xml:"path,attr"`
+	File     string   `xml:"file,attr"`
+	Methods  []string `xml:"methods"`
+	Priority int      `xml:"priority,attr"`
+	Type     string   `xml:"type,attr"`
+	RouteSettings
+
+	// Name of a registered provider supplying the template's data
+	Provider string `xml:"provider,attr"`
+
+	// Additional paths serving the same route, optionally redirecting to it
+	Aliases         []string `xml:"alias"`
+	RedirectAliases string   `xml:"redirectAliases,attr"`
+
+	// Config file defining the route
+	source string
+
+	// Primary path of an alias route
+	aliasOf string
+
+	// Set on routes serving a single-page app
+	spa *SPA
+
+	// Set on routes serving a static directory
+	static *Static
+
+	// Resolved from Provider, or given with Handle
+	provider Provider
+}
+
+// Settings available globally, on groups and on routes
+type RouteSettings struct {
+	Headers     []Header   `xml:"header"`
+	Cache       string     `xml:"cache,attr"`
+	Auth        *Auth      `xml:"auth"`
+	Access      *Access    `xml:"access"`
+	RateLimit   *RateLimit `xml:"ratelimit"`
+	Security    *Security  `xml:"security"`
+	ContentType string     `xml:"contentType,attr"`
+	BodyLimit   string     `xml:"bodyLimit,attr"`
+	ETag        string     `xml:"etag,attr"`
+
+	// How long rendered GET responses are served from the server-side cache
+	ResponseCache string `xml:"responseCache,attr"`
+
+	// Handler deadline and the page rendered when it passes
+	Timeout         string `xml:"timeout,attr"`
+	TimeoutTemplate string `xml:"timeoutTemplate,attr"`
+
+	// Format errors are answered in: json, html, or auto to follow Accept
+	Errors string `xml:"errors,attr"`
+
+	// Charset text responses are encoded in, unless the page names one
+	Charset string `xml:"charset,attr"`
+
+	// Bytes of source a page may hold with its includes parsed in
+	IncludeLimit string `xml:"includeLimit,attr"`
+
+	// Whether HTML pages are minified before they're sent
+	Minify string `xml:"minify,attr"`
+
+	// File-based routing
+	FileRouting     string `xml:"fileRouting,attr"`
+	Exclude         string `xml:"exclude"`
+	Index           string `xml:"index"`
+	TrailingSlash   string `xml:"trailingSlash,attr"`
+	CaseInsensitive string `xml:"caseInsensitive,attr"`
+}
+
+// Response header set on every response of a route, group or the whole site
+type Header struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
 }
 
 // Template processor for JSP-like syntax
 type TemplateProcessor struct {
-	rootPath string
-	data     map[string]interface{}
-	embedded bool
+	// Directories includes are looked up in, in order
+	roots []string
+
+	// Files the templates are read from, and the cache of those parsed,
+	// nil for none
+	files     *siteFS
+	templates *templateCache
+
+	data        map[string]interface{}
+	embedded    bool
+	contentType string
+
+	// Charset named by the page directive, if any
+	charset string
+
+	// Whether the output is minified, should it be HTML
+	minify bool
+
+	// Bytes of source the template may expand to with its includes, 0 for
+	// no limit
+	includeLimit int
+
+	// Request context, checked between tags so cancelled or timed out
+	// requests stop rendering
+	ctx context.Context
+	err error
+
+	// Files included while rendering
+	includes []string
+
+	// Files read while parsing, for the template cache
+	stamps []fileStamp
+
+	// Resolves the tags for the engine, kept here to spare an allocation
+	evaluator tagEvaluator
+
+	// Output of the branches taken and the buffer of the page writer, kept
+	// with pooled processors for their capacity
+	active engine.Output
+	output []byte
 }
 
 // File watcher
 type FileWatcher struct {
-	watcher  *fsnotify.Watcher
+	watcher  watchBackend
 	rootPath string
-	server   *echo.Echo
-}
 
-var (
-	rootPath   string
-	configFile string
-	port       string
-	watch      bool
-	output     string
-	embedded   bool
-)
+	// Server of the site watched, whose caches and browsers changes reach
+	server *server
 
-func main() {
-	var rootCmd = &cobra.Command{
+	// How changes are learnt of, inotify or poll
+	mode string
+
+	// Patterns of the names of --watch-ignore
+	ignore []string
+
+	// Directories watched, the roots and those of --watch-dir
+	roots     []string
+	extraDirs []string
+
+	// Reloads the site as its route config changes
+	reloader *reloader
+
+	// Files of the config served, followed again after reloads
+	mu          sync.Mutex
+	configFiles map[string]bool
+	reload      *time.Timer
+
+	// API keys files, reloaded when they change
+	keyFiles map[string][]*Auth
+
+	// Set with --validate-on-start, to check templates again as they change
+	validation *revalidation
+
+	// Commands of --on-change, stopped with the server
+	hooks       []*changeHook
+	hookContext context.Context
+
+	// Last change and error, for the admin endpoint and the metrics
+	health watcherHealth
+}
+
+// serverCommand is the command running the server, with its flags setting
+// options. Making it sets every server setting to its default.
+func serverCommand(options *serverOptions) *cobra.Command {
+	rootCmd := &cobra.Command{
 		Use:   "webframework",
 		Short: "GoLang Web Framework with JSP-like template processing",
 		Long:  "A CLI tool that serves HTML templates with JSP-like syntax using Echo framework",
-		Run:   runServer,
+		Run: func(cmd *cobra.Command, args []string) {
+			runServer(cmd, options)
+		},
 	}
 
+	options.sources = make(map[string]string)
+
+	// Server flags
+	rootCmd.Flags().StringVarP(&options.root, "root", "r", "./root_http", "Root directory for web files")
+	rootCmd.Flags().StringVarP(&options.config, "config", "c", "routes.xml", "XML configuration file for routing")
+	rootCmd.Flags().StringVarP(&options.port, "port", "p", "8080", "Port to run the server on")
+	rootCmd.Flags().StringVar(&options.host, "host", "", "Interface address to bind, e.g. 127.0.0.1 or [::1] (default all)")
+	rootCmd.Flags().StringVar(&options.host, "bind", "", "Alias for --host")
+	rootCmd.Flags().StringArrayVar(&options.listen, "listen", nil, "Listen address as host:port or unix:/path/to/socket, optionally with http:// or https://[...]?cert=FILE&key=FILE, repeatable, instead of --host and --port")
+	rootCmd.Flags().StringVar(&options.socketMode, "socket-mode", "0660", "Permissions of the --listen socket")
+	rootCmd.Flags().StringVar(&options.socketOwner, "socket-owner", "", "Owner of the --listen socket as user[:group]")
+	rootCmd.Flags().StringVar(&options.trustedProxies, "trusted-proxies", "", "Comma-separated proxy IPs and CIDR ranges whose X-Forwarded-For and X-Real-IP headers give the client IP")
+	rootCmd.Flags().BoolVarP(&options.watch, "watch", "w", false, "Watch for file changes and reload (default on in dev mode)")
+	rootCmd.Flags().DurationVar(&options.watchDebounce, "watch-debounce", 200*time.Millisecond, "How long a file must go without changes before the watcher handles them, 0 handles every event")
+	rootCmd.Flags().StringArrayVar(&options.watchDirs, "watch-dir", nil, "Watch a directory outside the root as well, such as that of the route config (repeatable)")
+	rootCmd.Flags().StringVar(&options.watchIgnore, "watch-ignore", defaultWatchIgnore, "Comma-separated glob patterns of file and directory names the watcher ignores")
+	rootCmd.Flags().StringVar(&options.watchMode, "watch-mode", "auto", "How the watcher learns of changes: auto, inotify (the system's notifications) or poll")
+	rootCmd.Flags().DurationVar(&options.watchInterval, "watch-interval", 2*time.Second, "How often --watch-mode poll scans for changes")
+	rootCmd.Flags().BoolVar(&options.liveReload, "live-reload", false, "Refresh the pages open in browsers as their files change, with --watch (default on in dev mode)")
+	rootCmd.Flags().StringArrayVar(&options.onChange, "on-change", nil, "Run a command as files change, as comma-separated globs=command, with --watch (repeatable)")
+	rootCmd.Flags().BoolVar(&options.followSymlinks, "follow-symlinks", false, "Serve, include and watch files through symlinks leading out of the root, and walk into symlinked directories")
+	rootCmd.Flags().StringVar(&options.runMode, "mode", "dev", "dev or prod, setting the defaults of --watch, --error-details, --caching and --verbose (also from GOSP_MODE)")
+	rootCmd.Flags().BoolVar(&options.errorDetails, "error-details", false, "Show error messages in 500 responses (default on in dev mode)")
+	rootCmd.Flags().BoolVar(&options.caching, "caching", true, "Honor Cache-Control policies and the response cache; off sends no-store (default off in dev mode)")
+	rootCmd.Flags().BoolVar(&options.verbose, "verbose", false, "Log debug messages, such as every watched file change (default on in dev mode)")
+	rootCmd.Flags().StringVar(&options.logLevel, "log-level", "", "Application log level: debug, info, warn or error; debug also traces every template tag (default info, debug with --verbose)")
+	rootCmd.Flags().StringVar(&options.logFormat, "log-format", "text", "Application log format: text or json")
+	rootCmd.Flags().BoolVarP(&options.embedded, "embedded", "e", false, "Run with embedded templates (compiled mode)")
+	rootCmd.Flags().StringVar(&options.bodyLimit, "body-limit", "", "Maximum request body size, e.g. 1M (overridden by bodyLimit in the config)")
+	rootCmd.Flags().StringVar(&options.timeout, "timeout", "", "Handler timeout, e.g. 5s (overridden by timeout in the config)")
+	rootCmd.Flags().StringVar(&options.includeLimit, "include-limit", "16M", "Bytes of source a page may expand to with its includes, empty for no limit (overridden by includeLimit in the config)")
+	rootCmd.Flags().BoolVar(&options.noFileRouting, "no-file-routing", false, "Serve only configured routes, without file-based routing")
+	rootCmd.Flags().BoolVar(&options.securityHeaders, "security-headers", false, "Send the default security headers on every response")
+	rootCmd.Flags().StringVar(&options.tlsCert, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	rootCmd.Flags().StringVar(&options.tlsKey, "tls-key", "", "TLS private key file")
+	rootCmd.Flags().StringVar(&options.tlsMinVersion, "tls-min-version", "", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3 (default 1.2)")
+	rootCmd.Flags().StringVar(&options.tlsCiphers, "tls-ciphers", "", "Comma-separated TLS 1.0-1.2 cipher suites (default Go's secure set)")
+	rootCmd.Flags().BoolVar(&options.autoCert, "auto-tls", false, "Obtain and renew certificates from Let's Encrypt, answering challenges on :80")
+	rootCmd.Flags().StringVar(&options.acmeDomains, "domains", "", "Comma-separated domains to obtain certificates for with --auto-tls")
+	rootCmd.Flags().StringVar(&options.acmeCacheDir, "cache-dir", "./certs", "Certificate cache directory for --auto-tls")
+	rootCmd.Flags().BoolVar(&options.h2cEnabled, "h2c", false, "Accept cleartext HTTP/2 (h2c) for proxies that multiplex to backends")
+	rootCmd.Flags().BoolVar(&options.redirectHTTP, "redirect-http", false, "Redirect plain HTTP on --http-port to HTTPS")
+	rootCmd.Flags().StringVar(&options.httpPort, "http-port", "80", "Port for HTTP redirects and ACME challenges")
+	rootCmd.Flags().IntVar(&options.hstsMaxAge, "hsts-max-age", 0, "Send Strict-Transport-Security with this max-age in seconds over HTTPS")
+	rootCmd.Flags().DurationVar(&options.shutdownTimeout, "shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests on SIGINT/SIGTERM")
+	rootCmd.Flags().DurationVar(&options.upgradeTimeout, "upgrade-timeout", 30*time.Second, "How long a SIGUSR2 upgrade waits for the new process to serve before keeping the old one")
+	rootCmd.Flags().IntVar(&options.responseCacheEntries, "response-cache-entries", 1000, "Maximum number of responses in the server-side response cache")
+	rootCmd.Flags().StringVar(&options.responseCacheSize, "response-cache-size", "64M", "Maximum total body size of the server-side response cache")
+	rootCmd.Flags().BoolVar(&options.noTemplateCache, "no-template-cache", false, "Read and parse templates on every request instead of keeping them parsed")
+	rootCmd.Flags().IntVar(&options.templateCacheEntries, "template-cache-entries", 1000, "Maximum number of parsed templates kept")
+	rootCmd.Flags().StringVar(&options.templateCacheSize, "template-cache-size", "64M", "Maximum total source size of the parsed templates kept")
+	rootCmd.Flags().StringVar(&options.memoryRoot, "memory-root", "", "Hold the pages of the root in memory up to this size, e.g. 256M, reading those over it from disk; kept in sync with --watch")
+	rootCmd.Flags().StringVar(&options.maxTemplateSize, "max-template-size", "16M", "Largest template rendered; larger ones are served as they are, without processing, empty for no limit")
+	rootCmd.Flags().StringVar(&options.rejectTemplateSize, "reject-template-size", "", "Largest template served at all; larger ones get a 500, empty for no limit")
+	rootCmd.Flags().IntVar(&options.maxRenders, "max-concurrent-renders", 0, "Templates rendering at once, 0 for no limit; requests over it wait for a slot")
+	rootCmd.Flags().DurationVar(&options.renderQueueTimeout, "render-queue-timeout", 5*time.Second, "How long requests wait for a render slot before a 503")
+	rootCmd.Flags().StringVar(&options.metricsPath, "metrics-path", "", "Serve Prometheus metrics on this path, e.g. /metrics")
+	rootCmd.Flags().StringVar(&options.healthPath, "health-path", "/healthz", "Liveness probe path, empty disables it")
+	rootCmd.Flags().StringVar(&options.readyPath, "ready-path", "/readyz", "Readiness probe path, empty disables it")
+	rootCmd.Flags().BoolVar(&options.pprofEnabled, "pprof", false, "Serve net/http/pprof profiles under /debug/pprof/")
+	rootCmd.Flags().StringVar(&options.pprofAddr, "pprof-addr", "127.0.0.1:6060", "Listener for --pprof, empty serves it on the main server")
+	rootCmd.Flags().BoolVar(&options.tracingEnabled, "tracing", false, "Trace requests, template renders and includes with OpenTelemetry, configured by OTEL_* variables")
+	rootCmd.Flags().StringVar(&options.adminPath, "admin-path", "", "Serve routes, templates and cache state as JSON on this path, e.g. /_gosp/admin")
+	rootCmd.Flags().StringVar(&options.reloadPath, "reload-path", "", "Re-read the route config and flush caches on POST to this path, e.g. /_gosp/reload")
+	rootCmd.Flags().StringArrayVar(&options.adminUsers, "admin-auth", nil, "Basic Auth user for --admin-path and --reload-path as user:password or user:bcrypt-hash, repeatable (default the --auth users)")
+	rootCmd.Flags().BoolVar(&options.compress, "compress", false, "Compress responses with brotli or gzip as the client accepts")
+	rootCmd.Flags().StringVar(&options.compressMinSize, "compress-min-size", "1K", "Smallest response body to compress")
+	rootCmd.Flags().IntVar(&options.gzipLevel, "gzip-level", 6, "gzip compression level, 1-9")
+	rootCmd.Flags().IntVar(&options.brotliLevel, "brotli-level", 5, "brotli compression level, 0-11")
+	rootCmd.Flags().DurationVar(&options.timeouts.Read, "read-timeout", time.Minute, "Maximum time to read a request including the body, 0 disables")
+	rootCmd.Flags().DurationVar(&options.timeouts.ReadHeader, "read-header-timeout", 10*time.Second, "Maximum time to read request headers, 0 uses --read-timeout")
+	rootCmd.Flags().DurationVar(&options.timeouts.Write, "write-timeout", time.Minute, "Maximum time to write a response, 0 disables")
+	rootCmd.Flags().DurationVar(&options.timeouts.Idle, "idle-timeout", 2*time.Minute, "How long keep-alive connections stay open between requests, 0 uses --read-timeout")
+	rootCmd.Flags().StringVar(&options.templateExts, "ext", ".html", "Template extensions, tried in order for extensionless URLs")
+	rootCmd.Flags().StringVar(&options.staticExts, "static-ext", "", "Page extensions served without template processing")
+	rootCmd.Flags().StringVar(&options.wellKnownRoot, "well-known-dir", "", "Directory favicon.ico, robots.txt and /.well-known/ files are served from (default the --root)")
+	rootCmd.Flags().StringVar(&options.wellKnownCache, "well-known-cache", "24h", "Cache policy of well-known files: a duration, no-store, no-cache, private or immutable")
+	rootCmd.Flags().StringVar(&options.tenantsDir, "tenants-dir", "", "Serve each host from its own root, <dir>/<host>/, falling back to --root")
+	rootCmd.Flags().StringVar(&options.tenantHeader, "tenant-header", "", "Request header naming the tenant instead of Host, e.g. X-Tenant")
+	rootCmd.Flags().StringVar(&options.tenantDomain, "tenant-domain", "", "Domain stripped from host names, so acme.example.com is tenant acme")
+	rootCmd.Flags().StringVar(&options.unknownTenantTemplate, "unknown-tenant-template", "", "Template under --root rendered with a 404 for unknown tenants")
+	rootCmd.Flags().BoolVar(&options.validateOnStart, "validate-on-start", false, "Check every template and include at startup and refuse to start on errors")
+	rootCmd.Flags().StringVar(&options.warmupSpec, "warmup", "", "Read templates before they're requested: all, routes, or a comma-separated list")
+	rootCmd.Flags().Lookup("warmup").NoOptDefVal = "all"
+	rootCmd.Flags().BoolVar(&options.warmupRender, "warmup-render", false, "Also render each --warmup template once for an empty request")
+	rootCmd.Flags().StringVar(&options.defaultCharset, "charset", "UTF-8", "Charset of text responses whose page and route name none, e.g. ISO-8859-1 (overridden by charset in the config)")
+	rootCmd.Flags().BoolVar(&options.minifyOutput, "minify", false, "Minify HTML pages before sending them (overridden by minify in the config)")
+	rootCmd.Flags().StringArrayVar(&options.authUsers, "auth", nil, "Require Basic Auth for everything as user:password or user:bcrypt-hash, repeatable (also from GOSP_AUTH)")
+	rootCmd.Flags().StringVar(&options.authExclude, "auth-exclude", "", "Comma-separated paths left open by --auth, e.g. /health,/metrics")
+	rootCmd.Flags().StringVar(&options.accessLog.Output, "access-log", "stdout", "Access log destination: stdout, stderr or a file path")
+	rootCmd.Flags().StringVar(&options.accessLog.Format, "access-log-format", "json", "Access log format: json, or a template such as '${remote_ip} ${method} ${uri} ${status} ${latency_human}'")
+	rootCmd.Flags().StringVar(&options.accessLog.MaxSize, "access-log-max-size", "", "Rotate the access log file at this size, e.g. 100M")
+	rootCmd.Flags().DurationVar(&options.accessLog.MaxAge, "access-log-max-age", 0, "Remove rotated access logs older than this, e.g. 168h")
+	rootCmd.Flags().IntVar(&options.accessLog.MaxBackups, "access-log-max-backups", 0, "Number of rotated access logs to keep, 0 keeps all")
+	rootCmd.Flags().StringVar(&options.accessLog.Exclude, "access-log-exclude", "", "Comma-separated paths left out of the access log, e.g. /healthz")
+	rootCmd.Flags().BoolVar(&options.accessLog.MissingWellKnown, "access-log-missing-well-known", false, "Log requests for missing favicon.ico, robots.txt and /.well-known/ files")
+	rootCmd.Flags().StringVar(&options.serverConfigPath, "server-config", "", "YAML file with flag settings, overridden by GOSP_* variables and flags (also from GOSP_SERVER_CONFIG)")
+
+	return rootCmd
+}
+
+// Main runs the gosp command: the development server, or one of its
+// subcommands
+func Main() {
+	options := &serverOptions{}
+	rootCmd := serverCommand(options)
+
+	compile := &compileOptions{}
 	var compileCmd = &cobra.Command{
 		Use:   "compile",
 		Short: "Compile HTML templates into a Go binary",
 		Long:  "Generate a standalone Go binary with embedded templates and routes",
-		Run:   compileTemplates,
+		Run: func(cmd *cobra.Command, args []string) {
+			compileTemplates(compile)
+		},
 	}
 
-	// Server flags
-	rootCmd.Flags().StringVarP(&rootPath, "root", "r", "./root_http", "Root directory for web files")
-	rootCmd.Flags().StringVarP(&configFile, "config", "c", "routes.xml", "XML configuration file for routing")
-	rootCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to run the server on")
-	rootCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Watch for file changes and reload")
-	rootCmd.Flags().BoolVarP(&embedded, "embedded", "e", false, "Run with embedded templates (compiled mode)")
-
 	// Compile flags
-	compileCmd.Flags().StringVarP(&rootPath, "root", "r", "./root_http", "Root directory for web files")
-	compileCmd.Flags().StringVarP(&configFile, "config", "c", "routes.xml", "XML configuration file for routing")
-	compileCmd.Flags().StringVarP(&output, "output", "o", "webframework-compiled", "Output binary name")
+	compileCmd.Flags().StringVarP(&compile.root, "root", "r", "./root_http", "Root directory for web files")
+	compileCmd.Flags().StringVarP(&compile.config, "config", "c", "routes.xml", "XML configuration file for routing")
+	compileCmd.Flags().StringVarP(&compile.output, "output", "o", "webframework-compiled", "Output binary name")
+	compileCmd.Flags().BoolVar(&compile.noFileRouting, "no-file-routing", false, "Serve only configured routes, without file-based routing")
+	compileCmd.Flags().BoolVar(&compile.followSymlinks, "follow-symlinks", false, "Embed files through symlinks leading out of the root, and walk into symlinked directories")
+	compileCmd.Flags().BoolVar(&compile.securityHeaders, "security-headers", false, "Send the default security headers on every response")
+	compileCmd.Flags().StringVar(&compile.templateExts, "ext", ".html", "Template extensions, tried in order for extensionless URLs")
+	compileCmd.Flags().StringVar(&compile.staticExts, "static-ext", "", "Page extensions served without template processing")
+	compileCmd.Flags().StringVar(&compile.wellKnownRoot, "well-known-dir", "", "Directory favicon.ico, robots.txt and /.well-known/ files are embedded from (default the --root)")
+	compileCmd.Flags().StringVar(&compile.maxEmbedSize, "max-embed-size", "16M", "Warn about files larger than this, which compiled binaries hold in memory")
+	compileCmd.Flags().BoolVar(&compile.skipLarge, "skip-large", false, "Leave out files larger than --max-embed-size instead of only warning")
+	compileCmd.Flags().BoolVar(&compile.embedStatic, "embed-static", true, "Embed the files of the static mounts and single-page apps, instead of serving mounts from their directories")
+	compileCmd.Flags().StringVar(&compile.goos, "goos", "", "Operating systems to build for, comma-separated (default the host's)")
+	compileCmd.Flags().StringVar(&compile.goarch, "goarch", "", "Architectures to build for, comma-separated, a binary for every pair with --goos (default the host's)")
+	compileCmd.Flags().BoolVar(&compile.cgo, "cgo", false, "Build with cgo, which cross builds need a C toolchain for")
+	compileCmd.Flags().BoolVar(&compile.sourceOnly, "source-only", false, "Write the Go project of the binary to --out-dir and print how to build it, instead of building it")
+	compileCmd.Flags().StringVar(&compile.outDir, "out-dir", "generated", "Directory --source-only writes the project to")
+	compileCmd.Flags().BoolVar(&compile.admin, "admin", false, "Include the admin endpoint, enabled at run time with --admin-path")
+	compileCmd.Flags().StringVar(&compile.logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	compileCmd.Flags().StringVar(&compile.logFormat, "log-format", "text", "Log format: text or json")
+
+	routesOptions := &serverOptions{}
+	var routesCmd = &cobra.Command{
+		Use:   "routes",
+		Short: "Print the effective route table",
+		Long:  "Print configured and file-based routes in the order they take precedence",
+		Run: func(cmd *cobra.Command, args []string) {
+			printRoutes(routesOptions)
+		},
+	}
+
+	// Routes flags
+	routesCmd.Flags().StringVarP(&routesOptions.config, "config", "c", "routes.xml", "XML configuration file for routing")
+	routesCmd.Flags().BoolVar(&routesOptions.noFileRouting, "no-file-routing", false, "Serve only configured routes, without file-based routing")
+
+	var depsRoot string
+	var depsReverse bool
+	var depsCmd = &cobra.Command{
+		Use:   "deps [template...]",
+		Short: "Print the includes of templates",
+		Long:  "Print the include tree of the named templates, or of every template under the root, or with --reverse the templates depending on each file",
+		Run: func(cmd *cobra.Command, args []string) {
+			printDeps(depsRoot, args, depsReverse)
+		},
+	}
+
+	// Deps flags
+	depsCmd.Flags().StringVarP(&depsRoot, "root", "r", "./root_http", "Root directory for web files")
+	depsCmd.Flags().BoolVar(&depsReverse, "reverse", false, "Print the templates including each file, directly or through other includes")
+
+	var sessionsCmd = &cobra.Command{
+		Use:   "sessions",
+		Short: "Maintain the session store",
+	}
+	var purgeConfig string
+	var purgeAll bool
+	var purgeCmd = &cobra.Command{
+		Use:   "purge",
+		Short: "Remove expired sessions from the file or Redis store",
+		Run: func(cmd *cobra.Command, args []string) {
+			purgeSessions(purgeConfig, purgeAll)
+		},
+	}
+
+	// Sessions flags
+	purgeCmd.Flags().StringVarP(&purgeConfig, "config", "c", "routes.xml", "XML configuration file for routing")
+	purgeCmd.Flags().BoolVar(&purgeAll, "all", false, "Remove every session, signing everybody out")
+	sessionsCmd.AddCommand(purgeCmd)
+
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server configuration",
+	}
+	var configPrintCmd = &cobra.Command{
+		Use:   "print",
+		Short: "Print the effective settings from flags, GOSP_* variables, the server config and defaults",
+		Run:   printServerConfig(options),
+	}
+
+	// Config flags, the same as the server's
+	configPrintCmd.Flags().AddFlagSet(rootCmd.Flags())
+	configCmd.AddCommand(configPrintCmd)
 
 	rootCmd.AddCommand(compileCmd)
+	rootCmd.AddCommand(routesCmd)
+	rootCmd.AddCommand(depsCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	rootCmd.AddCommand(configCmd)
 
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(err)
+		fatal(serverLog, err.Error())
 	}
 }
 
-func runServer(cmd *cobra.Command, args []string) {
-	// Initialize Echo
-	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
+// runServer serves the site of the options until a signal stops it
+func runServer(cmd *cobra.Command, options *serverOptions) {
+	if err := loadServerConfig(cmd, options); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	if err := applyMode(cmd, options); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	if err := setupLogging(options.logLevel, options.logFormat, options.verbose); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	logMode(cmd, options)
+	if err := options.timeouts.validate(); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+
+	// Listeners handed over by a SIGUSR2 upgrade, taken by listenOn
+	if err := inheritListeners(); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+
+	// What every build of the site is served with, its changes going to
+	// the subscribers of Subscribe
+	srv := newServer(options)
+	srv.changes = changes
 
 	// Load routes configuration
-	routes, err := loadRouteConfig(configFile)
-	if err != nil {
-		log.Printf("Warning: Could not load route config: %v", err)
+	routes, err := loadRouteConfig(srv.files, options.config)
+	if os.IsNotExist(err) {
+		serverLog.Warn("Could not load route config", "file", options.config, "err", err)
 		routes = &RouteConfig{}
+	} else if err != nil {
+		fatal(serverLog, "Error loading route config", "file", options.config, "err", err)
+	}
+	// Compiled binaries take the certificates as --tls-cert and --tls-key
+	if options.embedded && routes.TLS != nil {
+		routes.TLS.Cert, routes.TLS.Key = "", ""
+	}
+
+	if srv.logger, err = newAccessLogger(options.accessLog); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	if options.tracingEnabled {
+		if tracer, err = newTracer(); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+		tracer.start()
+	}
+	if options.pprofEnabled && options.pprofAddr == "" {
+		srv.pprof = pprofHandler()
+		serverLog.Warn("pprof is served on the main listener at /debug/pprof/, protect it with --auth")
+	}
+	if err := srv.setupShared(routes); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	srv.setupInstance(routes)
+	srv.seedTemplates(options.preparsed)
+
+	// The admin endpoints ask for their own users instead of the gate's
+	gateExclude := options.authExclude
+	if len(options.adminUsers) > 0 {
+		gateExclude += "," + options.adminPath + "," + options.reloadPath
+	}
+	if srv.gate, err = globalAuth(options.authUsers, gateExclude); err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+
+	// The instance endpoints belong to no tenant
+	if options.tenantsDir != "" {
+		if info, err := os.Stat(options.tenantsDir); err != nil || !info.IsDir() {
+			fatal(serverLog, "--tenants-dir is not a directory", "dir", options.tenantsDir)
+		}
+		if options.unknownTenantTemplate != "" && !srv.files.templateExists(options.root, options.unknownTenantTemplate) {
+			fatal(serverLog, "--unknown-tenant-template not found", "template", options.unknownTenantTemplate, "root", options.root)
+		}
+		srv.tenantExcluded = splitList(strings.Join([]string{options.metricsPath, options.adminPath, options.reloadPath}, ","))
+		if options.pprofEnabled && options.pprofAddr == "" {
+			srv.tenantExcluded = append(srv.tenantExcluded, "/debug/pprof")
+		}
+		serverLog.Info("Tenants directory", "dir", options.tenantsDir)
+	}
+
+	// Held before the watcher starts, so no change goes unseen
+	if options.memoryRoot != "" {
+		limit, err := bytes.Parse(options.memoryRoot)
+		if err != nil || limit <= 0 {
+			fatal(serverLog, "Startup failed", "err", fmt.Errorf("invalid --memory-root %q", options.memoryRoot))
+		}
+		dirs := []string{options.root}
+		if options.tenantsDir != "" {
+			dirs = append(dirs, options.tenantsDir)
+		}
+		if err := srv.files.loadMemoryRoots(limit, dirs...); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+		registerMemoryRootMetrics(srv.files)
+		if !options.watch {
+			serverLog.Warn("Pages changed on disk are served as loaded until a reload, run with --watch to follow them")
+		}
 	}
 
-	// Setup routes
-	setupRoutes(e, routes)
+	if options.adminPath != "" {
+		if srv.adminAuth, err = adminAuth(options.adminUsers, srv.gate != nil, "--admin-path"); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+		serverLog.Info("Admin endpoint", "path", options.adminPath)
+	}
+	if options.reloadPath != "" {
+		if srv.reloadAuth, err = adminAuth(options.adminUsers, srv.gate != nil, "--reload-path"); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+		serverLog.Info("Reload endpoint", "path", options.reloadPath)
+	}
 
 	// Setup file watcher if enabled
-	if watch {
-		watcher, err := setupFileWatcher(rootPath, e, routes)
+	var watcher *FileWatcher
+	if options.watch {
+		ignore, err := parseWatchIgnore(options.watchIgnore)
+		if err == nil {
+			err = checkWatchMode(options)
+		}
+		var hooks []*changeHook
+		if err == nil {
+			hooks, err = parseChangeHooks(options.onChange, options.watchDebounce)
+		}
+		var extra []string
+		if err == nil {
+			extra, err = parseWatchDirs(options.watchDirs, []string{options.root, options.tenantsDir})
+		}
 		if err != nil {
-			log.Printf("Warning: Could not setup file watcher: %v", err)
+			fatal(serverLog, "Invalid settings", "err", err)
+		}
+		watcher, err = srv.setupFileWatcher(routes, ignore, extra)
+		if err != nil {
+			watcherLog.Warn("Could not set up the file watcher", "err", err)
 		} else {
-			defer watcher.watcher.Close()
-			go watcher.watchFiles()
+			srv.watcher = watcher
+			registerWatcherMetrics(watcher)
+			watcher.hooks = hooks
+			if options.liveReload {
+				srv.browsers = newLiveReloads()
+			}
 		}
 	}
 
-	// Start server
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Root directory: %s", rootPath)
-	log.Printf("Config file: %s", configFile)
-	log.Printf("File watching: %v", watch)
+	// Reloads build the site again, to swap it in for the first one
+	srv.reloader = &reloader{server: srv}
+	first, err := srv.build(routes)
+	if err != nil {
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	if options.validateOnStart {
+		if problems := srv.validateTemplates(routes); logTemplateProblems(problems) {
+			fatal(renderLog, "Template problems, not starting", "count", len(problems))
+		}
+		renderLog.Info("Templates validated")
+	}
+	var warmups []string
+	if options.warmupSpec != "" {
+		if warmups, err = warmupTemplates(options.warmupSpec, first); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+	}
 
-	e.Logger.Fatal(e.Start(":" + port))
-}
+	// The Echo instance of the first site keeps the servers and their
+	// shutdown hooks
+	e := first.e
+	if srv.browsers != nil {
+		e.Server.RegisterOnShutdown(srv.browsers.close)
+		serverLog.Info("Live reload", "path", liveReloadPath)
+	}
+	sites := newSiteHandler(first)
+	srv.reloader.sites = sites
+	if watcher != nil {
+		srv.reloader.watcher = watcher
+		watcher.reloader = srv.reloader
+		if len(watcher.hooks) > 0 {
+			var stopHooks context.CancelFunc
+			watcher.hookContext, stopHooks = context.WithCancel(context.Background())
+			e.Server.RegisterOnShutdown(stopHooks)
+			serverLog.Info("Change hooks", "count", len(watcher.hooks))
+		}
+		go watcher.watchFiles()
+	}
+	if options.pprofEnabled && options.pprofAddr != "" {
+		if err := startPprof(e, options.pprofAddr); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+	}
 
-func loadRouteConfig(configPath string) (*RouteConfig, error) {
-	data, err := ioutil.ReadFile(configPath)
+	// Serve HTTPS when a certificate is configured or obtained automatically
+	tlsSettings := mergeTLSFlags(routes.TLS, options)
+	var tlsConfig *tls.Config
+	var acme *autoTLS
+	if options.autoCert {
+		if tlsSettings.Cert != "" || tlsSettings.Key != "" {
+			fatal(tlsLog, "--auto-tls can't be combined with a certificate and key")
+		}
+		if acme, err = newAutoTLS(options.acmeDomains, options.acmeCacheDir); err == nil {
+			tlsConfig, err = acme.tlsConfig(&tlsSettings)
+		}
+	} else {
+		tlsConfig, err = tlsSettings.serverConfig()
+	}
 	if err != nil {
-		return nil, err
+		fatal(tlsLog, "Error configuring TLS", "err", err)
 	}
 
-	var config RouteConfig
-	err = xml.Unmarshal(data, &config)
+	// One server per socket passed by systemd, --listen, or --host and --port
+	sockets, err := activatedSockets()
 	if err != nil {
-		return nil, err
+		fatal(serverLog, "Startup failed", "err", err)
+	}
+	listens := options.listen
+	if len(sockets) > 0 {
+		if len(listens) > 0 {
+			serverLog.Warn("Socket-activated, ignoring --listen")
+		}
+		listens = nil
+	} else if len(listens) == 0 {
+		listens = []string{""}
+	}
+	group := &serverGroup{e: e, handler: sites, options: options}
+	plain := false
+	// The socket named http serves redirects and ACME challenges when
+	// there are any
+	var redirectListener net.Listener
+	for _, socket := range sockets {
+		config := tlsConfig
+		switch socket.name {
+		case "http":
+			if options.redirectHTTP || acme != nil {
+				redirectListener = socket.listener
+				continue
+			}
+			config = nil
+		case "https":
+			if config == nil {
+				fatal(tlsLog, "systemd socket https needs a certificate, set --tls-cert and --tls-key or --auto-tls")
+			}
+		}
+		plain = plain || config == nil
+		group.attach(socket.listener, socket.listener.Addr().Network(), socket.listener.Addr().String(), config, options.h2cEnabled)
+	}
+	for _, value := range listens {
+		spec, err := parseListen(value, options.host, options.port)
+		if err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+		config := tlsConfig
+		switch {
+		case spec.cert != "":
+			settings := tlsSettings
+			settings.Cert, settings.Key = spec.cert, spec.key
+			if config, err = settings.serverConfig(); err != nil {
+				fatal(tlsLog, "Error configuring TLS", "listen", value, "err", err)
+			}
+		case spec.scheme == "http":
+			config = nil
+		case spec.scheme == "https" && config == nil:
+			fatal(tlsLog, "--listen needs a certificate, set --tls-cert and --tls-key, --auto-tls or ?cert=FILE&key=FILE", "listen", value)
+		}
+		plain = plain || config == nil
+		if err := group.bind(spec, config, options.h2cEnabled); err != nil {
+			fatal(serverLog, "Startup failed", "err", err)
+		}
+	}
+	if options.h2cEnabled && !plain {
+		fatal(serverLog, "--h2c is for plain HTTP, HTTP/2 is enabled over TLS already")
 	}
 
-	return &config, nil
-}
+	if acme != nil {
+		acme.start()
+	}
 
-func setupRoutes(e *echo.Echo, routes *RouteConfig) {
-	// Setup configured routes
-	for _, route := range routes.Routes {
-		for _, method := range route.Methods {
-			switch strings.ToUpper(method) {
-			case "GET":
-				e.GET(route.Path, createHandler(route.File))
-			case "POST":
-				e.POST(route.Path, createHandler(route.File))
-			case "PUT":
-				e.PUT(route.Path, createHandler(route.File))
-			case "DELETE":
-				e.DELETE(route.Path, createHandler(route.File))
-			case "PATCH":
-				e.PATCH(route.Path, createHandler(route.File))
-			case "ANY":
-				e.Any(route.Path, createHandler(route.File))
-			}
+	// ACME challenges need the plain HTTP listener too
+	if options.redirectHTTP || acme != nil {
+		https := group.firstTLS()
+		if https == nil {
+			fatal(serverLog, "--redirect-http needs HTTPS, set --tls-cert and --tls-key or --auto-tls")
+		}
+		redirectHost, httpsPort := "", options.port
+		if https.network == "tcp" {
+			redirectHost, httpsPort, _ = net.SplitHostPort(https.address)
 		}
+		startRedirectServer(newRedirectServer(net.JoinHostPort(redirectHost, options.httpPort), httpsPort, acme), e.TLSServer, redirectListener)
 	}
 
-	// Setup catch-all route for file-based routing
-	e.Any("/*", fileBasedHandler)
-}
+	// Start server
+	for _, bound := range group.servers {
+		serverLog.Info("Server listening", "addr", displayAddress(bound.network, bound.address), "scheme", bound.scheme)
+	}
+	serverLog.Info("Serving", "root", options.root, "config", options.config, "watch", options.watch)
 
-func createHandler(filename string) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		return processTemplate(c, filename)
+	// Readiness waits for it, so the server is up but gets no traffic yet
+	if options.warmupSpec != "" {
+		startWarmup(first, warmups, options.warmupRender)
 	}
+	srv.health.setReady("")
+	os.Exit(serveUntilSignal(group, srv.health, options.shutdownTimeout, func() {
+		if watcher != nil {
+			watcher.watcher.Close()
+		}
+		if acme != nil {
+			acme.close()
+		}
+		group.removeSockets()
+		if tracer != nil {
+			tracer.shutdown()
+		}
+	}))
 }
 
-func fileBasedHandler(c echo.Context) error {
-	path := c.Request().URL.Path
-	if path == "/" {
-		path = "/index"
+// setupShared sets up what every site the server builds shares: the
+// response and template caches, the render limiter, the template size
+// bounds and the session store, which is made for the session of the
+// first route config
+func (srv *server) setupShared(routes *RouteConfig) error {
+	cacheSize, err := bytes.Parse(srv.options.responseCacheSize)
+	if err != nil {
+		return fmt.Errorf("invalid --response-cache-size %q", srv.options.responseCacheSize)
+	}
+	if srv.responses, err = newResponseCache(srv.options.responseCacheEntries, cacheSize); err != nil {
+		return err
+	}
+
+	if !srv.options.noTemplateCache {
+		templateBytes, err := bytes.Parse(srv.options.templateCacheSize)
+		if err != nil {
+			return fmt.Errorf("invalid --template-cache-size %q", srv.options.templateCacheSize)
+		}
+		if srv.templates, err = newTemplateCache(srv.options.templateCacheEntries, templateBytes, srv.files); err != nil {
+			return err
+		}
 	}
 
-	// Remove leading slash and add .html extension
-	filename := strings.TrimPrefix(path, "/") + ".html"
+	if srv.largeTemplates, err = parseTemplateSizes(srv.options.maxTemplateSize, srv.options.rejectTemplateSize); err != nil {
+		return err
+	}
 
-	return processTemplate(c, filename)
-}
+	if srv.options.maxRenders < 0 || srv.options.renderQueueTimeout < 0 {
+		return fmt.Errorf("invalid --max-concurrent-renders %d or --render-queue-timeout %s", srv.options.maxRenders, srv.options.renderQueueTimeout)
+	}
+	if srv.options.maxRenders > 0 {
+		srv.renders = newRenderLimiter(srv.options.maxRenders, srv.options.renderQueueTimeout)
+	}
 
-func processTemplate(c echo.Context, filename string) error {
-	fullPath := filepath.Join(rootPath, filename)
+	if routes.Session != nil {
+		if srv.sessions, err = newSessionStore(routes.Session); err != nil {
+			return fmt.Errorf("session store: %v", err)
+		}
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return c.String(http.StatusNotFound, "File not found: "+filename)
+	if _, err := cacheControlValue(srv.options.wellKnownCache); err != nil {
+		return fmt.Errorf("invalid --well-known-cache: %v", err)
+	}
+	return nil
+}
+
+// setupInstance reports on what setupShared set up for the command: the
+// metrics of the caches and render limiter, and the session store among
+// the readiness checks. Expired sessions of a file store are removed
+// every 10 minutes. New leaves these to the program around the handler.
+func (srv *server) setupInstance(routes *RouteConfig) {
+	registerCacheMetrics(srv.responses)
+	if srv.templates != nil {
+		registerTemplateCacheMetrics(srv.templates)
 	}
+	if srv.renders != nil {
+		registerRenderMetrics(srv.renders)
+	}
+	if pinger, ok := srv.sessions.(interface{ Ping() error }); ok {
+		srv.health.addCheck("session store", pinger.Ping)
+	}
+	if srv.sessions != nil && routes.Session.Store == "file" {
+		go collectSessions(srv.sessions, 10*time.Minute)
+	}
+}
 
-	// Read template file
-	content, err := ioutil.ReadFile(fullPath)
+// setupSite builds the site of a route config on e: error handling, the
+// middleware routes share, well-known files and the routes themselves,
+// with the config, the options and the site flags. Listeners, logs, probes
+// and the instance endpoints are up to the caller, and setupShared is run
+// first.
+func (srv *server) setupSite(e *echo.Echo, routes *RouteConfig) (*site, error) {
+	s := &site{server: srv, e: e, routes: routes, root: srv.options.root, embedded: srv.options.embedded}
+	e.Pre(siteMiddleware(s), cleanPathMiddleware())
+	// Sends mounted files as well as those on disk
+	e.Filesystem = srv.files
+
+	proxies, err := parseCIDRs(srv.options.trustedProxies)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Error reading file: "+err.Error())
+		return nil, fmt.Errorf("invalid --trusted-proxies: %v", err)
+	}
+	// Use the peer address as the client IP unless it is a trusted proxy;
+	// forwarding headers from anyone else can be spoofed
+	e.IPExtractor = clientIPExtractor(proxies)
+	// Includes the message of internal errors in responses
+	e.Debug = srv.options.errorDetails
+	e.HTTPErrorHandler = errorHandler(e)
+	e.Use(recoverMiddleware())
+	if !srv.options.caching {
+		e.Use(noStoreMiddleware())
 	}
 
-	// Process JSP-like tags
-	processor := &TemplateProcessor{
-		rootPath: rootPath,
-		data:     make(map[string]interface{}),
-		embedded: false,
+	if srv.options.compress {
+		minSize, err := bytes.Parse(srv.options.compressMinSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --compress-min-size %q", srv.options.compressMinSize)
+		}
+		comp, err := newCompression(srv.options.gzipLevel, srv.options.brotliLevel, minSize)
+		if err != nil {
+			return nil, err
+		}
+		e.Use(compressMiddleware(comp))
+	}
+	if srv.browsers != nil {
+		setupLiveReload(e, srv.browsers)
 	}
 
-	// Add request data to template context
-	processor.data["request"] = c.Request()
-	processor.data["params"] = c.ParamValues()
-	processor.data["query"] = c.QueryParams()
-	processor.data["form"] = c.Request().Form
+	// The flag is the site-wide default, the config can override it
+	if routes.BodyLimit == "" {
+		if err := validateBodyLimit(srv.options.bodyLimit); err != nil {
+			return nil, fmt.Errorf("invalid --body-limit: %v", err)
+		}
+		routes.BodyLimit = srv.options.bodyLimit
+	}
+	if routes.Timeout == "" {
+		if err := validateTimeout(srv.options.timeout); err != nil {
+			return nil, fmt.Errorf("invalid --timeout: %v", err)
+		}
+		routes.Timeout = srv.options.timeout
+	}
+	if routes.IncludeLimit == "" {
+		if err := validateBodyLimit(srv.options.includeLimit); err != nil {
+			return nil, fmt.Errorf("invalid --include-limit: %v", err)
+		}
+		routes.IncludeLimit = srv.options.includeLimit
+	}
+	// Pages rendered outside of routes, such as error pages, get the site's limit
+	s.includeLimit = parseIncludeLimit(routes.IncludeLimit)
+	if routes.Minify == "" {
+		routes.Minify = strconv.FormatBool(srv.options.minifyOutput)
+	}
+	s.minify = routes.Minify == "true"
+	if err := validateCharset(srv.options.defaultCharset); err != nil {
+		return nil, fmt.Errorf("invalid --charset: %v", err)
+	}
 
-	processedContent, err := processor.processTemplate(string(content), c)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, "Template processing error: "+err.Error())
+	if srv.options.noFileRouting {
+		routes.FileRouting = "false"
+	}
+	if srv.options.securityHeaders && routes.Security == nil {
+		routes.Security = &Security{}
+	}
+	if routes.ErrorTemplate != "" && !srv.files.templateExists(s.root, routes.ErrorTemplate) {
+		return nil, fmt.Errorf("errorTemplate %s not found in %s", routes.ErrorTemplate, s.root)
+	}
+	s.errorTemplate = routes.ErrorTemplate
+	for _, name := range routes.listingTemplates() {
+		if !srv.files.templateExists(s.root, name) {
+			return nil, fmt.Errorf("listingTemplate %s not found in %s", name, s.root)
+		}
+	}
+	if err := routes.checkStaticDirs(s.root); err != nil {
+		return nil, err
+	}
+	if s.assets, err = routes.fingerprintStatics(srv.files); err != nil {
+		return nil, err
 	}
+	s.errorScopes = routes.errorScopes()
 
-	return c.HTML(http.StatusOK, processedContent)
-}
+	corsScopes, err := routes.corsScopes()
+	if err != nil {
+		return nil, err
+	}
+	e.Use(corsMiddleware(corsScopes))
 
-func (tp *TemplateProcessor) processTemplate(content string, c echo.Context) (string, error) {
-	// Process include tags first
-	content = tp.processIncludes(content)
+	if routes.Session != nil {
+		e.Use(sessionMiddleware(routes.Session, srv.sessions))
+	}
 
-	// Process code expression tags <%...%>
-	content = tp.processCodeExpressions(content, c)
+	// Before routing, so static files, 404s and error pages get them too
+	if security := routes.RouteSettings.inherit(RouteSettings{}).Security; security != nil {
+		e.Use(securityMiddleware(security.Headers()))
+	}
 
-	// Process output tags <%=...%>
-	content = tp.processOutputTags(content, c)
+	// Registered first, so routes for the same paths replace them
+	wellKnownDir := srv.options.wellKnownRoot
+	if wellKnownDir == "" {
+		wellKnownDir = s.root
+	}
+	setupWellKnown(e, wellKnownDir, srv.options.wellKnownCache)
 
-	return content, nil
+	s.setupHooks(routes.hooks)
+	s.setupRoutes(routes)
+	return s, nil
 }
 
-func (tp *TemplateProcessor) processIncludes(content string) string {
-	includeRegex := regexp.MustCompile(`<%@include\s+file="([^"]+)"\s*%>`)
+func loadRouteConfig(files *siteFS, configPath string) (*RouteConfig, error) {
+	data, err := files.readFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteConfig(files, configPath, data)
+}
 
-	return includeRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := includeRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
-		}
+// parseRouteConfig parses a config as if read from configPath, which its
+// imports and directories are relative to, reading its imports and the
+// files it names from files
+func parseRouteConfig(files *siteFS, configPath string, data []byte) (*RouteConfig, error) {
+	config, err := parseConfigFile(files, configPath, data, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
 
-		includeFile := matches[1]
-		includePath := filepath.Join(tp.rootPath, includeFile)
+	err = config.checkDuplicates()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
 
-		includeContent, err := ioutil.ReadFile(includePath)
-		if err != nil {
-			return fmt.Sprintf("<!-- Include error: %v -->", err)
-		}
+	return config, nil
+}
 
-		// Recursively process includes
-		return tp.processIncludes(string(includeContent))
-	})
+// loadConfigFile reads one config file and, recursively, its imports
+func loadConfigFile(files *siteFS, configPath string, visited map[string]bool) (*RouteConfig, error) {
+	data, err := files.readFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(files, configPath, data, visited)
 }
 
-func (tp *TemplateProcessor) processCodeExpressions(content string, c echo.Context) string {
-	codeRegex := regexp.MustCompile(`<%\s*([^=][^%]*)\s*%>`)
+// parseConfigFile parses one config file and, recursively, its imports
+func parseConfigFile(files *siteFS, configPath string, data []byte, visited map[string]bool) (*RouteConfig, error) {
+	if absPath, err := filepath.Abs(configPath); err == nil {
+		visited[absPath] = true
+	}
 
-	return codeRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := codeRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
+	// Resolve ${ENV} references before parsing so errors see real values,
+	// unless gosp compile did
+	if !files.configExpanded {
+		var err error
+		if data, err = expandConfigEnv(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", configPath, err)
 		}
+	}
 
-		code := strings.TrimSpace(matches[1])
+	var config RouteConfig
+	err := xml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
 
-		// Simple variable assignment processing
-		if strings.Contains(code, "=") {
-			parts := strings.SplitN(code, "=", 2)
-			if len(parts) == 2 {
-				varName := strings.TrimSpace(parts[0])
-				varValue := strings.TrimSpace(parts[1])
+	err = config.prepare(files, filepath.Dir(configPath))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
 
-				// Remove quotes if present
-				if strings.HasPrefix(varValue, "\"") && strings.HasSuffix(varValue, "\"") {
-					varValue = varValue[1 : len(varValue)-1]
-				}
+	config.tagSource(configPath)
+	config.files = []string{configPath}
 
-				tp.data[varName] = varValue
-			}
-		}
+	err = config.resolveImports(files, configPath, visited)
+	if err != nil {
+		return nil, err
+	}
 
-		return "" // Code blocks don't output content
-	})
+	return &config, nil
 }
 
-func (tp *TemplateProcessor) processOutputTags(content string, c echo.Context) string {
-	outputRegex := regexp.MustCompile(`<%=\s*([^%]+)\s*%>`)
+// prepare validates route and group settings and builds their runtime state
+func (config *RouteConfig) prepare(files *siteFS, baseDir string) error {
+	if err := config.RouteSettings.prepare(files, baseDir); err != nil {
+		return err
+	}
 
-	return outputRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := outputRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
+	for _, rewrite := range config.Rewrites {
+		if err := rewrite.prepare(); err != nil {
+			return err
 		}
+	}
 
-		expression := strings.TrimSpace(matches[1])
-
-		// Handle simple variable output
-		if value, exists := tp.data[expression]; exists {
-			return fmt.Sprintf("%v", value)
+	if config.TLS != nil {
+		if err := config.TLS.prepare(baseDir); err != nil {
+			return err
 		}
+	}
 
-		// Handle request parameters
-		if strings.HasPrefix(expression, "request.") {
-			return tp.handleRequestExpression(expression, c)
+	if config.CORS != nil {
+		if err := config.CORS.prepare(); err != nil {
+			return err
 		}
+	}
 
-		// Handle query parameters
-		if strings.HasPrefix(expression, "query.") {
-			paramName := strings.TrimPrefix(expression, "query.")
-			return c.QueryParam(paramName)
+	if config.Session != nil {
+		if err := config.Session.prepare(baseDir); err != nil {
+			return err
 		}
+	}
 
-		// Handle form parameters
-		if strings.HasPrefix(expression, "form.") {
-			paramName := strings.TrimPrefix(expression, "form.")
-			return c.FormValue(paramName)
+	if err := config.prepareHooks(); err != nil {
+		return err
+	}
+
+	for _, group := range config.Groups {
+		if err := group.prepare(files, baseDir); err != nil {
+			return fmt.Errorf("group %s: %v", group.Prefix, err)
+		}
+		if group.CORS != nil {
+			if err := group.CORS.prepare(); err != nil {
+				return fmt.Errorf("group %s: %v", group.Prefix, err)
+			}
+		}
+		// By index, as preparing resolves the provider
+		for i := range group.Routes {
+			if err := group.Routes[i].prepare(files, baseDir); err != nil {
+				return fmt.Errorf("route %s%s: %v", group.Prefix, group.Routes[i].Path, err)
+			}
+		}
+	}
+
+	for i := range config.Routes {
+		if err := config.Routes[i].prepare(files, baseDir); err != nil {
+			return fmt.Errorf("route %s: %v", config.Routes[i].Path, err)
+		}
+	}
+
+	// By index, as preparing resolves the directories
+	for i := range config.Statics {
+		if err := config.Statics[i].prepare(baseDir); err != nil {
+			return err
+		}
+	}
+	for i := range config.Groups {
+		for j := range config.Groups[i].Statics {
+			if err := config.Groups[i].Statics[j].prepare(baseDir); err != nil {
+				return fmt.Errorf("group %s: %v", config.Groups[i].Prefix, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepare validates the route type and aliases before preparing its settings
+func (route *Route) prepare(files *siteFS, baseDir string) error {
+	switch route.Type {
+	case "", "html", "json":
+	default:
+		return fmt.Errorf("invalid type %q, expected html or json", route.Type)
+	}
+
+	if err := route.validateAliases(); err != nil {
+		return err
+	}
+
+	if err := route.prepareProvider(); err != nil {
+		return err
+	}
+
+	return route.RouteSettings.prepare(files, baseDir)
+}
+
+func (settings *RouteSettings) prepare(files *siteFS, baseDir string) error {
+	if _, err := cacheControlValue(settings.Cache); err != nil {
+		return err
+	}
+
+	switch settings.TrailingSlash {
+	case "", "serve-both", "redirect-to-slash", "redirect-to-no-slash":
+	default:
+		return fmt.Errorf("invalid trailingSlash %q: expected serve-both, redirect-to-slash or redirect-to-no-slash", settings.TrailingSlash)
+	}
+
+	switch settings.CaseInsensitive {
+	case "", "true", "false", "redirect":
+	default:
+		return fmt.Errorf("invalid caseInsensitive %q: expected true, false or redirect", settings.CaseInsensitive)
+	}
+
+	switch settings.FileRouting {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid fileRouting %q: expected true or false", settings.FileRouting)
+	}
+
+	switch settings.ETag {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid etag %q: expected true or false", settings.ETag)
+	}
+
+	switch settings.Minify {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid minify %q: expected true or false", settings.Minify)
+	}
+
+	switch settings.Errors {
+	case "", "auto", "json", "html":
+	default:
+		return fmt.Errorf("invalid errors %q: expected auto, json or html", settings.Errors)
+	}
+
+	if err := validateExcludePatterns(settings.ExcludePatterns()); err != nil {
+		return err
+	}
+
+	if err := validateBodyLimit(settings.BodyLimit); err != nil {
+		return fmt.Errorf("invalid bodyLimit: %v", err)
+	}
+
+	if err := validateBodyLimit(settings.IncludeLimit); err != nil {
+		return fmt.Errorf("invalid includeLimit: %v", err)
+	}
+
+	if err := validateTimeout(settings.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %v", err)
+	}
+
+	if err := validateTimeout(settings.ResponseCache); err != nil {
+		return fmt.Errorf("invalid responseCache: %v", err)
+	}
+
+	if settings.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(settings.ContentType); err != nil {
+			serverLog.Warn("Malformed content type", "value", settings.ContentType, "err", err)
+		}
+	}
+
+	if err := validateCharset(settings.Charset); err != nil {
+		return fmt.Errorf("invalid charset: %v", err)
+	}
+
+	if settings.Auth != nil {
+		if err := settings.Auth.loadCredentials(files, baseDir); err != nil {
+			return err
+		}
+	}
+
+	if settings.Access != nil {
+		if err := settings.Access.prepare(); err != nil {
+			return err
+		}
+	}
+
+	if settings.RateLimit != nil {
+		if err := settings.RateLimit.prepare(); err != nil {
+			return err
+		}
+	}
+
+	if settings.Security != nil {
+		if err := settings.Security.prepare(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inherit fills unset settings from the (already resolved) parent. Headers
+// are merged, with the cache policy and explicit headers of the child
+// overriding the parent's.
+func (settings RouteSettings) inherit(parent RouteSettings) RouteSettings {
+	own := settings.Headers
+	if value, _ := cacheControlValue(settings.Cache); value != "" {
+		own = mergeHeaders([]Header{{Name: "Cache-Control", Value: value}}, own)
+	}
+	if settings.ContentType != "" {
+		own = mergeHeaders([]Header{{Name: echo.HeaderContentType, Value: settings.ContentType}}, own)
+	}
+	settings.Headers = mergeHeaders(parent.Headers, own)
+
+	if settings.Cache == "" {
+		settings.Cache = parent.Cache
+	}
+	if settings.ContentType == "" {
+		settings.ContentType = parent.ContentType
+	}
+	if settings.FileRouting == "" {
+		settings.FileRouting = parent.FileRouting
+	}
+	if settings.Exclude == "" {
+		settings.Exclude = parent.Exclude
+	}
+	if settings.Index == "" {
+		settings.Index = parent.Index
+	}
+	if settings.TrailingSlash == "" {
+		settings.TrailingSlash = parent.TrailingSlash
+	}
+	if settings.CaseInsensitive == "" {
+		settings.CaseInsensitive = parent.CaseInsensitive
+	}
+	if settings.BodyLimit == "" {
+		settings.BodyLimit = parent.BodyLimit
+	}
+	if settings.ETag == "" {
+		settings.ETag = parent.ETag
+	}
+	if settings.Charset == "" {
+		settings.Charset = parent.Charset
+	}
+	if settings.IncludeLimit == "" {
+		settings.IncludeLimit = parent.IncludeLimit
+	}
+	if settings.Minify == "" {
+		settings.Minify = parent.Minify
+	}
+	if settings.ResponseCache == "" {
+		settings.ResponseCache = parent.ResponseCache
+	}
+	if settings.Timeout == "" {
+		settings.Timeout = parent.Timeout
+	}
+	if settings.TimeoutTemplate == "" {
+		settings.TimeoutTemplate = parent.TimeoutTemplate
+	}
+	if settings.Errors == "" {
+		settings.Errors = parent.Errors
+	}
+	if settings.Auth == nil {
+		settings.Auth = parent.Auth
+	}
+	if settings.Access == nil {
+		settings.Access = parent.Access
+	}
+	if settings.RateLimit == nil {
+		settings.RateLimit = parent.RateLimit
+	}
+	if settings.Security == nil {
+		settings.Security = parent.Security
+	} else {
+		settings.Security = settings.Security.merge(parent.Security)
+	}
+
+	return settings
+}
+
+// validateBodyLimit checks a size such as "512K" or "20M" as accepted by
+// Echo's BodyLimit middleware
+func validateBodyLimit(limit string) error {
+	if limit == "" {
+		return nil
+	}
+	size, err := bytes.Parse(limit)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("%q must be positive", limit)
+	}
+	return nil
+}
+
+// cacheControlValue translates a cache attribute (a preset or a duration)
+// into a Cache-Control header value
+func cacheControlValue(cache string) (string, error) {
+	switch cache {
+	case "":
+		return "", nil
+	case "no-store", "no-cache":
+		return cache, nil
+	case "private":
+		return "private, no-cache", nil
+	case "immutable":
+		return "public, max-age=31536000, immutable", nil
+	}
+
+	duration, err := time.ParseDuration(cache)
+	if err != nil || duration < 0 {
+		return "", fmt.Errorf("invalid cache policy %q: expected no-store, no-cache, private, immutable or a duration", cache)
+	}
+
+	return fmt.Sprintf("public, max-age=%d", int(duration.Seconds())), nil
+}
+
+var (
+	attrValueRegex = regexp.MustCompile(`=\s*("[^"]*"|'[^']*')`)
+	envRefRegex    = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+// expandConfigEnv substitutes ${NAME} and ${NAME:-default} references
+// inside attribute values of the raw route config. As in the shell, the
+// default also stands in for a variable set to the empty string.
+func expandConfigEnv(data []byte) ([]byte, error) {
+	var missing []string
+
+	expanded := attrValueRegex.ReplaceAllFunc(data, func(attr []byte) []byte {
+		return envRefRegex.ReplaceAllFunc(attr, func(ref []byte) []byte {
+			matches := envRefRegex.FindSubmatch(ref)
+			name := string(matches[1])
+
+			value, ok := os.LookupEnv(name)
+			if ok && (value != "" || len(matches[2]) == 0) {
+				return []byte(xmlEscapeAttr(value))
+			}
+			if len(matches[2]) > 0 {
+				return matches[3]
+			}
+
+			missing = append(missing, name)
+			return ref
+		})
+	})
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variable(s) not set: %s", strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+func xmlEscapeAttr(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return strings.ReplaceAll(b.String(), "'", "&#39;")
+}
+
+// resolveRoutes flattens groups into a single route list, applying the
+// group prefix and merging group settings into each route. Every group also
+// gets catch-all routes (empty File) for its prefix so file-based pages under
+// it receive the group settings, and the list ends with the global catch-all.
+func (config *RouteConfig) resolveRoutes() []Route {
+	var resolved []Route
+	global := config.RouteSettings.inherit(RouteSettings{})
+
+	for _, route := range config.Routes {
+		route.RouteSettings = route.inherit(global)
+		resolved = append(resolved, route.withAliases("")...)
+	}
+
+	for _, spa := range config.SPAs {
+		resolved = append(resolved, spaRoutes(spa, "", global)...)
+	}
+
+	for _, static := range config.Statics {
+		resolved = append(resolved, staticRoutes(static, "", global)...)
+	}
+
+	for _, group := range config.Groups {
+		groupSettings := group.inherit(global)
+
+		for _, route := range group.Routes {
+			route.RouteSettings = route.inherit(groupSettings)
+			resolved = append(resolved, route.withAliases(group.Prefix)...)
+		}
+
+		for _, spa := range group.SPAs {
+			resolved = append(resolved, spaRoutes(spa, group.Prefix, groupSettings)...)
+		}
+
+		for _, static := range group.Statics {
+			resolved = append(resolved, staticRoutes(static, group.Prefix, groupSettings)...)
+		}
+
+		if !groupSettings.fileRoutingEnabled() {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(group.Prefix, "/")
+		if groupSettings.isCaseInsensitive() {
+			prefix = lowerStaticSegments(prefix)
+		}
+		if prefix != "" {
+			resolved = append(resolved, Route{
+				Path:          prefix,
+				Methods:       []string{"ANY"},
+				RouteSettings: groupSettings,
+			})
+		}
+		resolved = append(resolved, Route{
+			Path:          prefix + "/*",
+			Methods:       []string{"ANY"},
+			RouteSettings: groupSettings,
+		})
+	}
+
+	// Setup catch-all route for file-based routing
+	if global.fileRoutingEnabled() {
+		resolved = append(resolved, Route{
+			Path:          "/*",
+			Methods:       []string{"ANY"},
+			RouteSettings: global,
+		})
+	}
+
+	return resolved
+}
+
+// normalizeCase lowercases the path of case-insensitive routes, matching
+// the lowercased request paths produced by caseInsensitiveMiddleware
+func (route Route) normalizeCase() Route {
+	if route.isCaseInsensitive() {
+		route.Path = lowerStaticSegments(route.Path)
+	}
+	return route
+}
+
+// mergeHeaders combines header lists, later lists overriding earlier ones
+func mergeHeaders(lists ...[]Header) []Header {
+	var merged []Header
+	index := make(map[string]int)
+
+	for _, list := range lists {
+		for _, header := range list {
+			key := http.CanonicalHeaderKey(header.Name)
+			if i, exists := index[key]; exists {
+				merged[i] = header
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, header)
+		}
+	}
+
+	return merged
+}
+
+func headersMiddleware(headers []Header) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, header := range headers {
+				c.Response().Header().Set(header.Name, header.Value)
+			}
+			return next(c)
+		}
+	}
+}
+
+// routeMiddleware builds the middleware chain applied before a route's handler
+func (s *site) routeMiddleware(route Route) []echo.MiddlewareFunc {
+	var middlewares []echo.MiddlewareFunc
+
+	// First, so rejections by the others are answered in the route's format
+	if format := route.errorFormat(); format != "" {
+		middlewares = append(middlewares, errorFormatMiddleware(format))
+	}
+	if route.Charset != "" {
+		middlewares = append(middlewares, charsetMiddleware(route.Charset))
+	}
+	if route.IncludeLimit != "" {
+		middlewares = append(middlewares, includeLimitMiddleware(parseIncludeLimit(route.IncludeLimit)))
+	}
+	if route.Minify != "" {
+		middlewares = append(middlewares, minifyMiddleware(route.Minify == "true"))
+	}
+
+	// Applied again, since groups and routes can override the site's.
+	// Explicit headers still win.
+	if route.Security != nil {
+		middlewares = append(middlewares, securityMiddleware(route.Security.Headers()))
+	}
+	middlewares = append(middlewares, headersMiddleware(route.Headers))
+
+	// Rejected clients never see the authentication prompt
+	if route.Access != nil {
+		middlewares = append(middlewares, accessMiddleware(route.Access))
+	}
+
+	if route.Auth != nil {
+		middlewares = append(middlewares, authMiddleware(route.Auth))
+	}
+
+	if route.RateLimit != nil {
+		middlewares = append(middlewares, rateLimitMiddleware(route.RateLimit))
+	}
+
+	// Oversized bodies get a 413 from the Content-Length, or once reading
+	// passes the limit, so they are never buffered whole
+	if route.BodyLimit != "" {
+		middlewares = append(middlewares, middleware.BodyLimit(route.BodyLimit))
+	}
+
+	if route.Timeout != "" {
+		timeout, _ := time.ParseDuration(route.Timeout)
+		middlewares = append(middlewares, timeoutMiddleware(timeout, route.TimeoutTemplate))
+	}
+
+	// Inside everything that may reject the request, so the tag covers
+	// exactly what was rendered
+	if route.ETag == "true" {
+		middlewares = append(middlewares, etagMiddleware())
+	}
+
+	if route.ResponseCache != "" && s.options.caching {
+		ttl, _ := time.ParseDuration(route.ResponseCache)
+		middlewares = append(middlewares, responseCacheMiddleware(s.responses, ttl, !s.embedded))
+	}
+
+	return middlewares
+}
+
+// setupRoutes registers the routes of a route config on the site's Echo
+// instance, their handlers closing over the site
+func (s *site) setupRoutes(routes *RouteConfig) {
+	e := s.e
+	// Apply rewrite rules before routing
+	if len(routes.Rewrites) > 0 {
+		e.Pre(rewriteMiddleware(routes.Rewrites))
+	}
+
+	// Lowercase paths before routing where matching is case-insensitive
+	if scopes := routes.caseScopes(); scopes != nil {
+		warnCaseCollisions(s.files.templateNames(s.root))
+		e.Pre(caseInsensitiveMiddleware(scopes))
+	}
+
+	// Setup configured routes. Registering in reverse precedence order lets
+	// higher precedence routes replace lower ones sharing a method and path.
+	effective := routes.effectiveRoutes()
+	allowed := make(map[string]*allowedMethods)
+	var paths []string
+	for i := len(effective) - 1; i >= 0; i-- {
+		route := effective[i]
+		handler := s.createHandler(route)
+		middlewares := s.routeMiddleware(route)
+
+		for _, method := range route.Methods {
+			switch strings.ToUpper(method) {
+			case "GET":
+				e.GET(route.Path, handler, middlewares...)
+				// HEAD takes the same route, instead of the catch-all, and
+				// renders the page once for its headers
+				e.HEAD(route.Path, handler, middlewares...)
+			case "HEAD":
+				e.HEAD(route.Path, handler, middlewares...)
+			case "OPTIONS":
+				e.OPTIONS(route.Path, handler, middlewares...)
+			case "POST":
+				e.POST(route.Path, handler, middlewares...)
+			case "PUT":
+				e.PUT(route.Path, handler, middlewares...)
+			case "DELETE":
+				e.DELETE(route.Path, handler, middlewares...)
+			case "PATCH":
+				e.PATCH(route.Path, handler, middlewares...)
+			case "ANY":
+				e.Any(route.Path, handler, middlewares...)
+			}
+		}
+
+		methods, exists := allowed[route.Path]
+		if !exists {
+			methods = &allowedMethods{}
+			allowed[route.Path] = methods
+			paths = append(paths, route.Path)
 		}
+		methods.add(route.Methods, middlewares)
+	}
 
-		// Handle simple expressions (this uses strconv)
-		if strings.Contains(expression, "+") {
-			return tp.evaluateSimpleExpression(expression)
+	// OPTIONS lists the methods of each path in Allow, unless a route
+	// answers it itself
+	for _, path := range paths {
+		if methods := allowed[path]; !methods.explicit {
+			e.OPTIONS(path, optionsHandler(methods.header()), methods.middlewares...)
 		}
+	}
+}
+
+func (s *site) createHandler(route Route) echo.HandlerFunc {
+	if route.File == "" {
+		return s.fileBasedHandler(route.RouteSettings)
+	}
+
+	if primary := route.AliasRedirect(); primary != "" {
+		return aliasRedirectHandler(primary)
+	}
 
-		return expression // Return as-is if not recognized
+	if route.spa != nil {
+		return spaHandler(route.spa)
+	}
+
+	if route.static != nil {
+		return staticHandler(route.static, route.IndexFiles(s.files.pageExtensions()))
+	}
+
+	if route.Type == "json" {
+		return withProvider(route, func(c echo.Context) error {
+			return renderJSON(c, route.File)
+		})
+	}
+
+	return withProvider(route, func(c echo.Context) error {
+		return servePage(c, route.File)
 	})
 }
 
+// fileBasedHandler maps the request path onto a template under the root,
+// applying the index documents and trailing-slash policy of the settings
+func (s *site) fileBasedHandler(settings RouteSettings) echo.HandlerFunc {
+	resolver := templateResolver{
+		indexFiles:      settings.IndexFiles(s.files.pageExtensions()),
+		extensions:      s.files.pageExtensions(),
+		caseInsensitive: settings.isCaseInsensitive(),
+		files:           s.files,
+	}
+	exclude := settings.ExcludePatterns()
+
+	return func(c echo.Context) error {
+		path := c.Request().URL.Path
+
+		// The tenant of the request decides where templates are found
+		resolver := resolver
+		resolver.roots = s.templateRoots(c)
+
+		switch settings.TrailingSlash {
+		case "redirect-to-no-slash":
+			if path != "/" && strings.HasSuffix(path, "/") {
+				return redirectPreservingQuery(c, strings.TrimRight(path, "/"))
+			}
+		case "redirect-to-slash":
+			if !strings.HasSuffix(path, "/") && resolver.findPage(strings.TrimPrefix(path, "/")) == "" &&
+				resolver.findIndexFile(strings.TrimPrefix(path, "/")+"/") != "" {
+				return redirectPreservingQuery(c, path+"/")
+			}
+		}
+
+		file := resolver.resolve(path)
+		if isExcluded(exclude, file) {
+			// Same response as a missing file, so excluded files stay hidden
+			return notFound(c, "File not found: "+file)
+		}
+		return servePage(c, file)
+	}
+}
+
+// IndexFiles returns the configured index documents in lookup order,
+// defaulting to index with each of the page extensions
+func (settings RouteSettings) IndexFiles(extensions []string) []string {
+	if settings.Index == "" {
+		var files []string
+		for _, ext := range extensions {
+			files = append(files, "index"+ext)
+		}
+		return files
+	}
+
+	var files []string
+	for _, file := range strings.Split(settings.Index, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// templateResolver finds the template file for a URL path
+type templateResolver struct {
+	indexFiles      []string
+	extensions      []string
+	caseInsensitive bool
+
+	// Directories searched, in order, and the files they are read from
+	roots []string
+	files *siteFS
+}
+
+// resolve finds the template for a URL path. Paths ending in "/" try the
+// index documents first, others try the page extensions first; each then
+// falls back to the other form.
+func (r templateResolver) resolve(path string) string {
+	name := strings.TrimPrefix(path, "/")
+	dir := strings.TrimSuffix(name, "/")
+
+	if name == "" || strings.HasSuffix(name, "/") {
+		if index := r.findIndexFile(name); index != "" {
+			return index
+		}
+		if dir != "" {
+			if file := r.findPage(dir); file != "" {
+				return file
+			}
+		}
+		return name + r.indexFiles[0]
+	}
+
+	if file := r.findPage(name); file != "" {
+		return file
+	}
+	if index := r.findIndexFile(name + "/"); index != "" {
+		return index
+	}
+	return name + r.extensions[0]
+}
+
+// findPage tries each page extension in order for an extensionless name
+func (r templateResolver) findPage(name string) string {
+	for _, ext := range r.extensions {
+		if file, ok := r.lookup(name + ext); ok {
+			return file
+		}
+	}
+	return ""
+}
+
+func (r templateResolver) findIndexFile(dir string) string {
+	for _, index := range r.indexFiles {
+		if file, ok := r.lookup(dir + index); ok {
+			return file
+		}
+	}
+	return ""
+}
+
+// lookup returns the actual name of a template, folding case if enabled
+func (r templateResolver) lookup(filename string) (string, bool) {
+	if _, ok := r.files.findInRoots(r.roots, filename); ok {
+		return filename, true
+	}
+	if r.caseInsensitive {
+		for _, root := range r.roots {
+			if name, ok := r.files.findFoldedPath(root, filename); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// templateExists reports whether a template is a file under root
+func (f *siteFS) templateExists(root, filename string) bool {
+	info, err := f.statRootFile(filepath.Join(root, filename))
+	return err == nil && !info.IsDir()
+}
+
+// redirectPreservingQuery issues a permanent redirect keeping the query string
+func redirectPreservingQuery(c echo.Context, path string) error {
+	// A single leading slash keeps "//host" paths from becoming external
+	// redirects. Browsers take a backslash for a slash and drop tabs and
+	// line breaks, so "/\host" and "/\t/host" are such paths too.
+	path = "/" + strings.TrimLeft(path, "/\\\t\r\n")
+	if query := c.Request().URL.RawQuery; query != "" {
+		path += "?" + query
+	}
+	return c.Redirect(http.StatusMovedPermanently, path)
+}
+
+func processTemplate(c echo.Context, filename string) error {
+	return renderTemplate(c, filename, http.StatusOK)
+}
+
+// renderTemplate processes a template and responds with the given status
+func renderTemplate(c echo.Context, filename string, status int) error {
+	defer renderAsGet(c)()
+	site := siteOf(c)
+	fullPath, ok := templatePath(c, filename)
+
+	// Check if file exists
+	info, err := site.files.statRootFile(fullPath)
+	if !ok || os.IsNotExist(err) {
+		return notFound(c, "File not found: "+filename)
+	}
+	// Too large to read whole and parse
+	if err == nil && !site.largeTemplates.processes(info.Size()) {
+		return site.largeTemplates.serveLarge(c, filename, fullPath, info)
+	}
+
+	// Pages holding no tags are sent as they were cached, without taking a
+	// render slot or a processor, unless hooks want to see them
+	roots := site.templateRoots(c)
+	cached := site.templates.lookup(templateKey(fullPath, roots))
+	if page := cached.plainWithin(includeLimitOf(c)); page != nil && len(site.beforeHooks) == 0 && len(site.afterHooks) == 0 {
+		c.Set(templateNameKey, filename)
+		if sent, err := servePlain(c, status, page); sent {
+			recordDependencies(c, fullPath)
+			return err
+		}
+	}
+
+	// Queued before reading the file, so waiting requests hold no memory,
+	// and released once rendered, so slow clients don't keep the slot
+	release, err := site.renders.hold(c.Request().Context())
+	if err == errRendersBusy {
+		return site.renders.reject(c)
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	c.Set(templateNameKey, filename)
+	ctx, span := startSpan(c.Request().Context(), "render "+filename)
+	span.setAttr("template.path", filename)
+
+	// Process JSP-like tags, with a processor given back once the page is
+	// written
+	processor := site.newProcessor(ctx)
+	defer processor.recycle()
+	processor.roots = roots
+	processor.includeLimit = includeLimitOf(c)
+	// Content type configured on the route, if any
+	processor.contentType = c.Response().Header().Get(echo.HeaderContentType)
+
+	// Add request data to template context
+	processor.data["request"] = c.Request()
+	processor.data["params"] = c.ParamValues()
+	processor.data["query"] = c.QueryParams()
+	processor.data["form"] = c.Request().Form
+	if values, ok := c.Get(templateValuesKey).(map[string]interface{}); ok {
+		for key, value := range values {
+			processor.data[key] = value
+		}
+	}
+	if err := site.beforeRender(ctx, filename, processor.data); err != nil {
+		release()
+		span.finish(err)
+		return serveError(c, errorReport{message: "Render hook error", err: err, template: filename})
+	}
+
+	// Parsed once for as long as its files don't change
+	parsed, err := processor.loadCached(cached, fullPath, filename)
+	if err != nil {
+		release()
+		span.finish(err)
+		if isInterruption(err) {
+			logCancelled(c, filename, err)
+			return err
+		}
+		return serveError(c, errorReport{message: loadErrorMessage(err), err: err, template: filename})
+	}
+	span.setAttr("template.size", parsed.Size)
+
+	// All code runs before the first byte is written, so its errors still
+	// get an error page. Long pages stream as they render.
+	processor.run(parsed, c)
+	contentType, encoder := responseEncoding(c, processor.contentType, processor.charset)
+	page := newPageWriter(c, status, contentType, encoder, processor.output)
+	page.minify = processor.minify && isHTML(contentType)
+	// AfterRender hooks take the whole page
+	page.hold = len(site.afterHooks) > 0
+	err = processor.writeOutput(page, c)
+	// The processor keeps its buffer for the next render, not the output
+	// hooks return
+	processor.output = page.buffer
+	if err == nil && page.hold {
+		page.buffer, err = site.afterRender(ctx, filename, page.buffer)
+	}
+	if err == nil {
+		// A page that started streaming holds its slot until it's sent
+		if !page.started() {
+			release()
+		}
+		err = page.close()
+	}
+	release()
+	span.setAttr("template.output_size", page.written)
+	span.finish(err)
+	recordDependencies(c, append([]string{fullPath}, processor.includes...)...)
+	if isInterruption(err) {
+		logCancelled(c, filename, err)
+		return err
+	}
+	if err != nil && c.Response().Committed {
+		// Too late for an error page, the body ends where it stopped
+		renderLog.Warn("Response truncated", "template", filename, "request_id", requestID(c), "err", err)
+		return nil
+	}
+	if err != nil {
+		return serveError(c, errorReport{message: "Template processing error", err: err, template: filename, includes: processor.includes})
+	}
+	return nil
+}
+
+// renderAsGet has a HEAD request render as the GET of the same URL, so the
+// headers match those of the GET, Content-Length included, and a response
+// cached by the HEAD is the page the GET gets. The server drops the body.
+// The request is given back once rendered, for the access log.
+func renderAsGet(c echo.Context) func() {
+	req := c.Request()
+	if req.Method != http.MethodHead {
+		return func() {}
+	}
+	get := *req
+	get.Method = http.MethodGet
+	c.SetRequest(&get)
+	return func() { c.SetRequest(req) }
+}
+
+// runCode runs a code tag outside of the if block syntax
+func (tp *TemplateProcessor) runCode(code string, c echo.Context) {
+	// Session changes, saved before the response is written
+	if strings.HasPrefix(code, "session.") {
+		tp.handleSessionCode(strings.TrimPrefix(code, "session."), c)
+		return
+	}
+
+	// Simple variable assignment processing
+	if name, value, ok := engine.Assignment(code); ok {
+		tp.data[name] = value
+	}
+}
+
+func (tp *TemplateProcessor) evaluateOutput(expression string, c echo.Context) string {
+	// Handle simple variable output, strings without going through fmt
+	if value, exists := tp.data[expression]; exists {
+		if s, ok := value.(string); ok {
+			return s
+		}
+		return fmt.Sprintf("%v", value)
+	}
+
+	// Handle the Content-Security-Policy nonce of the request
+	if expression == "cspNonce()" {
+		return cspNonce(c)
+	}
+
+	// Handle the trace ID, e.g. for error pages
+	if expression == "traceId()" {
+		return traceID(c.Request().Context())
+	}
+
+	// Handle the request ID, also sent as X-Request-ID
+	if expression == "requestId()" {
+		return requestID(c)
+	}
+
+	// Handle the hashed URL of a fingerprinted static file
+	if name, ok := assetArgument(expression); ok {
+		return assetURL(c, name)
+	}
+
+	// Handle request parameters
+	if strings.HasPrefix(expression, "request.") {
+		return tp.handleRequestExpression(expression, c)
+	}
+
+	// Handle claims of the verified JWT
+	if strings.HasPrefix(expression, "jwt.") {
+		value, _ := lookupClaim(c, strings.TrimPrefix(expression, "jwt."))
+		return engine.FormatValue(value)
+	}
+
+	// Handle the name of the API key of the caller
+	if expression == "apikey.name" {
+		c.Set(apiKeyNameUsedKey, true)
+		name, _ := c.Get(apiKeyNameKey).(string)
+		return name
+	}
+
+	// Handle session values
+	if strings.HasPrefix(expression, "session.") {
+		if session := sessionFor(c); session != nil {
+			return session.get(strings.TrimPrefix(expression, "session."))
+		}
+		return ""
+	}
+
+	// Handle query parameters
+	if strings.HasPrefix(expression, "query.") {
+		paramName := strings.TrimPrefix(expression, "query.")
+		return c.QueryParam(paramName)
+	}
+
+	// Handle form parameters
+	if strings.HasPrefix(expression, "form.") {
+		paramName := strings.TrimPrefix(expression, "form.")
+		// A streamed body passing the body limit fails the render with 413,
+		// rather than reading as an empty form
+		var tooLarge *echo.HTTPError
+		if _, err := c.FormParams(); errors.As(err, &tooLarge) && tooLarge.Code == http.StatusRequestEntityTooLarge && tp.err == nil {
+			tp.err = tooLarge
+		}
+		return c.FormValue(paramName)
+	}
+
+	// Handle string literals, such as <%= "2024-01-01" %>
+	if n := len(expression); n >= 2 && expression[0] == '"' && expression[n-1] == '"' && !strings.Contains(expression[1:n-1], `"`) {
+		return expression[1 : n-1]
+	}
+
+	// Handle simple expressions (this uses strconv)
+	if strings.Contains(expression, "+") {
+		return tp.evaluateSimpleExpression(expression)
+	}
+
+	return expression // Return as-is if not recognized
+}
+
 func (tp *TemplateProcessor) handleRequestExpression(expression string, c echo.Context) string {
 	switch expression {
 	case "request.method":
@@ -337,496 +2038,660 @@ func (tp *TemplateProcessor) handleRequestExpression(expression string, c echo.C
 		return c.Request().Host
 	case "request.remoteaddr":
 		return c.Request().RemoteAddr
+	case "request.ip":
+		return c.RealIP()
+	case "request.originalpath":
+		return originalPath(c)
 	default:
 		return expression
 	}
 }
 
-func (tp *TemplateProcessor) evaluateSimpleExpression(expression string) string {
-	// Simple arithmetic evaluation (this function uses strconv)
-	parts := strings.Split(expression, "+")
-	if len(parts) == 2 {
-		left := strings.TrimSpace(parts[0])
-		right := strings.TrimSpace(parts[1])
+func (tp *TemplateProcessor) evaluateSimpleExpression(expression string) string {
+	// Simple arithmetic evaluation (this function uses strconv)
+	if left, right, ok := strings.Cut(expression, "+"); ok && !strings.Contains(right, "+") {
+		left = strings.TrimSpace(left)
+		right = strings.TrimSpace(right)
+
+		// Try numeric addition
+		if leftVal, ok := atoi(left); ok {
+			if rightVal, ok := atoi(right); ok {
+				return strconv.Itoa(leftVal + rightVal)
+			}
+		}
+
+		// String concatenation fallback
+		return left + right
+	}
+
+	// Try simple number parsing for single values
+	if val, ok := atoi(strings.TrimSpace(expression)); ok {
+		return strconv.Itoa(val)
+	}
+
+	return expression
+}
+
+// atoi parses an integer, skipping strconv for operands that can't be one,
+// as the error it returns for them is allocated
+func atoi(s string) (int, bool) {
+	if s == "" || (s[0] != '-' && s[0] != '+' && (s[0] < '0' || s[0] > '9')) {
+		return 0, false
+	}
+	val, err := strconv.Atoi(s)
+	return val, err == nil
+}
+
+func (srv *server) setupFileWatcher(routes *RouteConfig, ignore, extraDirs []string) (*FileWatcher, error) {
+	rootPath := srv.options.root
+	fw := &FileWatcher{
+		rootPath:  rootPath,
+		server:    srv,
+		ignore:    ignore,
+		extraDirs: extraDirs,
+	}
+	if srv.options.validateOnStart {
+		fw.validation = &revalidation{server: srv}
+	}
+
+	// Add the root directory and all subdirectories, the tenants and the
+	// directories of --watch-dir
+	fw.roots = []string{rootPath}
+	if srv.options.tenantsDir != "" {
+		fw.roots = append(fw.roots, srv.options.tenantsDir)
+	}
+	fw.roots = append(fw.roots, extraDirs...)
+	if err := fw.watchRoots(fw.roots); err != nil {
+		return nil, err
+	}
+
+	fw.follow(routes)
+
+	watcherLog.Info("Watching", "mode", fw.mode, "roots", strings.Join(fw.roots, ","), "dirs", fw.watchedDirs(), "ignore", strings.Join(ignore, ","))
+	return fw, nil
+}
+
+// follow watches the files of the route config served: the config, its
+// imports and the API keys files, in place of those of the one before.
+// Watches of files no longer used stay, their events being ignored.
+func (fw *FileWatcher) follow(routes *RouteConfig) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.configFiles = make(map[string]bool)
+	for _, file := range routes.files {
+		if err := fw.watcher.Add(file); err != nil {
+			watcherLog.Warn("Could not watch config file", "file", file, "err", err)
+			continue
+		}
+		fw.configFiles[filepath.Clean(file)] = true
+	}
+
+	fw.keyFiles = make(map[string][]*Auth)
+	for _, auth := range routes.apiKeyFiles() {
+		file := filepath.Clean(auth.keysPath)
+		if len(fw.keyFiles[file]) == 0 {
+			if err := fw.watcher.Add(file); err != nil {
+				watcherLog.Warn("Could not watch keys file", "file", file, "err", err)
+				continue
+			}
+		}
+		fw.keyFiles[file] = append(fw.keyFiles[file], auth)
+	}
+
+	// Files of fingerprinted mounts are hashed again as they change
+	for _, dir := range routes.fingerprintedDirs() {
+		if err := fw.addTree(dir); err != nil {
+			watcherLog.Warn("Could not watch static dir", "dir", dir, "err", err)
+		}
+	}
+
+	if fw.validation != nil {
+		fw.validation.follow(routes)
+	}
+}
+
+// watchedFiles returns how the files of the config are followed: whether a
+// path is a config file, or the auths of an API keys file
+func (fw *FileWatcher) watchedFiles(path string) (bool, []*Auth) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	path = filepath.Clean(path)
+	return fw.configFiles[path], fw.keyFiles[path]
+}
+
+// watchFiles handles the watcher's events until it is closed. Those of the
+// files of the config, which debounce their own reloads, are handled right
+// away, the others once their path has been quiet for --watch-debounce.
+func (fw *FileWatcher) watchFiles() {
+	queue := newEventQueue(fw.server.options.watchDebounce)
+	for {
+		select {
+		case event, ok := <-fw.watcher.events():
+			if !ok {
+				return
+			}
+
+			config, auths := fw.watchedFiles(event.Name)
+			if config {
+				fw.reloadConfig(event)
+				continue
+			}
+			if auths != nil {
+				fw.reloadAPIKeys(event, auths)
+				continue
+			}
+			if fw.ignores(event.Name) {
+				continue
+			}
+
+			if fw.server.options.watchDebounce <= 0 {
+				fw.changed(event)
+				fw.refreshBrowsers([]fsnotify.Event{event})
+				fw.runHooks([]fsnotify.Event{event})
+				fw.publish([]fsnotify.Event{event})
+				continue
+			}
+			queue.add(event)
 
-		// Try numeric addition
-		if leftVal, err1 := strconv.Atoi(left); err1 == nil {
-			if rightVal, err2 := strconv.Atoi(right); err2 == nil {
-				return strconv.Itoa(leftVal + rightVal)
+		case <-queue.ready():
+			events := queue.due()
+			for _, event := range events {
+				fw.changed(event)
+			}
+			fw.refreshBrowsers(events)
+			fw.runHooks(events)
+			fw.publish(events)
+
+		case err, ok := <-fw.watcher.errors():
+			if !ok {
+				return
 			}
+			fw.failed(err)
 		}
+	}
+}
 
-		// String concatenation fallback
-		return left + right
+// changed updates what depends on a file of the roots once it changed, the
+// event holding every op seen for it during the debounce window. A path
+// removed or renamed away may have been a directory, so what was built
+// from the files below it goes too.
+func (fw *FileWatcher) changed(event fsnotify.Event) {
+	gone := false
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if _, err := os.Lstat(event.Name); os.IsNotExist(err) {
+			gone = true
+			watcherLog.Debug("Removed", "path", event.Name)
+			fw.unwatch(event.Name)
+		}
 	}
 
-	// Try simple number parsing for single values
-	if val, err := strconv.Atoi(strings.TrimSpace(expression)); err == nil {
-		return strconv.Itoa(val)
+	// Nothing is served from the directories of --watch-dir
+	outside := fw.watchDirOf(event.Name)
+	if outside != "" {
+		fw.logOutside(event, outside)
 	}
 
-	return expression
-}
+	if event.Op != fsnotify.Chmod && outside == "" {
+		// Before the caches, so the page parsed again is the new one
+		files := fw.server.files
+		files.syncMemoryRoots(event.Name)
+		fw.syncAssets(event.Name)
+		if count := fw.server.responses.invalidate(event.Name); count > 0 {
+			watcherLog.Debug("Flushed cached responses", "file", event.Name, "count", count)
+		}
+		if count := fw.server.templates.invalidate(event.Name); count > 0 {
+			watcherLog.Debug("Flushed parsed templates", "file", event.Name, "count", count)
+		}
+		if fw.validation != nil && (gone || files.isPageFile(event.Name) && !files.isStaticFile(event.Name)) {
+			fw.validation.schedule()
+		}
+	}
 
-func setupFileWatcher(rootPath string, server *echo.Echo, routes *RouteConfig) (*FileWatcher, error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
+	if event.Op&fsnotify.Write == fsnotify.Write && event.Op&fsnotify.Create == 0 && fw.server.files.isPageFile(event.Name) {
+		watcherLog.Debug("File modified", "file", event.Name)
 	}
 
-	fw := &FileWatcher{
-		watcher:  watcher,
-		rootPath: rootPath,
-		server:   server,
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			watcherLog.Debug("Directory created", "dir", event.Name)
+			fw.addCreatedTree(event.Name)
+		} else if fw.server.files.isPageFile(event.Name) {
+			watcherLog.Debug("File created", "file", event.Name)
+		}
 	}
+}
 
-	// Add root directory to watcher
-	err = watcher.Add(rootPath)
-	if err != nil {
-		return nil, err
+// reloadConfig reloads the site as a file of its route config changes.
+// Saving by renaming a new file over the old one drops the watch, so it is
+// watched again first.
+func (fw *FileWatcher) reloadConfig(event fsnotify.Event) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if err := fw.watcher.Add(event.Name); err != nil {
+			watcherLog.Warn("Route config is gone, keeping the site as it is", "file", event.Name)
+			return
+		}
+	} else if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+		return
+	}
+
+	// Saving may take a few writes, the config being read once they stop
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.reload != nil {
+		fw.reload.Stop()
 	}
+	fw.reload = time.AfterFunc(200*time.Millisecond, func() {
+		// Sites made by New take their config from the program
+		if fw.reloader == nil {
+			watcherLog.Warn("Route config modified, make the handler again to apply it", "file", event.Name)
+			return
+		}
+		watcherLog.Info("Route config modified, reloading", "file", event.Name)
+		if browsers := fw.server.browsers; fw.reloader.reload().Reloaded && browsers != nil {
+			browsers.broadcast("reload")
+		}
+	})
+}
 
-	// Add all subdirectories
-	err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+// addCreatedTree watches a directory that appeared and the directories
+// below it. Trees moved or copied in, such as a new tenant, arrive without
+// events for what they hold, so the files found are handled as created,
+// with those written before their directory was watched.
+func (fw *FileWatcher) addCreatedTree(dir string) {
+	var files []string
+	err := fw.server.files.walkRoot(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if path != dir && fw.ignores(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if info.IsDir() {
-			return watcher.Add(path)
+			return fw.watcher.Add(path)
 		}
+		files = append(files, path)
 		return nil
 	})
-
 	if err != nil {
-		return nil, err
+		watcherLog.Error("Could not watch directory", "dir", dir, "err", err)
+	}
+	for _, file := range files {
+		fw.changed(fsnotify.Event{Name: file, Op: fsnotify.Create})
 	}
-
-	return fw, nil
 }
 
-func (fw *FileWatcher) watchFiles() {
-	for {
-		select {
-		case event, ok := <-fw.watcher.Events:
-			if !ok {
-				return
-			}
-
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				log.Printf("File modified: %s", event.Name)
-			}
-
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("File created: %s", event.Name)
-				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
-					fw.watcher.Add(event.Name)
-				}
-			}
-
-		case err, ok := <-fw.watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Printf("Watcher error: %v", err)
+// unwatch drops the watches of a path gone from disk and of the
+// directories that were below it. A directory renamed within the root is
+// watched again under its new name as it is created there; left alone,
+// the old watches would report its events under the old name. Files of
+// the config keep their watches, to be reloaded if they come back.
+func (fw *FileWatcher) unwatch(path string) {
+	path = filepath.Clean(path)
+	for _, watched := range fw.watcher.WatchList() {
+		if !pathWithin(watched, path) {
+			continue
 		}
+		if config, auths := fw.watchedFiles(watched); config || auths != nil {
+			continue
+		}
+		// Removed directories lost their watch already on most platforms
+		fw.watcher.Remove(watched)
 	}
 }
 
-// COMPILATION FUNCTIONS
-
-func compileTemplates(cmd *cobra.Command, args []string) {
-	log.Printf("🔥 Compiling templates from: %s", rootPath)
-	log.Printf("📄 Config file: %s", configFile)
-	log.Printf("📦 Output binary: %s", output)
+// pathWithin reports whether a path is dir or below it
+func pathWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
 
-	// Scan all HTML files
-	templates := make(map[string]string)
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+// addTree watches a directory and all directories below it, those
+// --watch-ignore names aside
+func (fw *FileWatcher) addTree(dir string) error {
+	return fw.server.files.walkRoot(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && fw.ignores(path) {
+			return filepath.SkipDir
+		}
+		return fw.watcher.Add(path)
+	})
+}
 
-		if !info.IsDir() && strings.HasSuffix(path, ".html") {
-			// Get relative path from root
-			relPath, err := filepath.Rel(rootPath, path)
-			if err != nil {
-				return err
-			}
+// COMPILATION FUNCTIONS
 
-			// Convert to forward slashes for consistency
-			relPath = filepath.ToSlash(relPath)
+// compileOptions are the settings of gosp compile: those of the server it
+// shares, and those of the build
+type compileOptions struct {
+	serverOptions
 
-			// Read file content
-			content, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
+	// Binary written, or named in the commands of --source-only
+	output string
 
-			templates[relPath] = string(content)
-			log.Printf("✅ Added template: %s", relPath)
-		}
+	// Files compile warns about, or leaves out with skipLarge, for their size
+	maxEmbedSize string
+	skipLarge    bool
 
-		return nil
-	})
+	// Embed the files of the static mounts in compiled binaries, rather
+	// than serving them from their directories
+	embedStatic bool
 
+	// Builds the admin endpoint into compiled binaries
+	admin bool
+
+	// Platforms built for, and whether with cgo
+	goos   string
+	goarch string
+	cgo    bool
+
+	// Write the project to outDir instead of building it
+	sourceOnly bool
+	outDir     string
+}
+
+// compileTemplates compiles the site of the options into the output binary
+func compileTemplates(options *compileOptions) {
+	if err := setupLogging(options.logLevel, options.logFormat, false); err != nil {
+		fatal(compileLog, "Invalid settings", "err", err)
+	}
+	output := options.output
+	compileLog.Info("Compiling templates", "root", options.root, "config", options.config, "output", output)
+
+	targets, err := parseTargets(options.goos, options.goarch, options.cgo)
 	if err != nil {
-		log.Fatal("❌ Error scanning templates:", err)
+		fatal(compileLog, "Invalid settings", "err", err)
 	}
 
-	// Load routes configuration
-	routes, err := loadRouteConfig(configFile)
+	var embedLimit int64
+	if options.maxEmbedSize != "" {
+		var err error
+		if embedLimit, err = bytes.Parse(options.maxEmbedSize); err != nil {
+			fatal(compileLog, "Invalid settings", "err", fmt.Errorf("invalid --max-embed-size %q", options.maxEmbedSize))
+		}
+	}
+
+	// Scan all template and static page files
+	site := newCompiledSite(options.root, newSiteFS(&options.serverOptions), options.skipLarge)
+	templates, err := scanTemplates(site, embedLimit)
 	if err != nil {
-		log.Printf("⚠️  Warning: Could not load route config: %v", err)
+		fatal(compileLog, "Error scanning templates", "err", err)
+	}
+
+	// Load routes configuration
+	routes, err := loadRouteConfig(site.source, options.config)
+	if os.IsNotExist(err) {
+		compileLog.Warn("Could not load route config", "file", options.config, "err", err)
 		routes = &RouteConfig{}
+	} else if err != nil {
+		fatal(compileLog, "Error loading route config", "file", options.config, "err", err)
+	}
+
+	if options.noFileRouting {
+		routes.FileRouting = "false"
+	}
+	if options.securityHeaders && routes.Security == nil {
+		routes.Security = &Security{}
+	}
+
+	if routes.TLS != nil && (routes.TLS.Cert != "" || routes.TLS.Key != "") {
+		compileLog.Warn("TLS certificate paths are not embedded, run the binary with --tls-cert and --tls-key")
+	}
+	if len(routes.Hooks) > 0 {
+		fatal(compileLog, "Render hooks can't be compiled, they are Go code of the program serving them", "hook", routes.Hooks[0].Name)
+	}
+	for _, route := range routes.resolveRoutes() {
+		if route.Provider != "" {
+			fatal(compileLog, "Routes with a provider can't be compiled, it is Go code of the program serving them", "route", route.Path, "provider", route.Provider)
+		}
+	}
+	if _, exists := templates[routes.ErrorTemplate]; routes.ErrorTemplate != "" && !exists {
+		fatal(compileLog, "errorTemplate is not a template under the root", "template", routes.ErrorTemplate, "root", options.root)
+	}
+	for _, name := range routes.listingTemplates() {
+		if _, exists := templates[name]; !exists {
+			fatal(compileLog, "listingTemplate is not a template under the root", "template", name, "root", options.root)
+		}
+	}
+	if err := routes.checkStaticDirs(options.root); err != nil {
+		fatal(compileLog, "Error loading route config", "file", options.config, "err", err)
+	}
+
+	// The binary runs the server of this module with the settings it was
+	// compiled with, reading these files from memory
+	site.index = embeddedIndex{
+		Root:            options.root,
+		Config:          options.config,
+		Admin:           options.admin,
+		NoFileRouting:   options.noFileRouting,
+		SecurityHeaders: options.securityHeaders,
+		TemplateExts:    options.templateExts,
+		StaticExts:      options.staticExts,
+		WellKnownDir:    options.wellKnownRoot,
+	}
+	if options.embedStatic {
+		if err := collectStaticFiles(site, routes, options.root, embedLimit); err != nil {
+			fatal(compileLog, "Error reading static files", "err", err)
+		}
+	}
+	if err := site.collect(routes, templates); err != nil {
+		fatal(compileLog, "Error reading embedded files", "err", err)
+	}
+	reportEmbedded(site)
+
+	if routes.caseScopes() != nil {
+		var names []string
+		for name := range templates {
+			names = append(names, name)
+		}
+		warnCaseCollisions(names)
+	}
+	if err := site.preparse(templates); err != nil {
+		fatal(compileLog, "Error parsing templates", "err", err)
+	}
+
+	if options.sourceOnly {
+		commands, err := writeSourceProject(options.outDir, site, output, targets)
+		if err != nil {
+			fatal(compileLog, "Error generating project", "err", err)
+		}
+		compileLog.Info("Wrote project", "templates", len(templates), "dir", options.outDir)
+		fmt.Println(strings.Join(commands, "\n"))
+		return
 	}
 
 	// Generate compiled binary
-	err = generateCompiledBinary(templates, routes, output)
+	outputs, err := generateCompiledBinary(site, output, targets)
 	if err != nil {
-		log.Fatal("❌ Error generating binary:", err)
+		fatal(compileLog, "Error generating binary", "err", err)
 	}
 
-	log.Printf("🎉 Successfully compiled %d templates into %s", len(templates), output)
-	log.Printf("🚀 Run with: ./%s --port 8080", output)
+	// go build may succeed without a binary, for a main package it didn't build
+	for _, path := range outputs {
+		size, err := checkArtifact(path)
+		if err != nil {
+			fatal(compileLog, "Error generating binary", "err", err)
+		}
+		compileLog.Info("Compiled", "templates", len(templates), "output", path, "size", bytes.Format(size))
+	}
 }
 
-func generateCompiledBinary(templates map[string]string, routes *RouteConfig, outputPath string) error {
+func generateCompiledBinary(site *compiledSite, outputPath string, targets []buildTarget) ([]string, error) {
 	// Create temporary directory
-	tempDir, err := ioutil.TempDir("", "webframework-compile-*")
+	tempDir, err := os.MkdirTemp("", "webframework-compile-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %v", err)
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
 	}
 	defer os.RemoveAll(tempDir)
 
-	log.Printf("🔧 Using temporary directory: %s", tempDir)
-
-	// Generate main.go
-	mainGoPath := filepath.Join(tempDir, "main.go")
-	err = generateMainGo(templates, routes, mainGoPath)
-	if err != nil {
-		return fmt.Errorf("failed to generate main.go: %v", err)
-	}
+	compileLog.Debug("Using temporary directory", "dir", tempDir)
 
-	// Generate go.mod
-	goModPath := filepath.Join(tempDir, "go.mod")
-	err = generateGoMod(goModPath)
-	if err != nil {
-		return fmt.Errorf("failed to generate go.mod: %v", err)
+	if err := writeProject(tempDir, site); err != nil {
+		return nil, err
 	}
 
 	// Build the binary
 	absOutputPath, err := filepath.Abs(outputPath)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute output path: %v", err)
+		return nil, fmt.Errorf("failed to get absolute output path: %v", err)
 	}
 
 	originalDir, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("failed to get current directory: %v", err)
+		return nil, fmt.Errorf("failed to get current directory: %v", err)
 	}
 
 	err = os.Chdir(tempDir)
 	if err != nil {
-		return fmt.Errorf("failed to change to temp directory: %v", err)
+		return nil, fmt.Errorf("failed to change to temp directory: %v", err)
 	}
 	defer os.Chdir(originalDir)
 
 	// Download dependencies
-	log.Println("📦 Downloading dependencies...")
+	compileLog.Info("Downloading dependencies")
 	err = executeCommand("go mod tidy")
 	if err != nil {
-		return fmt.Errorf("failed to download dependencies: %v", err)
+		return nil, fmt.Errorf("failed to download dependencies: %v", err)
 	}
 
-	// Build the binary
-	log.Printf("🔨 Building binary: %s", absOutputPath)
-	buildCmd := fmt.Sprintf("go build -o %s main.go", absOutputPath)
-	err = executeCommand(buildCmd)
-	if err != nil {
-		return fmt.Errorf("failed to build binary: %v", err)
+	// Build a binary for each platform
+	var outputs []string
+	for _, target := range targets {
+		output := target.output(absOutputPath, len(targets) > 1)
+		compileLog.Info("Building binary", "output", output, "target", target.String(), "cgo", target.cgo)
+		if err := target.build(output); err != nil {
+			return nil, fmt.Errorf("failed to build binary for %s: %v", target, err)
+		}
+		outputs = append(outputs, output)
 	}
 
-	return nil
-}
-
-func generateGoMod(outputPath string) error {
-	goModContent := `module compiled-webframework
-
-go 1.19
-
-require (
-	github.com/labstack/echo/v4 v4.11.1
-	github.com/spf13/cobra v1.7.0
-)
-
-require (
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
-	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/labstack/gommon v0.4.0 // indirect
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.11.0 // indirect
-	golang.org/x/net v0.12.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
-	golang.org/x/text v0.11.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
-)
-`
-
-	return ioutil.WriteFile(outputPath, []byte(goModContent), 0644)
+	return outputs, nil
 }
 
-func generateMainGo(templates map[string]string, routes *RouteConfig, outputPath string) error {
-	// Create the template data structure
-	data := struct {
-		Templates map[string]string
-		Routes    *RouteConfig
-	}{
-		Templates: templates,
-		Routes:    routes,
-	}
-
-	// Create the template
-	tmpl := template.New("main")
-	tmpl, err := tmpl.Parse(compiledMainTemplate)
+// writeProject writes the Go project of a compiled binary to dir: a
+// main.go running the server of this module, which it holds a copy of, on
+// the embedded files, with go.mod and go.sum
+func writeProject(dir string, site *compiledSite) error {
+	// Generate main.go
+	err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(compiledMain), 0644)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %v", err)
+		return fmt.Errorf("failed to generate main.go: %v", err)
+	}
+	if err := site.write(filepath.Join(dir, "embedded")); err != nil {
+		return fmt.Errorf("writing embedded files: %v", err)
 	}
 
-	// Create output file
-	file, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+	// The gosp module main.go imports, replaced by the copy
+	if err := writePackageSources(filepath.Join(dir, "gosp")); err != nil {
+		return fmt.Errorf("failed to write the gosp module: %v", err)
 	}
-	defer file.Close()
 
-	// Execute template
-	err = tmpl.Execute(file, data)
+	// Generate go.mod, and go.sum with the sums of this module's
+	// dependencies, which are the binary's, so it builds offline
+	err = generateGoMod(filepath.Join(dir, "go.mod"))
 	if err != nil {
-		return fmt.Errorf("failed to execute template: %v", err)
+		return fmt.Errorf("failed to generate go.mod: %v", err)
 	}
-
-	return nil
-}
-
-func executeCommand(cmd string) error {
-	parts := strings.Fields(cmd)
-	if len(parts) == 0 {
-		return fmt.Errorf("empty command")
+	if err := os.WriteFile(filepath.Join(dir, "go.sum"), moduleSums, 0644); err != nil {
+		return fmt.Errorf("failed to generate go.sum: %v", err)
 	}
-
-	command := exec.Command(parts[0], parts[1:]...)
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
-
-	return command.Run()
+	return nil
 }
 
-// Template for the compiled binary - SIMPLIFIED VERSION
-const compiledMainTemplate = `package main
+// main.go of compiled binaries
+const compiledMain = `// Command compiled-webframework serves a site compiled by gosp compile
+package main
 
 import (
-	"encoding/xml"
-	"fmt"
-	"log"
-	"net/http"
-	"regexp"
-	"strings"
+	"embed"
 
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"github.com/spf13/cobra"
+	"gosp"
 )
 
-type RouteConfig struct {
-	XMLName xml.Name ` + "`xml:\"routes\"`" + `
-	Routes  []Route  ` + "`xml:\"route\"`" + `
-}
-
-type Route struct {
-	Path    string   ` + "`xml:\"path,attr\"`" + `
-	File    string   ` + "`xml:\"file,attr\"`" + `
-	Methods []string ` + "`xml:\"methods\"`" + `
-}
-
-type TemplateProcessor struct {
-	data map[string]interface{}
-}
-
-var embeddedTemplates = map[string]string{
-{{range $key, $value := .Templates}}	{{printf "%q" $key}}: {{printf "%q" $value}},
-{{end}}}
+//go:embed embedded
+var files embed.FS
 
-var embeddedRoutes = &RouteConfig{
-	Routes: []Route{
-{{range .Routes.Routes}}		{
-			Path: {{printf "%q" .Path}},
-			File: {{printf "%q" .File}},
-			Methods: []string{ {{range .Methods}}{{printf "%q" .}}, {{end}} },
-		},
-{{end}}	},
+func main() {
+	gosp.RunCompiled(files)
 }
+`
 
-var port string
+// go.mod and go.sum of this module, and the go.sum of compiled binaries
+//
+//go:embed go.mod
+var moduleFile []byte
 
-func main() {
-	var rootCmd = &cobra.Command{
-		Use:   "compiled-webframework",
-		Short: "Compiled GoLang Web Framework",
-		Run:   runServer,
-	}
-	rootCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to run the server on")
-	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(err)
-	}
-}
+//go:embed go.sum
+var moduleSums []byte
 
-func runServer(cmd *cobra.Command, args []string) {
-	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
-	setupRoutes(e, embeddedRoutes)
-	log.Printf("🚀 Compiled server starting on port %s with %d templates", port, len(embeddedTemplates))
-	e.Logger.Fatal(e.Start(":" + port))
-}
+// Sources of this module, its engine and cache packages included, which
+// compiled binaries are built from as this one is
+//
+//go:embed *.go engine/*.go cache/*.go
+var packageSources embed.FS
 
-func setupRoutes(e *echo.Echo, routes *RouteConfig) {
-	for _, route := range routes.Routes {
-		for _, method := range route.Methods {
-			switch strings.ToUpper(method) {
-			case "GET":
-				e.GET(route.Path, createHandler(route.File))
-			case "POST":
-				e.POST(route.Path, createHandler(route.File))
-			case "PUT":
-				e.PUT(route.Path, createHandler(route.File))
-			case "DELETE":
-				e.DELETE(route.Path, createHandler(route.File))
-			case "ANY":
-				e.Any(route.Path, createHandler(route.File))
-			}
+// writePackageSources copies the module to dir, without its tests
+func writePackageSources(dir string) error {
+	err := fs.WalkDir(packageSources, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		source, err := packageSources.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, source, 0644)
+	})
+	if err != nil {
+		return err
 	}
-	e.Any("/*", fileBasedHandler)
-}
-
-func createHandler(filename string) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		return processTemplate(c, filename)
-	}
-}
-
-func fileBasedHandler(c echo.Context) error {
-	path := c.Request().URL.Path
-	if path == "/" {
-		path = "/index"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), moduleFile, 0644); err != nil {
+		return err
 	}
-	filename := strings.TrimPrefix(path, "/") + ".html"
-	return processTemplate(c, filename)
+	return os.WriteFile(filepath.Join(dir, "go.sum"), moduleSums, 0644)
 }
 
-func processTemplate(c echo.Context, filename string) error {
-	content, exists := embeddedTemplates[filename]
-	if !exists {
-		return c.String(http.StatusNotFound, "Template not found: "+filename)
-	}
-	processor := &TemplateProcessor{data: make(map[string]interface{})}
-	processor.data["request"] = c.Request()
-	processor.data["query"] = c.QueryParams()
-	processor.data["form"] = c.Request().Form
-	processedContent, err := processor.processTemplate(content, c)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, "Template processing error: "+err.Error())
+// generateGoMod writes the go.mod of compiled binaries, requiring the
+// copy of this module and, as it does, its dependencies
+func generateGoMod(outputPath string) error {
+	requires := string(moduleFile)
+	if i := strings.Index(requires, "\nrequire"); i >= 0 {
+		requires = requires[i:]
 	}
-	return c.HTML(http.StatusOK, processedContent)
-}
+	goModContent := `module compiled-webframework
 
-func (tp *TemplateProcessor) processTemplate(content string, c echo.Context) (string, error) {
-	content = tp.processIncludes(content)
-	content = tp.processCodeExpressions(content, c)
-	content = tp.processOutputTags(content, c)
-	return content, nil
-}
+go 1.21
 
-func (tp *TemplateProcessor) processIncludes(content string) string {
-	includeRegex := regexp.MustCompile(` + "`<%@include\\s+file=\"([^\"]+)\"\\s*%>`)" + `
-	return includeRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := includeRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
-		}
-		includeFile := matches[1]
-		includeContent, exists := embeddedTemplates[includeFile]
-		if !exists {
-			return "<!-- Include error: template " + includeFile + " not found -->"
-		}
-		return tp.processIncludes(includeContent)
-	})
-}
+require gosp v0.0.0
 
-func (tp *TemplateProcessor) processCodeExpressions(content string, c echo.Context) string {
-	codeRegex := regexp.MustCompile(` + "`<%\\s*([^=][^%]*)\\s*%>`)" + `
-	return codeRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := codeRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
-		}
-		code := strings.TrimSpace(matches[1])
-		if strings.Contains(code, "=") {
-			parts := strings.SplitN(code, "=", 2)
-			if len(parts) == 2 {
-				varName := strings.TrimSpace(parts[0])
-				varValue := strings.TrimSpace(parts[1])
-				if strings.HasPrefix(varValue, "\"") && strings.HasSuffix(varValue, "\"") {
-					varValue = varValue[1 : len(varValue)-1]
-				}
-				tp.data[varName] = varValue
-			}
-		}
-		return ""
-	})
-}
+replace gosp => ./gosp
+` + requires
 
-func (tp *TemplateProcessor) processOutputTags(content string, c echo.Context) string {
-	outputRegex := regexp.MustCompile(` + "`<%=\\s*([^%]+)\\s*%>`)" + `
-	return outputRegex.ReplaceAllStringFunc(content, func(match string) string {
-		matches := outputRegex.FindStringSubmatch(match)
-		if len(matches) < 2 {
-			return match
-		}
-		expression := strings.TrimSpace(matches[1])
-		if value, exists := tp.data[expression]; exists {
-			return fmt.Sprintf("%v", value)
-		}
-		if strings.HasPrefix(expression, "request.") {
-			return tp.handleRequestExpression(expression, c)
-		}
-		if strings.HasPrefix(expression, "query.") {
-			paramName := strings.TrimPrefix(expression, "query.")
-			return c.QueryParam(paramName)
-		}
-		if strings.HasPrefix(expression, "form.") {
-			paramName := strings.TrimPrefix(expression, "form.")
-			return c.FormValue(paramName)
-		}
-		return expression
-	})
+	return os.WriteFile(outputPath, []byte(goModContent), 0644)
 }
 
-func (tp *TemplateProcessor) handleRequestExpression(expression string, c echo.Context) string {
-	switch expression {
-	case "request.method":
-		return c.Request().Method
-	case "request.url":
-		return c.Request().URL.String()
-	case "request.host":
-		return c.Request().Host
-	default:
-		return expression
+func executeCommand(cmd string) error {
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		return fmt.Errorf("empty command")
 	}
+
+	command := exec.Command(parts[0], parts[1:]...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	return command.Run()
 }
-`
@@ -0,0 +1,85 @@
+package gosp
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Paths browsers would resolve to another host must redirect to one on the
+// site
+func TestRedirectStaysOnSite(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{"index.html": "home"},
+		`<routes trailingSlash="redirect-to-no-slash"/>`)
+
+	for path, want := range map[string]string{
+		"/docs/":          "/docs",
+		"//evil.com/":     "/evil.com",
+		"/\\evil.com/":    "/evil.com",
+		"/\\/evil.com/":   "/evil.com",
+		"/%09/evil.com/":  "/evil.com",
+		"/\\\\evil.com/?": "/evil.com",
+		"/a/?q=1":         "/a?q=1",
+	} {
+		res, _ := get(t, handler, http.MethodGet, path)
+		if res.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%s: status %d", path, res.StatusCode)
+			continue
+		}
+		if location := res.Header.Get("Location"); location != want {
+			t.Errorf("%s: Location %q, want %q", path, location, want)
+		}
+	}
+}
+
+// Extensionless paths find the page of the first --ext that has one,
+// templates before static pages, then an index document, folding case
+// when the routes say to
+func TestTemplateLookupPrecedence(t *testing.T) {
+	pages := map[string]string{
+		"pricing.gsp":        "gsp <%= 1 + 1 %>",
+		"pricing.html":       "html <%= 1 + 1 %>",
+		"pricing/index.html": "pricing index",
+		"plans.html":         "html plans <%= 1 + 1 %>",
+		"plans/index.gsp":    "plans index",
+		"about/index.gsp":    "gsp about",
+		"about/index.html":   "html about",
+		"Contact.gsp":        "gsp contact",
+	}
+	for _, test := range []struct {
+		ext, staticExt string
+		want           map[string]string
+	}{
+		{".gsp,.html", "", map[string]string{
+			"/pricing":  "gsp 2",
+			"/pricing/": "pricing index",
+			"/plans":    "html plans 2",
+			"/plans/":   "plans index",
+			"/about":    "gsp about",
+			"/contact":  "gsp contact",
+		}},
+		{".html,.gsp", "", map[string]string{
+			"/pricing": "html 2",
+			"/about":   "html about",
+		}},
+		// The static page is sent as it is, after the template
+		{".gsp", ".html", map[string]string{
+			"/pricing": "gsp 2",
+			"/plans":   "html plans <%= 1 + 1 %>",
+		}},
+		{".html", "", map[string]string{
+			"/pricing": "html 2",
+			"/plans/":  "html plans 2",
+		}},
+	} {
+		options := []Option{Flag("ext", test.ext)}
+		if test.staticExt != "" {
+			options = append(options, Flag("static-ext", test.staticExt))
+		}
+		handler, _ := newTestSite(t, pages, `<routes caseInsensitive="true"/>`, options...)
+		for path, want := range test.want {
+			if res, body := get(t, handler, http.MethodGet, path); res.StatusCode != http.StatusOK || body != want {
+				t.Errorf("--ext %s --static-ext %s %s: %d %q, want %q", test.ext, test.staticExt, path, res.StatusCode, body, want)
+			}
+		}
+	}
+}
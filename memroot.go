@@ -0,0 +1,308 @@
+package gosp
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memoryFS holds the pages under a directory in memory, as an fs.FS of
+// their names under it, up to a total size. Pages that don't fit are left
+// on disk and read from there. The watcher keeps it in sync.
+type memoryFS struct {
+	dir   string
+	limit int64
+
+	// Files of the server holding it, which tell pages from other files
+	owner *siteFS
+
+	mu     sync.RWMutex
+	files  map[string]*memoryFile
+	onDisk map[string]bool
+	bytes  int64
+}
+
+type memoryFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+// loadMemoryRoots loads each directory into memory, up to limit bytes each
+func (f *siteFS) loadMemoryRoots(limit int64, dirs ...string) error {
+	f.memory = nil
+	for _, dir := range dirs {
+		root := &memoryFS{dir: filepath.Clean(dir), limit: limit, owner: f}
+		if err := root.load(); err != nil {
+			return fmt.Errorf("loading %s into memory: %v", dir, err)
+		}
+		files, held, onDisk := root.stats()
+		serverLog.Info("Root loaded into memory", "dir", dir, "files", files, "bytes", held, "on_disk", onDisk)
+		f.memory = append(f.memory, root)
+	}
+	return nil
+}
+
+// load reads the pages under the directory again, replacing those held
+func (m *memoryFS) load() error {
+	files := make(map[string]*memoryFile)
+	onDisk := make(map[string]bool)
+	var held int64
+	err := m.owner.walkRoot(m.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !m.owner.isPageFile(path) {
+			return nil
+		}
+		name, _ := m.name(path)
+		if held+info.Size() > m.limit {
+			onDisk[name] = true
+			return nil
+		}
+		content, err := m.owner.readFile(path)
+		if err != nil {
+			return err
+		}
+		files[name] = &memoryFile{name: name, data: content, modTime: info.ModTime()}
+		held += int64(len(content))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.files, m.onDisk, m.bytes = files, onDisk, held
+	m.mu.Unlock()
+	return nil
+}
+
+// name returns the name of a path under the directory, if it is under it
+func (m *memoryFS) name(path string) (string, bool) {
+	rel, err := filepath.Rel(m.dir, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// lookup returns the page held for a path, and whether the path is for
+// this root to answer, which a missing page is too. Other files and pages
+// left on disk are read from there.
+func (m *memoryFS) lookup(path string) (*memoryFile, bool) {
+	name, ok := m.name(path)
+	if !ok || !m.owner.isPageFile(name) {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.onDisk[name] {
+		return nil, false
+	}
+	return m.files[name], true
+}
+
+// sync updates a path from disk after the watcher reported it changed,
+// created or removed. New directories are loaded with what they hold, as
+// copied trees arrive without events for their files.
+func (m *memoryFS) sync(path string) {
+	name, ok := m.name(path)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		m.owner.walkRoot(path, func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				m.sync(file)
+			}
+			return nil
+		})
+		return
+	}
+
+	gone := err != nil
+	var content []byte
+	if !gone && m.owner.isPageFile(name) {
+		// Read before taking the lock, so renders aren't held up by disk
+		content, err = os.ReadFile(path)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drop(name)
+	switch {
+	case gone:
+		// A removed directory takes the pages under it
+		for held := range m.files {
+			if strings.HasPrefix(held, name+"/") {
+				m.drop(held)
+			}
+		}
+		for left := range m.onDisk {
+			if strings.HasPrefix(left, name+"/") {
+				delete(m.onDisk, left)
+			}
+		}
+	case !m.owner.isPageFile(name):
+	case err != nil || m.bytes+int64(len(content)) > m.limit:
+		// Read from disk, failing there as it would without memory
+		m.onDisk[name] = true
+	default:
+		m.files[name] = &memoryFile{name: name, data: content, modTime: info.ModTime()}
+		m.bytes += int64(len(content))
+	}
+}
+
+func (m *memoryFS) drop(name string) {
+	if file, exists := m.files[name]; exists {
+		m.bytes -= int64(len(file.data))
+		delete(m.files, name)
+	}
+	delete(m.onDisk, name)
+}
+
+// stats returns the pages held and their size, and the pages on disk
+func (m *memoryFS) stats() (int, int64, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.files), m.bytes, len(m.onDisk)
+}
+
+// Open opens a page held in memory. Holding pages only, the fs.FS has no
+// directories to list.
+func (m *memoryFS) Open(name string) (fs.File, error) {
+	file, err := m.file("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &openMemoryFile{memoryFileInfo{file}, bytes.NewReader(file.data)}, nil
+}
+
+// ReadFile returns the content of a page held in memory, which mustn't be
+// modified
+func (m *memoryFS) ReadFile(name string) ([]byte, error) {
+	file, err := m.file("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return file.data, nil
+}
+
+// Stat describes a page held in memory
+func (m *memoryFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := m.file("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryFileInfo{file}, nil
+}
+
+func (m *memoryFS) file(op, name string) (*memoryFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.RLock()
+	file := m.files[name]
+	m.mu.RUnlock()
+	if file == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+type memoryFileInfo struct {
+	file *memoryFile
+}
+
+func (i memoryFileInfo) Name() string       { return filepath.Base(i.file.name) }
+func (i memoryFileInfo) Size() int64        { return int64(len(i.file.data)) }
+func (i memoryFileInfo) Mode() fs.FileMode  { return 0444 }
+func (i memoryFileInfo) ModTime() time.Time { return i.file.modTime }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+type openMemoryFile struct {
+	info memoryFileInfo
+	*bytes.Reader
+}
+
+func (f *openMemoryFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *openMemoryFile) Close() error               { return nil }
+
+// memoryRootFor returns the root held in memory answering for a path
+func (f *siteFS) memoryRootFor(path string) (*memoryFS, *memoryFile) {
+	for _, root := range f.memory {
+		if file, ok := root.lookup(path); ok {
+			return root, file
+		}
+	}
+	return nil, nil
+}
+
+// readRootFile reads a file of a template root, from memory when its root
+// holds it, in which case the content mustn't be modified. Missing pages
+// fail as they do on disk.
+func (f *siteFS) readRootFile(path string) ([]byte, error) {
+	root, file := f.memoryRootFor(path)
+	if root == nil {
+		return f.readFile(path)
+	}
+	if file == nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	return file.data, nil
+}
+
+// statRootFile describes a file of a template root, from memory when its
+// root holds it
+func (f *siteFS) statRootFile(path string) (os.FileInfo, error) {
+	root, file := f.memoryRootFor(path)
+	if root == nil {
+		return f.statFile(path)
+	}
+	if file == nil {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: syscall.ENOENT}
+	}
+	return memoryFileInfo{file}, nil
+}
+
+// syncMemoryRoots updates the roots held in memory for a watcher event
+func (f *siteFS) syncMemoryRoots(path string) {
+	for _, root := range f.memory {
+		root.sync(path)
+	}
+}
+
+// memoryRootStats adds up the stats of the roots held in memory
+func (f *siteFS) memoryRootStats() (files int, held int64, onDisk int) {
+	for _, root := range f.memory {
+		rootFiles, rootHeld, rootOnDisk := root.stats()
+		files += rootFiles
+		held += rootHeld
+		onDisk += rootOnDisk
+	}
+	return files, held, onDisk
+}
+
+func registerMemoryRootMetrics(files *siteFS) {
+	registerMetric("gosp_memory_root_files", "gauge", "Pages of the template roots held in memory", func() float64 {
+		pages, _, _ := files.memoryRootStats()
+		return float64(pages)
+	})
+	registerMetric("gosp_memory_root_bytes", "gauge", "Bytes of the pages held in memory", func() float64 {
+		_, held, _ := files.memoryRootStats()
+		return float64(held)
+	})
+	registerMetric("gosp_memory_root_on_disk", "gauge", "Pages over --memory-root, read from disk", func() float64 {
+		_, _, onDisk := files.memoryRootStats()
+		return float64(onDisk)
+	})
+}
@@ -0,0 +1,76 @@
+package gosp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Methods routes can be registered for, in the order Allow lists them.
+// ANY stands for all of them.
+var routeMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodPatch,
+	http.MethodOptions,
+}
+
+// allowedMethods collects the methods registered for one path
+type allowedMethods struct {
+	methods map[string]bool
+
+	// Set when a route answers OPTIONS itself
+	explicit bool
+
+	// Middlewares of the route with the highest precedence, which guard
+	// OPTIONS as well
+	middlewares []echo.MiddlewareFunc
+}
+
+// add records the methods of a route, HEAD coming with GET. Routes are
+// added in reverse precedence order, like they are registered.
+func (a *allowedMethods) add(methods []string, middlewares []echo.MiddlewareFunc) {
+	if a.methods == nil {
+		a.methods = map[string]bool{http.MethodOptions: true}
+	}
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		switch method {
+		case "ANY":
+			for _, any := range routeMethods {
+				a.methods[any] = true
+			}
+		case http.MethodGet:
+			a.methods[http.MethodGet] = true
+			a.methods[http.MethodHead] = true
+		case http.MethodOptions:
+			a.explicit = true
+		default:
+			a.methods[method] = true
+		}
+	}
+	a.middlewares = middlewares
+}
+
+// header is the Allow header value
+func (a *allowedMethods) header() string {
+	var allow []string
+	for _, method := range routeMethods {
+		if a.methods[method] {
+			allow = append(allow, method)
+		}
+	}
+	return strings.Join(allow, ", ")
+}
+
+// optionsHandler answers OPTIONS with the methods of the path
+func optionsHandler(allow string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderAllow, allow)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,63 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// metric is a value reported on the metrics endpoint
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func() float64
+}
+
+// The metrics of the process, which the command registers once at startup
+// for the one server it runs. Sites made by New register none, so it
+// needn't be kept per server.
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+// registerMetric adds a counter or gauge to the metrics endpoint
+func registerMetric(name, kind, help string, value func() float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, metric{name: name, kind: kind, help: help, value: value})
+}
+
+// metricsHandler reports the registered metrics in the Prometheus text format
+func metricsHandler(c echo.Context) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	var out strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value())
+	}
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(out.String()))
+}
+
+func registerCacheMetrics(cache *responseCache) {
+	registerMetric("gosp_response_cache_hits_total", "counter", "Requests answered from the response cache", func() float64 {
+		return float64(cache.entries.Stats().Hits)
+	})
+	registerMetric("gosp_response_cache_misses_total", "counter", "Cacheable requests that had to be rendered", func() float64 {
+		return float64(cache.entries.Stats().Misses)
+	})
+	registerMetric("gosp_response_cache_evictions_total", "counter", "Responses dropped to stay within the cache bounds", func() float64 {
+		return float64(cache.entries.Stats().Evictions)
+	})
+	registerMetric("gosp_response_cache_entries", "gauge", "Responses held in the response cache", func() float64 {
+		return float64(cache.entries.Stats().Entries)
+	})
+	registerMetric("gosp_response_cache_bytes", "gauge", "Body bytes held in the response cache", func() float64 {
+		return float64(cache.entries.Stats().Bytes)
+	})
+}
@@ -0,0 +1,42 @@
+package gosp
+
+import (
+	"mime"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Context key of whether a route minifies its HTML pages
+const minifyKey = "gosp.minify"
+
+// minifyMiddleware records whether the pages of a route are minified
+func minifyMiddleware(minify bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(minifyKey, minify)
+			return next(c)
+		}
+	}
+}
+
+// minifies reports whether a page is minified: as its page directive says,
+// else as its route does, else as the site does for pages rendered outside
+// of routes
+func minifies(c echo.Context, directive string) bool {
+	switch directive {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if minify, ok := c.Get(minifyKey).(bool); ok {
+		return minify
+	}
+	return siteOf(c).minify
+}
+
+// isHTML reports whether a content type is HTML, the only output minified
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == echo.MIMETextHTML
+}
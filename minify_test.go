@@ -0,0 +1,138 @@
+package gosp
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"gosp/engine"
+)
+
+// minifyPages are pages whose whitespace matters in places: raw elements,
+// flush tags splitting them, and pages long enough to stream
+var minifyPages = map[string]string{
+	"small.html": `<!DOCTYPE html>
+<html>
+  <head>
+    <title>  Shop  </title>
+    <style>
+      p  { margin : 0 }
+    </style>
+  </head>
+  <body>
+    <!-- navigation -->
+    <p>Hello,
+       <b><%= query.name %></b>   and   welcome.</p>
+    <pre>
+  line   one
+    line two
+</pre>
+    <textarea name="note">  keep
+   this  </textarea>
+    <script>
+      if (a  <  b) { s = "<!-- not a comment -->" }
+    </script>
+  </body>
+</html>
+`,
+	"flushed.html": `<html><body>
+  <p>  before  </p>
+  <pre>  one  <% flush %>  two  </pre>
+  <% flush %>
+  <script>  var x  =  <% flush %>  1;  </script>
+  <p>  after  <!-- gone --> </p>
+</body></html>
+`,
+	"long.html": `<html><body>
+  <ul>
+<% i = "item" %>` + strings.Repeat(`    <li>  <%= i %>   <b> bold </b>  </li>
+    <pre>  kept   as  is  </pre>
+`, 1500) + `  </ul>
+</body></html>
+`,
+}
+
+// Minified pages, streamed or flushed ones too, are the HTML minified
+// whole, and render the same as the pages sent as they are
+func TestMinifiedPagesRenderTheSame(t *testing.T) {
+	plain, _ := newTestSite(t, minifyPages, "<routes/>")
+	minified, _ := newTestSite(t, minifyPages, "<routes/>", Flag("minify", "true"))
+
+	for _, test := range []struct {
+		path     string
+		streamed bool
+	}{
+		{"/small?name=jo", false},
+		{"/flushed", true},
+		{"/long", true},
+	} {
+		_, original := get(t, plain, http.MethodGet, test.path)
+		res, body := get(t, minified, http.MethodGet, test.path)
+		if streamed := res.Header.Get("Content-Length") == ""; streamed != test.streamed {
+			t.Errorf("%s streamed %v, want %v", test.path, streamed, test.streamed)
+		}
+		if want := string(engine.MinifyHTML([]byte(original))); body != want {
+			t.Errorf("%s minified to\n%q\nwant\n%q", test.path, body, want)
+		}
+		if len(body) >= len(original) {
+			t.Errorf("%s: %d bytes minified, %d as it is", test.path, len(body), len(original))
+		}
+		if got, want := rendered(t, body), rendered(t, original); got != want {
+			t.Errorf("%s renders\n%s\nminified, and\n%s\nas it is", test.path, got, want)
+		}
+	}
+}
+
+// rendered returns what of an HTML page shows: its elements and their
+// attributes, the text of pre, textarea, script and style as it is, and
+// other text with its whitespace collapsed, as browsers lay it out.
+// Comments don't show.
+func rendered(t *testing.T, page string) string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	space := false
+	var walk func(n *html.Node, raw bool)
+	walk = func(n *html.Node, raw bool) {
+		switch n.Type {
+		case html.ElementNode:
+			b.WriteString("<" + n.Data)
+			for _, attr := range n.Attr {
+				b.WriteString(" " + attr.Key + "=" + attr.Val)
+			}
+			b.WriteString(">")
+			space = false
+			raw = raw || n.Data == "pre" || n.Data == "textarea" || n.Data == "script" || n.Data == "style"
+		case html.TextNode:
+			if raw {
+				b.WriteString(n.Data)
+				break
+			}
+			for _, c := range n.Data {
+				if strings.ContainsRune(" \t\n\r\f", c) {
+					if !space {
+						b.WriteByte(' ')
+					}
+					space = true
+					continue
+				}
+				b.WriteRune(c)
+				space = false
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child, raw)
+		}
+		if n.Type == html.ElementNode {
+			b.WriteString("</" + n.Data + ">")
+			space = false
+		}
+	}
+	walk(doc, false)
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/cobra"
+)
+
+// Flags whose defaults follow --mode, in the order they are reported
+var modeFlags = []string{"watch", "error-details", "caching", "verbose", "live-reload"}
+
+// modeDefaults are the settings implied by each mode. An explicitly given
+// flag always wins.
+var modeDefaults = map[string]map[string]bool{
+	"dev":  {"watch": true, "error-details": true, "caching": false, "verbose": true, "live-reload": true},
+	"prod": {"watch": false, "error-details": false, "caching": true, "verbose": false, "live-reload": false},
+}
+
+// applyMode sets the flags left unset to the defaults of the mode
+func applyMode(cmd *cobra.Command, options *serverOptions) error {
+	flags := cmd.Flags()
+	defaults, ok := modeDefaults[options.runMode]
+	if !ok {
+		return fmt.Errorf("invalid --mode %q, expected dev or prod", options.runMode)
+	}
+
+	for _, name := range modeFlags {
+		flag := flags.Lookup(name)
+		if flag == nil || flags.Changed(name) {
+			continue
+		}
+		if value := strconv.FormatBool(defaults[name]); value != flag.DefValue {
+			flags.Set(name, value)
+			options.sources[name] = "--mode " + options.runMode
+		}
+	}
+	return nil
+}
+
+// logMode logs the mode with the flags it set and those given otherwise,
+// once the logger is set up
+func logMode(cmd *cobra.Command, options *serverOptions) {
+	var implied, overridden []string
+	for _, name := range modeFlags {
+		flag := cmd.Flags().Lookup(name)
+		switch {
+		case flag == nil:
+		case options.sources[name] == "--mode "+options.runMode:
+			implied = append(implied, "--"+name+"="+flag.Value.String())
+		case cmd.Flags().Changed(name):
+			overridden = append(overridden, "--"+name+"="+flag.Value.String())
+		}
+	}
+
+	args := []interface{}{"mode", options.runMode}
+	if len(implied) > 0 {
+		args = append(args, "implied", strings.Join(implied, " "))
+	}
+	if len(overridden) > 0 {
+		args = append(args, "overridden", strings.Join(overridden, " "))
+	}
+	serverLog.Info("Mode", args...)
+	if options.sources["mode"] == "" && options.runMode == "dev" {
+		serverLog.Warn("No --mode given, so dev mode shows error details to clients and watches and reloads files; start with --mode prod in production")
+	}
+	if options.serverConfigLoaded != "" {
+		serverLog.Info("Server config", "file", options.serverConfigLoaded)
+	}
+}
+
+// errorMessage is the body of a 500 response. The error is always logged
+// with the request ID, but only shown to clients with --error-details.
+func errorMessage(c echo.Context, message string, err error) string {
+	name, _ := c.Get(templateNameKey).(string)
+	renderLog.Error(message, "method", c.Request().Method, "path", c.Request().URL.Path, "route", c.Path(), "template", name, "request_id", requestID(c), "err", err)
+	if !siteOf(c).options.errorDetails {
+		return http.StatusText(http.StatusInternalServerError)
+	}
+	return message + ": " + err.Error()
+}
+
+// noStoreMiddleware keeps browsers from caching anything with --caching off,
+// replacing the configured policy right before the headers are written
+func noStoreMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Before(func() {
+				res.Header().Set(echo.HeaderCacheControl, "no-store")
+				res.Header().Del("Expires")
+			})
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package gosp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long after a hook ran the changes of files it didn't run for are
+// taken for its own output, on top of --watch-debounce
+const hookCooldown = time.Second
+
+// changeHook runs a command as files matching its patterns change, such as
+// a CSS build as stylesheets or their config are edited. Changes are
+// collected for --watch-debounce before it runs, and one run at a time;
+// those coming while it runs are run for once it is done.
+type changeHook struct {
+	patterns []string
+	command  string
+
+	// --watch-debounce, how long it waits for changes to stop
+	debounce time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	changed []string
+
+	// Set while running, and to when changes become the user's again after
+	// it ran: until then, those of files other than the ones it ran for
+	// are the files it wrote
+	running bool
+	quiet   time.Time
+	ran     map[string]bool
+}
+
+// parseChangeHooks reads the hooks of --on-change: comma-separated glob
+// patterns, an "=" and the command run by the shell, run once changes stop
+// for debounce
+func parseChangeHooks(specs []string, debounce time.Duration) ([]*changeHook, error) {
+	var hooks []*changeHook
+	for _, spec := range specs {
+		globs, command, ok := strings.Cut(spec, "=")
+		command = strings.TrimSpace(command)
+		if !ok || command == "" {
+			return nil, fmt.Errorf("invalid --on-change %q: want glob=command", spec)
+		}
+		hook := &changeHook{command: command, debounce: debounce}
+		for _, pattern := range strings.Split(globs, ",") {
+			pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid --on-change pattern %q: %v", pattern, err)
+			}
+			hook.patterns = append(hook.patterns, pattern)
+		}
+		if len(hook.patterns) == 0 {
+			return nil, fmt.Errorf("invalid --on-change %q: no glob before the command", spec)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// matches reports whether a file is for the hook: patterns without a slash
+// match its name, others its slash-separated path under the root
+func (hook *changeHook) matches(name string) bool {
+	for _, pattern := range hook.patterns {
+		subject := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			subject = name
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks hands the files of the events the watcher handled to the hooks
+// matching them
+func (fw *FileWatcher) runHooks(events []fsnotify.Event) {
+	for _, event := range events {
+		if event.Op == fsnotify.Chmod {
+			continue
+		}
+		name := event.Name
+		if rel, err := filepath.Rel(fw.rootPath, event.Name); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		name = filepath.ToSlash(name)
+		for _, hook := range fw.hooks {
+			if hook.matches(name) {
+				hook.trigger(fw.hookContext, name)
+			}
+		}
+	}
+}
+
+// trigger puts the hook's run off until changes stop for --watch-debounce,
+// unless they are its own. A change while it runs is kept for another run
+// once it is done.
+func (hook *changeHook) trigger(ctx context.Context, name string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if (hook.running || time.Now().Before(hook.quiet)) && !hook.ran[name] {
+		watcherLog.Debug("Change taken for the hook's output", "hook", hook.command, "file", name)
+		return
+	}
+	if !containsString(hook.changed, name) {
+		hook.changed = append(hook.changed, name)
+	}
+	if !hook.running {
+		hook.schedule(ctx)
+	}
+}
+
+// schedule runs the hook once --watch-debounce passes without another
+// change. The caller holds the lock.
+func (hook *changeHook) schedule(ctx context.Context) {
+	if hook.timer != nil {
+		hook.timer.Stop()
+	}
+	hook.timer = time.AfterFunc(hook.debounce, func() { hook.run(ctx) })
+}
+
+// run runs the command with the shell, logging what it writes line by line
+// and a failure as a warning
+func (hook *changeHook) run(ctx context.Context) {
+	hook.mu.Lock()
+	if hook.running || len(hook.changed) == 0 {
+		hook.mu.Unlock()
+		return
+	}
+	hook.running = true
+	changed := hook.changed
+	hook.changed = nil
+	hook.ran = make(map[string]bool, len(changed))
+	for _, name := range changed {
+		hook.ran[name] = true
+	}
+	hook.mu.Unlock()
+
+	defer func() {
+		hook.mu.Lock()
+		hook.running = false
+		hook.quiet = time.Now().Add(hook.debounce + hookCooldown)
+		if len(hook.changed) > 0 && ctx.Err() == nil {
+			hook.schedule(ctx)
+		}
+		hook.mu.Unlock()
+	}()
+
+	watcherLog.Info("Running hook", "hook", hook.command, "files", strings.Join(changed, ","))
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.command)
+	cmd.Env = append(os.Environ(), "GOSP_CHANGED="+strings.Join(changed, " "))
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		watcherLog.Warn("Could not run hook", "hook", hook.command, "err", err)
+		return
+	}
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go hook.log(&output, stdout, "stdout")
+	go hook.log(&output, stderr, "stderr")
+	output.Wait()
+
+	err := cmd.Wait()
+	var exit *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		watcherLog.Info("Hook stopped", "hook", hook.command)
+	case errors.As(err, &exit):
+		watcherLog.Warn("Hook failed", "hook", hook.command, "exit", exit.ExitCode(), "duration", time.Since(start).String())
+	case err != nil:
+		watcherLog.Warn("Hook failed", "hook", hook.command, "err", err)
+	default:
+		watcherLog.Info("Hook done", "hook", hook.command, "duration", time.Since(start).String())
+	}
+}
+
+// log logs the lines of an output of the command as they come
+func (hook *changeHook) log(done *sync.WaitGroup, output io.Reader, stream string) {
+	defer done.Done()
+	lines := bufio.NewScanner(output)
+	for lines.Scan() {
+		watcherLog.Info(lines.Text(), "hook", hook.command, "stream", stream)
+	}
+}
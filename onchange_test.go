@@ -0,0 +1,136 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestChangeHookQueuesChanges checks a file changing again while the hook
+// runs for it gets one more run, and the hook's own output none
+func TestChangeHookQueuesChanges(t *testing.T) {
+	debounce := 10 * time.Millisecond
+	runs := filepath.Join(t.TempDir(), "runs")
+	hooks, err := parseChangeHooks([]string{`*.css=echo "$GOSP_CHANGED" >> ` + runs + `; sleep 0.3`}, debounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := hooks[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := func() bool {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return hook.running
+	}
+	waitFor := func(want bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); running() != want; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("hook running is not %v", want)
+			}
+		}
+	}
+
+	hook.trigger(ctx, "src/site.css")
+	waitFor(true)
+	hook.trigger(ctx, "dist/site.css")
+	hook.trigger(ctx, "src/site.css")
+	hook.trigger(ctx, "src/site.css")
+	waitFor(false)
+	waitFor(true)
+	hook.trigger(ctx, "dist/site.css")
+	waitFor(false)
+	time.Sleep(debounce + 100*time.Millisecond)
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(data)), []string{"src/site.css", "src/site.css"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("hook ran for %q, want %q", got, want)
+	}
+	if running() {
+		t.Fatal("hook ran a third time")
+	}
+}
+
+// TestEditorSaveHandledOnce checks a save is handled as one change of
+// the page, flushing it and running the validation once: one writing a
+// temporary file and renaming it over the page, as editors do, and one
+// writing the page in place in pieces
+func TestEditorSaveHandledOnce(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	ts := newTestServer(t, map[string]string{"index.html": "version 0"}, "<routes/>", "--validate-on-start", "--watch-debounce", "50ms")
+	watcher, err := ts.setupFileWatcher(ts.sites.active().routes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.watcher = watcher
+	changes := ts.changes.subscribe()
+	go watcher.watchFiles()
+	t.Cleanup(func() { watcher.watcher.Close() })
+	page, _ := filepath.Abs(filepath.Join(ts.root, "index.html"))
+
+	saves := []func(content string) error{
+		func(content string) error {
+			temp := page + ".tmp"
+			if err := os.WriteFile(temp, []byte(content), 0600); err != nil {
+				return err
+			}
+			if err := os.Rename(temp, page); err != nil {
+				return err
+			}
+			return os.Chmod(page, 0644)
+		},
+		func(content string) error {
+			f, err := os.OpenFile(page, os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				return err
+			}
+			for _, piece := range []string{content[:4], content[4:]} {
+				if _, err := f.WriteString(piece); err != nil {
+					f.Close()
+					return err
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			return f.Close()
+		},
+	}
+	for save := 1; save <= 4; save++ {
+		content := fmt.Sprintf("version %d", save)
+		if err := saves[save%2](content); err != nil {
+			t.Fatal(err)
+		}
+
+		// The validation runs 200ms after the last change handled
+		pageChanges := 0
+		for quiet := time.After(600 * time.Millisecond); quiet != nil; {
+			select {
+			case change := <-changes:
+				if change.Path == page {
+					pageChanges++
+				}
+			case <-quiet:
+				quiet = nil
+			}
+		}
+		if pageChanges != 1 {
+			t.Errorf("save %d: %d changes of the page, want 1", save, pageChanges)
+		}
+		if validations := strings.Count(logs.String(), "Templates validated"); validations != save {
+			t.Errorf("save %d: validated %d times, want once per save", save, validations)
+		}
+		if _, body := get(t, ts.sites, http.MethodGet, "/"); body != content {
+			t.Errorf("save %d: %q served", save, body)
+		}
+	}
+}
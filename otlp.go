@@ -0,0 +1,341 @@
+package gosp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Spans sent per export request
+	traceBatchSize = 512
+
+	// Finished spans held while the collector is slow; more are dropped
+	traceQueueLimit = 8192
+
+	traceFlushInterval = 5 * time.Second
+)
+
+// spanTracer exports finished spans in batches, to an OTLP/HTTP collector
+// or stdout, configured by the standard OTEL_* environment variables
+type spanTracer struct {
+	exporter string
+	protocol string
+	endpoint string
+	headers  map[string]string
+	resource []spanAttr
+	client   *http.Client
+
+	// Share of new traces sampled, and whether an incoming traceparent
+	// decides instead
+	ratio       float64
+	parentBased bool
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int
+
+	flushNow chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newTracer reads the OTEL_* environment variables. OTLP is sent over
+// HTTP, encoded as protobuf by default or as JSON.
+func newTracer() (*spanTracer, error) {
+	t := &spanTracer{
+		exporter:    envDefault("OTEL_TRACES_EXPORTER", "otlp"),
+		headers:     make(map[string]string),
+		ratio:       1,
+		parentBased: true,
+		flushNow:    make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	switch t.exporter {
+	case "otlp", "console", "none":
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q, expected otlp, console or none", t.exporter)
+	}
+
+	t.protocol = envDefault("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", envDefault("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf"))
+	switch t.protocol {
+	case "http/protobuf", "http/json":
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected http/protobuf or http/json", t.protocol)
+	}
+
+	t.endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if t.endpoint == "" {
+		t.endpoint = strings.TrimSuffix(envDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "/") + "/v1/traces"
+	}
+	if parsed, err := url.Parse(t.endpoint); err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP traces endpoint %q", t.endpoint)
+	}
+
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		headers, err := parseOTelList(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, header := range headers {
+			t.headers[header.key] = header.value.(string)
+		}
+	}
+
+	timeout := 10 * time.Second
+	if value := envDefault("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT")); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("invalid OTLP timeout %q, expected milliseconds", value)
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	t.client = &http.Client{Timeout: timeout}
+
+	attrs, err := parseOTelList("OTEL_RESOURCE_ATTRIBUTES")
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME wins over a service.name resource attribute
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	for _, attr := range attrs {
+		if attr.key == "service.name" {
+			if service == "" {
+				service = attr.value.(string)
+			}
+			continue
+		}
+		t.resource = append(t.resource, attr)
+	}
+	if service == "" {
+		service = "gosp"
+	}
+	serviceName := spanAttr{key: "service.name", value: service}
+	t.resource = append([]spanAttr{serviceName}, t.resource...)
+
+	if err := t.setSampler(envDefault("OTEL_TRACES_SAMPLER", "parentbased_always_on"), os.Getenv("OTEL_TRACES_SAMPLER_ARG")); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *spanTracer) setSampler(sampler, arg string) error {
+	t.parentBased = strings.HasPrefix(sampler, "parentbased_")
+	switch strings.TrimPrefix(sampler, "parentbased_") {
+	case "always_on":
+		t.ratio = 1
+	case "always_off":
+		t.ratio = 0
+	case "traceidratio":
+		t.ratio = 1
+		if arg != "" {
+			ratio, err := strconv.ParseFloat(arg, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, expected a ratio from 0 to 1", arg)
+			}
+			t.ratio = ratio
+		}
+	default:
+		return fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", sampler)
+	}
+	return nil
+}
+
+func envDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseOTelList reads the key=value,key=value format of OTEL_* variables,
+// with URL-encoded values
+func parseOTelList(name string) ([]spanAttr, error) {
+	var list []spanAttr
+	for _, entry := range splitList(os.Getenv(name)) {
+		key, value, found := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("malformed %s entry %q, expected key=value", name, entry)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s value for %q: %v", name, key, err)
+		}
+		list = append(list, spanAttr{key: key, value: decoded})
+	}
+	return list, nil
+}
+
+// start exports in the background until shutdown
+func (t *spanTracer) start() {
+	go func() {
+		ticker := time.NewTicker(traceFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-t.flushNow:
+			case <-t.stop:
+				t.flush()
+				close(t.done)
+				return
+			}
+			t.flush()
+		}
+	}()
+}
+
+// shutdown exports the remaining spans, waiting a few seconds at most
+func (t *spanTracer) shutdown() {
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func (t *spanTracer) queue(s *span) {
+	if t.exporter == "none" {
+		return
+	}
+
+	t.mu.Lock()
+	if len(t.pending) < traceQueueLimit {
+		t.pending = append(t.pending, s)
+	} else {
+		t.dropped++
+	}
+	full := len(t.pending) >= traceBatchSize
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *spanTracer) flush() {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		serverLog.Warn("Dropped spans, the trace exporter is falling behind", "count", dropped)
+	}
+	for len(spans) > 0 {
+		batch := spans
+		if len(batch) > traceBatchSize {
+			batch = batch[:traceBatchSize]
+		}
+		spans = spans[len(batch):]
+
+		if err := t.export(batch); err != nil {
+			serverLog.Warn("Could not export spans", "count", len(batch), "err", err)
+		}
+	}
+}
+
+// export sends spans as an OTLP ExportTraceServiceRequest, in the
+// encoding of the protocol; the console gets JSON
+func (t *spanTracer) export(spans []*span) error {
+	if t.exporter == "console" {
+		payload, err := t.encodeJSON(spans)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(payload, '\n'))
+		return err
+	}
+
+	payload, contentType := t.encodeProtobuf(spans), "application/x-protobuf"
+	if t.protocol == "http/json" {
+		var err error
+		if payload, err = t.encodeJSON(spans); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// encodeJSON encodes spans as an ExportTraceServiceRequest in the JSON
+// mapping of OTLP
+func (t *spanTracer) encodeJSON(spans []*span) ([]byte, error) {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		out := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			out["status"] = map[string]interface{}{"code": 2, "message": s.errMessage}
+		}
+		encoded = append(encoded, out)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(t.resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "gosp"},
+				"spans": encoded,
+			}},
+		}},
+	})
+}
+
+func otlpAttributes(attrs []spanAttr) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for _, attr := range attrs {
+		var value map[string]interface{}
+		switch v := attr.value.(type) {
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": attr.key, "value": value})
+	}
+	return out
+}
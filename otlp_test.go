@@ -0,0 +1,204 @@
+package gosp
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// protoField is a field of a protobuf message, as read by readProto
+type protoField struct {
+	num   int
+	wire  int
+	value uint64
+	data  []byte
+}
+
+// readProto reads the fields of a protobuf message
+func readProto(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("bad field key")
+		}
+		data = data[n:]
+		field := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch field.wire {
+		case wireVarint:
+			field.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatal("bad varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				t.Fatal("short fixed64")
+			}
+			field.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				t.Fatal("bad length")
+			}
+			field.data, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			t.Fatalf("wire type %d", field.wire)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoGet returns the fields of a message with a number
+func protoGet(fields []protoField, num int) []protoField {
+	var found []protoField
+	for _, field := range fields {
+		if field.num == num {
+			found = append(found, field)
+		}
+	}
+	return found
+}
+
+// only returns the one field of a message with a number
+func only(t *testing.T, fields []protoField, num int) protoField {
+	t.Helper()
+	found := protoGet(fields, num)
+	if len(found) != 1 {
+		t.Fatalf("%d fields %d, want 1", len(found), num)
+	}
+	return found[0]
+}
+
+func TestTracerProtocols(t *testing.T) {
+	for protocol, want := range map[string]string{"": "http/protobuf", "http/protobuf": "http/protobuf", "http/json": "http/json"} {
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", protocol)
+		tracer, err := newTracer()
+		if err != nil {
+			t.Fatalf("%q: %v", protocol, err)
+		}
+		if tracer.protocol != want {
+			t.Errorf("%q: protocol %s, want %s", protocol, tracer.protocol, want)
+		}
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	if _, err := newTracer(); err == nil {
+		t.Error("grpc accepted")
+	}
+}
+
+// Spans are exported as the protobuf ExportTraceServiceRequest of OTLP
+func TestExportProtobuf(t *testing.T) {
+	var contentType string
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", collector.URL+"/v1/traces")
+	t.Setenv("OTEL_SERVICE_NAME", "shop")
+	tracer, err := newTracer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 5)
+	s := &span{name: "GET /", kind: spanKindServer, start: start, end: start.Add(time.Millisecond)}
+	s.traceID[0], s.spanID[0], s.parentID[0] = 1, 2, 3
+	s.setAttr("http.route", "/")
+	s.setAttr("http.status_code", 500)
+	s.failed, s.errMessage = true, "boom"
+	if err := tracer.export([]*span{s}); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/x-protobuf" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+
+	resourceSpans := readProto(t, only(t, readProto(t, body), 1).data)
+	resource := readProto(t, only(t, resourceSpans, 1).data)
+	service := readProto(t, only(t, resource, 1).data)
+	if key := string(only(t, service, 1).data); key != "service.name" {
+		t.Errorf("resource attribute %q", key)
+	}
+	if value := string(only(t, readProto(t, only(t, service, 2).data), 1).data); value != "shop" {
+		t.Errorf("service.name %q", value)
+	}
+
+	scopeSpans := readProto(t, only(t, resourceSpans, 2).data)
+	if name := string(only(t, readProto(t, only(t, scopeSpans, 1).data), 1).data); name != "gosp" {
+		t.Errorf("scope %q", name)
+	}
+	encoded := readProto(t, only(t, scopeSpans, 2).data)
+	for num, want := range map[int][]byte{1: s.traceID[:], 2: s.spanID[:], 4: s.parentID[:], 5: []byte("GET /")} {
+		if got := only(t, encoded, num).data; string(got) != string(want) {
+			t.Errorf("field %d: %x, want %x", num, got, want)
+		}
+	}
+	if kind := only(t, encoded, 6); kind.wire != wireVarint || kind.value != spanKindServer {
+		t.Errorf("kind %+v", kind)
+	}
+	for num, want := range map[int]time.Time{7: s.start, 8: s.end} {
+		if got := only(t, encoded, num); got.wire != wireFixed64 || int64(got.value) != want.UnixNano() {
+			t.Errorf("field %d: %+v, want %d", num, got, want.UnixNano())
+		}
+	}
+
+	attrs := protoGet(encoded, 9)
+	if len(attrs) != 2 {
+		t.Fatalf("%d attributes", len(attrs))
+	}
+	value := readProto(t, only(t, readProto(t, attrs[1].data), 2).data)
+	if code := only(t, value, 3); code.wire != wireVarint || code.value != 500 {
+		t.Errorf("http.status_code %+v", code)
+	}
+	status := readProto(t, only(t, encoded, 15).data)
+	if string(only(t, status, 2).data) != "boom" || only(t, status, 3).value != 2 {
+		t.Errorf("status %+v", status)
+	}
+}
+
+// http/json sends the JSON mapping instead
+func TestExportJSON(t *testing.T) {
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "http/json")
+	tracer, err := newTracer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &span{name: "render", kind: spanKindInternal, start: time.Now(), end: time.Now()}
+	if err := tracer.export([]*span{s}); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+}
+
+// A collector refusing the spans fails the export
+func TestExportCollectorError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", collector.URL)
+	tracer, err := newTracer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tracer.export([]*span{{name: "x", start: time.Now(), end: time.Now()}})
+	if err == nil {
+		t.Error("export succeeded")
+	}
+}
@@ -0,0 +1,114 @@
+package gosp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoWriter appends the fields of a protobuf message, for the few OTLP
+// messages the exporter sends
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (w *protoWriter) varint(field int, value uint64) {
+	w.tag(field, wireVarint)
+	w.buf = binary.AppendUvarint(w.buf, value)
+}
+
+func (w *protoWriter) fixed64(field int, value uint64) {
+	w.tag(field, wireFixed64)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, value)
+}
+
+func (w *protoWriter) bytes(field int, value []byte) {
+	w.tag(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *protoWriter) string(field int, value string) {
+	w.tag(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+// message writes the fields encode writes as an embedded message
+func (w *protoWriter) message(field int, encode func(*protoWriter)) {
+	var inner protoWriter
+	encode(&inner)
+	w.bytes(field, inner.buf)
+}
+
+// encodeProtobuf encodes spans as an ExportTraceServiceRequest in the
+// protobuf encoding of OTLP, with the field numbers of
+// opentelemetry/proto/trace/v1/trace.proto
+func (t *spanTracer) encodeProtobuf(spans []*span) []byte {
+	var request protoWriter
+	// ExportTraceServiceRequest.resource_spans
+	request.message(1, func(resourceSpans *protoWriter) {
+		// ResourceSpans.resource
+		resourceSpans.message(1, func(resource *protoWriter) {
+			protoAttributes(resource, 1, t.resource)
+		})
+		// ResourceSpans.scope_spans
+		resourceSpans.message(2, func(scopeSpans *protoWriter) {
+			scopeSpans.message(1, func(scope *protoWriter) {
+				scope.string(1, "gosp")
+			})
+			for _, s := range spans {
+				scopeSpans.message(2, s.encodeProtobuf)
+			}
+		})
+	})
+	return request.buf
+}
+
+// encodeProtobuf writes the fields of an OTLP Span
+func (s *span) encodeProtobuf(w *protoWriter) {
+	w.bytes(1, s.traceID[:])
+	w.bytes(2, s.spanID[:])
+	if s.parentID != [8]byte{} {
+		w.bytes(4, s.parentID[:])
+	}
+	w.string(5, s.name)
+	w.varint(6, uint64(s.kind))
+	w.fixed64(7, uint64(s.start.UnixNano()))
+	w.fixed64(8, uint64(s.end.UnixNano()))
+	protoAttributes(w, 9, s.attrs)
+	if s.failed {
+		w.message(15, func(status *protoWriter) {
+			status.string(2, s.errMessage)
+			// STATUS_CODE_ERROR
+			status.varint(3, 2)
+		})
+	}
+}
+
+// protoAttributes writes attributes as repeated KeyValue fields
+func protoAttributes(w *protoWriter, field int, attrs []spanAttr) {
+	for _, attr := range attrs {
+		w.message(field, func(kv *protoWriter) {
+			kv.string(1, attr.key)
+			kv.message(2, func(value *protoWriter) {
+				switch v := attr.value.(type) {
+				case int64:
+					value.varint(3, uint64(v))
+				default:
+					value.string(1, fmt.Sprint(v))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package gosp
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchBackend reports the changes of the paths added to it, as
+// fsnotify does
+type watchBackend interface {
+	Add(name string) error
+	Remove(name string) error
+	WatchList() []string
+	Close() error
+
+	events() <-chan fsnotify.Event
+	errors() <-chan error
+}
+
+// notifyWatcher watches with the system's notifications
+type notifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w notifyWatcher) events() <-chan fsnotify.Event { return w.Events }
+func (w notifyWatcher) errors() <-chan error          { return w.Errors }
+
+// pollWatcher watches by scanning the paths added on an interval, for the
+// filesystems whose notifications don't arrive, such as NFS and the bind
+// mounts of Docker on macOS. Like notifications, the scan of a directory
+// reports its files and directories created or removed and its files
+// written, not what happens further below.
+type pollWatcher struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	watched map[string]*polledPath
+
+	eventsC chan fsnotify.Event
+	errorsC chan error
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// polledPath is the snapshot of a path added, with that of its entries
+// when it is a directory
+type polledPath struct {
+	state   fileState
+	entries map[string]fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+func stateOf(info os.FileInfo) fileState {
+	return fileState{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		interval: interval,
+		watched:  make(map[string]*polledPath),
+		eventsC:  make(chan fsnotify.Event),
+		errorsC:  make(chan error),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) events() <-chan fsnotify.Event { return w.eventsC }
+func (w *pollWatcher) errors() <-chan error          { return w.errorsC }
+
+// Add takes the snapshot of a path, changes being reported against it
+func (w *pollWatcher) Add(name string) error {
+	name = filepath.Clean(name)
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	polled := &polledPath{state: stateOf(info)}
+	if info.IsDir() {
+		if polled.entries, err = listEntries(name); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, exists := w.watched[name]; !exists {
+		w.watched[name] = polled
+	}
+	return nil
+}
+
+func (w *pollWatcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watched, filepath.Clean(name))
+	return nil
+}
+
+func (w *pollWatcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := make([]string, 0, len(w.watched))
+	for name := range w.watched {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Close stops the scans, closing the channels of events
+func (w *pollWatcher) Close() error {
+	w.closed.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	defer close(w.errorsC)
+	defer close(w.eventsC)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		for _, event := range w.scan() {
+			select {
+			case w.eventsC <- event:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// scan compares the paths added with their snapshots, which it updates,
+// and returns the events of the differences. They are sent once the lock
+// is released, as their handling adds and removes paths.
+func (w *pollWatcher) scan() []fsnotify.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// A file added and its directory report it once
+	var events []fsnotify.Event
+	seen := make(map[string]int)
+	report := func(name string, op fsnotify.Op) {
+		if i, exists := seen[name]; exists {
+			events[i].Op |= op
+			return
+		}
+		seen[name] = len(events)
+		events = append(events, fsnotify.Event{Name: name, Op: op})
+	}
+
+	names := make([]string, 0, len(w.watched))
+	for name := range w.watched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var gone []string
+	for _, name := range names {
+		polled := w.watched[name]
+		info, err := os.Stat(name)
+		if err != nil {
+			// Gone, its watch with it. The directory holding it reports
+			// the removal, when it is watched.
+			gone = append(gone, name)
+			if _, parent := w.watched[filepath.Dir(name)]; !parent {
+				report(name, fsnotify.Remove)
+			}
+			continue
+		}
+
+		state := stateOf(info)
+		if polled.entries == nil {
+			if op := changeOf(polled.state, state); op != 0 {
+				report(name, op)
+			}
+			polled.state = state
+			continue
+		}
+
+		entries, err := listEntries(name)
+		if err != nil {
+			continue
+		}
+		for entry, now := range entries {
+			before, existed := polled.entries[entry]
+			switch {
+			case !existed || before.mode.IsDir() != now.mode.IsDir():
+				report(filepath.Join(name, entry), fsnotify.Create)
+			case now.mode.IsDir():
+				// Directories change as their entries do, which their own
+				// scans report
+			default:
+				if op := changeOf(before, now); op != 0 {
+					report(filepath.Join(name, entry), op)
+				}
+			}
+		}
+		for entry := range polled.entries {
+			if _, exists := entries[entry]; !exists {
+				report(filepath.Join(name, entry), fsnotify.Remove)
+			}
+		}
+		polled.state, polled.entries = state, entries
+	}
+	for _, name := range gone {
+		delete(w.watched, name)
+	}
+	return events
+}
+
+// changeOf returns the op of a file that changed between two snapshots,
+// 0 for none
+func changeOf(before, now fileState) fsnotify.Op {
+	switch {
+	case !before.modTime.Equal(now.modTime) || before.size != now.size:
+		return fsnotify.Write
+	case before.mode != now.mode:
+		return fsnotify.Chmod
+	}
+	return 0
+}
+
+// listEntries takes the snapshot of the entries of a directory
+func listEntries(dir string) (map[string]fileState, error) {
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]fileState, len(list))
+	for _, entry := range list {
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since it was listed
+			continue
+		}
+		entries[entry.Name()] = stateOf(info)
+	}
+	return entries, nil
+}
@@ -0,0 +1,55 @@
+package gosp
+
+import (
+	"context"
+	"sync"
+)
+
+// Output buffers grown past this aren't kept, so one large page doesn't
+// pin its memory in the pool
+const maxPooledOutput = 1 << 20
+
+// Processors of finished renders, reused with their data map and output
+// buffer
+var processorPool = sync.Pool{
+	New: func() interface{} {
+		return &TemplateProcessor{data: make(map[string]interface{})}
+	},
+}
+
+// newProcessor takes a processor from the pool for a render of the
+// server's pages. It must be given back with recycle once the output was
+// written.
+func (srv *server) newProcessor(ctx context.Context) *TemplateProcessor {
+	tp := processorPool.Get().(*TemplateProcessor)
+	tp.ctx = ctx
+	tp.files = srv.files
+	tp.templates = srv.templates
+	return tp
+}
+
+// recycle clears the processor and puts it back in the pool. The data map
+// is emptied rather than replaced, and the slices are kept for their
+// capacity. Stamps are dropped, as the template cache holds on to them.
+func (tp *TemplateProcessor) recycle() {
+	clear(tp.data)
+	tp.roots = nil
+	tp.files = nil
+	tp.templates = nil
+	tp.embedded = false
+	tp.contentType = ""
+	tp.charset = ""
+	tp.minify = false
+	tp.includeLimit = 0
+	tp.ctx = nil
+	tp.err = nil
+	tp.includes = tp.includes[:0]
+	tp.stamps = nil
+	tp.evaluator = tagEvaluator{}
+	tp.active.Reset()
+	tp.output = tp.output[:0]
+	if cap(tp.output) > maxPooledOutput {
+		tp.output = nil
+	}
+	processorPool.Put(tp)
+}
@@ -0,0 +1,45 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// pprofHandler serves the runtime profiles under /debug/pprof/
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startPprof serves the profiles for --pprof on their own listener at
+// addr, which stops with the main server. Without an address they are
+// routes of the site, behind its middleware.
+func startPprof(e *echo.Echo, addr string) error {
+	handler := pprofHandler()
+	listener, err := listenOn("tcp", addr, "", "")
+	if err != nil {
+		return fmt.Errorf("pprof listener: %v", err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	e.Server.RegisterOnShutdown(func() {
+		server.Shutdown(context.Background())
+	})
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serverLog.Error("pprof listener stopped", "addr", addr, "err", err)
+		}
+	}()
+	serverLog.Info("pprof listening", "url", fmt.Sprintf("http://%s/debug/pprof/", listener.Addr()))
+	return nil
+}
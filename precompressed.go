@@ -0,0 +1,109 @@
+package gosp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Suffixes of the precompressed sidecars a build may write next to a static
+// file, by the encoding they hold
+var sidecarSuffixes = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// findSidecar picks the precompressed sidecar of a file to send for a
+// request, the one of the encoding the client prefers. Sidecars older than
+// the file are left from an earlier build and ignored, as are those of
+// files whose type the extension doesn't tell. varies reports whether the
+// file has any sidecar, so the response depends on Accept-Encoding.
+func (f *siteFS) findSidecar(req *http.Request, file string, info os.FileInfo) (encoding string, sidecar os.FileInfo, varies bool) {
+	if mime.TypeByExtension(filepath.Ext(file)) == "" {
+		return "", nil, false
+	}
+	fresh := make(map[string]os.FileInfo)
+	for encoding, suffix := range sidecarSuffixes {
+		stat, err := f.statFile(file + suffix)
+		if err == nil && !stat.IsDir() && !stat.ModTime().Before(info.ModTime()) {
+			fresh[encoding] = stat
+		}
+	}
+	if len(fresh) == 0 {
+		return "", nil, false
+	}
+	for _, encoding := range acceptedEncodings(req.Header.Get(echo.HeaderAcceptEncoding)) {
+		if stat, ok := fresh[encoding]; ok {
+			return encoding, stat, true
+		}
+	}
+	return "", nil, true
+}
+
+// serveSidecar sends the sidecar of a file as the file in its encoding. The
+// ETag differs from the uncompressed file's, as the bytes do.
+func (f *siteFS) serveSidecar(c echo.Context, file, encoding string, sidecar os.FileInfo) error {
+	sent, err := f.openFile(file + sidecarSuffixes[encoding])
+	if err != nil {
+		return err
+	}
+	defer sent.Close()
+	content, ok := sent.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("%s can't seek", file+sidecarSuffixes[encoding])
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, mime.TypeByExtension(filepath.Ext(file)))
+	header.Set(echo.HeaderContentEncoding, encoding)
+	header.Set("ETag", fmt.Sprintf("\"%x-%x-%s\"", sidecar.ModTime().UnixNano(), sidecar.Size(), encoding))
+	http.ServeContent(c.Response(), c.Request(), filepath.Base(file), sidecar.ModTime(), content)
+	return nil
+}
+
+// addVary adds a field to the Vary header unless it's there already, as
+// the compression middleware may have added it
+func addVary(header http.Header, field string) {
+	for _, value := range header.Values(echo.HeaderVary) {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), field) {
+				return
+			}
+		}
+	}
+	header.Add(echo.HeaderVary, field)
+}
+
+// collectSidecars embeds the fresh sidecars of the static pages compiled
+// in
+func collectSidecars(site *compiledSite, templates map[string]string) error {
+	for name := range templates {
+		if !site.source.isStaticFile(name) || mime.TypeByExtension(path.Ext(name)) == "" {
+			continue
+		}
+		file := filepath.Join(site.root, filepath.FromSlash(name))
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		for _, suffix := range sidecarSuffixes {
+			stat, err := os.Stat(file + suffix)
+			if err != nil || stat.IsDir() {
+				continue
+			}
+			if stat.ModTime().Before(info.ModTime()) {
+				compileLog.Warn("Skipped sidecar older than its file", "file", name+suffix)
+				continue
+			}
+			if err := site.readFile(file + suffix); err != nil {
+				return err
+			}
+			compileLog.Info("Added sidecar", "file", name+suffix)
+		}
+	}
+	return nil
+}
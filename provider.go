@@ -0,0 +1,67 @@
+package gosp
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Provider supplies the data of a page from Go. The values it returns are
+// rendered by the route's template as if it had assigned them. An error is
+// answered with an error page, with the status and message of an
+// *echo.HTTPError or as a 500.
+type Provider func(c echo.Context) (map[string]interface{}, error)
+
+// Providers by name, for the provider attribute of routes
+var providers = map[string]Provider{}
+
+// RegisterProvider names a provider for the routes of the config, as in
+// <route path="/users/:id" file="user.html" provider="user">. Providers
+// are registered before New or Main reads the config.
+func RegisterProvider(name string, provider Provider) {
+	providers[name] = provider
+}
+
+// Handle serves a template at a path of the site New makes, with the data
+// of a provider, for GET and HEAD requests. It is ordered with the routes
+// of the config, one of them for the same path being a duplicate.
+func Handle(path, file string, provider Provider) Option {
+	return func(o *siteOptions) error {
+		o.handled = append(o.handled, Route{
+			Path:     path,
+			File:     file,
+			Methods:  []string{"GET"},
+			source:   "gosp.Handle",
+			provider: provider,
+		})
+		return nil
+	}
+}
+
+// prepareProvider looks up the provider a route names
+func (route *Route) prepareProvider() error {
+	if route.Provider == "" {
+		return nil
+	}
+	if route.provider = providers[route.Provider]; route.provider == nil {
+		return fmt.Errorf("unknown provider %q", route.Provider)
+	}
+	return nil
+}
+
+// withProvider runs the provider of a route before its template, handing
+// the data it returns to the template
+func withProvider(route Route, next echo.HandlerFunc) echo.HandlerFunc {
+	if route.provider == nil {
+		return next
+	}
+	return func(c echo.Context) error {
+		c.Set(templateNameKey, route.File)
+		data, err := route.provider(c)
+		if err != nil {
+			return serveError(c, errorReport{message: "Provider error", err: err, template: route.File})
+		}
+		c.Set(templateValuesKey, data)
+		return next(c)
+	}
+}
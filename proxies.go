@@ -0,0 +1,67 @@
+package gosp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP is the address of the direct peer of a request, or unix:/path
+// for Unix socket listeners
+func peerIP(req *http.Request) string {
+	if peer, ok := req.Context().Value(socketPeerKey{}).(string); ok {
+		return peer
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// clientIPExtractor resolves the client behind the trusted proxies. Hops
+// of X-Forwarded-For are walked from the nearest until one isn't trusted;
+// without the header, a trusted peer's X-Real-IP is used. Headers from
+// untrusted peers are ignored. The proxy in front of a Unix socket is
+// always trusted, as the socket permissions decide who connects.
+func clientIPExtractor(trusted []*net.IPNet) echo.IPExtractor {
+	return func(req *http.Request) string {
+		client := peerIP(req)
+		if _, socket := req.Context().Value(socketPeerKey{}).(string); !socket {
+			if ip := net.ParseIP(client); ip == nil || !isTrustedProxy(trusted, ip) {
+				return client
+			}
+		}
+
+		if forwarded := req.Header.Values(echo.HeaderXForwardedFor); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				// A malformed hop leaves the last proxy that could be checked
+				ip := net.ParseIP(strings.Trim(strings.TrimSpace(hops[i]), "[]"))
+				if ip == nil {
+					return client
+				}
+				client = ip.String()
+				if !isTrustedProxy(trusted, ip) {
+					return client
+				}
+			}
+			return client
+		}
+
+		if ip := net.ParseIP(strings.Trim(strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP)), "[]")); ip != nil {
+			return ip.String()
+		}
+		return client
+	}
+}
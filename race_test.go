@@ -0,0 +1,209 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// These tests run the state requests share from many goroutines at once,
+// and are meant for go test -race.
+
+// Renders of the same templates at once each get their own data, includes
+// and output
+func TestConcurrentRenders(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"a.html":        `<%@include file="inc/head.html" %><% n = "a" %><%= n %>=<%= query.n %>`,
+		"b.html":        `<%@include file="inc/head.html" %><% n = "b" %>b=<%= query.n %><%= n %>`,
+		"inc/head.html": `[<%= query.n %>]`,
+	}, "<routes/>")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				n := strconv.Itoa(i*100 + j)
+				if _, body := get(t, handler, http.MethodGet, "/a?n="+n); body != "["+n+"]a="+n {
+					t.Errorf("a for %s: %q", n, body)
+					return
+				}
+				if _, body := get(t, handler, http.MethodGet, "/b?n="+n); body != "["+n+"]b="+n+"b" {
+					t.Errorf("b for %s: %q", n, body)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Pages render whole, as before or after a change, while the watcher
+// drops what the changed include was cached in
+func TestRendersDuringInvalidation(t *testing.T) {
+	ts := newTestServer(t, map[string]string{
+		"index.html":    `<%@include file="inc/part.html" %>!`,
+		"inc/part.html": "v0",
+	}, "<routes/>", "--watch")
+	routes := ts.sites.active().routes
+	fw, err := ts.setupFileWatcher(routes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.watcher.Close()
+
+	part := filepath.Join(ts.root, "inc", "part.html")
+	var version atomic.Int64
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		for v := 1; ; v++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Written aside and renamed, so no render reads it half written
+			next := part + ".next"
+			if err := os.WriteFile(next, []byte("v"+strconv.Itoa(v)), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := os.Rename(next, part); err != nil {
+				t.Error(err)
+				return
+			}
+			fw.changed(fsnotify.Event{Name: part, Op: fsnotify.Write})
+			version.Store(int64(v))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 100; j++ {
+				before := version.Load()
+				res, body := get(t, ts.sites, http.MethodGet, "/")
+				var v int64
+				if _, err := fmt.Sscanf(body, "v%d!", &v); err != nil || res.StatusCode != http.StatusOK {
+					t.Errorf("%d %q", res.StatusCode, body)
+					return
+				}
+				// A version the watcher was told about before the request
+				// began is never served stale
+				if v < before {
+					t.Errorf("served v%d after v%d was invalidated", v, before)
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	writer.Wait()
+}
+
+// Reloads swapping the site under traffic leave every request served by
+// one site or the other
+func TestReloadUnderTraffic(t *testing.T) {
+	configs := []string{
+		`<routes><route path="/page" file="one.html"><methods>GET</methods></route></routes>`,
+		`<routes><route path="/page" file="two.html"><methods>GET</methods></route></routes>`,
+	}
+	ts := newTestServer(t, map[string]string{"one.html": "one", "two.html": "two"}, configs[0])
+
+	stop := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 1; i <= 30; i++ {
+			if err := os.WriteFile(ts.config, []byte(configs[i%2]), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			if result := ts.reloader.reload(); !result.Reloaded {
+				t.Errorf("reload %d: %v", i, result.Errors)
+				return
+			}
+		}
+		close(stop)
+	}()
+
+	var requests sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if res, body := get(t, ts.sites, http.MethodGet, "/page"); res.StatusCode != http.StatusOK || body != "one" && body != "two" {
+					t.Errorf("%d %q during a reload", res.StatusCode, body)
+					return
+				}
+			}
+		}()
+	}
+	reloads.Wait()
+	requests.Wait()
+	if _, body := get(t, ts.sites, http.MethodGet, "/page"); body != "one" {
+		t.Errorf("after the last reload: %q", body)
+	}
+}
+
+// Sessions read and written at once, by many clients and by one client
+// from many requests, keep their values
+func TestParallelSessions(t *testing.T) {
+	for _, store := range []string{"file", "cookie"} {
+		t.Run(store, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "sessions")
+			handler, _ := newTestSite(t, map[string]string{
+				"set.html": `<% session.user = query.user %>set`,
+				"get.html": `user=<%= session.user %>`,
+			}, `<routes><session store="`+store+`" dir="`+dir+`" secret="0123456789abcdef0123456789abcdef"/></routes>`)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					user := "user" + strconv.Itoa(i)
+					res, _ := get(t, handler, http.MethodGet, "/set?user="+user)
+					cookie := "gosp_session=" + cookieOf(res, "gosp_session")
+
+					// The client's own requests read it at once
+					var reads sync.WaitGroup
+					for j := 0; j < 8; j++ {
+						reads.Add(1)
+						go func() {
+							defer reads.Done()
+							if _, body := get(t, handler, http.MethodGet, "/get", "Cookie", cookie); body != "user="+user {
+								t.Errorf("%s reads %q", user, body)
+							}
+						}()
+					}
+					reads.Wait()
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package gosp
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+const defaultRateLimitKeys = 10000
+
+// Rate limit settings for a route or group
+type RateLimit struct {
+	RPS      string `xml:"rps,attr"`
+	Burst    int    `xml:"burst,attr"`
+	By       string `xml:"by,attr"`
+	MaxKeys  int    `xml:"maxKeys,attr"`
+	Template string `xml:"template,attr"`
+
+	limiter *limiterStore
+}
+
+// prepare validates the settings and creates the limiter store
+func (rl *RateLimit) prepare() error {
+	rps, err := strconv.ParseFloat(rl.RPS, 64)
+	if err != nil || rps <= 0 || math.IsInf(rps, 0) {
+		return fmt.Errorf("ratelimit rps must be a positive number, got %q", rl.RPS)
+	}
+
+	if rl.Burst <= 0 {
+		rl.Burst = int(math.Ceil(rps))
+	}
+	if rl.MaxKeys <= 0 {
+		rl.MaxKeys = defaultRateLimitKeys
+	}
+	if rl.By == "" {
+		rl.By = "ip"
+	}
+	if rl.By != "ip" && !strings.HasPrefix(rl.By, "header:") {
+		return fmt.Errorf("ratelimit by must be \"ip\" or \"header:<name>\", got %q", rl.By)
+	}
+
+	rl.limiter = newLimiterStore(rate.Limit(rps), rl.Burst, rl.MaxKeys)
+	return nil
+}
+
+// Limit returns the parsed requests per second
+func (rl *RateLimit) Limit() float64 {
+	return float64(rl.limiter.limit)
+}
+
+// key identifies the client a request is counted against
+func (rl *RateLimit) key(c echo.Context) string {
+	if header := strings.TrimPrefix(rl.By, "header:"); header != rl.By {
+		if value := c.Request().Header.Get(header); value != "" {
+			return "header:" + value
+		}
+	}
+
+	return "ip:" + c.RealIP()
+}
+
+func rateLimitMiddleware(rl *RateLimit) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			allowed, retryAfter := rl.limiter.allow(rl.key(c), time.Now())
+			if allowed {
+				return next(c)
+			}
+
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+
+			if rl.Template != "" {
+				return renderTemplate(c, rl.Template, http.StatusTooManyRequests)
+			}
+			return c.String(http.StatusTooManyRequests, "Too many requests")
+		}
+	}
+}
+
+// limiterStore holds one token bucket per key, evicting the least
+// recently used key once maxKeys is reached
+type limiterStore struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	maxKeys int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type limiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newLimiterStore(limit rate.Limit, burst, maxKeys int) *limiterStore {
+	return &limiterStore{
+		limit:   limit,
+		burst:   burst,
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// allow consumes a token for key, returning how long to wait when none is left
+func (store *limiterStore) allow(key string, now time.Time) (bool, time.Duration) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var limiter *rate.Limiter
+	if element, exists := store.entries[key]; exists {
+		store.order.MoveToFront(element)
+		limiter = element.Value.(*limiterEntry).limiter
+	} else {
+		if store.order.Len() >= store.maxKeys {
+			oldest := store.order.Back()
+			store.order.Remove(oldest)
+			delete(store.entries, oldest.Value.(*limiterEntry).key)
+		}
+		limiter = rate.NewLimiter(store.limit, store.burst)
+		store.entries[key] = store.order.PushFront(&limiterEntry{key: key, limiter: limiter})
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+
+	reservation.CancelAt(now)
+	return false, delay
+}
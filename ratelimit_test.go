@@ -0,0 +1,146 @@
+package gosp
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A key gets its burst at once, then a token per 1/rps
+func TestLimiterBurst(t *testing.T) {
+	store := newLimiterStore(rate.Limit(2), 3, 10)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if allowed, _ := store.allow("a", now); !allowed {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	allowed, wait := store.allow("a", now)
+	if allowed || wait != 500*time.Millisecond {
+		t.Fatalf("request over the burst: allowed %v, wait %s", allowed, wait)
+	}
+	// A refused request takes no token
+	if allowed, wait := store.allow("a", now.Add(250*time.Millisecond)); allowed || wait != 250*time.Millisecond {
+		t.Fatalf("250ms later: allowed %v, wait %s", allowed, wait)
+	}
+	if allowed, _ := store.allow("a", now.Add(500*time.Millisecond)); !allowed {
+		t.Fatal("refused once a token was back")
+	}
+	if allowed, _ := store.allow("b", now); !allowed {
+		t.Fatal("another key shares the bucket")
+	}
+
+	// The bucket fills up to the burst only
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := store.allow("a", later); !allowed {
+			t.Fatalf("request %d of the burst an hour later refused", i+1)
+		}
+	}
+	if allowed, _ := store.allow("a", later); allowed {
+		t.Fatal("burst grew past its size while idle")
+	}
+}
+
+// Over maxKeys the least recently used key is forgotten, and starts over
+// with a full bucket
+func TestLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newLimiterStore(rate.Limit(1), 1, 2)
+	now := time.Now()
+	store.allow("a", now)
+	store.allow("b", now)
+	// a is used again, so b is the oldest
+	if allowed, _ := store.allow("a", now); allowed {
+		t.Fatal("a allowed over its burst")
+	}
+	store.allow("c", now)
+	if len(store.entries) != 2 || store.order.Len() != 2 {
+		t.Fatalf("%d keys held, want 2", len(store.entries))
+	}
+	if _, held := store.entries["b"]; held {
+		t.Fatal("b kept, though used least recently")
+	}
+	if allowed, _ := store.allow("a", now); allowed {
+		t.Fatal("a forgotten, though used recently")
+	}
+	if allowed, _ := store.allow("b", now); !allowed {
+		t.Fatal("b refused after it was forgotten")
+	}
+}
+
+// Concurrent requests of one key get the burst and no more. Run with
+// -race.
+func TestLimiterConcurrentBurst(t *testing.T) {
+	store := newLimiterStore(rate.Limit(0.001), 20, 5)
+	now := time.Now()
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if ok, _ := store.allow("shared", now); ok {
+				allowed.Add(1)
+			}
+			// Other keys churn through the store meanwhile
+			store.allow("key"+strconv.Itoa(i%3), now)
+		}(i)
+	}
+	wg.Wait()
+	if allowed.Load() != 20 {
+		t.Fatalf("%d requests allowed, want the burst of 20", allowed.Load())
+	}
+	if len(store.entries) > 5 {
+		t.Fatalf("%d keys held, over maxKeys", len(store.entries))
+	}
+}
+
+func TestRateLimitPrepare(t *testing.T) {
+	rl := &RateLimit{RPS: "2.5"}
+	if err := rl.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Burst != 3 || rl.MaxKeys != defaultRateLimitKeys || rl.By != "ip" || rl.Limit() != 2.5 {
+		t.Errorf("defaults %+v", rl)
+	}
+	for _, bad := range []RateLimit{{RPS: "0"}, {RPS: "-1"}, {RPS: "fast"}, {RPS: "+Inf"}, {RPS: "1", By: "cookie:x"}} {
+		if err := bad.prepare(); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+// A route's burst is served, then requests over it get 429 with a
+// Retry-After, per client
+func TestRateLimitRouteBurst(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"contact.html": "sent",
+		"slow.html":    "slow down",
+	}, `<routes>
+  <route path="/contact" file="contact.html">
+    <methods>GET</methods>
+    <ratelimit rps="0.5" burst="3" by="header:X-Client" template="slow.html"/>
+  </route>
+</routes>`)
+
+	for i := 0; i < 3; i++ {
+		if res, body := get(t, handler, http.MethodGet, "/contact", "X-Client", "a"); res.StatusCode != http.StatusOK || body != "sent" {
+			t.Fatalf("request %d of the burst: %d %q", i+1, res.StatusCode, body)
+		}
+	}
+	res, body := get(t, handler, http.MethodGet, "/contact", "X-Client", "a")
+	if res.StatusCode != http.StatusTooManyRequests || body != "slow down" {
+		t.Fatalf("over the burst: %d %q", res.StatusCode, body)
+	}
+	if retry := res.Header.Get("Retry-After"); retry != "2" {
+		t.Errorf("Retry-After %q, want 2", retry)
+	}
+	if res, _ := get(t, handler, http.MethodGet, "/contact", "X-Client", "b"); res.StatusCode != http.StatusOK {
+		t.Errorf("another client: %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,83 @@
+package gosp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newRedirectServer answers plain HTTP on addr with permanent redirects to
+// the HTTPS listener on httpsPort, serving ACME challenges first when
+// certificates are obtained automatically
+func newRedirectServer(addr, httpsPort string, acme *autoTLS) *http.Server {
+	handler := httpsRedirectHandler(httpsPort)
+	if acme != nil {
+		handler = acme.manager.HTTPHandler(handler)
+	}
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// startRedirectServer runs the redirect listener until the HTTPS server
+// shuts down, opening redirect.Addr unless systemd passed the listener
+func startRedirectServer(redirect *http.Server, https *http.Server, listener net.Listener) {
+	https.RegisterOnShutdown(func() {
+		redirect.Shutdown(context.Background())
+	})
+
+	if listener == nil {
+		var err error
+		listener, err = listenOn("tcp", redirect.Addr, "", "")
+		if err != nil {
+			serverLog.Error("HTTP redirect listener failed", "err", err)
+			return
+		}
+	}
+	go func() {
+		if err := redirect.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serverLog.Error("HTTP redirect listener stopped", "addr", listener.Addr().String(), "err", err)
+		}
+	}()
+	serverLog.Info("Redirect listening (HTTP to HTTPS)", "addr", listener.Addr().String())
+}
+
+// httpsRedirectHandler redirects to the same host, path and query over HTTPS
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			// IPv6 literal
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// hstsMiddleware tells browsers to use HTTPS for the next maxAge seconds
+func hstsMiddleware(maxAge int) echo.MiddlewareFunc {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.IsTLS() {
+				c.Response().Header().Set("Strict-Transport-Security", value)
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package gosp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "gosp:session:"
+	redisTimeout   = 5 * time.Second
+	redisIdleConns = 8
+)
+
+// redisSessionStore keeps sessions in Redis, which expires them by itself
+type redisSessionStore struct {
+	settings *RedisSettings
+	idle     chan *redisConn
+}
+
+// redisConn is one connection speaking the Redis protocol (RESP)
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Error reply sent by the server, the connection stays usable
+type redisError string
+
+func (err redisError) Error() string { return "redis: " + string(err) }
+
+func newRedisSessionStore(settings *RedisSettings) *redisSessionStore {
+	return &redisSessionStore{settings: settings, idle: make(chan *redisConn, redisIdleConns)}
+}
+
+func (store *redisSessionStore) dial() (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	if store.settings.TLS == "true" {
+		host, _, _ := net.SplitHostPort(store.settings.Address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", store.settings.Address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", store.settings.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if store.settings.Password != "" {
+		if _, err := rc.do("AUTH", store.settings.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if store.settings.DB != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(store.settings.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command on an idle or new connection
+func (store *redisSessionStore) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-store.idle:
+	default:
+		var err error
+		if rc, err = store.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case store.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply parses one reply: strings, integers, nil or arrays of those
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (store *redisSessionStore) Load(token string) (map[string]string, error) {
+	if !validSessionToken(token) {
+		return nil, nil
+	}
+
+	reply, err := store.do("GET", redisKeyPrefix+token)
+	data, found := reply.(string)
+	if err != nil || !found {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (store *redisSessionStore) Save(token string, values map[string]string, maxAge time.Duration) (string, error) {
+	if !validSessionToken(token) {
+		var err error
+		if token, err = newSessionToken(); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	_, err = store.do("SET", redisKeyPrefix+token, string(data), "PX", strconv.FormatInt(maxAge.Milliseconds(), 10))
+	return token, err
+}
+
+func (store *redisSessionStore) Delete(token string) error {
+	if !validSessionToken(token) {
+		return nil
+	}
+	_, err := store.do("DEL", redisKeyPrefix+token)
+	return err
+}
+
+// Ping checks the server answers, for readiness
+func (store *redisSessionStore) Ping() error {
+	_, err := store.do("PING")
+	return err
+}
+
+// Purge only has work with all, Redis drops expired sessions itself
+func (store *redisSessionStore) Purge(all bool) (int, error) {
+	if !all {
+		return 0, nil
+	}
+
+	count := 0
+	cursor := "0"
+	for {
+		reply, err := store.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return count, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return count, errors.New("redis: unexpected SCAN reply")
+		}
+
+		keys, _ := page[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				args = append(args, fmt.Sprint(key))
+			}
+			deleted, err := store.do(args...)
+			if err != nil {
+				return count, err
+			}
+			if n, ok := deleted.(int64); ok {
+				count += int(n)
+			}
+		}
+
+		if cursor = fmt.Sprint(page[0]); cursor == "0" {
+			return count, nil
+		}
+	}
+}
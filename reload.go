@@ -0,0 +1,180 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// reloadResult is the JSON summary of a reload
+type reloadResult struct {
+	Reloaded bool     `json:"reloaded"`
+	Errors   []string `json:"errors,omitempty"`
+
+	// Route table differences from the config served before, keyed by
+	// "METHODS path"
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+
+	ResponsesFlushed int      `json:"responses_flushed"`
+	TemplatesFlushed int      `json:"templates_flushed"`
+	APIKeysReloaded  []string `json:"api_keys_reloaded,omitempty"`
+	Duration         string   `json:"duration"`
+}
+
+// reloader re-reads the route config on demand, builds its site and swaps
+// it in, flushing the caches. Requests arriving while a reload runs share
+// its result.
+type reloader struct {
+	sites  *siteHandler
+	server *server
+
+	// Follows the files of the config swapped in, nil when not watching
+	watcher *FileWatcher
+
+	mu      sync.Mutex
+	running *reloadCall
+}
+
+type reloadCall struct {
+	done   chan struct{}
+	result reloadResult
+}
+
+// reload runs a reload, or waits for the one in progress
+func (r *reloader) reload() reloadResult {
+	r.mu.Lock()
+	if call := r.running; call != nil {
+		r.mu.Unlock()
+		<-call.done
+		return call.result
+	}
+	call := &reloadCall{done: make(chan struct{})}
+	r.running = call
+	r.mu.Unlock()
+
+	call.result = r.run()
+	if call.result.Reloaded {
+		serverLog.Info("Reloaded", "responses_flushed", call.result.ResponsesFlushed, "templates_flushed", call.result.TemplatesFlushed)
+	} else {
+		serverLog.Error("Reload failed", "errors", strings.Join(call.result.Errors, "; "))
+	}
+
+	r.mu.Lock()
+	r.running = nil
+	r.mu.Unlock()
+	close(call.done)
+	return call.result
+}
+
+func (r *reloader) run() reloadResult {
+	start := time.Now()
+	result := reloadResult{}
+
+	// A config that doesn't build leaves the active site serving
+	active := r.sites.active().routes
+	s, err := r.rebuild(active)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		result.Duration = time.Since(start).String()
+		return result
+	}
+	r.sites.swap(s)
+	routes := s.routes
+	if r.watcher != nil {
+		r.watcher.follow(routes)
+	}
+
+	result.Added, result.Removed, result.Changed = diffRoutes(active.effectiveRoutes(), routes.effectiveRoutes())
+	// Read again with the config they belong to
+	for _, auth := range routes.apiKeyFiles() {
+		result.APIKeysReloaded = append(result.APIKeysReloaded, auth.KeysFile)
+	}
+
+	// Followed by the watcher when there is one
+	if r.watcher == nil {
+		for _, root := range r.server.files.memory {
+			if err := root.load(); err != nil {
+				serverLog.Warn("Could not load the root into memory again, keeping it as it was", "dir", root.dir, "err", err)
+			}
+		}
+	}
+	result.ResponsesFlushed = r.server.responses.flush()
+	result.TemplatesFlushed = r.server.templates.flush()
+	result.Reloaded = true
+	result.Duration = time.Since(start).String()
+	return result
+}
+
+// rebuild reads the route config again and builds its site aside,
+// refusing what a running server can't change
+func (r *reloader) rebuild(active *RouteConfig) (*site, error) {
+	options := r.server.options
+	routes, err := loadRouteConfig(r.server.files, options.config)
+	if err != nil {
+		return nil, err
+	}
+	if !sameSession(active.Session, routes.Session) {
+		return nil, fmt.Errorf("session settings changed, restart to apply")
+	}
+	s, err := r.server.build(routes)
+	if err != nil {
+		return nil, err
+	}
+	if options.validateOnStart {
+		if problems := r.server.validateTemplates(routes); logTemplateProblems(problems) {
+			return nil, fmt.Errorf("template problems: %d", len(problems))
+		}
+	}
+	return s, nil
+}
+
+// diffRoutes compares route tables by methods and path
+func diffRoutes(active, loaded []Route) (added, removed, changed []string) {
+	files := func(routes []Route) map[string]string {
+		byKey := make(map[string]string)
+		for _, route := range routes {
+			key := strings.TrimSpace(strings.ToUpper(strings.Join(route.Methods, ",")) + " " + route.Path)
+			if _, exists := byKey[key]; !exists {
+				byKey[key] = route.File
+			}
+		}
+		return byKey
+	}
+	before, after := files(active), files(loaded)
+
+	for key, file := range after {
+		if oldFile, exists := before[key]; !exists {
+			added = append(added, key)
+		} else if oldFile != file {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, exists := after[key]; !exists {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// reloadHandler answers POST requests with the reload summary, 422 when the
+// config has errors
+func reloadHandler(r *reloader) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		result := r.reload()
+		if !result.Reloaded {
+			return c.JSON(http.StatusUnprocessableEntity, result)
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,102 @@
+package gosp
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errRendersBusy = errors.New("too many concurrent renders")
+
+// renderLimiter caps the templates rendering at once. Requests over the
+// limit wait for a slot up to the queue timeout. Static files, cached
+// responses and health checks never render, so they aren't held up.
+type renderLimiter struct {
+	// First, for 64-bit atomic access on 32-bit platforms
+	queued   int64
+	rejected uint64
+
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newRenderLimiter(max int, timeout time.Duration) *renderLimiter {
+	return &renderLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// hold takes a render slot, waiting for one to free up. It fails with
+// errRendersBusy once the queue timeout passes, or with the context error
+// when the request is cancelled or times out first. The release function
+// may be called more than once.
+func (l *renderLimiter) hold(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&l.queued, 1)
+		err := l.wait(ctx)
+		atomic.AddInt64(&l.queued, -1)
+		if err == errRendersBusy {
+			atomic.AddUint64(&l.rejected, 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}, nil
+}
+
+func (l *renderLimiter) wait(ctx context.Context) error {
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errRendersBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reject answers a request that got no render slot with a 503, asking the
+// client to come back after about as long as it waited
+func (l *renderLimiter) reject(c echo.Context) error {
+	seconds := int(math.Ceil(l.timeout.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+	if wantsJSONError(c) {
+		return jsonError(c, http.StatusServiceUnavailable, "Server busy")
+	}
+	return c.String(http.StatusServiceUnavailable, "Server busy")
+}
+
+func registerRenderMetrics(l *renderLimiter) {
+	registerMetric("gosp_renders_active", "gauge", "Templates rendering now", func() float64 {
+		return float64(len(l.slots))
+	})
+	registerMetric("gosp_renders_queued", "gauge", "Requests waiting for a render slot", func() float64 {
+		return float64(atomic.LoadInt64(&l.queued))
+	})
+	registerMetric("gosp_renders_rejected_total", "counter", "Requests answered 503 for want of a render slot", func() float64 {
+		return float64(atomic.LoadUint64(&l.rejected))
+	})
+	registerMetric("gosp_renders_limit", "gauge", "Templates allowed to render at once", func() float64 {
+		return float64(cap(l.slots))
+	})
+}
@@ -0,0 +1,250 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/cache"
+)
+
+// Context key of the files a response was built from
+const dependenciesKey = "gosp.dependencies"
+
+// responseCache holds complete rendered GET responses, enabled per route,
+// bounded by their count and body size. The request headers the responses
+// of a method, path and query vary on are an entry of their own, so they
+// are evicted with the responses rather than kept for every URL seen.
+type responseCache struct {
+	entries *cache.Cache
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	files  []string
+}
+
+func newResponseCache(maxEntries int, maxBytes int64) (*responseCache, error) {
+	entries, err := cache.New(maxEntries, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("response cache %v", err)
+	}
+	return &responseCache{entries: entries}, nil
+}
+
+// varyKey is the key of the request headers the responses of a primary key
+// vary on. Variant keys name a header with "=" after the NUL.
+func varyKey(primary string) string {
+	return primary + "\x00vary"
+}
+
+// variantKey extends the primary key with the request headers named by Vary
+func variantKey(primary string, vary []string, req *http.Request) string {
+	key := primary
+	for _, name := range vary {
+		key += "\x00" + name + "=" + strings.Join(req.Header.Values(name), ",")
+	}
+	return key
+}
+
+func (cache *responseCache) get(primary string, req *http.Request) *cachedResponse {
+	var vary []string
+	if value, ok := cache.entries.Get(varyKey(primary), nil); ok {
+		vary = value.([]string)
+	}
+
+	value, ok := cache.entries.Get(variantKey(primary, vary, req), nil)
+	if !ok {
+		return nil
+	}
+	return value.(*cachedResponse)
+}
+
+// put stores a response for ttl
+func (cache *responseCache) put(primary string, vary []string, req *http.Request, entry *cachedResponse, ttl time.Duration) {
+	if len(vary) > 0 {
+		size := int64(0)
+		for _, name := range vary {
+			size += int64(len(name))
+		}
+		cache.entries.Put(varyKey(primary), vary, size, ttl)
+	} else {
+		cache.entries.Remove(varyKey(primary))
+	}
+	cache.entries.Put(variantKey(primary, vary, req), entry, int64(len(entry.body)), ttl)
+}
+
+// invalidate drops every response built from the file, or from the files
+// below it for a directory, and returns how many
+func (cache *responseCache) invalidate(file string) int {
+	file = filepath.Clean(file)
+	return cache.entries.RemoveIf(func(_ string, value interface{}) bool {
+		response, ok := value.(*cachedResponse)
+		if !ok {
+			return false
+		}
+		for _, dependency := range response.files {
+			if pathWithin(dependency, file) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// flush drops every response and returns how many
+func (cache *responseCache) flush() int {
+	count := cache.entries.RemoveIf(func(_ string, value interface{}) bool {
+		_, ok := value.(*cachedResponse)
+		return ok
+	})
+	cache.entries.Clear()
+	return count
+}
+
+// recordDependencies notes the files a response is built from, so cached
+// copies can be dropped when one of them changes
+func recordDependencies(c echo.Context, files ...string) {
+	if dependencies, ok := c.Get(dependenciesKey).(*[]string); ok {
+		for _, file := range files {
+			*dependencies = append(*dependencies, filepath.Clean(file))
+		}
+	}
+}
+
+// responseCacheMiddleware answers repeated GET and HEAD requests from the
+// cache for ttl, HEAD sharing the entries of GET. Only complete 200
+// responses without cookies, session use, JWT claims, the API key name, a
+// CSP nonce or a private or no-store Cache-Control are stored.
+func responseCacheMiddleware(cache *responseCache, ttl time.Duration, debug bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Byte ranges are left to the handler, which stores nothing as
+			// only 200 responses are kept
+			req := c.Request()
+			if req.Method != http.MethodGet && req.Method != http.MethodHead || req.Header.Get("Range") != "" {
+				return next(c)
+			}
+
+			res := c.Response()
+			primary := http.MethodGet + " " + req.URL.RequestURI()
+			// Tenants share paths, not pages
+			if t := tenantFor(c); t != nil {
+				primary = t.name + " " + primary
+			}
+			if entry := cache.get(primary, req); entry != nil {
+				for name, values := range entry.header {
+					res.Header()[name] = append([]string(nil), values...)
+				}
+				if debug {
+					res.Header().Set("X-Gosp-Cache", "HIT")
+				}
+				res.WriteHeader(entry.status)
+				_, err := res.Write(entry.body)
+				return err
+			}
+			if debug {
+				res.Header().Set("X-Gosp-Cache", "MISS")
+			}
+
+			// Headers set outside are set again on every hit
+			before := res.Header().Clone()
+			dependencies := &[]string{}
+			c.Set(dependenciesKey, dependencies)
+
+			writer := &captureWriter{ResponseWriter: res.Writer, limit: cache.entries.MaxBytes()}
+			res.Writer = writer
+			err := next(c)
+			res.Writer = writer.ResponseWriter
+
+			// Pages with a CSP nonce differ on every request, and those using
+			// the session, JWT claims or API key name are personal
+			if err != nil || !writer.cacheable() || c.Get(cspNonceUsedKey) != nil || c.Get(jwtClaimsUsedKey) != nil || c.Get(apiKeyNameUsedKey) != nil {
+				return err
+			}
+			if session := sessionFor(c); session != nil && session.used() {
+				return nil
+			}
+			// Precompressed sidecars suit only the clients accepting them
+			header := res.Header()
+			if header.Get("Set-Cookie") != "" || strings.Contains(header.Get("Cache-Control"), "private") ||
+				strings.Contains(header.Get("Cache-Control"), "no-store") || header.Get(echo.HeaderContentEncoding) != "" {
+				return nil
+			}
+
+			stored := make(http.Header)
+			for name, values := range header {
+				if strings.Join(values, "\n") != strings.Join(before[name], "\n") {
+					stored[name] = append([]string(nil), values...)
+				}
+			}
+			var vary []string
+			for _, value := range stored.Values(echo.HeaderVary) {
+				for _, name := range strings.Split(value, ",") {
+					// The cache holds the body before compression
+					if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && name != echo.HeaderAcceptEncoding {
+						vary = append(vary, name)
+					}
+				}
+			}
+			sort.Strings(vary)
+
+			cache.put(primary, vary, req, &cachedResponse{
+				status: writer.status,
+				header: stored,
+				body:   writer.body,
+				files:  *dependencies,
+			}, ttl)
+			return nil
+		}
+	}
+}
+
+// captureWriter keeps a copy of the response body while writing it through
+type captureWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	body     []byte
+	tooLarge bool
+	streamed bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if int64(len(w.body)+len(b)) > w.limit {
+			w.tooLarge = true
+			w.body = nil
+		} else {
+			w.body = append(w.body, b...)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush marks the response as streamed, those are never cached
+func (w *captureWriter) Flush() {
+	w.streamed = true
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *captureWriter) cacheable() bool {
+	return w.status == http.StatusOK && !w.tooLarge && !w.streamed
+}
@@ -0,0 +1,53 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Responses varying on a request header are kept apart, and the headers
+// they vary on are evicted with them: URLs never asked again don't hold
+// memory past --response-cache-entries
+func TestResponseCacheVaryBounded(t *testing.T) {
+	ts := newTestServer(t, map[string]string{
+		"page.html": `<%@header name="Vary" value="Accept-Language" %>page <%= query.n %>`,
+	}, `<routes responseCache="1m"/>`, "--response-cache-entries", "10")
+
+	for _, step := range []struct{ language, want string }{{"en", "MISS"}, {"en", "HIT"}, {"fr", "MISS"}, {"fr", "HIT"}, {"en", "HIT"}} {
+		res, body := get(t, ts.sites, http.MethodGet, "/page?n=1", "Accept-Language", step.language)
+		if got := res.Header.Get("X-Gosp-Cache"); got != step.want || body != "page 1" {
+			t.Errorf("%s: %s %q, want %s", step.language, got, body, step.want)
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		get(t, ts.sites, http.MethodGet, fmt.Sprintf("/page?n=%d", i), "Accept-Language", "en")
+	}
+	if stats := ts.responses.entries.Stats(); stats.Entries > 10 {
+		t.Errorf("%d cache entries after 500 URLs, bound 10", stats.Entries)
+	}
+	if count := ts.responses.flush(); count == 0 || count > 10 {
+		t.Errorf("flush dropped %d responses", count)
+	}
+}
+
+// A page printing the API key name isn't cached for the next key holder
+func TestResponseCacheSkipsKeyName(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"whoami.html": `key <%= apikey.name %>`,
+		"shared.html": `shared`,
+	}, `<routes responseCache="1m"><auth type="apikey" keys="alice:alice-key,bob:bob-key"/></routes>`)
+
+	for _, step := range []struct{ key, path, want, cache string }{
+		{"alice-key", "/whoami", "key alice", "MISS"},
+		{"bob-key", "/whoami", "key bob", "MISS"},
+		{"alice-key", "/shared", "shared", "MISS"},
+		{"bob-key", "/shared", "shared", "HIT"},
+	} {
+		res, body := get(t, handler, http.MethodGet, step.path, "X-API-Key", step.key)
+		if body != step.want || res.Header.Get("X-Gosp-Cache") != step.cache {
+			t.Errorf("%s with %s: %q %s, want %q %s", step.path, step.key, body, res.Header.Get("X-Gosp-Cache"), step.want, step.cache)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const originalPathKey = "gosp.originalPath"
+
+// Rewrite maps request paths matching a pattern onto another path, either
+// internally or with an external redirect
+type Rewrite struct {
+	Pattern  string `xml:"pattern,attr"`
+	To       string `xml:"to,attr"`
+	Redirect string `xml:"redirect,attr"`
+
+	regex  *regexp.Regexp
+	status int
+}
+
+func (rw *Rewrite) prepare() error {
+	// An empty pattern matches every path, rewriting each request in a loop
+	if rw.Pattern == "" {
+		return fmt.Errorf("rewrite to %q: missing pattern", rw.To)
+	}
+	regex, err := regexp.Compile(rw.Pattern)
+	if err != nil {
+		return fmt.Errorf("rewrite %q: %v", rw.Pattern, err)
+	}
+	rw.regex = regex
+
+	switch rw.Redirect {
+	case "", "false":
+	case "true":
+		rw.status = http.StatusMovedPermanently
+	default:
+		status, err := strconv.Atoi(rw.Redirect)
+		if err != nil || status < 300 || status > 308 {
+			return fmt.Errorf("rewrite %q: invalid redirect %q, expected true or a 3xx status", rw.Pattern, rw.Redirect)
+		}
+		rw.status = status
+	}
+
+	return nil
+}
+
+// Status returns the redirect status, or 0 for an internal rewrite
+func (rw *Rewrite) Status() int {
+	return rw.status
+}
+
+// rewriteMiddleware applies the rules in order to the request path, the
+// path each rewrites to being matched against the rules again. A rule
+// applies once per request, so one whose target matches its own pattern,
+// as ^/docs/(.*)$ to /docs/v2/$1 does, doesn't loop.
+func rewriteMiddleware(rewrites []*Rewrite) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			originalPath := req.URL.Path
+			c.Set(originalPathKey, originalPath)
+
+			applied := make(map[*Rewrite]bool)
+			for {
+				rule := matchRewrite(rewrites, req.URL.Path, applied)
+				if rule == nil {
+					break
+				}
+				applied[rule] = true
+
+				target := rule.regex.ReplaceAllString(req.URL.Path, rule.To)
+				if rule.status != 0 {
+					return c.Redirect(rule.status, mergeRewriteQuery(target, req.URL.RawQuery))
+				}
+				if target == req.URL.Path {
+					break
+				}
+
+				path, query, _ := strings.Cut(target, "?")
+				req.URL.Path = path
+				req.URL.RawPath = ""
+				if query != "" {
+					req.URL.RawQuery = mergeQuery(query, req.URL.RawQuery)
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// matchRewrite returns the first rule matching path that wasn't applied
+func matchRewrite(rewrites []*Rewrite, path string, applied map[*Rewrite]bool) *Rewrite {
+	for _, rule := range rewrites {
+		if !applied[rule] && rule.regex.MatchString(path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// mergeRewriteQuery appends the original query string to a rewrite target
+func mergeRewriteQuery(target, rawQuery string) string {
+	path, query, _ := strings.Cut(target, "?")
+	if merged := mergeQuery(query, rawQuery); merged != "" {
+		return path + "?" + merged
+	}
+	return path
+}
+
+func mergeQuery(first, second string) string {
+	if first == "" {
+		return second
+	}
+	if second == "" {
+		return first
+	}
+	return first + "&" + second
+}
+
+// originalPath returns the request path before any rewrites
+func originalPath(c echo.Context) string {
+	if path, ok := c.Get(originalPathKey).(string); ok {
+		return path
+	}
+	return c.Request().URL.Path
+}
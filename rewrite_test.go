@@ -0,0 +1,47 @@
+package gosp
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A rule without a pattern, which would match every path, fails the config
+func TestRewriteNeedsPattern(t *testing.T) {
+	for _, config := range []string{
+		`<routes><rewrite pattern="" to="/new"/></routes>`,
+		`<routes><rewrite from="^/old$" to="/new"/></routes>`,
+	} {
+		_, err := parseRouteConfig(newSiteFS(&serverOptions{}), "site/routes.xml", []byte(config))
+		if err == nil || !strings.Contains(err.Error(), "site/routes.xml") || !strings.Contains(err.Error(), "missing pattern") {
+			t.Errorf("%s: %v", config, err)
+		}
+	}
+}
+
+// Each rule applies once, so a rule whose target matches its own pattern
+// rewrites once, while distinct rules still chain
+func TestRewriteSelfMatchingRule(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{
+		"docs/v2/intro.html": `v2 intro <%= request.originalpath %>`,
+		"posts/hello.html":   `post hello`,
+	}, `<routes>
+  <rewrite pattern="^/docs/(.*)$" to="/docs/v2/$1"/>
+  <rewrite pattern="^/blog/(.*)$" to="/articles/$1"/>
+  <rewrite pattern="^/articles/(.*)$" to="/posts/$1"/>
+</routes>`)
+
+	for path, want := range map[string]string{
+		"/docs/intro":  "v2 intro /docs/intro",
+		"/blog/hello":  "post hello",
+		"/posts/hello": "post hello",
+	} {
+		if res, body := get(t, handler, http.MethodGet, path); res.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s: %d %q, want %q", path, res.StatusCode, body, want)
+		}
+	}
+	// Applied once, /docs/v2/intro becomes /docs/v2/v2/intro
+	if res, _ := get(t, handler, http.MethodGet, "/docs/v2/intro"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("/docs/v2/intro: %d", res.StatusCode)
+	}
+}
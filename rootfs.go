@@ -0,0 +1,327 @@
+package gosp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// siteFS reads the files of a site: those under the directories mounted
+// from an fs.FS, such as the site a compiled binary embeds, from there,
+// pages of the roots held in memory from memory, and others from disk.
+// It knows the page extensions and whether symlinks are followed, which
+// decide what is served. Each server has its own.
+type siteFS struct {
+	// Mounts, the most specific first
+	mounts []*rootMount
+
+	// Roots held in memory with --memory-root
+	memory []*memoryFS
+
+	templateExts []string
+	staticExts   []string
+
+	// Follow symlinks leading out of the roots, walking into the
+	// directories they lead to
+	followSymlinks bool
+
+	// Real paths of the roots, which symlinks leading out of are refused
+	realRoots sync.Map
+
+	// Route configs had their variables expanded by gosp compile
+	configExpanded bool
+}
+
+// newSiteFS reads files as the options say, from the fs.FS mounted in them
+func newSiteFS(options *serverOptions) *siteFS {
+	files := &siteFS{
+		templateExts:   parseExtensions(options.templateExts),
+		followSymlinks: options.followSymlinks,
+		configExpanded: options.configExpanded,
+	}
+	if len(files.templateExts) == 0 {
+		files.templateExts = []string{".html"}
+	}
+	// Template extensions win when an extension is listed as both
+	for _, ext := range parseExtensions(options.staticExts) {
+		if !containsString(files.templateExts, ext) {
+			files.staticExts = append(files.staticExts, ext)
+		}
+	}
+	for _, m := range options.mounts {
+		files.mount(m.dir, m.fsys, m.partial)
+	}
+	return files
+}
+
+// rootMount serves the files below a directory from an fs.FS, by their
+// slash-separated names under it. A partial mount answers for the files
+// and directories it holds only, leaving the rest of the directory on
+// disk; a whole one answers for the directory, its missing files missing.
+type rootMount struct {
+	dir     string
+	fsys    fs.FS
+	partial bool
+}
+
+// mount serves a directory from fsys, in front of the disk and of the
+// roots held in memory
+func (f *siteFS) mount(dir string, fsys fs.FS, partial bool) {
+	f.mounts = append(f.mounts, &rootMount{dir: filepath.Clean(dir), fsys: fsys, partial: partial})
+	sort.SliceStable(f.mounts, func(i, j int) bool {
+		return len(f.mounts[i].dir) > len(f.mounts[j].dir)
+	})
+}
+
+// name returns the name of a path under the mount, if it is under it
+func (m *rootMount) name(file string) (string, bool) {
+	return mountName(m.dir, file)
+}
+
+// mountName returns the slash-separated name of a path under dir, if it
+// is under it
+func mountName(dir, file string) (string, bool) {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// mountFor returns the FS answering for a path and the name of the path in
+// it, nil for paths read from disk
+func (f *siteFS) mountFor(file string) (fs.FS, string) {
+	file = filepath.Clean(file)
+	for _, m := range f.mounts {
+		name, ok := m.name(file)
+		if !ok {
+			continue
+		}
+		if m.partial {
+			if info, err := fs.Stat(m.fsys, name); err != nil || info.IsDir() {
+				continue
+			}
+		}
+		return m.fsys, name
+	}
+	return nil, ""
+}
+
+// mounted reports whether a path is read from a mount, which has no
+// symlinks to check
+func (f *siteFS) mounted(file string) bool {
+	fsys, _ := f.mountFor(file)
+	return fsys != nil
+}
+
+// mountError reports an error of a mount under the path it was asked for
+func mountError(op, file string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &fs.PathError{Op: op, Path: file, Err: pathErr.Err}
+	}
+	return err
+}
+
+// openFile opens a file or directory from its mount, or from disk
+func (f *siteFS) openFile(file string) (fs.File, error) {
+	fsys, name := f.mountFor(file)
+	if fsys == nil {
+		return os.Open(file)
+	}
+	opened, err := fsys.Open(name)
+	return opened, mountError("open", file, err)
+}
+
+// readFile reads a file from its mount, or from disk
+func (f *siteFS) readFile(file string) ([]byte, error) {
+	fsys, name := f.mountFor(file)
+	if fsys == nil {
+		return os.ReadFile(file)
+	}
+	data, err := fs.ReadFile(fsys, name)
+	return data, mountError("open", file, err)
+}
+
+// statFile describes a file from its mount, or from disk
+func (f *siteFS) statFile(file string) (os.FileInfo, error) {
+	fsys, name := f.mountFor(file)
+	if fsys == nil {
+		return os.Stat(file)
+	}
+	info, err := fs.Stat(fsys, name)
+	return info, mountError("stat", file, err)
+}
+
+// readDir lists a directory from its mount, or from disk, sorted by name
+func (f *siteFS) readDir(dir string) ([]fs.DirEntry, error) {
+	fsys, name := f.mountFor(dir)
+	if fsys == nil {
+		return os.ReadDir(dir)
+	}
+	entries, err := fs.ReadDir(fsys, name)
+	return entries, mountError("readdir", dir, err)
+}
+
+// walkMount walks a directory of a mount as filepath.Walk does, reporting
+// its files by their path. Mounts hold no symlinks.
+func walkMount(fsys fs.FS, name, dir string, fn filepath.WalkFunc) error {
+	return fs.WalkDir(fsys, name, func(below string, entry fs.DirEntry, err error) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(below, name), "/")
+		if name == "." && below != "." {
+			rel = below
+		}
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		if err != nil {
+			return fn(file, nil, mountError("lstat", file, err))
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fn(file, nil, mountError("lstat", file, err))
+		}
+		return fn(file, info, nil)
+	})
+}
+
+// Open opens a file by its path through the mounts, as the Filesystem of
+// the Echo instances, so c.File sends mounted files too
+func (f *siteFS) Open(name string) (fs.File, error) {
+	return f.openFile(name)
+}
+
+// embeddedFS is an fs.FS of files held in memory, with their modification
+// times, for the files compiled binaries embed
+type embeddedFS struct {
+	files    map[string]*memoryFile
+	dirs     map[string][]fs.DirEntry
+	dirTimes map[string]time.Time
+}
+
+func newEmbeddedFS() *embeddedFS {
+	return &embeddedFS{files: make(map[string]*memoryFile), dirs: map[string][]fs.DirEntry{".": nil}, dirTimes: make(map[string]time.Time)}
+}
+
+// add holds a file by its slash-separated name, making the directories on
+// its way
+func (e *embeddedFS) add(name string, data []byte, modTime time.Time) {
+	e.files[name] = &memoryFile{name: name, data: data, modTime: modTime}
+	e.addEntry(name, memoryFileInfo{e.files[name]})
+}
+
+// addDir makes a directory and those on its way. Those made first, before
+// their files, get the modification time.
+func (e *embeddedFS) addDir(name string, modTime time.Time) {
+	if _, exists := e.dirs[name]; exists {
+		if name == "." {
+			e.dirTimes[name] = modTime
+		}
+		return
+	}
+	e.dirs[name] = nil
+	e.dirTimes[name] = modTime
+	e.addEntry(name, e.dirInfo(name))
+}
+
+func (e *embeddedFS) dirInfo(name string) embeddedDirInfo {
+	return embeddedDirInfo{name: path.Base(name), modTime: e.dirTimes[name]}
+}
+
+func (e *embeddedFS) addEntry(name string, info fs.FileInfo) {
+	if name == "." {
+		return
+	}
+	parent := path.Dir(name)
+	e.addDir(parent, time.Time{})
+	entries := append(e.dirs[parent], fs.FileInfoToDirEntry(info))
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	e.dirs[parent] = entries
+}
+
+func (e *embeddedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if file, ok := e.files[name]; ok {
+		return &openMemoryFile{memoryFileInfo{file}, bytes.NewReader(file.data)}, nil
+	}
+	if entries, ok := e.dirs[name]; ok {
+		return &openEmbeddedDir{info: e.dirInfo(name), name: name, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadFile returns the content of a file, which mustn't be modified
+func (e *embeddedFS) ReadFile(name string) ([]byte, error) {
+	if file, ok := e.files[name]; ok {
+		return file.data, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (e *embeddedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if entries, ok := e.dirs[name]; ok {
+		return append([]fs.DirEntry(nil), entries...), nil
+	}
+	if _, ok := e.files[name]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+}
+
+func (e *embeddedFS) Stat(name string) (fs.FileInfo, error) {
+	if file, ok := e.files[name]; ok {
+		return memoryFileInfo{file}, nil
+	}
+	if _, ok := e.dirs[name]; ok {
+		return e.dirInfo(name), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// embeddedDirInfo describes a directory of an embeddedFS
+type embeddedDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i embeddedDirInfo) Name() string       { return i.name }
+func (i embeddedDirInfo) Size() int64        { return 0 }
+func (i embeddedDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i embeddedDirInfo) ModTime() time.Time { return i.modTime }
+func (i embeddedDirInfo) IsDir() bool        { return true }
+func (i embeddedDirInfo) Sys() interface{}   { return nil }
+
+type openEmbeddedDir struct {
+	info    embeddedDirInfo
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openEmbeddedDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openEmbeddedDir) Close() error               { return nil }
+
+func (d *openEmbeddedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *openEmbeddedDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	left := d.entries[d.offset:]
+	if count > 0 && len(left) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && count < len(left) {
+		left = left[:count]
+	}
+	d.offset += len(left)
+	return left, nil
+}
@@ -0,0 +1,125 @@
+package gosp
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp of rotated files, e.g. access-2024-05-01T10-30-00.000.log
+const rotateTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is an append-only log file that is moved aside once it would
+// grow past maxSize. Old files beyond maxBackups or older than maxAge are
+// removed; zero keeps them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.prune()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file after the time and starts a new one
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+
+	ext := filepath.Ext(rf.path)
+	backup := strings.TrimSuffix(rf.path, ext) + "-" + time.Now().UTC().Format(rotateTimeFormat) + ext
+	renameErr := os.Rename(rf.path, backup)
+
+	// Reopened even when the rename failed, so logging goes on
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.prune()
+	return nil
+}
+
+// prune removes the rotated files past the limits, newest kept first
+func (rf *rotatingFile) prune() {
+	if rf.maxBackups == 0 && rf.maxAge == 0 {
+		return
+	}
+
+	dir := filepath.Dir(rf.path)
+	ext := filepath.Ext(rf.path)
+	prefix := strings.TrimSuffix(filepath.Base(rf.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		name    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		rotated, err := time.Parse(rotateTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{name: name, rotated: rotated})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.After(backups[j].rotated) })
+
+	for i, b := range backups {
+		if (rf.maxBackups > 0 && i >= rf.maxBackups) || (rf.maxAge > 0 && time.Since(b.rotated) > rf.maxAge) {
+			os.Remove(filepath.Join(dir, b.name))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// effectiveRoutes returns the resolved routes in precedence order: explicit
+// routes before catch-alls, then static segments before parameters before
+// wildcards, then higher priority first, then declaration order. When two
+// entries share a method and path, the earlier one wins.
+func (config *RouteConfig) effectiveRoutes() []Route {
+	routes := config.resolveRoutes()
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if catchAllA, catchAllB := a.File == "", b.File == ""; catchAllA != catchAllB {
+			return !catchAllA
+		}
+		if cmp := compareSpecificity(a.Path, b.Path); cmp != 0 {
+			return cmp < 0
+		}
+		return a.Priority > b.Priority
+	})
+
+	return routes
+}
+
+// compareSpecificity orders paths segment by segment, static segments first,
+// then parameters, then wildcards; a longer path wins over its own prefix
+func compareSpecificity(a, b string) int {
+	segmentsA := strings.Split(strings.Trim(a, "/"), "/")
+	segmentsB := strings.Split(strings.Trim(b, "/"), "/")
+
+	for i := 0; i < len(segmentsA) && i < len(segmentsB); i++ {
+		if rankA, rankB := segmentRank(segmentsA[i]), segmentRank(segmentsB[i]); rankA != rankB {
+			return rankA - rankB
+		}
+	}
+
+	return len(segmentsB) - len(segmentsA)
+}
+
+func segmentRank(segment string) int {
+	switch {
+	case strings.HasPrefix(segment, "*"):
+		return 2
+	case strings.HasPrefix(segment, ":"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// printRoutes prints the route table of the route config file of the
+// options
+func printRoutes(options *serverOptions) {
+	configFile := options.config
+	routes, err := loadRouteConfig(newSiteFS(options), configFile)
+	if os.IsNotExist(err) {
+		serverLog.Warn("Could not load route config", "file", configFile, "err", err)
+		routes = &RouteConfig{}
+	} else if err != nil {
+		fatal(serverLog, "Error loading route config", "file", configFile, "err", err)
+	}
+
+	if options.noFileRouting {
+		routes.FileRouting = "false"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ORDER\tMETHODS\tPATH\tFILE\tPRIORITY")
+
+	effective := routes.effectiveRoutes()
+	for i, route := range effective {
+		if route.aliasOf != "" {
+			continue
+		}
+
+		file := route.File
+		if file == "" {
+			file = "(file-based)"
+		} else if route.spa != nil {
+			file += " (spa)"
+		} else if route.static != nil {
+			file += " (static)"
+		}
+		methods := strings.ToUpper(strings.Join(route.Methods, ","))
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\n", i+1, methods, route.Path, file, route.Priority)
+
+		// List aliases right below their primary
+		for j, alias := range effective {
+			if alias.aliasOf != route.Path || alias.File != route.File || !sameMethods(alias.Methods, route.Methods) {
+				continue
+			}
+			target := alias.File
+			if alias.AliasRedirect() != "" {
+				target = "(redirect)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t  alias %s\t%s\t%d\n", j+1, methods, alias.Path, target, alias.Priority)
+		}
+	}
+
+	w.Flush()
+}
+
+func sameMethods(a, b []string) bool {
+	return strings.EqualFold(strings.Join(a, ","), strings.Join(b, ","))
+}
@@ -0,0 +1,155 @@
+package gosp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	cspNonceKey     = "gosp.cspNonce"
+	cspNonceUsedKey = "gosp.cspNonceUsed"
+
+	// Replaced in the CSP with the nonce of the request
+	noncePlaceholder = "{nonce}"
+)
+
+// Security response headers for the site, a group or a route. Unset
+// attributes are inherited, "off" drops the header.
+type Security struct {
+	ContentTypeOptions string `xml:"contentTypeOptions,attr"`
+	FrameOptions       string `xml:"frameOptions,attr"`
+	ReferrerPolicy     string `xml:"referrerPolicy,attr"`
+	PermissionsPolicy  string `xml:"permissionsPolicy,attr"`
+	CSP                string `xml:"csp,attr"`
+	CSPReportOnly      string `xml:"cspReportOnly,attr"`
+}
+
+// Used where a security block is enabled without its own values
+var defaultSecurity = Security{
+	ContentTypeOptions: "nosniff",
+	FrameOptions:       "SAMEORIGIN",
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+}
+
+func (security *Security) prepare() error {
+	switch security.ContentTypeOptions {
+	case "", "nosniff", "off":
+	default:
+		return fmt.Errorf("invalid security contentTypeOptions %q: expected nosniff or off", security.ContentTypeOptions)
+	}
+
+	switch strings.ToUpper(security.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN", "OFF":
+	default:
+		return fmt.Errorf("invalid security frameOptions %q: expected DENY, SAMEORIGIN or off", security.FrameOptions)
+	}
+
+	switch security.CSPReportOnly {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid security cspReportOnly %q: expected true or false", security.CSPReportOnly)
+	}
+
+	return nil
+}
+
+// merge fills the unset attributes from the parent, or from the defaults at
+// the top level
+func (security *Security) merge(parent *Security) *Security {
+	if parent == nil {
+		parent = &defaultSecurity
+	}
+
+	merged := *security
+	if merged.ContentTypeOptions == "" {
+		merged.ContentTypeOptions = parent.ContentTypeOptions
+	}
+	if merged.FrameOptions == "" {
+		merged.FrameOptions = parent.FrameOptions
+	}
+	if merged.ReferrerPolicy == "" {
+		merged.ReferrerPolicy = parent.ReferrerPolicy
+	}
+	if merged.PermissionsPolicy == "" {
+		merged.PermissionsPolicy = parent.PermissionsPolicy
+	}
+	if merged.CSP == "" {
+		merged.CSP = parent.CSP
+	}
+	if merged.CSPReportOnly == "" {
+		merged.CSPReportOnly = parent.CSPReportOnly
+	}
+	return &merged
+}
+
+// Headers lists every header the block controls, with an empty value for
+// those that are off so they get removed
+func (security *Security) Headers() []Header {
+	value := func(setting string) string {
+		if strings.EqualFold(setting, "off") {
+			return ""
+		}
+		return setting
+	}
+
+	cspHeader, reportOnlyHeader := echo.HeaderContentSecurityPolicy, echo.HeaderContentSecurityPolicyReportOnly
+	if security.CSPReportOnly == "true" {
+		cspHeader, reportOnlyHeader = reportOnlyHeader, cspHeader
+	}
+
+	return []Header{
+		{Name: echo.HeaderXContentTypeOptions, Value: value(security.ContentTypeOptions)},
+		{Name: echo.HeaderXFrameOptions, Value: strings.ToUpper(value(security.FrameOptions))},
+		{Name: echo.HeaderReferrerPolicy, Value: value(security.ReferrerPolicy)},
+		{Name: "Permissions-Policy", Value: value(security.PermissionsPolicy)},
+		{Name: cspHeader, Value: value(security.CSP)},
+		{Name: reportOnlyHeader},
+	}
+}
+
+// securityMiddleware sets the headers before the handler runs, so error
+// responses carry them too
+func securityMiddleware(headers []Header) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Response().Header()
+			for _, h := range headers {
+				switch {
+				case h.Value == "":
+					header.Del(h.Name)
+				case strings.Contains(h.Value, noncePlaceholder):
+					header.Set(h.Name, strings.ReplaceAll(h.Value, noncePlaceholder, requestNonce(c)))
+				default:
+					header.Set(h.Name, h.Value)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// requestNonce returns the CSP nonce of the request, creating it on first use
+func requestNonce(c echo.Context) string {
+	if nonce, ok := c.Get(cspNonceKey).(string); ok {
+		return nonce
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("cannot create CSP nonce: %v", err))
+	}
+	nonce := base64.StdEncoding.EncodeToString(b)
+	c.Set(cspNonceKey, nonce)
+	return nonce
+}
+
+// cspNonce is the nonce as output by templates. Pages using it differ on
+// every request and are never stored in the response cache.
+func cspNonce(c echo.Context) string {
+	c.Set(cspNonceUsedKey, true)
+	return requestNonce(c)
+}
@@ -0,0 +1,301 @@
+package gosp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serverOptions name the site a server serves and how it runs, as the
+// flags of the command set them. Each command and each New has its own,
+// so servers of different sites can run in one process.
+type serverOptions struct {
+	root   string
+	config string
+	port   string
+	watch  bool
+
+	// Run as compiled binaries are, with embedded templates
+	embedded bool
+
+	// Directories served from an fs.FS rather than disk, and whether the
+	// route configs among their files had their variables expanded by
+	// gosp compile
+	mounts         []*rootMount
+	configExpanded bool
+
+	// Templates parsed by gosp compile, put in the template cache at
+	// startup
+	preparsed []compiledTemplate
+
+	bodyLimit    string
+	timeout      string
+	includeLimit string
+
+	noFileRouting bool
+
+	// Enables the default security headers without a <security> block
+	securityHeaders bool
+
+	// How long to wait for in-flight requests on shutdown
+	shutdownTimeout time.Duration
+
+	// How long a SIGUSR2 upgrade waits for the new process to serve
+	upgradeTimeout time.Duration
+
+	// Connection timeouts of the HTTP server
+	timeouts serverTimeouts
+
+	// Access log format, destination and rotation
+	accessLog accessLogSettings
+
+	// Bounds of the response cache shared by all routes
+	responseCacheEntries int
+	responseCacheSize    string
+
+	// Parsed template cache and its bounds
+	noTemplateCache      bool
+	templateCacheEntries int
+	templateCacheSize    string
+
+	// Size of the pages of the root held in memory, empty reading them from
+	// disk
+	memoryRoot string
+
+	// Templates served unprocessed, and those refused, for their size
+	maxTemplateSize    string
+	rejectTemplateSize string
+
+	// Templates rendering at once, 0 for no limit, and how long requests
+	// over it wait for a slot
+	maxRenders         int
+	renderQueueTimeout time.Duration
+
+	// Prometheus metrics endpoint, disabled when empty
+	metricsPath string
+
+	// Liveness and readiness probes, disabled when empty
+	healthPath string
+	readyPath  string
+
+	// Runtime profiles, on their own listener unless the address is empty
+	pprofEnabled bool
+	pprofAddr    string
+
+	// OpenTelemetry tracing, exported as the OTEL_* variables say
+	tracingEnabled bool
+
+	// Admin and reload endpoints, disabled when empty, and their Basic
+	// Auth users
+	adminPath  string
+	reloadPath string
+	adminUsers []string
+
+	// dev or prod, and the settings whose defaults follow it
+	runMode      string
+	errorDetails bool
+	caching      bool
+	verbose      bool
+
+	// Application log threshold and format
+	logLevel  string
+	logFormat string
+
+	// gzip and brotli response compression
+	compress        bool
+	compressMinSize string
+	gzipLevel       int
+	brotliLevel     int
+
+	// HTTPS, overriding the <tls> config
+	tlsCert       string
+	tlsKey        string
+	tlsMinVersion string
+	tlsCiphers    string
+
+	// Let's Encrypt certificates
+	autoCert     bool
+	acmeDomains  string
+	acmeCacheDir string
+
+	// Cleartext HTTP/2
+	h2cEnabled bool
+
+	// Plain HTTP redirect listener and HSTS
+	redirectHTTP bool
+	httpPort     string
+	hstsMaxAge   int
+
+	// Interface to bind, or host:port and Unix domain socket listeners
+	// instead of --port
+	host        string
+	listen      []string
+	socketMode  string
+	socketOwner string
+
+	// Proxies whose X-Forwarded-For and X-Real-IP headers are honored
+	trustedProxies string
+
+	// Basic Auth users gating the whole instance, and paths left open
+	authUsers   []string
+	authExclude string
+
+	// Comma-separated template and static page extensions
+	templateExts string
+	staticExts   string
+
+	// Where favicon.ico, robots.txt and /.well-known/ files are served from,
+	// and their cache policy
+	wellKnownRoot  string
+	wellKnownCache string
+
+	// Charset of text responses whose page and route name none
+	defaultCharset string
+
+	// Whether HTML pages are minified, unless the config says otherwise
+	minifyOutput bool
+
+	// Directory of the tenant roots, each named after its host, and how
+	// requests name their tenant
+	tenantsDir            string
+	tenantHeader          string
+	tenantDomain          string
+	unknownTenantTemplate string
+
+	// Refuse to start with broken templates, and recheck them on changes
+	validateOnStart bool
+
+	// Templates read ahead of the first requests, and whether to render them
+	warmupSpec   string
+	warmupRender bool
+
+	// YAML file with the settings of the flags
+	serverConfigPath string
+
+	// Watcher settings, and what it runs and refreshes as files change
+	watchDebounce time.Duration
+	watchDirs     []string
+	watchIgnore   string
+	watchMode     string
+	watchInterval time.Duration
+	liveReload    bool
+	onChange      []string
+
+	// Follow symlinks leading out of the roots
+	followSymlinks bool
+
+	// Where each flag got its value, for "config print": "command line",
+	// the variable or file name, or the mode
+	sources map[string]string
+
+	// Server config file the settings were read from, logged with the mode
+	serverConfigLoaded string
+
+	// Keys of flags compiled binaries don't have, accepted and left alone
+	// in their server config so it can be shared with the dev server
+	ignoredSettings map[string]bool
+}
+
+// server is an instance serving a site: its options, and what every build
+// of the site is served with, made once and shared by the builds. Sites
+// and their handlers close over it rather than reading package state.
+type server struct {
+	options *serverOptions
+
+	// Files of the site, read through the mounts and --memory-root
+	files *siteFS
+
+	// Response and parsed template caches, nil for templates with
+	// --no-template-cache
+	responses *responseCache
+	templates *templateCache
+
+	// Limiter of --max-concurrent-renders, nil when renders are unlimited
+	renders *renderLimiter
+
+	// Bounds of --max-template-size and --reject-template-size
+	largeTemplates templateSizes
+
+	// Store of the sessions, made for the session of the first route
+	// config, nil without one
+	sessions SessionStore
+
+	// Event streams of the browsers open on the site with --live-reload
+	browsers *liveReloads
+
+	logger  *accessLogger
+	gate    echo.MiddlewareFunc
+	started time.Time
+
+	// Set for pprof on the main listener
+	pprof http.Handler
+
+	// Paths under --tenants-dir that belong to no tenant
+	tenantExcluded []string
+
+	adminAuth  []echo.MiddlewareFunc
+	reloadAuth []echo.MiddlewareFunc
+	reloader   *reloader
+
+	// The file watcher, nil when not watching
+	watcher *FileWatcher
+
+	// Where the watcher sends the changes it handled
+	changes *changeFeed
+
+	// Readiness of the instance, with the checks of its session store and
+	// warm-up
+	health *healthChecks
+}
+
+// newServer makes the server of the options, its files read through the
+// mounts they list
+func newServer(options *serverOptions) *server {
+	return &server{options: options, files: newSiteFS(options), started: time.Now(), changes: &changeFeed{}, health: newHealthChecks()}
+}
+
+// build builds the site of a route config on a new Echo instance, with the
+// request logs, probes, tracing, gate and instance endpoints around it
+func (srv *server) build(routes *RouteConfig) (*site, error) {
+	e := echo.New()
+	e.Use(srv.logger.middleware())
+	// Probes skip auth, sessions and templates, and are muted with --access-log-exclude
+	e.Use(healthMiddleware(srv.health, srv.options.healthPath, srv.options.readyPath))
+	if tracer != nil {
+		e.Use(tracingMiddleware())
+	}
+
+	// Registered first, so routes for the same paths replace them
+	if srv.options.metricsPath != "" {
+		e.GET(srv.options.metricsPath, metricsHandler)
+	}
+	if srv.pprof != nil {
+		e.Any("/debug/pprof/*", echo.WrapHandler(srv.pprof))
+	}
+
+	s, err := srv.setupSite(e, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if srv.gate != nil {
+		e.Use(srv.gate)
+	}
+	if srv.options.tenantsDir != "" {
+		e.Use(tenantMiddleware(srv.options.tenantsDir, srv.tenantExcluded))
+	}
+	if srv.options.adminPath != "" {
+		admin := newAdminState(routes, srv)
+		admin.started = srv.started
+		admin.watcher = srv.watcher
+		e.GET(srv.options.adminPath, adminHandler(admin), srv.adminAuth...)
+	}
+	if srv.options.reloadPath != "" {
+		e.POST(srv.options.reloadPath, reloadHandler(srv.reloader), srv.reloadAuth...)
+	}
+	if srv.options.hstsMaxAge > 0 {
+		e.Use(hstsMiddleware(srv.options.hstsMaxAge))
+	}
+	return s, nil
+}
@@ -0,0 +1,40 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Connection timeouts for the HTTP servers. Zero disables one; for the
+// header and idle timeouts it falls back to the read timeout.
+type serverTimeouts struct {
+	Read       time.Duration
+	ReadHeader time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+func (timeouts serverTimeouts) validate() error {
+	for name, value := range map[string]time.Duration{
+		"--read-timeout":        timeouts.Read,
+		"--read-header-timeout": timeouts.ReadHeader,
+		"--write-timeout":       timeouts.Write,
+		"--idle-timeout":        timeouts.Idle,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s can't be negative, use 0 to disable it", name)
+		}
+	}
+	return nil
+}
+
+// apply sets the timeouts on each server
+func (timeouts serverTimeouts) apply(servers ...*http.Server) {
+	for _, server := range servers {
+		server.ReadTimeout = timeouts.Read
+		server.ReadHeaderTimeout = timeouts.ReadHeader
+		server.WriteTimeout = timeouts.Write
+		server.IdleTimeout = timeouts.Idle
+	}
+}
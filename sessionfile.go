@@ -0,0 +1,124 @@
+package gosp
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileSessionStore keeps every session in a JSON file named after its id
+type fileSessionStore struct {
+	dir string
+}
+
+type storedSession struct {
+	Expires time.Time         `json:"expires"`
+	Values  map[string]string `json:"values"`
+}
+
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (store *fileSessionStore) path(token string) string {
+	return filepath.Join(store.dir, token+".json")
+}
+
+func (store *fileSessionStore) Load(token string) (map[string]string, error) {
+	if !validSessionToken(token) {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(store.path(token))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session storedSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expires) {
+		return nil, nil
+	}
+	return session.Values, nil
+}
+
+func (store *fileSessionStore) Save(token string, values map[string]string, maxAge time.Duration) (string, error) {
+	if !validSessionToken(token) {
+		var err error
+		if token, err = newSessionToken(); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(storedSession{Expires: time.Now().Add(maxAge), Values: values})
+	if err != nil {
+		return "", err
+	}
+
+	// Written aside and renamed, so concurrent loads never see half a file
+	temp, err := os.CreateTemp(store.dir, ".session-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return "", err
+	}
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+	return token, os.Rename(temp.Name(), store.path(token))
+}
+
+func (store *fileSessionStore) Delete(token string) error {
+	if !validSessionToken(token) {
+		return nil
+	}
+	if err := os.Remove(store.path(token)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *fileSessionStore) Purge(all bool) (int, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	now := time.Now()
+	for _, entry := range entries {
+		token := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || token == entry.Name() || !validSessionToken(token) {
+			continue
+		}
+
+		if !all {
+			data, err := os.ReadFile(store.path(token))
+			if err != nil {
+				continue
+			}
+			var session storedSession
+			if json.Unmarshal(data, &session) == nil && !now.After(session.Expires) {
+				continue
+			}
+		}
+
+		if err := os.Remove(store.path(token)); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,459 @@
+package gosp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	sessionKey = "gosp.session"
+
+	// Browsers drop cookies larger than this
+	maxCookieSize = 4096
+)
+
+// Session configures where session values are kept between requests
+type Session struct {
+	Store    string `xml:"store,attr"`
+	Name     string `xml:"name,attr"`
+	Secret   string `xml:"secret,attr"`
+	MaxAge   string `xml:"maxAge,attr"`
+	Secure   string `xml:"secure,attr"`
+	SameSite string `xml:"sameSite,attr"`
+
+	// Directory of the file store
+	Dir string `xml:"dir,attr"`
+
+	Redis *RedisSettings `xml:"redis"`
+
+	maxAge time.Duration
+}
+
+// Connection settings of the Redis store
+type RedisSettings struct {
+	Address  string `xml:"address,attr"`
+	Password string `xml:"password,attr"`
+	DB       int    `xml:"db,attr"`
+	TLS      string `xml:"tls,attr"`
+}
+
+// SessionStore keeps session values between requests. The token is the
+// value of the session cookie, "" for a new session.
+type SessionStore interface {
+	// Load returns nil for unknown, expired or tampered tokens
+	Load(token string) (map[string]string, error)
+
+	// Save stores the values and returns the token to send back
+	Save(token string, values map[string]string, maxAge time.Duration) (string, error)
+
+	Delete(token string) error
+
+	// Purge removes expired sessions, or every session, and returns how many
+	Purge(all bool) (int, error)
+}
+
+// Serializes saving the same session, hashed onto a fixed set of locks
+var sessionLocks [64]sync.Mutex
+
+func (session *Session) prepare(baseDir string) error {
+	if session.Name == "" {
+		session.Name = "gosp_session"
+	}
+	if session.MaxAge == "" {
+		session.MaxAge = "24h"
+	}
+	if err := validateTimeout(session.MaxAge); err != nil {
+		return fmt.Errorf("invalid session maxAge: %v", err)
+	}
+	session.maxAge, _ = time.ParseDuration(session.MaxAge)
+
+	switch session.Secure {
+	case "", "auto", "true", "false":
+	default:
+		return fmt.Errorf("invalid session secure %q: expected auto, true or false", session.Secure)
+	}
+
+	switch strings.ToLower(session.SameSite) {
+	case "", "lax", "strict", "none":
+	default:
+		return fmt.Errorf("invalid session sameSite %q: expected lax, strict or none", session.SameSite)
+	}
+
+	switch session.Store {
+	case "", "cookie":
+		if session.Secret == "" {
+			return fmt.Errorf("cookie sessions need a secret to sign them")
+		}
+		if len(session.Secret) < 32 {
+			sessionLog.Warn("Session secret is shorter than 32 characters")
+		}
+	case "file":
+		if session.Dir == "" {
+			session.Dir = "sessions"
+		}
+		if !filepath.IsAbs(session.Dir) {
+			session.Dir = filepath.Join(baseDir, session.Dir)
+		}
+	case "redis":
+		if session.Redis == nil || session.Redis.Address == "" {
+			return fmt.Errorf("redis sessions need a <redis address=\"host:port\"/> element")
+		}
+		switch session.Redis.TLS {
+		case "", "true", "false":
+		default:
+			return fmt.Errorf("invalid redis tls %q: expected true or false", session.Redis.TLS)
+		}
+	default:
+		return fmt.Errorf("invalid session store %q: expected cookie, file or redis", session.Store)
+	}
+
+	return nil
+}
+
+// sameSession reports whether two session elements describe the same
+// store and cookie
+func sameSession(a, b *Session) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	x.Redis, y.Redis = nil, nil
+	if x != y {
+		return false
+	}
+	if a.Redis == nil || b.Redis == nil {
+		return a.Redis == b.Redis
+	}
+	return *a.Redis == *b.Redis
+}
+
+func newSessionStore(session *Session) (SessionStore, error) {
+	switch session.Store {
+	case "file":
+		return newFileSessionStore(session.Dir)
+	case "redis":
+		return newRedisSessionStore(session.Redis), nil
+	default:
+		return &cookieSessionStore{secret: []byte(session.Secret)}, nil
+	}
+}
+
+// cookieSessionStore keeps the values in the cookie itself, signed so
+// clients can't change them
+type cookieSessionStore struct {
+	secret []byte
+}
+
+type cookiePayload struct {
+	Expires int64             `json:"e"`
+	Values  map[string]string `json:"v"`
+}
+
+func (store *cookieSessionStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, store.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *cookieSessionStore) Load(token string) (map[string]string, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(store.sign(payload))) {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil
+	}
+	var decoded cookiePayload
+	if err := json.Unmarshal(data, &decoded); err != nil || time.Now().Unix() > decoded.Expires {
+		return nil, nil
+	}
+	return decoded.Values, nil
+}
+
+func (store *cookieSessionStore) Save(token string, values map[string]string, maxAge time.Duration) (string, error) {
+	data, err := json.Marshal(cookiePayload{Expires: time.Now().Add(maxAge).Unix(), Values: values})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	token = payload + "." + store.sign(payload)
+	if len(token) > maxCookieSize {
+		return "", fmt.Errorf("session data exceeds the %d byte cookie limit, use the file or redis store", maxCookieSize)
+	}
+	return token, nil
+}
+
+// Delete can't reach cookies, clearing the cookie is all there is
+func (store *cookieSessionStore) Delete(token string) error {
+	return nil
+}
+
+func (store *cookieSessionStore) Purge(all bool) (int, error) {
+	return 0, errors.New("cookie sessions live in the browsers, change the secret to revoke them all")
+}
+
+// newSessionToken returns a random session id for the server-side stores
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validSessionToken rejects cookies that can't be a server-side session id,
+// so they are never used in file names or keys
+func validSessionToken(token string) bool {
+	if len(token) != 43 {
+		return false
+	}
+	for _, r := range token {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionState is the session of one request. Values are loaded on first
+// use, and changes are saved before the response is written.
+type sessionState struct {
+	config *Session
+	store  SessionStore
+	c      echo.Context
+
+	token     string
+	values    map[string]string
+	loaded    bool
+	changes   map[string]string
+	destroyed bool
+}
+
+// sessionMiddleware makes the session available to templates
+func sessionMiddleware(config *Session, store SessionStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := &sessionState{config: config, store: store, c: c}
+			if cookie, err := c.Cookie(config.Name); err == nil {
+				state.token = cookie.Value
+			}
+			c.Set(sessionKey, state)
+			c.Response().Before(state.commit)
+			return next(c)
+		}
+	}
+}
+
+// handleSessionCode runs session.name = value and session.invalidate().
+// Unquoted values are evaluated like output expressions, e.g. form.user.
+func (tp *TemplateProcessor) handleSessionCode(code string, c echo.Context) {
+	session := sessionFor(c)
+	if session == nil {
+		sessionLog.Warn("Template uses the session without a <session> block", "code", "session."+code, "request_id", requestID(c))
+		return
+	}
+
+	if code == "invalidate()" {
+		session.invalidate()
+		return
+	}
+
+	key, value, found := strings.Cut(code, "=")
+	if !found {
+		return
+	}
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		value = value[1 : len(value)-1]
+	} else {
+		value = tp.evaluateOutput(value, c)
+	}
+	session.set(strings.TrimSpace(key), value)
+}
+
+func sessionFor(c echo.Context) *sessionState {
+	state, _ := c.Get(sessionKey).(*sessionState)
+	return state
+}
+
+func (state *sessionState) load() {
+	if state.loaded {
+		return
+	}
+	state.loaded = true
+
+	if state.token == "" {
+		return
+	}
+	values, err := state.store.Load(state.token)
+	if err != nil {
+		sessionLog.Error("Loading session failed", "request_id", requestID(state.c), "err", err)
+	}
+	state.values = values
+	if values == nil {
+		// Unknown or expired, start over
+		state.token = ""
+	}
+}
+
+func (state *sessionState) get(key string) string {
+	state.load()
+	if value, changed := state.changes[key]; changed {
+		return value
+	}
+	return state.values[key]
+}
+
+// set changes a value, an empty value removes it
+func (state *sessionState) set(key, value string) {
+	if state.changes == nil {
+		state.changes = make(map[string]string)
+	}
+	state.changes[key] = value
+}
+
+// invalidate drops the session, later changes start a new one
+func (state *sessionState) invalidate() {
+	state.load()
+	state.destroyed = true
+	state.changes = nil
+}
+
+// used reports whether the page read or changed the session, making the
+// response personal
+func (state *sessionState) used() bool {
+	return state.loaded || state.changes != nil
+}
+
+// commit saves the changes and sets the cookie, right before the response
+// headers are written
+func (state *sessionState) commit() {
+	if state.destroyed {
+		if state.token != "" {
+			if err := state.store.Delete(state.token); err != nil {
+				sessionLog.Error("Deleting session failed", "request_id", requestID(state.c), "err", err)
+			}
+			state.token = ""
+		}
+		if state.changes == nil {
+			cookie := state.cookie("")
+			cookie.MaxAge = -1
+			state.c.SetCookie(cookie)
+			return
+		}
+	}
+	if state.changes == nil {
+		return
+	}
+
+	lock := sessionLock(state.token)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Reloaded so concurrent requests of the session keep each other's changes
+	values := make(map[string]string)
+	if state.token != "" {
+		current, err := state.store.Load(state.token)
+		if err != nil {
+			sessionLog.Error("Loading session failed", "request_id", requestID(state.c), "err", err)
+			return
+		}
+		// A token the store doesn't know is never adopted, or a cookie set
+		// by someone else would carry the session they wait for
+		if current == nil {
+			state.token = ""
+		}
+		for key, value := range current {
+			values[key] = value
+		}
+	}
+	for key, value := range state.changes {
+		if value == "" {
+			delete(values, key)
+		} else {
+			values[key] = value
+		}
+	}
+
+	token, err := state.store.Save(state.token, values, state.config.maxAge)
+	if err != nil {
+		sessionLog.Error("Saving session failed", "request_id", requestID(state.c), "err", err)
+		return
+	}
+	state.c.SetCookie(state.cookie(token))
+}
+
+func (state *sessionState) cookie(token string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     state.config.Name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(state.config.maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   state.config.Secure == "true" || (state.config.Secure != "false" && state.c.IsTLS()),
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(state.config.SameSite) {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+func sessionLock(token string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(token))
+	return &sessionLocks[hash.Sum32()%uint32(len(sessionLocks))]
+}
+
+// collectSessions purges expired sessions from the store periodically
+func collectSessions(store SessionStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		if count, err := store.Purge(false); err != nil {
+			sessionLog.Warn("Session cleanup failed", "err", err)
+		} else if count > 0 {
+			sessionLog.Info("Removed expired sessions", "count", count)
+		}
+	}
+}
+
+// purgeSessions removes the expired sessions of the route config file's
+// store, or all of them
+func purgeSessions(configFile string, all bool) {
+	routes, err := loadRouteConfig(newSiteFS(&serverOptions{}), configFile)
+	if err != nil {
+		fatal(sessionLog, "Error loading route config", "file", configFile, "err", err)
+	}
+	if routes.Session == nil {
+		fatal(sessionLog, "Route config has no <session> block", "file", configFile)
+	}
+
+	store, err := newSessionStore(routes.Session)
+	if err != nil {
+		fatal(sessionLog, "Error opening session store", "err", err)
+	}
+	count, err := store.Purge(all)
+	if err != nil {
+		fatal(sessionLog, "Error removing sessions", "err", err)
+	}
+	sessionLog.Info("Removed sessions", "count", count)
+}
@@ -0,0 +1,43 @@
+package gosp
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A cookie naming a session the store doesn't have must not become the
+// session a page writes to, or whoever planted it shares the session
+func TestSessionIgnoresUnknownToken(t *testing.T) {
+	for _, store := range []string{"file", "cookie"} {
+		t.Run(store, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "sessions")
+			config := `<routes><session store="` + store + `" dir="` + dir + `" secret="0123456789abcdef0123456789abcdef"/></routes>`
+			handler, _ := newTestSite(t, map[string]string{
+				"set.html": `<% session.user = "alice" %>set`,
+				"get.html": `user=<%= session.user %>`,
+			}, config)
+
+			planted := strings.Repeat("A", 43)
+			res, _ := get(t, handler, http.MethodGet, "/set", "Cookie", "gosp_session="+planted)
+			token := cookieOf(res, "gosp_session")
+			if token == "" || token == planted {
+				t.Fatalf("session saved under token %q, planted %q", token, planted)
+			}
+			if _, err := os.Stat(filepath.Join(dir, planted+".json")); err == nil {
+				t.Fatal("session file created for the planted token")
+			}
+
+			_, body := get(t, handler, http.MethodGet, "/get", "Cookie", "gosp_session="+planted)
+			if body != "user=" {
+				t.Fatalf("planted token reads %q", body)
+			}
+			_, body = get(t, handler, http.MethodGet, "/get", "Cookie", "gosp_session="+token)
+			if body != "user=alice" {
+				t.Fatalf("minted token reads %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package gosp
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serveUntilSignal runs the servers until SIGINT or SIGTERM, then stops
+// accepting connections and waits up to timeout for in-flight requests.
+// A server failing stops the others the same way, and so does SIGUSR2
+// once the upgraded process it starts serves. Readiness fails through
+// health as they stop, and cleanup runs once they have stopped. Returns the process exit code: 0 after a clean
+// drain, 1 on a server error, a drain timeout or a second signal.
+func serveUntilSignal(group *serverGroup, health *healthChecks, timeout time.Duration, cleanup func()) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- group.serve()
+	}()
+	notifyUpgradeReady()
+	notifySystemd("READY=1")
+
+	upgraded := make(chan error, 1)
+	upgrading := false
+wait:
+	for {
+		select {
+		case err := <-serverErr:
+			serverLog.Error("Server error", "err", err)
+			health.setReady("server error")
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			group.shutdown(ctx)
+			cleanup()
+			return 1
+		case sig := <-signals:
+			if sig != syscall.SIGUSR2 {
+				serverLog.Info("Shutting down, waiting for in-flight requests", "signal", sig.String(), "timeout", timeout.String())
+				break wait
+			}
+			if upgrading {
+				serverLog.Warn("An upgrade is in progress already", "signal", sig.String())
+				continue
+			}
+			serverLog.Info("Upgrading", "signal", sig.String())
+			upgrading = true
+			go func() {
+				upgraded <- upgrade(group.options.upgradeTimeout)
+			}()
+		case err := <-upgraded:
+			upgrading = false
+			if err != nil {
+				serverLog.Error("Upgrade failed, still serving", "err", err)
+				continue
+			}
+			serverLog.Info("Upgrade: new process is serving, draining this one", "timeout", timeout.String())
+			keepSockets()
+			group.upgraded = true
+			break wait
+		}
+	}
+	health.setReady("shutting down")
+	notifySystemd("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- group.shutdown(ctx)
+	}()
+
+	var err error
+drain:
+	for {
+		select {
+		case err = <-drained:
+			break drain
+		case sig := <-signals:
+			if sig == syscall.SIGUSR2 {
+				continue
+			}
+			serverLog.Warn("Exiting without waiting for in-flight requests", "signal", sig.String())
+			cleanup()
+			return 1
+		}
+	}
+
+	cleanup()
+	if err != nil {
+		serverLog.Error("Shutdown did not complete", "err", err)
+		return 1
+	}
+
+	serverLog.Info("Server stopped")
+	return 0
+}
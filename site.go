@@ -0,0 +1,111 @@
+package gosp
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// site is a route config built into the Echo instance serving it, with
+// what its requests look up from the config as they run. It is built by
+// its server, whose options, files and caches it shares with the other
+// builds.
+type site struct {
+	*server
+
+	e      *echo.Echo
+	routes *RouteConfig
+
+	// Directory the templates are read from, and whether they are embedded
+	// in the binary
+	root     string
+	embedded bool
+
+	// Page rendered for 500 errors outside dev mode, from the errorTemplate
+	// attribute of the route config
+	errorTemplate string
+
+	// Error formats of the site and its groups, longest prefix first
+	errorScopes []errorScope
+
+	// Include limit of pages outside of routes, in bytes
+	includeLimit int
+
+	// Whether pages outside of routes are minified
+	minify bool
+
+	// Manifests of the static mounts fingerprinting their files
+	assets []*assetManifest
+
+	// Render hooks in the order they run
+	beforeHooks []BeforeRender
+	afterHooks  []AfterRender
+}
+
+// Holds the site serving a request
+const siteKey = "gosp.site"
+
+// Site of contexts made outside of a site's Echo instance, with the
+// default options
+var noSite = &site{server: newServer(&serverOptions{})}
+
+// siteMiddleware records the site serving the request, before routing so
+// 404s and errors have it too
+func siteMiddleware(s *site) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(siteKey, s)
+			return next(c)
+		}
+	}
+}
+
+// siteOf returns the site serving a request
+func siteOf(c echo.Context) *site {
+	if s, ok := c.Get(siteKey).(*site); ok {
+		return s
+	}
+	return noSite
+}
+
+// siteHandler serves requests with the site swapped in last. A reload
+// builds its site aside and swaps it in with a single store; requests
+// running by then finish on the site they started on.
+type siteHandler struct {
+	current atomic.Pointer[site]
+}
+
+func newSiteHandler(s *site) *siteHandler {
+	h := &siteHandler{}
+	h.current.Store(s)
+	return h
+}
+
+func (h *siteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.current.Load().e.ServeHTTP(w, r)
+}
+
+// active returns the site serving new requests
+func (h *siteHandler) active() *site {
+	return h.current.Load()
+}
+
+// swap makes a site serve new requests, stopping the background work of
+// the one it replaces
+func (h *siteHandler) swap(s *site) {
+	if old := h.current.Swap(s); old != nil && old != s {
+		old.close()
+	}
+}
+
+// close stops what the site runs in the background, once it no longer
+// serves new requests. Those still running on it finish.
+func (s *site) close() {
+	if s.routes == nil {
+		return
+	}
+	for _, cache := range s.routes.jwksCaches() {
+		cache.stop()
+	}
+}
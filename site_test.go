@@ -0,0 +1,115 @@
+package gosp
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowHook holds renders of slow.html, so they are in flight as the site
+// is swapped, counting them
+type slowHook struct{}
+
+var slowRenders atomic.Int64
+
+func (slowHook) BeforeRender(ctx context.Context, template string, data map[string]interface{}) error {
+	if template == "slow.html" {
+		slowRenders.Add(1)
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+func init() {
+	RegisterHook("test-slow", slowHook{})
+}
+
+// Reloads swapping the route table without pause, under traffic, keep
+// every request on one whole table: routes in both always answer, routes
+// in one answer as that one says, and requests in flight finish on the
+// site they started on. Run with -race.
+func TestHotSwapStress(t *testing.T) {
+	configs := []string{
+		`<routes><hook name="test-slow"/>
+  <route path="/page" file="one.html"><methods>GET</methods></route>
+  <route path="/slow" file="slow.html"><methods>GET</methods></route>
+</routes>`,
+		`<routes><hook name="test-slow"/>
+  <route path="/page" file="two.html"><methods>GET</methods></route>
+  <route path="/slow" file="slow.html"><methods>GET</methods></route>
+  <route path="/added" file="two.html"><methods>GET</methods></route>
+</routes>`,
+	}
+	ts := newTestServer(t, map[string]string{"one.html": "one", "two.html": "two", "slow.html": "slow"}, configs[0])
+
+	stop := make(chan struct{})
+	var reloads atomic.Int64
+	var reloader sync.WaitGroup
+	reloader.Add(1)
+	go func() {
+		defer reloader.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := os.WriteFile(ts.config, []byte(configs[i%2]), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			if result := ts.reloader.reload(); !result.Reloaded {
+				t.Errorf("reload %d: %v", i, result.Errors)
+				return
+			}
+			reloads.Add(1)
+		}
+	}()
+
+	var requests sync.WaitGroup
+	var served atomic.Int64
+	for i := 0; i < 24; i++ {
+		requests.Add(1)
+		go func(i int) {
+			defer requests.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				switch i % 3 {
+				case 0:
+					if res, body := get(t, ts.sites, http.MethodGet, "/page"); res.StatusCode != http.StatusOK || body != "one" && body != "two" {
+						t.Errorf("/page: %d %q", res.StatusCode, body)
+						return
+					}
+				case 1:
+					res, body := get(t, ts.sites, http.MethodGet, "/added")
+					if !(res.StatusCode == http.StatusOK && body == "two") && res.StatusCode != http.StatusNotFound {
+						t.Errorf("/added: %d %q", res.StatusCode, body)
+						return
+					}
+				case 2:
+					if res, body := get(t, ts.sites, http.MethodGet, "/slow"); res.StatusCode != http.StatusOK || body != "slow" {
+						t.Errorf("/slow in flight across a swap: %d %q", res.StatusCode, body)
+						return
+					}
+				}
+				served.Add(1)
+			}
+		}(i)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	reloader.Wait()
+	requests.Wait()
+	if reloads.Load() < 10 || served.Load() < 100 || slowRenders.Load() == 0 {
+		t.Fatalf("%d reloads, %d requests and %d slow renders, too few to stress the swap", reloads.Load(), served.Load(), slowRenders.Load())
+	}
+}
@@ -0,0 +1,105 @@
+package gosp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenUnix creates a Unix domain socket with the given octal mode and
+// user[:group] owner, replacing a stale socket left behind by a crash
+func listenUnix(socketPath, mode, owner string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, fmt.Errorf("invalid socket mode %q, expected octal permissions like 0660", mode)
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socketPath, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(socketPath, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes a socket file nobody is listening on anymore.
+// Regular files and live sockets are left alone.
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", socketPath)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", socketPath)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot check existing socket %s: %v", socketPath, err)
+	}
+
+	return os.Remove(socketPath)
+}
+
+// lookupOwner resolves user[:group], by name or numeric id, to ids for
+// os.Chown. Parts that aren't given are -1 and stay unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+
+	userName, groupName, _ := strings.Cut(owner, ":")
+	if userName != "" {
+		found, err := user.Lookup(userName)
+		if err != nil {
+			if found, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown socket owner %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(found.Uid)
+	}
+	if groupName != "" {
+		found, err := user.LookupGroup(groupName)
+		if err != nil {
+			if found, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown socket group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(found.Gid)
+	}
+
+	return uid, gid, nil
+}
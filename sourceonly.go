@@ -0,0 +1,58 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeSourceProject writes the project generateCompiledBinary would build
+// to dir, for a build without network access or an audit of the code, and
+// returns the commands building it. The project builds offline with a plain
+// go build, its dependencies pinned by go.mod and go.sum.
+func writeSourceProject(dir string, site *compiledSite, output string, targets []buildTarget) ([]string, error) {
+	if err := clearProject(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	if err := writeProject(dir, site); err != nil {
+		return nil, err
+	}
+
+	// Relative outputs are taken from where compile ran, not from dir
+	absOutput, err := filepath.Abs(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute output path: %v", err)
+	}
+	commands := []string{"cd " + dir}
+	for _, target := range targets {
+		commands = append(commands, strings.Join(target.env(), " ")+" go build -o "+target.output(absOutput, len(targets) > 1)+" .")
+	}
+	return commands, nil
+}
+
+// clearProject removes what an earlier --source-only run wrote to dir, so
+// files no longer embedded don't linger. Anything else there is refused
+// rather than overwritten.
+func clearProject(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) || err == nil && len(entries) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	mod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil || !strings.HasPrefix(string(mod), "module compiled-webframework\n") {
+		return fmt.Errorf("%s is not empty and holds no generated project", dir)
+	}
+	for _, name := range []string{"main.go", "go.mod", "go.sum", "embedded", "gosp", "engine", "cache"} {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package gosp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The project --source-only writes builds offline with the commands it
+// prints, passes go vet, and its binary serves the site
+func TestSourceOnlyProjectBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated project")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"root_http/index.html":    `<%@include file="inc/head.html" %><p>Hello <%= query.name %></p>`,
+		"root_http/inc/head.html": `<h1>Head</h1>`,
+		"routes.xml":              `<routes/>`,
+	})
+	site := collectSite(t, filepath.Join(dir, "root_http"), filepath.Join(dir, "routes.xml"))
+	project, binary := filepath.Join(dir, "generated"), filepath.Join(dir, "app")
+	commands, err := writeSourceProject(project, site, binary, []buildTarget{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProject(t, dir, project, commands, binary)
+
+	// The sources are gone, the binary serves what it embeds
+	if err := os.RemoveAll(filepath.Join(dir, "root_http")); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := fetch(t, addr, "/?name=farm"); body != "<h1>Head</h1><p>Hello farm</p>" {
+		t.Errorf("generated binary answered %q", body)
+	}
+}
+
+// serveProject builds a generated project offline with the commands
+// printed for it, vets it and starts its binary, returning the address it
+// listens on
+func serveProject(t *testing.T, dir, project string, commands []string, binary string) string {
+	t.Helper()
+	// Without network access, as in a build farm
+	env := append(os.Environ(), "GOPROXY=off", "GOFLAGS=")
+	run := func(name string, args ...string) {
+		t.Helper()
+		cmd := exec.Command(name, args...)
+		cmd.Dir, cmd.Env = project, env
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, output)
+		}
+	}
+	run("sh", "-c", strings.Join(commands, " && "))
+	run("go", "vet", "./...")
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	server := exec.Command(binary, "--listen", addr, "--access-log", filepath.Join(dir, "access.log"))
+	server.Env = env
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Process.Kill()
+		server.Wait()
+	})
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("generated binary isn't listening: %v", err)
+		}
+	}
+}
+
+// fetch gets a path of a server, failing the test if it doesn't answer
+func fetch(t *testing.T, addr, path string) (*http.Response, string) {
+	t.Helper()
+	res, err := http.Get("http://" + addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// A root of a few hundred files, with names go:embed would refuse and
+// binary static files, compiles to a small main.go and a binary serving
+// every page and file as the sources do
+func TestLargeRootCompiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a generated project")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"routes.xml":                  `<routes><static path="/assets" dir="public"/></routes>`,
+		"root_http/inc/head.html":     `<head><title><%= query.title %></title></head>`,
+		"root_http/_drafts/next.html": `draft <%= query.n %>`,
+		"root_http/my page.html":      `spaced <%= query.n %>`,
+	}
+	var paths []string
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("root_http/inc/part%d.html", i)] = fmt.Sprintf("<section>part %d <%%= query.n %%></section>\n", i)
+	}
+	for i := 0; i < 300; i++ {
+		page := fmt.Sprintf("pages/%d/page%d.html", i%10, i)
+		files["root_http/"+page] = fmt.Sprintf(`<%%@include file="/inc/head.html" %%><h1>Page %d</h1><%%@include file="/inc/part%d.html" %%>`, i, i%20) +
+			strings.Repeat(fmt.Sprintf("<p>text of page %d</p>\n", i), 20)
+		paths = append(paths, "/"+strings.TrimSuffix(page, ".html")+"?n=7&title=t")
+	}
+	for i := 0; i < 60; i++ {
+		name := fmt.Sprintf("img/%d.bin", i)
+		data := make([]byte, 1024+i)
+		for j := range data {
+			data[j] = byte(i * j)
+		}
+		files["public/"+name] = string(data)
+		paths = append(paths, "/assets/"+name)
+	}
+	paths = append(paths, "/_drafts/next?n=1", "/my%20page?n=2", "/missing")
+	writeFiles(t, dir, files)
+	root, config := filepath.Join(dir, "root_http"), filepath.Join(dir, "routes.xml")
+
+	// What the sources serve, to compare the binary with
+	sources, err := New(Root(root), ConfigFile(config), Mode("prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type answer struct {
+		status int
+		body   string
+	}
+	want := make(map[string]answer)
+	for _, path := range paths {
+		res, body := get(t, sources, http.MethodGet, path)
+		want[path] = answer{res.StatusCode, body}
+	}
+	if page := want["/pages/3/page13?n=7&title=t"]; page.status != http.StatusOK || !strings.Contains(page.body, "<title>t</title></head><h1>Page 13</h1><section>part 13 7</section>") {
+		t.Fatalf("the sources answered %d %q", page.status, page.body)
+	}
+
+	site := collectSite(t, root, config)
+	project, binary := filepath.Join(dir, "generated"), filepath.Join(dir, "app")
+	commands, err := writeSourceProject(project, site, binary, []buildTarget{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainGo, err := os.Stat(filepath.Join(project, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mainGo.Size() > 64<<10 {
+		t.Errorf("main.go of %d bytes, the sources being in it", mainGo.Size())
+	}
+	addr := serveProject(t, dir, project, commands, binary)
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		if res, body := fetch(t, addr, path); res.StatusCode != want[path].status || body != want[path].body {
+			t.Errorf("%s: %d %q, the sources answered %d %q", path, res.StatusCode, body, want[path].status, want[path].body)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gosp
+
+import (
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SPA serves a single-page app's entry file for every path under a prefix
+// that doesn't match a real file
+type SPA struct {
+	Path    string `xml:"path,attr"`
+	Entry   string `xml:"entry,attr"`
+	Process string `xml:"process,attr"`
+
+	// Config file defining the SPA
+	source string
+}
+
+// ProcessEntry reports whether the entry file goes through the template
+// processor; process="false" serves it untouched
+func (spa *SPA) ProcessEntry() bool {
+	return spa.Process != "false"
+}
+
+// spaRoutes builds the routes serving an SPA mounted below prefix
+func spaRoutes(spa SPA, prefix string, settings RouteSettings) []Route {
+	mount := strings.TrimSuffix(prefix+spa.Path, "/")
+
+	var routes []Route
+	for _, routePath := range []string{mount, mount + "/*"} {
+		if routePath == "" {
+			continue
+		}
+		route := Route{
+			Path:          routePath,
+			File:          spa.Entry,
+			Methods:       []string{"GET"},
+			RouteSettings: settings,
+			source:        spa.source,
+			spa:           &spa,
+		}
+		routes = append(routes, route.normalizeCase())
+	}
+	return routes
+}
+
+// SPA returns the single-page app served by the route, if any
+func (route Route) SPA() *SPA {
+	return route.spa
+}
+
+func spaHandler(spa *SPA) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Serve real files such as bundles and images directly
+		s := siteOf(c)
+		name := strings.TrimPrefix(path.Clean("/"+c.Request().URL.Path), "/")
+		if name != "" {
+			if fullPath, ok := s.files.findInRoots(s.templateRoots(c), name); ok {
+				if info, err := s.files.statFile(fullPath); err == nil {
+					recordDependencies(c, fullPath)
+					return serveFile(c, fullPath, info)
+				}
+			}
+		}
+
+		if spa.ProcessEntry() {
+			return processTemplate(c, spa.Entry)
+		}
+
+		entryPath, ok := templatePath(c, spa.Entry)
+		info, err := s.files.statFile(entryPath)
+		if !ok || err != nil {
+			return notFound(c, "File not found: "+spa.Entry)
+		}
+		recordDependencies(c, entryPath)
+		return serveFile(c, entryPath, info)
+	}
+}
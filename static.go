@@ -0,0 +1,339 @@
+package gosp
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// Context key of values a handler adds to the template it renders, such as
+// a directory listing
+const templateValuesKey = "gosp.templateValues"
+
+// Static serves the files of a directory outside the template root as they
+// are, listing folders without an index file when listing="true", and
+// under content-hashed names for asset() with fingerprint="true"
+type Static struct {
+	Path            string `xml:"path,attr"`
+	Dir             string `xml:"dir,attr"`
+	Listing         string `xml:"listing,attr"`
+	ListingTemplate string `xml:"listingTemplate,attr"`
+	Fingerprint     string `xml:"fingerprint,attr"`
+
+	// Hashed names of the files, when fingerprinted
+	assets *assetManifest
+
+	// URL path the directory is mounted on, with the group prefix
+	mount string
+
+	// Config file defining the mount
+	source string
+}
+
+// prepare resolves the directory against the config file
+func (static *Static) prepare(baseDir string) error {
+	if static.Dir == "" {
+		return fmt.Errorf("static %s: missing dir", static.Path)
+	}
+	if !filepath.IsAbs(static.Dir) {
+		static.Dir = filepath.Join(baseDir, static.Dir)
+	}
+
+	switch static.Listing {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("static %s: invalid listing %q: expected true or false", static.Path, static.Listing)
+	}
+	switch static.Fingerprint {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("static %s: invalid fingerprint %q: expected true or false", static.Path, static.Fingerprint)
+	}
+	return nil
+}
+
+// checkRoot checks the directory stays clear of the template root, whose
+// templates it would expose
+func (static *Static) checkRoot(templateRoot string) error {
+	dir, err := filepath.Abs(static.Dir)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(templateRoot)
+	if err != nil {
+		return err
+	}
+	if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) || strings.HasPrefix(root, dir+string(filepath.Separator)) {
+		return fmt.Errorf("static %s: dir %s overlaps the template root %s", static.Path, static.Dir, templateRoot)
+	}
+	return nil
+}
+
+// checkStaticDirs checks every static mount stays clear of the template
+// root, which the config doesn't know until it is served
+func (config *RouteConfig) checkStaticDirs(root string) error {
+	for i := range config.Statics {
+		if err := config.Statics[i].checkRoot(root); err != nil {
+			return err
+		}
+	}
+	for _, group := range config.Groups {
+		for i := range group.Statics {
+			if err := group.Statics[i].checkRoot(root); err != nil {
+				return fmt.Errorf("group %s: %v", group.Prefix, err)
+			}
+		}
+	}
+	return nil
+}
+
+// listingTemplates returns the listing templates of every static mount, which
+// must exist at startup like the error template
+func (config *RouteConfig) listingTemplates() []string {
+	var names []string
+	statics := config.Statics
+	for _, group := range config.Groups {
+		statics = append(statics, group.Statics...)
+	}
+	for _, static := range statics {
+		if static.ListingTemplate != "" {
+			names = append(names, static.ListingTemplate)
+		}
+	}
+	return names
+}
+
+// Mount returns the URL path the directory is served on
+func (static *Static) Mount() string {
+	return static.mount
+}
+
+// ListsFolders reports whether folders without an index file are listed
+func (static *Static) ListsFolders() bool {
+	return static.Listing == "true"
+}
+
+// staticRoutes builds the routes serving a directory mounted below prefix
+func staticRoutes(static Static, prefix string, settings RouteSettings) []Route {
+	static.mount = strings.TrimSuffix(prefix+static.Path, "/")
+
+	var routes []Route
+	for _, routePath := range []string{static.mount, static.mount + "/*"} {
+		if routePath == "" {
+			continue
+		}
+		route := Route{
+			Path:          routePath,
+			File:          static.Dir,
+			Methods:       []string{"GET"},
+			RouteSettings: settings,
+			source:        static.source,
+			static:        &static,
+		}
+		routes = append(routes, route.normalizeCase())
+	}
+	return routes
+}
+
+// Static returns the directory served by the route, if any
+func (route Route) Static() *Static {
+	return route.static
+}
+
+// staticHandler sends a file of the directory, or the index file or listing
+// of a folder. Dotfiles and paths leaving the directory, through symlinks as
+// well, are answered like missing files.
+func staticHandler(static *Static, indexFiles []string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		files := siteOf(c).files
+		urlPath := c.Request().URL.Path
+		name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(urlPath, static.mount)), "/")
+		// Hashed names are served for good, the files' own briefly, unless
+		// the mount has a policy
+		name, cacheControl := static.assets.cacheControl(name)
+		fullPath, ok := static.resolve(files, name)
+		if !ok {
+			return notFound(c, "File not found: "+urlPath)
+		}
+		info, err := files.statFile(fullPath)
+		if err != nil {
+			return notFound(c, "File not found: "+urlPath)
+		}
+		if !info.IsDir() {
+			header := c.Response().Header()
+			if cacheControl == hashedAssetCache || cacheControl != "" && header.Get(echo.HeaderCacheControl) == "" {
+				header.Set(echo.HeaderCacheControl, cacheControl)
+			}
+			return serveFile(c, fullPath, info)
+		}
+
+		// Relative links in the index or listing need the slash
+		if !strings.HasSuffix(urlPath, "/") {
+			return redirectPreservingQuery(c, urlPath+"/")
+		}
+		for _, index := range indexFiles {
+			indexPath := filepath.Join(fullPath, filepath.FromSlash(index))
+			if info, err := files.statFile(indexPath); err == nil && !info.IsDir() {
+				return serveFile(c, indexPath, info)
+			}
+		}
+		if !static.ListsFolders() {
+			return notFound(c, "File not found: "+urlPath)
+		}
+		return static.serveListing(c, fullPath, name)
+	}
+}
+
+// serveFile sends a file through http.ServeContent, which answers Range,
+// If-Range and conditional requests. The ETag of its modification time and
+// size lets a resumed download check the file didn't change in between.
+// A fresh .br or .gz sidecar the client accepts is sent in its place.
+func serveFile(c echo.Context, file string, info os.FileInfo) error {
+	files := siteOf(c).files
+	encoding, sidecar, varies := files.findSidecar(c.Request(), file, info)
+	if varies {
+		addVary(c.Response().Header(), echo.HeaderAcceptEncoding)
+	}
+	if sidecar != nil {
+		if err := files.serveSidecar(c, file, encoding, sidecar); err == nil {
+			return nil
+		}
+	}
+	c.Response().Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+	return c.File(file)
+}
+
+// resolve returns the file for a slash-separated name under the directory,
+// false for dotfiles, files inside dot folders and symlinks leading out
+func (static *Static) resolve(files *siteFS, name string) (string, bool) {
+	if name != "" {
+		for _, segment := range strings.Split(name, "/") {
+			if strings.HasPrefix(segment, ".") {
+				return "", false
+			}
+		}
+	}
+	if files.mounted(static.Dir) {
+		return filepath.Join(static.Dir, filepath.FromSlash(name)), true
+	}
+	base, err := filepath.EvalSymlinks(static.Dir)
+	if err != nil {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(static.Dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", false
+	}
+	if resolved != base && !strings.HasPrefix(resolved, base+string(filepath.Separator)) {
+		return "", false
+	}
+	return resolved, true
+}
+
+// serveListing renders the listing of a folder, folders first and then by
+// name, with the listingTemplate or the built-in page. The values are
+// escaped here, as the page has no content type to escape output tags by.
+func (static *Static) serveListing(c echo.Context, dir, name string) error {
+	site := siteOf(c)
+	entries, err := site.files.readDir(dir)
+	if err != nil {
+		return serveError(c, errorReport{message: "Error reading directory", err: err})
+	}
+
+	type listed struct {
+		name string
+		info os.FileInfo
+	}
+	var files []listed
+	for _, entry := range entries {
+		entryName := path.Join(name, entry.Name())
+		if _, ok := static.resolve(site.files, entryName); !ok {
+			continue
+		}
+		info, err := site.files.statFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		files = append(files, listed{entry.Name(), info})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].info.IsDir() != files[j].info.IsDir() {
+			return files[i].info.IsDir()
+		}
+		return files[i].name < files[j].name
+	})
+
+	var rows strings.Builder
+	for _, file := range files {
+		label, link, size := file.name, (&url.URL{Path: file.name}).String(), bytes.Format(file.info.Size())
+		if file.info.IsDir() {
+			label, link, size = label+"/", link+"/", "-"
+		}
+		modified := file.info.ModTime()
+		fmt.Fprintf(&rows, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td><time datetime=\"%s\">%s</time></td></tr>\n",
+			html.EscapeString(link), html.EscapeString(label), size,
+			modified.Format("2006-01-02T15:04:05Z07:00"), modified.Format("2006-01-02 15:04"))
+	}
+
+	// A link per folder from the mount down to this one
+	crumb := func(urlPath, label string) string {
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString((&url.URL{Path: urlPath}).String()), html.EscapeString(label))
+	}
+	current := static.mount
+	crumbs := []string{crumb(current+"/", path.Base("/"+current))}
+	if name != "" {
+		for _, segment := range strings.Split(name, "/") {
+			current += "/" + segment
+			crumbs = append(crumbs, crumb(current+"/", segment))
+		}
+	}
+
+	data := map[string]interface{}{
+		"listing.path":        html.EscapeString(current + "/"),
+		"listing.breadcrumbs": strings.Join(crumbs, " / "),
+		"listing.entries":     rows.String(),
+		"listing.count":       strconv.Itoa(len(files)),
+	}
+	if static.ListingTemplate != "" {
+		c.Set(templateValuesKey, data)
+		return renderTemplate(c, static.ListingTemplate, http.StatusOK)
+	}
+
+	processor := &TemplateProcessor{data: data, ctx: c.Request().Context()}
+	page, err := processor.processTemplate(listingPage, c)
+	if err != nil {
+		return serveError(c, errorReport{message: "Listing error", err: err})
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(page)))
+	return c.HTML(http.StatusOK, page)
+}
+
+const listingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of <%= listing.path %></title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+</style>
+</head>
+<body>
+<h1><%= listing.breadcrumbs %></h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+<%= listing.entries %></table>
+</body>
+</html>
+`
@@ -0,0 +1,71 @@
+package gosp
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A download is resumed from its second half: the range is answered with
+// 206 and its bytes, for HEAD too, as long as the file didn't change
+func TestStaticRangeResume(t *testing.T) {
+	var content strings.Builder
+	for i := 0; content.Len() < 10000; i++ {
+		fmt.Fprintf(&content, "%08d\n", i)
+	}
+	file := content.String()[:10000]
+	dir := filepath.Join(t.TempDir(), "downloads")
+	writeFiles(t, dir, map[string]string{"video.bin": file})
+	handler, _ := newTestSite(t, nil, `<routes><static path="/downloads" dir="`+dir+`"/></routes>`)
+
+	res, body := get(t, handler, http.MethodGet, "/downloads/video.bin")
+	if res.StatusCode != http.StatusOK || body != file || res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("whole file: %d, %d bytes, Accept-Ranges %q", res.StatusCode, len(body), res.Header.Get("Accept-Ranges"))
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag for If-Range")
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		res, body := get(t, handler, method, "/downloads/video.bin", "Range", "bytes=5000-", "If-Range", etag)
+		if res.StatusCode != http.StatusPartialContent {
+			t.Fatalf("%s second half: %d", method, res.StatusCode)
+		}
+		if got := res.Header.Get("Content-Range"); got != "bytes 5000-9999/10000" {
+			t.Errorf("%s Content-Range %q", method, got)
+		}
+		if got := res.Header.Get("Content-Length"); got != "5000" {
+			t.Errorf("%s Content-Length %q", method, got)
+		}
+		want := file[5000:]
+		if method == http.MethodHead {
+			want = ""
+		}
+		if body != want {
+			t.Errorf("%s second half: %d bytes, want %d", method, len(body), len(want))
+		}
+	}
+
+	// A changed file starts over
+	res, body = get(t, handler, http.MethodGet, "/downloads/video.bin", "Range", "bytes=5000-", "If-Range", `"stale"`)
+	if res.StatusCode != http.StatusOK || body != file {
+		t.Errorf("stale If-Range: %d, %d bytes", res.StatusCode, len(body))
+	}
+
+	res, _ = get(t, handler, http.MethodGet, "/downloads/video.bin", "Range", "bytes=20000-")
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable || res.Header.Get("Content-Range") != "bytes */10000" {
+		t.Errorf("range past the end: %d %q", res.StatusCode, res.Header.Get("Content-Range"))
+	}
+
+	res, body = get(t, handler, http.MethodGet, "/downloads/video.bin", "Range", "bytes=0-9,5000-5009")
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(body, file[:10]) || !strings.Contains(body, file[5000:5010]) {
+		t.Errorf("two ranges: %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if strings.Contains(body, file[10:20]) {
+		t.Error("two ranges answered bytes outside them")
+	}
+}
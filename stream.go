@@ -0,0 +1,138 @@
+package gosp
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/encoding"
+
+	"gosp/engine"
+)
+
+// Output held back before a page starts streaming. Pages under it go out
+// whole with a Content-Length, and still become error pages on failure.
+const streamThreshold = 32 << 10
+
+// pageWriter sends a rendered page. Output is collected until
+// streamThreshold bytes or a flush tag, then the response starts and the
+// page is written on in chunks of about that size, minified if it is to be
+// and converted to its charset on the way out.
+type pageWriter struct {
+	c           echo.Context
+	status      int
+	contentType string
+	encoder     *encoding.Encoder
+	buffer      []byte
+
+	// Set to collect the whole page, which then starts at close
+	hold bool
+
+	// Set to minify the page, which the minifier does chunk by chunk once
+	// it streams
+	minify bool
+
+	// Response body once started, through the minifier and the encoder if
+	// any
+	out io.Writer
+
+	// Bytes rendered, before charset conversion
+	written int
+	err     error
+}
+
+func newPageWriter(c echo.Context, status int, contentType string, encoder *encoding.Encoder, buffer []byte) *pageWriter {
+	return &pageWriter{c: c, status: status, contentType: contentType, encoder: encoder, buffer: buffer[:0]}
+}
+
+func (w *pageWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buffer = append(w.buffer, b...)
+	w.written += len(b)
+	if len(w.buffer) >= streamThreshold && !w.hold {
+		w.send()
+	}
+	return len(b), w.err
+}
+
+// WriteString spares text nodes a conversion to bytes
+func (w *pageWriter) WriteString(s string) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buffer = append(w.buffer, s...)
+	w.written += len(s)
+	if len(w.buffer) >= streamThreshold && !w.hold {
+		w.send()
+	}
+	return len(s), w.err
+}
+
+// Flush sends what was rendered so far to the client, for flush tags
+func (w *pageWriter) Flush() {
+	if w.err != nil || w.hold {
+		return
+	}
+	w.send()
+	if flusher, ok := w.c.Response().Writer.(http.Flusher); ok && w.err == nil {
+		flusher.Flush()
+	}
+}
+
+// started reports whether the response was sent, so errors can no longer
+// become error pages
+func (w *pageWriter) started() bool {
+	return w.out != nil
+}
+
+// send writes out the buffered output, starting the response without a
+// Content-Length
+func (w *pageWriter) send() {
+	if w.out == nil {
+		res := w.c.Response()
+		res.Header().Set(echo.HeaderContentType, w.contentType)
+		res.Header().Del(echo.HeaderContentLength)
+		res.WriteHeader(w.status)
+		w.out = res
+		if w.encoder != nil {
+			w.out = w.encoder.Writer(res)
+		}
+		if w.minify {
+			w.out = engine.NewMinifier(w.out)
+		}
+	}
+	if w.err == nil {
+		_, w.err = w.out.Write(w.buffer)
+	}
+	w.buffer = w.buffer[:0]
+}
+
+// close finishes the page. One that never started is sent whole, its
+// Content-Length declared up front so HEAD answers with the length GET
+// sends, which net/http would leave out after buffering 2KB.
+func (w *pageWriter) close() error {
+	if w.out != nil {
+		w.send()
+		if closer, ok := w.out.(io.Closer); ok && w.err == nil {
+			w.err = closer.Close()
+		}
+		return w.err
+	}
+
+	body := w.buffer
+	if w.minify {
+		body = engine.MinifyHTML(body)
+	}
+	if w.encoder != nil {
+		if encoded, err := w.encoder.Bytes(body); err == nil {
+			body = encoded
+		}
+	}
+	header := w.c.Response().Header()
+	header.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+	header.Set(echo.HeaderContentType, w.contentType)
+	return w.c.Blob(w.status, w.contentType, body)
+}
@@ -0,0 +1,114 @@
+package gosp
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// rootFile returns the file of a slash-separated name under a root and
+// whether it may be served: a name can't climb out of the root, and
+// neither can the symlinks on its way unless --follow-symlinks is set.
+// Missing files may be; they are found missing.
+func (f *siteFS) rootFile(root, name string) (string, bool) {
+	root = filepath.Clean(root)
+	file := filepath.Join(root, filepath.FromSlash(name))
+	if !pathWithin(file, root) {
+		return file, false
+	}
+	if f.followSymlinks {
+		return file, true
+	}
+	if memory, _ := f.memoryRootFor(file); memory != nil || f.mounted(file) {
+		// Loaded by walkRoot, which refused them already, or mounted
+		return file, true
+	}
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return file, true
+	}
+	return file, pathWithin(real, f.realRoot(root))
+}
+
+func (f *siteFS) realRoot(root string) string {
+	if real, ok := f.realRoots.Load(root); ok {
+		return real.(string)
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return root
+	}
+	f.realRoots.Store(root, real)
+	return real
+}
+
+// walkRoot walks the tree of a directory as filepath.Walk does, but for
+// symlinks to files, which are reported with the file they lead to. Those
+// leading out of the directory are left out, and symlinks to directories
+// aren't walked into, unless --follow-symlinks is set. Then both are
+// followed, the files below a directory being reported under the
+// symlink's name, but for symlinks leading back to a directory they are
+// in, which would walk for ever. Broken symlinks are left out.
+func (f *siteFS) walkRoot(dir string, fn filepath.WalkFunc) error {
+	if fsys, name := f.mountFor(dir); fsys != nil {
+		return walkMount(fsys, name, dir, fn)
+	}
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		base = dir
+	}
+	return f.walkLinked(dir, base, fn, base, nil)
+}
+
+// walkLinked walks real, a directory, reporting its files under name.
+// The directories holding the symlinks walked into so far are ancestors,
+// by their real path.
+func (f *siteFS) walkLinked(name, real string, fn filepath.WalkFunc, base string, ancestors []string) error {
+	return filepath.Walk(real, func(path string, info os.FileInfo, err error) error {
+		if rel, relErr := filepath.Rel(real, path); relErr == nil {
+			path = filepath.Join(name, rel)
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return fn(path, info, err)
+		}
+
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil
+		}
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			return nil
+		}
+		switch {
+		case !f.followSymlinks && !pathWithin(target, base):
+			return nil
+		case !f.followSymlinks && targetInfo.IsDir():
+			return fn(path, info, nil)
+		case !targetInfo.IsDir():
+			return fn(path, targetInfo, nil)
+		}
+
+		parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		for _, dir := range append(ancestors, parent) {
+			if pathWithin(dir, target) {
+				return nil
+			}
+		}
+		if err := fn(path, targetInfo, nil); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+		return f.walkLinked(path, target, func(below string, info os.FileInfo, err error) error {
+			// Reported above, as the symlink
+			if below == path {
+				return nil
+			}
+			return fn(below, info, err)
+		}, base, append(ancestors, parent))
+	})
+}
@@ -0,0 +1,85 @@
+package gosp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment of a socket-activated service: the sockets are passed as
+// fds from 3 on, named by FileDescriptorName= of the socket unit
+const (
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	notifySocketEnv  = "NOTIFY_SOCKET"
+)
+
+// Set when systemd passed the listeners. The unit owns them, so upgrades
+// restart it instead and socket files are left in place.
+var socketActivated bool
+
+// activatedSocket is a listener passed by systemd with its name
+type activatedSocket struct {
+	name     string
+	listener net.Listener
+}
+
+// activatedSockets returns the sockets systemd passed to this process,
+// none when it isn't socket-activated
+func activatedSockets() ([]activatedSocket, error) {
+	// The variables may be left over from the parent of this process
+	pid, err := strconv.Atoi(os.Getenv(listenPIDEnv))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid %s %q", listenFDsEnv, os.Getenv(listenFDsEnv))
+	}
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	os.Unsetenv(listenPIDEnv)
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(listenFDNamesEnv)
+
+	var sockets []activatedSocket
+	for i := 0; i < count; i++ {
+		fd := 3 + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d (%s) is not a stream socket: %v", fd, name, err)
+		}
+		sockets = append(sockets, activatedSocket{name, listener})
+	}
+	socketActivated = true
+	return sockets, nil
+}
+
+// notifySystemd reports a state such as READY=1 to the service manager of
+// a Type=notify unit, doing nothing outside of one
+func notifySystemd(state string) {
+	socket := os.Getenv(notifySocketEnv)
+	if socket == "" {
+		return
+	}
+	// A leading @ stands for the abstract namespace, which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		serverLog.Warn("Cannot notify systemd", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		serverLog.Warn("Cannot notify systemd", "err", err)
+	}
+}
@@ -0,0 +1,144 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// buildTarget is a platform compile builds a binary for. Empty fields are
+// the host's, or those of GOOS and GOARCH in the environment.
+type buildTarget struct {
+	goos   string
+	goarch string
+
+	// Build with cgo, which cross builds need a C toolchain for
+	cgo bool
+}
+
+func (target buildTarget) String() string {
+	if target.goos == "" && target.goarch == "" {
+		return "host"
+	}
+	return target.goos + "/" + target.goarch
+}
+
+// parseTargets reads --goos and --goarch, building every pair of them, so
+// "--goos linux --goarch amd64,arm64" builds both Linux binaries. Pairs
+// the go tool doesn't know, and Windows, are refused before anything is
+// built. They build with cgo if it is set.
+func parseTargets(systems, archs string, cgo bool) ([]buildTarget, error) {
+	split := func(list string) []string {
+		var values []string
+		for _, value := range strings.Split(list, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return []string{""}
+		}
+		return values
+	}
+
+	known := knownTargets()
+	seen := make(map[buildTarget]bool)
+	var targets []buildTarget
+	for _, system := range split(systems) {
+		for _, arch := range split(archs) {
+			target := buildTarget{goos: system, goarch: arch, cgo: cgo}
+			if target.goos == "" && target.goarch != "" || target.goos != "" && target.goarch == "" {
+				target.goos, target.goarch = hostTarget(target.goos, target.goarch)
+			}
+			if known != nil && target.goos != "" && !known[target.String()] {
+				return nil, fmt.Errorf("invalid --goos/--goarch: go can't build for %s", target)
+			}
+			if target.goos == "windows" {
+				return nil, fmt.Errorf("invalid --goos windows: compiled binaries use Unix signals and sockets")
+			}
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// hostTarget fills in the platform left out of one of --goos and --goarch
+// with the one go builds for by default
+func hostTarget(system, arch string) (string, string) {
+	if system == "" {
+		system = goEnv("GOOS")
+	}
+	if arch == "" {
+		arch = goEnv("GOARCH")
+	}
+	return system, arch
+}
+
+func goEnv(name string) string {
+	value, err := exec.Command("go", "env", name).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// knownTargets returns the platforms the go tool builds for, nil when it
+// can't say, leaving go build to refuse the unknown ones
+func knownTargets() map[string]bool {
+	list, err := exec.Command("go", "tool", "dist", "list").Output()
+	if err != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, target := range strings.Fields(string(list)) {
+		known[target] = true
+	}
+	return known
+}
+
+// output names the binary of the target: the --output itself for a single
+// one, suffixed with the platform when there are several, as in
+// webapp-linux-arm64
+func (target buildTarget) output(output string, suffixed bool) string {
+	if !suffixed {
+		return output
+	}
+	return output + "-" + target.goos + "-" + target.goarch
+}
+
+// build runs go build for the target in the current directory
+func (target buildTarget) build(output string) error {
+	command := exec.Command("go", "build", "-o", output, ".")
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.Env = append(os.Environ(), target.env()...)
+	return command.Run()
+}
+
+// env returns the variables go build runs with for the target
+func (target buildTarget) env() []string {
+	env := []string{"CGO_ENABLED=0"}
+	if target.cgo {
+		env[0] = "CGO_ENABLED=1"
+	}
+	if target.goos != "" {
+		env = append(env, "GOOS="+target.goos, "GOARCH="+target.goarch)
+	}
+	return env
+}
+
+// checkArtifact makes sure go build left a binary behind
+func checkArtifact(output string) (int64, error) {
+	info, err := os.Stat(output)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("no binary at %s: %v", output, err)
+	case !info.Mode().IsRegular() || info.Size() == 0:
+		return 0, fmt.Errorf("binary at %s is empty", output)
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,213 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gosp/cache"
+	"gosp/engine"
+)
+
+// templateCache holds parsed templates by file and roots, bounded by their
+// count and source size. Entries are checked against the files they were
+// parsed from on every use.
+type templateCache struct {
+	entries *cache.Cache
+
+	// Files of the server, which the entries are checked against
+	files *siteFS
+}
+
+type cachedTemplate struct {
+	parsed *engine.Template
+	stamps []fileStamp
+
+	// Output of a template holding no tags, nil for others
+	plain *plainPage
+}
+
+// plainPage is what a template holding no tags outputs, sent as it is
+type plainPage struct {
+	body []byte
+	etag string
+
+	// What the page directive says about minifying, and the page minified,
+	// made the first time it is sent so
+	minify   string
+	once     sync.Once
+	minified *plainPage
+}
+
+// minifiedPage returns the page with its body minified
+func (page *plainPage) minifiedPage() *plainPage {
+	page.once.Do(func() {
+		body := engine.MinifyHTML(page.body)
+		page.minified = &plainPage{body: body, etag: bodyETag(body), minify: page.minify}
+	})
+	return page.minified
+}
+
+// plainWithin returns the page of a template holding no tags unless it is
+// over the include limit, nil for a template with tags or a nil one
+func (t *cachedTemplate) plainWithin(limit int) *plainPage {
+	if t == nil || limit > 0 && t.parsed.Size > limit {
+		return nil
+	}
+	return t.plain
+}
+
+// fileStamp is the state of a file when a template was parsed from it.
+// Include candidates that didn't exist are kept too, as creating one in an
+// earlier root changes which file is included.
+type fileStamp struct {
+	path    string
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func (f *siteFS) stampFile(path string) (fileStamp, os.FileInfo) {
+	info, err := f.statRootFile(path)
+	if err != nil || info.IsDir() {
+		return fileStamp{path: path}, nil
+	}
+	return fileStamp{path: path, exists: true, modTime: info.ModTime(), size: info.Size()}, info
+}
+
+// current reports whether the file is still as when it was stamped
+func (s fileStamp) current(files *siteFS) bool {
+	now, _ := files.stampFile(s.path)
+	return now.exists == s.exists && now.modTime.Equal(s.modTime) && now.size == s.size
+}
+
+func newTemplateCache(maxEntries int, maxBytes int64, files *siteFS) (*templateCache, error) {
+	entries, err := cache.New(maxEntries, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("template cache %v", err)
+	}
+	return &templateCache{entries: entries, files: files}, nil
+}
+
+// templateKey identifies a parse: the file with the roots its includes are
+// looked up in, which differ between tenants
+func templateKey(file string, roots []string) string {
+	return filepath.Clean(file) + "\x00" + strings.Join(roots, "\x00")
+}
+
+// lookup returns the cached template unless one of its files changed
+// since. A nil cache has nothing.
+func (cache *templateCache) lookup(key string) *cachedTemplate {
+	if cache == nil {
+		return nil
+	}
+	value, ok := cache.entries.Get(key, func(value interface{}) bool {
+		for _, stamp := range value.(*cachedTemplate).stamps {
+			if !stamp.current(cache.files) {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		return nil
+	}
+	return value.(*cachedTemplate)
+}
+
+// put keeps a parsed template, with its output when it holds no tags
+func (cache *templateCache) put(key string, parsed *engine.Template, stamps []fileStamp) {
+	if cache == nil {
+		return
+	}
+	cached := &cachedTemplate{parsed: parsed, stamps: stamps}
+	if text, ok := parsed.Text(); ok {
+		body := []byte(text)
+		cached.plain = &plainPage{body: body, etag: bodyETag(body), minify: parsed.Minify}
+	}
+	cache.entries.Put(key, cached, int64(parsed.Size), 0)
+}
+
+// invalidate drops every template parsed from the file, or that would
+// include it had it existed, and returns how many. For a directory, that
+// is the templates of every file below it.
+func (cache *templateCache) invalidate(file string) int {
+	if cache == nil {
+		return 0
+	}
+	file = filepath.Clean(file)
+	return cache.entries.RemoveIf(func(_ string, value interface{}) bool {
+		for _, stamp := range value.(*cachedTemplate).stamps {
+			if pathWithin(stamp.path, file) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// flush drops every template and returns how many
+func (cache *templateCache) flush() int {
+	if cache == nil {
+		return 0
+	}
+	return cache.entries.Clear()
+}
+
+// loadTemplate returns a template parsed, from the cache when its files are
+// unchanged. The files are stamped before they are read, so one changing
+// in between is parsed again on the next request.
+func (tp *TemplateProcessor) loadTemplate(file, name string) (*engine.Template, error) {
+	return tp.loadCached(tp.templates.lookup(templateKey(file, tp.roots)), file, name)
+}
+
+// loadCached is loadTemplate for a cache already looked up, cached being
+// what it had, nil for nothing
+func (tp *TemplateProcessor) loadCached(cached *cachedTemplate, file, name string) (*engine.Template, error) {
+	if cached != nil {
+		parsed := cached.parsed
+		// Parsed for a route allowing more
+		if tp.includeLimit > 0 && parsed.Size > tp.includeLimit {
+			return nil, &engine.SizeError{Size: parsed.Size, Limit: tp.includeLimit}
+		}
+		return parsed, nil
+	}
+
+	// Not read for a request already gone
+	if tp.interrupted() {
+		return nil, tp.err
+	}
+	stamp, _ := tp.files.stampFile(file)
+	content, err := tp.files.readRootFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tp.stamps = []fileStamp{stamp}
+	parsed := tp.parseTemplate(file, decodeTemplate(name, content))
+	if parsed == nil {
+		return nil, tp.err
+	}
+	tp.templates.put(templateKey(file, tp.roots), parsed, tp.stamps)
+	return parsed, nil
+}
+
+func registerTemplateCacheMetrics(cache *templateCache) {
+	registerMetric("gosp_template_cache_hits_total", "counter", "Renders that used a cached parsed template", func() float64 {
+		return float64(cache.entries.Stats().Hits)
+	})
+	registerMetric("gosp_template_cache_misses_total", "counter", "Renders that had to read and parse the template", func() float64 {
+		return float64(cache.entries.Stats().Misses)
+	})
+	registerMetric("gosp_template_cache_evictions_total", "counter", "Parsed templates dropped to stay within the cache bounds", func() float64 {
+		return float64(cache.entries.Stats().Evictions)
+	})
+	registerMetric("gosp_template_cache_entries", "gauge", "Parsed templates held in the template cache", func() float64 {
+		return float64(cache.entries.Stats().Entries)
+	})
+	registerMetric("gosp_template_cache_bytes", "gauge", "Template source bytes held in the template cache", func() float64 {
+		return float64(cache.entries.Stats().Bytes)
+	})
+}
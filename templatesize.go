@@ -0,0 +1,52 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+)
+
+// templateSizes bound the template files read whole to render them. Over
+// max a file is served as it is, streamed from disk without processing;
+// over reject it is refused. 0 is no bound.
+type templateSizes struct {
+	max    int64
+	reject int64
+}
+
+// parseTemplateSizes parses the flags, empty being no bound
+func parseTemplateSizes(max, reject string) (templateSizes, error) {
+	var sizes templateSizes
+	var err error
+	if max != "" {
+		if sizes.max, err = bytes.Parse(max); err != nil || sizes.max < 0 {
+			return sizes, fmt.Errorf("invalid --max-template-size %q", max)
+		}
+	}
+	if reject != "" {
+		if sizes.reject, err = bytes.Parse(reject); err != nil || sizes.reject < 0 {
+			return sizes, fmt.Errorf("invalid --reject-template-size %q", reject)
+		}
+	}
+	return sizes, nil
+}
+
+// processes reports whether a template file is small enough to render
+func (sizes templateSizes) processes(size int64) bool {
+	return (sizes.max == 0 || size <= sizes.max) && (sizes.reject == 0 || size <= sizes.reject)
+}
+
+// serveLarge answers for a template too large to render: the file as it
+// is, or a 500 once it is over the reject bound
+func (sizes templateSizes) serveLarge(c echo.Context, filename, fullPath string, info os.FileInfo) error {
+	if sizes.reject > 0 && info.Size() > sizes.reject {
+		c.Set(templateNameKey, filename)
+		err := fmt.Errorf("%s is %d bytes, over --reject-template-size of %d", filename, info.Size(), sizes.reject)
+		return serveError(c, errorReport{message: "Template too large", err: err, template: filename})
+	}
+	renderLog.Debug("Serving large template unprocessed", "template", filename, "size", info.Size())
+	recordDependencies(c, fullPath)
+	return serveFile(c, fullPath, info)
+}
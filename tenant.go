@@ -0,0 +1,131 @@
+package gosp
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Context key of the tenant a request is for, with --tenants-dir
+const tenantKey = "gosp.tenant"
+
+// tenant is a site served from its own directory under --tenants-dir,
+// falling back to --root for the templates and includes it lacks
+type tenant struct {
+	name string
+	root string
+}
+
+// Tenant names are lowercase host names, which are safe directory names
+var tenantNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// tenantName derives the tenant from the --tenant-header, or the Host
+// without its port, stripped of the --tenant-domain
+func tenantName(req *http.Request, options *serverOptions) string {
+	host := req.Host
+	if options.tenantHeader != "" {
+		host = req.Header.Get(options.tenantHeader)
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if options.tenantDomain != "" {
+		host = strings.TrimSuffix(host, "."+strings.TrimPrefix(strings.ToLower(options.tenantDomain), "."))
+	}
+	return host
+}
+
+// tenantMiddleware resolves the tenant of every request but those for
+// the instance itself, such as metrics. A tenant exists as long as its
+// directory does, so new ones are served without a restart.
+func tenantMiddleware(dir string, excluded []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if excludedPath(c.Request().URL.Path, excluded) {
+				return next(c)
+			}
+
+			name := tenantName(c.Request(), siteOf(c).options)
+			root := filepath.Join(dir, name)
+			if !tenantNameRegex.MatchString(name) {
+				return unknownTenant(c, name)
+			}
+			if info, err := os.Stat(root); err != nil || !info.IsDir() {
+				return unknownTenant(c, name)
+			}
+			c.Set(tenantKey, &tenant{name: name, root: root})
+			return next(c)
+		}
+	}
+}
+
+// unknownTenant answers a request for a site that doesn't exist with the
+// --unknown-tenant-template from the shared root, or a plain 404
+func unknownTenant(c echo.Context, name string) error {
+	serverLog.Debug("No such tenant", "tenant", name, "host", c.Request().Host)
+	if template := siteOf(c).options.unknownTenantTemplate; template != "" {
+		return renderTemplate(c, template, http.StatusNotFound)
+	}
+	return notFound(c, "No such site")
+}
+
+// tenantFor returns the tenant of a request, nil without --tenants-dir
+func tenantFor(c echo.Context) *tenant {
+	t, _ := c.Get(tenantKey).(*tenant)
+	return t
+}
+
+// templateRoots lists the directories templates of a request are looked
+// up in: the tenant's, then the root of the site
+func (s *site) templateRoots(c echo.Context) []string {
+	if t := tenantFor(c); t != nil {
+		return []string{t.root, s.root}
+	}
+	return []string{s.root}
+}
+
+// findInRoots returns the path of a file in the first root having it and
+// serving it
+func (f *siteFS) findInRoots(roots []string, filename string) (string, bool) {
+	for _, root := range roots {
+		fullPath, ok := f.rootFile(root, filename)
+		if !ok {
+			continue
+		}
+		if info, err := f.statRootFile(fullPath); err == nil && !info.IsDir() {
+			return fullPath, true
+		}
+	}
+	return "", false
+}
+
+// templatePath returns the file of a template for a request, in the first
+// root having it. Missing ones are reported under the first root, and
+// whether it may be served, as rootFile does.
+func templatePath(c echo.Context, filename string) (string, bool) {
+	s := siteOf(c)
+	roots := s.templateRoots(c)
+	if fullPath, ok := s.files.findInRoots(roots, filename); ok {
+		return fullPath, true
+	}
+	return s.files.rootFile(roots[0], filename)
+}
+
+// includePath returns the file of an include, in the first root having it,
+// and whether it may be read
+func (tp *TemplateProcessor) includePath(name string) (string, bool) {
+	if fullPath, ok := tp.files.findInRoots(tp.roots, name); ok {
+		return fullPath, true
+	}
+	root := ""
+	if len(tp.roots) > 0 {
+		root = tp.roots[0]
+	}
+	return tp.files.rootFile(root, name)
+}
@@ -0,0 +1,96 @@
+package gosp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"gosp/engine"
+)
+
+// validateTimeout checks a handler timeout such as "5s" or "1m30s"
+func validateTimeout(timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("%q must be positive", timeout)
+	}
+	return nil
+}
+
+// timeoutMiddleware gives the handler a context deadline. Rendering stops
+// at the next tag boundary once it passes and the client gets a 503, or
+// the timeout template when one is configured.
+func timeoutMiddleware(timeout time.Duration, template string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+
+			// Render the error response without the expired deadline
+			c.SetRequest(req)
+
+			if c.Response().Committed {
+				renderLog.Error("Timed out after the response started, it may be truncated", "timeout", timeout.String(), "path", req.URL.Path, "request_id", requestID(c))
+				return nil
+			}
+
+			if template != "" {
+				return renderTemplate(c, template, http.StatusServiceUnavailable)
+			}
+			return c.String(http.StatusServiceUnavailable, "Request timed out")
+		}
+	}
+}
+
+// interrupted reports whether the request was cancelled or its deadline
+// passed, recording why as an *engine.CancelledError so processing stops at
+// the next tag
+func (tp *TemplateProcessor) interrupted() bool {
+	if tp.err != nil {
+		return true
+	}
+	if tp.ctx == nil {
+		return false
+	}
+	if err := tp.ctx.Err(); err != nil {
+		tp.err = &engine.CancelledError{Err: err}
+	}
+	return tp.err != nil
+}
+
+// isInterruption reports whether a processing error means the request was
+// cancelled or timed out, leaving the response to the caller
+func isInterruption(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// logCancelled logs a render its context stopped, at the route's timeout
+// or because the client went away, apart from the errors of templates
+func logCancelled(c echo.Context, template string, err error) {
+	var cancelled *engine.CancelledError
+	if !errors.As(err, &cancelled) {
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		renderLog.Warn("Render cancelled at the timeout", "template", template, "request_id", requestID(c))
+		return
+	}
+	renderLog.Debug("Render cancelled, client gone", "template", template, "request_id", requestID(c))
+}
@@ -0,0 +1,82 @@
+package gosp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// slowValue is page data that takes its time to print, as a slow data tag
+// would, calling done once it has
+type slowValue struct {
+	delay  time.Duration
+	done   func()
+	prints *atomic.Int64
+}
+
+func (v *slowValue) String() string {
+	v.prints.Add(1)
+	time.Sleep(v.delay)
+	if v.done != nil {
+		v.done()
+	}
+	return "slow"
+}
+
+// A request cancelled mid-render stops at the next tag: neither the tags
+// after it nor the branch of a condition it decided run
+func TestCancelledRenderStops(t *testing.T) {
+	for _, page := range []string{
+		`before <%= slow %> <%= after %> <%= after %>`,
+		`<% if slow == "slow" %><%= after %><% end %> <%= after %>`,
+	} {
+		var slowPrints, afterPrints atomic.Int64
+		ctx, cancel := context.WithCancel(context.Background())
+		handler, _ := newTestSite(t, map[string]string{"page.html": page}, "<routes/>",
+			Handle("/page", "page.html", func(c echo.Context) (map[string]interface{}, error) {
+				return map[string]interface{}{
+					"slow":  &slowValue{delay: 10 * time.Millisecond, done: cancel, prints: &slowPrints},
+					"after": &slowValue{prints: &afterPrints},
+				}, nil
+			}))
+
+		req := httptest.NewRequest(http.MethodGet, "/page", nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if slowPrints.Load() != 1 {
+			t.Errorf("%s: slow printed %d times", page, slowPrints.Load())
+		}
+		if afterPrints.Load() != 0 {
+			t.Errorf("%s: %d tags ran after the request was cancelled", page, afterPrints.Load())
+		}
+		if strings.Contains(rec.Body.String(), "slow") {
+			t.Errorf("%s: cancelled render answered %q", page, rec.Body.String())
+		}
+	}
+}
+
+func init() {
+	RegisterProvider("test-slow-data", func(c echo.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"slow": &slowValue{delay: 30 * time.Millisecond, prints: new(atomic.Int64)}}, nil
+	})
+}
+
+// A render passing the route's timeout answers 503 instead of the page
+func TestRenderTimeout(t *testing.T) {
+	handler, _ := newTestSite(t, map[string]string{"page.html": `<%= slow %> <%= slow %> <%= slow %> done`},
+		`<routes><route path="/page" file="page.html" provider="test-slow-data" timeout="40ms"><methods>GET</methods></route></routes>`)
+	start := time.Now()
+	res, body := get(t, handler, http.MethodGet, "/page")
+	if res.StatusCode != http.StatusServiceUnavailable || body != "Request timed out" {
+		t.Errorf("timed out render: %d %q", res.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed >= 90*time.Millisecond {
+		t.Errorf("timed out render took %s, past its last tag", elapsed)
+	}
+}
@@ -0,0 +1,211 @@
+package gosp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certCheckInterval = 5 * time.Second
+
+// TLS settings for serving HTTPS
+type TLS struct {
+	Cert       string `xml:"cert,attr"`
+	Key        string `xml:"key,attr"`
+	MinVersion string `xml:"minVersion,attr"`
+	Ciphers    string `xml:"ciphers,attr"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// prepare resolves the certificate paths against the config file directory
+// and validates the version and cipher names
+func (t *TLS) prepare(baseDir string) error {
+	for _, file := range []*string{&t.Cert, &t.Key} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(baseDir, *file)
+		}
+	}
+
+	_, err := t.options()
+	return err
+}
+
+// enabled reports whether HTTPS is configured, requiring both files
+func (t *TLS) enabled() (bool, error) {
+	if t.Cert == "" && t.Key == "" {
+		return false, nil
+	}
+	if t.Cert == "" || t.Key == "" {
+		return false, fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	return true, nil
+}
+
+// options builds a TLS configuration without certificates
+func (t *TLS) options() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if t.MinVersion != "" {
+		version, exists := tlsVersions[t.MinVersion]
+		if !exists {
+			return nil, fmt.Errorf("invalid TLS minVersion %q, expected 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(t.Ciphers, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, exists := suites[name]
+		if !exists {
+			return nil, fmt.Errorf("unsupported TLS cipher %q, expected one of %s", name, strings.Join(sortedKeys(suites), ", "))
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	return config, nil
+}
+
+// serverConfig builds the listener configuration, loading the certificate
+// pair and reloading it whenever the files change. Returns nil when no
+// certificate is configured.
+func (t *TLS) serverConfig() (*tls.Config, error) {
+	if enabled, err := t.enabled(); !enabled || err != nil {
+		return nil, err
+	}
+
+	config, err := t.options()
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	config.GetCertificate = reloader.getCertificate
+
+	return config, nil
+}
+
+// mergeTLSFlags returns the <tls> config with the TLS flags of the options
+// applied over it
+func mergeTLSFlags(configured *TLS, options *serverOptions) TLS {
+	var settings TLS
+	if configured != nil {
+		settings = *configured
+	}
+
+	for _, flag := range []struct {
+		value  string
+		target *string
+	}{
+		{options.tlsCert, &settings.Cert},
+		{options.tlsKey, &settings.Key},
+		{options.tlsMinVersion, &settings.MinVersion},
+		{options.tlsCiphers, &settings.Ciphers},
+	} {
+		if flag.value != "" {
+			*flag.target = flag.value
+		}
+	}
+
+	return settings
+}
+
+// certReloader serves a certificate pair, picking up renewed files
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := reloader.modTime()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TLS certificate: %v", err)
+	}
+
+	if err := reloader.load(modified); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// load reads the pair, failing when the key doesn't match the certificate
+func (r *certReloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate %s and key %s: %v", r.certFile, r.keyFile, err)
+	}
+
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+// modTime returns the latest modification time of the pair
+func (r *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		if modified, err := r.modTime(); err == nil && !modified.Equal(r.modified) {
+			// Keep serving the old pair until the new one loads, e.g. while
+			// only one of the files has been replaced
+			if err := r.load(modified); err != nil {
+				tlsLog.Warn("Could not reload TLS certificate", "file", r.certFile, "err", err)
+			} else {
+				tlsLog.Info("Reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+
+	return r.cert, nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
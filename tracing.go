@@ -0,0 +1,186 @@
+package gosp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OpenTelemetry span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// span is one timed operation of a trace
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []spanAttr
+
+	// Set when the operation failed
+	errMessage string
+	failed     bool
+}
+
+// spanAttr is a string or int64 attribute of a span
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+type spanContextKey struct{}
+
+// Set by --tracing, nil leaves requests untraced. It is the process's: the
+// OTEL_* variables configuring its exporter are, spans find it from
+// anywhere below a request without a handle on the server, and only Main
+// sets it, sites made by New tracing nothing of their own.
+var tracer *spanTracer
+
+// startSpan starts a child of the span in ctx, or a new trace. It returns
+// a nil span when tracing is off; span methods accept nil.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: spanKindInternal, start: time.Now()}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = tracer.sampleRoot(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if n, ok := value.(int); ok {
+		value = int64(n)
+	}
+	s.attrs = append(s.attrs, spanAttr{key: key, value: value})
+}
+
+// finish ends the span, marking it failed for a non-nil err, and queues
+// it for export when sampled
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.failed, s.errMessage = true, err.Error()
+	}
+	if s.sampled {
+		tracer.queue(s)
+	}
+}
+
+// traceID returns the trace ID of the request as 32 hex digits, empty when
+// tracing is off
+func traceID(ctx context.Context) string {
+	if s, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	return ""
+}
+
+// parseTraceparent reads a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+
+	parent := &span{}
+	version, err1 := hex.DecodeString(parts[0])
+	traceID, err2 := hex.DecodeString(parts[1])
+	spanID, err3 := hex.DecodeString(parts[2])
+	flags, err4 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(version) != 1 ||
+		len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 || parts[1] != strings.ToLower(parts[1]) {
+		return nil, false
+	}
+	copy(parent.traceID[:], traceID)
+	copy(parent.spanID[:], spanID)
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return nil, false
+	}
+	parent.sampled = flags[0]&1 == 1
+	return parent, true
+}
+
+// tracingMiddleware starts a server span per request, continuing the trace
+// of an incoming traceparent header
+func tracingMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := req.Context()
+			if parent, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+				if !tracer.parentBased {
+					parent.sampled = tracer.sampleRoot(parent.traceID)
+				}
+				ctx = context.WithValue(ctx, spanContextKey{}, parent)
+			}
+
+			ctx, s := startSpan(ctx, req.Method)
+			s.kind = spanKindServer
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			if route := c.Path(); route != "" {
+				s.name = req.Method + " " + route
+				s.setAttr("http.route", route)
+			}
+			s.setAttr("http.method", req.Method)
+			s.setAttr("http.target", req.URL.RequestURI())
+			s.setAttr("http.status_code", status)
+			s.setAttr("http.user_agent", req.UserAgent())
+			s.setAttr("net.sock.peer.addr", c.RealIP())
+			s.setAttr("http.response_content_length", c.Response().Size)
+
+			// Client errors don't fail a server span
+			var failure error
+			if status >= http.StatusInternalServerError {
+				failure = err
+				if failure == nil {
+					failure = echo.NewHTTPError(status)
+				}
+			}
+			s.finish(failure)
+			return err
+		}
+	}
+}
+
+// sampleRoot decides for traces started here, keeping the same share of
+// trace IDs as other services would
+func (t *spanTracer) sampleRoot(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>11 < uint64(t.ratio*(1<<53))
+}
@@ -0,0 +1,217 @@
+package gosp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment of a process started by an upgrade: the listeners handed
+// over, as fds from 3 on, and the fd of the pipe to report readiness on
+const (
+	upgradeListenersEnv = "GOSP_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "GOSP_UPGRADE_READY"
+)
+
+// inheritedListener names a listener handed over by an upgrade with the
+// network and address it was requested as
+type inheritedListener struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// openListener is a listener opened by listenOn, kept for handing over
+type openListener struct {
+	inheritedListener
+	listener net.Listener
+}
+
+var listenerRegistry struct {
+	mu   sync.Mutex
+	open []openListener
+
+	// Listeners from the previous process, by "network address", not
+	// taken yet
+	inherited map[string]net.Listener
+}
+
+func listenerKey(network, address string) string {
+	return network + " " + address
+}
+
+// inheritListeners picks up the listeners handed over by the process this
+// one upgrades
+func inheritListeners() error {
+	encoded := os.Getenv(upgradeListenersEnv)
+	if encoded == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+
+	var names []inheritedListener
+	if err := json.Unmarshal([]byte(encoded), &names); err != nil {
+		return fmt.Errorf("invalid %s: %v", upgradeListenersEnv, err)
+	}
+
+	listenerRegistry.inherited = make(map[string]net.Listener)
+	for i, name := range names {
+		file := os.NewFile(uintptr(3+i), name.Address)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot inherit listener on %s: %v", displayAddress(name.Network, name.Address), err)
+		}
+		listenerRegistry.inherited[listenerKey(name.Network, name.Address)] = listener
+	}
+	serverLog.Info("Upgrade: inherited listeners", "count", len(names))
+	return nil
+}
+
+// takeInherited returns the handed over listener for an address, if any
+func takeInherited(network, address string) net.Listener {
+	listenerRegistry.mu.Lock()
+	defer listenerRegistry.mu.Unlock()
+	key := listenerKey(network, address)
+	listener, exists := listenerRegistry.inherited[key]
+	if exists {
+		delete(listenerRegistry.inherited, key)
+	}
+	return listener
+}
+
+func registerListener(network, address string, listener net.Listener) {
+	listenerRegistry.mu.Lock()
+	defer listenerRegistry.mu.Unlock()
+	listenerRegistry.open = append(listenerRegistry.open, openListener{inheritedListener{network, address}, listener})
+}
+
+// notifyUpgradeReady tells the previous process to drain once this one
+// serves, closing inherited listeners no longer configured
+func notifyUpgradeReady() {
+	listenerRegistry.mu.Lock()
+	for key, listener := range listenerRegistry.inherited {
+		serverLog.Info("Upgrade: closing inherited listener, it is no longer configured", "listener", key)
+		listener.Close()
+	}
+	listenerRegistry.inherited = nil
+	listenerRegistry.mu.Unlock()
+
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	ready := os.NewFile(uintptr(fd), "upgrade-ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// keepSockets stops Unix listeners from removing their socket files on
+// close, as the new process serves them now
+func keepSockets() {
+	listenerRegistry.mu.Lock()
+	defer listenerRegistry.mu.Unlock()
+	for _, open := range listenerRegistry.open {
+		if unix, ok := open.listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// upgrade starts the executable again with the same arguments, handing
+// over every listener, and waits up to timeout for it to report it is
+// serving. On an error the new process is stopped and this one keeps
+// serving.
+func upgrade(timeout time.Duration) error {
+	if socketActivated {
+		return fmt.Errorf("the listeners belong to the systemd socket unit, restart it instead")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listenerRegistry.mu.Lock()
+	var names []inheritedListener
+	var files []*os.File
+	for _, open := range listenerRegistry.open {
+		fileListener, ok := open.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := fileListener.File()
+		if err != nil {
+			listenerRegistry.mu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("cannot hand over %s: %v", displayAddress(open.Network, open.Address), err)
+		}
+		names = append(names, open.inheritedListener)
+		files = append(files, file)
+	}
+	listenerRegistry.mu.Unlock()
+	defer closeFiles(files)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	encoded, _ := json.Marshal(names)
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, upgradeListenersEnv+"=") && !strings.HasPrefix(variable, upgradeReadyEnv+"=") {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		upgradeListenersEnv+"="+string(encoded),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	serverLog.Info("Upgrade: started new process, waiting for it to serve", "executable", executable, "pid", cmd.Process.Pid, "timeout", timeout.String())
+
+	// A process exiting or failing before it is ready closes the pipe
+	// without writing
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := ready.Read(b); n == 1 {
+			result <- nil
+			return
+		}
+		result <- fmt.Errorf("new process exited before serving")
+	}()
+
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process not serving after %s", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// The new process outlives this one
+	cmd.Process.Release()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
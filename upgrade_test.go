@@ -0,0 +1,230 @@
+package gosp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set in the environment of the test binary run as a gosp server, to the
+// file naming the release it serves
+const upgradeReleaseEnv = "GOSP_TEST_RELEASE"
+
+// TestMain runs the test binary as the server when the upgrade test starts
+// it, which an upgrade starts again as its new process
+func TestMain(m *testing.M) {
+	if file := os.Getenv(upgradeReleaseEnv); file != "" {
+		serveRelease(file)
+	}
+	os.Exit(m.Run())
+}
+
+// serveRelease serves the root the release file names at startup, as a
+// newly deployed binary would, noting its pid for the test to stop it. A
+// release of "hang" never gets to serve.
+func serveRelease(file string) {
+	release, err := os.ReadFile(file)
+	if err != nil {
+		fatal(serverLog, "No release", "err", err)
+	}
+	pids, err := os.OpenFile(file+".pids", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fatal(serverLog, "No pid file", "err", err)
+	}
+	fmt.Fprintln(pids, os.Getpid())
+	pids.Close()
+
+	if string(release) == "hang" {
+		select {}
+	}
+	os.Setenv("GOSP_ROOT", string(release))
+	Main()
+	os.Exit(0)
+}
+
+// A SIGUSR2 upgrade hands the listener to the new release without a
+// request failing, while one that never serves is stopped at
+// --upgrade-timeout and the old release keeps serving
+func TestUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts servers")
+	}
+	dir := t.TempDir()
+	for _, version := range []string{"v1", "v2"} {
+		writeFiles(t, filepath.Join(dir, version), map[string]string{
+			"index.html": `<%@include file="includes/version.html" %> home`,
+			"about.html": `<%@include file="includes/version.html" %> about`,
+		})
+		writeFiles(t, filepath.Join(dir, version, "includes"), map[string]string{"version.html": version})
+	}
+	writeFiles(t, dir, map[string]string{"routes.xml": "<routes/>"})
+	release := filepath.Join(dir, "release")
+	deploy := func(version string) {
+		t.Helper()
+		if version != "hang" {
+			version = filepath.Join(dir, version)
+		}
+		if err := os.WriteFile(release, []byte(version), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		pids, _ := os.ReadFile(release + ".pids")
+		for _, pid := range strings.Fields(string(pids)) {
+			if n, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(n, syscall.SIGKILL)
+			}
+		}
+	})
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	log, err := os.Create(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	deploy("v1")
+	old := exec.Command(os.Args[0], "--listen", addr, "--config", filepath.Join(dir, "routes.xml"),
+		"--mode", "prod", "--watch=false", "--upgrade-timeout", "1s", "--shutdown-timeout", "5s", "--access-log", filepath.Join(dir, "access.log"))
+	old.Env = append(os.Environ(), upgradeReleaseEnv+"="+release)
+	old.Stdout, old.Stderr = log, log
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- old.Wait() }()
+	defer func() {
+		if t.Failed() {
+			logged, _ := os.ReadFile(log.Name())
+			t.Logf("server log:\n%s", logged)
+		}
+	}()
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	fetch := func(path string) (string, error) {
+		res, err := client.Get("http://" + addr + path)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s: %d %q", path, res.StatusCode, body)
+		}
+		return string(body), err
+	}
+	// waitFor polls until the page answers want
+	waitFor := func(want string) {
+		t.Helper()
+		var body string
+		var err error
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if body, err = fetch("/"); err == nil && body == want {
+				return
+			}
+		}
+		t.Fatalf("waiting for %q: %q %v", want, body, err)
+	}
+	waitFor("v1 home")
+
+	// Traffic throughout the upgrades, every request answered by a release
+	stop := make(chan struct{})
+	var traffic sync.WaitGroup
+	var served atomic.Int64
+	var failures []string
+	var failuresMu sync.Mutex
+	for i := 0; i < 4; i++ {
+		traffic.Add(1)
+		go func() {
+			defer traffic.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, page := range []string{"home", "about"} {
+					path := "/"
+					if page != "home" {
+						path += page
+					}
+					body, err := fetch(path)
+					if err == nil && (body == "v1 "+page || body == "v2 "+page) {
+						served.Add(1)
+						continue
+					}
+					failuresMu.Lock()
+					failures = append(failures, fmt.Sprintf("%s: %q %v", path, body, err))
+					failuresMu.Unlock()
+				}
+			}
+		}()
+	}
+	stopTraffic := func() {
+		close(stop)
+		traffic.Wait()
+		for _, failure := range failures {
+			t.Error(failure)
+		}
+	}
+	defer func() {
+		select {
+		case <-stop:
+		default:
+			stopTraffic()
+		}
+	}()
+
+	// A release that never serves leaves the old one serving
+	deploy("hang")
+	if err := old.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("old release exited on a failed upgrade: %v", err)
+	case <-time.After(2 * time.Second):
+	}
+	if body, err := fetch("/"); err != nil || body != "v1 home" {
+		t.Fatalf("after the failed upgrade: %q %v", body, err)
+	}
+
+	deploy("v2")
+	if err := old.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("old release exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("old release still running after the upgrade")
+	}
+	waitFor("v2 home")
+	if body, err := fetch("/about"); err != nil || body != "v2 about" {
+		t.Errorf("after the upgrade: %q %v", body, err)
+	}
+
+	stopTraffic()
+	if served.Load() == 0 {
+		t.Error("no request served during the upgrades")
+	}
+}
@@ -0,0 +1,303 @@
+package gosp
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gosp/engine"
+)
+
+// Directives checked by the validator, which must make up the whole tag.
+// Includes, attributes and code tags are matched as the processor does.
+var (
+	validatePageRegex   = regexp.MustCompile(`^<%@page\s+([^%]*)%>$`)
+	validateHeaderRegex = regexp.MustCompile(`^<%@header\s+name="([^"]+)"\s+value="([^"]*)"\s*%>$`)
+)
+
+// templateProblem is an error found in a template without rendering it
+type templateProblem struct {
+	file    string
+	line    int
+	message string
+}
+
+func (p templateProblem) String() string {
+	if p.line == 0 {
+		return fmt.Sprintf("%s: %s", p.file, p.message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.file, p.line, p.message)
+}
+
+// validateTemplates checks every template under the server's root and each
+// tenant root, and the templates the routes name, without a request.
+// Problems of an include are reported once, however many templates
+// include it.
+func (srv *server) validateTemplates(routes *RouteConfig) []templateProblem {
+	root, tenantsDir := srv.options.root, srv.options.tenantsDir
+	problems := srv.files.validateRoot([]string{root}, srv.largeTemplates)
+	if tenantsDir != "" {
+		entries, _ := os.ReadDir(tenantsDir)
+		for _, entry := range entries {
+			if entry.IsDir() && tenantNameRegex.MatchString(entry.Name()) {
+				problems = append(problems, srv.files.validateRoot([]string{filepath.Join(tenantsDir, entry.Name()), root}, srv.largeTemplates)...)
+			}
+		}
+	}
+
+	// Tenants may each have the file, so only a single root is checked
+	if tenantsDir == "" {
+		for _, route := range routes.effectiveRoutes() {
+			if route.File == "" || route.spa != nil || route.static != nil || route.AliasRedirect() != "" {
+				continue
+			}
+			if _, ok := srv.files.findInRoots([]string{root}, route.File); !ok {
+				problems = append(problems, templateProblem{file: route.source, message: fmt.Sprintf("route %s: template %s not found", route.Path, route.File)})
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var unique []templateProblem
+	for _, problem := range problems {
+		if key := problem.String(); !seen[key] {
+			seen[key] = true
+			unique = append(unique, problem)
+		}
+	}
+	sort.SliceStable(unique, func(i, j int) bool {
+		if unique[i].file != unique[j].file {
+			return unique[i].file < unique[j].file
+		}
+		return unique[i].line < unique[j].line
+	})
+	return unique
+}
+
+// validateRoot checks the templates under the first root, resolving
+// includes against all of them, skipping those over the size bounds
+func (f *siteFS) validateRoot(roots []string, sizes templateSizes) []templateProblem {
+	var problems []templateProblem
+	f.walkRoot(roots[0], func(path string, info os.FileInfo, err error) error {
+		// Templates too large to render are served as they are
+		if err != nil || info.IsDir() || !f.isPageFile(path) || f.isStaticFile(path) || !sizes.processes(info.Size()) {
+			return nil
+		}
+		if rel, err := filepath.Rel(roots[0], path); err == nil {
+			problems = append(problems, f.validateTemplate(roots, filepath.ToSlash(rel))...)
+		}
+		return nil
+	})
+	return problems
+}
+
+// segment maps a stretch of the expanded template back to its file
+type segment struct {
+	start  int
+	file   string
+	offset int
+}
+
+// templateValidator expands a template's includes the way the processor
+// does, recording where each stretch came from so problems found in the
+// expanded source point at a file and line
+type templateValidator struct {
+	files    *siteFS
+	roots    []string
+	sources  map[string]string
+	segments []segment
+	expanded strings.Builder
+	problems []templateProblem
+}
+
+// validateTemplate checks one template and everything it includes
+func (f *siteFS) validateTemplate(roots []string, name string) []templateProblem {
+	v := &templateValidator{files: f, roots: roots, sources: make(map[string]string)}
+	fullPath, _ := f.findInRoots(roots, name)
+	v.expand(fullPath, nil)
+	v.checkBlocks()
+	return v.problems
+}
+
+func (v *templateValidator) problem(file string, offset int, format string, args ...interface{}) {
+	line := 0
+	if source, ok := v.sources[file]; ok {
+		line = strings.Count(source[:offset], "\n") + 1
+	}
+	v.problems = append(v.problems, templateProblem{file: file, line: line, message: fmt.Sprintf(format, args...)})
+}
+
+// expand appends a file with its includes expanded, checking its tags
+func (v *templateValidator) expand(file string, stack []string) {
+	content, err := v.files.readRootFile(file)
+	if err != nil {
+		v.problems = append(v.problems, templateProblem{file: file, message: err.Error()})
+		return
+	}
+	source := v.decode(file, content)
+	v.sources[file] = source
+	v.checkTags(file, source)
+
+	last := 0
+	for _, loc := range engine.IncludePattern.FindAllStringSubmatchIndex(source, -1) {
+		v.segments = append(v.segments, segment{start: v.expanded.Len(), file: file, offset: last})
+		v.expanded.WriteString(source[last:loc[0]])
+		last = loc[1]
+
+		name := source[loc[2]:loc[3]]
+		included, ok := v.files.findInRoots(v.roots, name)
+		if !ok {
+			v.problem(file, loc[0], "included file %s not found", name)
+			continue
+		}
+		if containsString(stack, included) || included == file {
+			v.problem(file, loc[0], "include cycle through %s", name)
+			continue
+		}
+		v.expand(included, append(stack, file))
+	}
+	v.segments = append(v.segments, segment{start: v.expanded.Len(), file: file, offset: last})
+	v.expanded.WriteString(source[last:])
+}
+
+// decode converts a file to UTF-8 like the processor, reporting charsets
+// it doesn't know
+func (v *templateValidator) decode(file string, content []byte) string {
+	if matches := pageEncodingRegex.FindSubmatch(content); matches != nil {
+		if err := validateCharset(string(matches[1])); err != nil {
+			v.problems = append(v.problems, templateProblem{file: file, line: strings.Count(string(content[:len(content)-len(content[len(matches[0]):])]), "\n") + 1, message: "pageEncoding: " + err.Error()})
+			return string(content)
+		}
+	}
+	return decodeTemplate(file, content)
+}
+
+// checkTags reports unterminated tags and malformed directives in a file
+func (v *templateValidator) checkTags(file, source string) {
+	for _, tok := range engine.Lex(source) {
+		start, tag := tok.Start, source[tok.Start:tok.End]
+		if tok.Kind == engine.UnclosedToken {
+			v.problem(file, start, "tag is never closed with %%>")
+			continue
+		}
+		if tok.Kind != engine.DirectiveToken {
+			continue
+		}
+		directive := strings.Fields(tok.Body)
+		switch {
+		case len(directive) == 0:
+			v.problem(file, start, "empty directive")
+		case directive[0] == "include":
+			if !engine.IncludePattern.MatchString(tag) {
+				v.problem(file, start, "malformed include directive, expected <%%@include file=\"...\" %%>")
+			}
+		case directive[0] == "header":
+			if !validateHeaderRegex.MatchString(tag) {
+				v.problem(file, start, "malformed header directive, expected <%%@header name=\"...\" value=\"...\" %%>")
+			}
+		case directive[0] == "page":
+			matches := validatePageRegex.FindStringSubmatch(tag)
+			if matches == nil {
+				v.problem(file, start, "malformed page directive")
+				continue
+			}
+			for _, attr := range engine.AttrPattern.FindAllStringSubmatch(matches[1], -1) {
+				switch attr[1] {
+				case "contentType":
+					if _, _, err := mime.ParseMediaType(attr[2]); err != nil {
+						v.problem(file, start, "malformed contentType %q: %v", attr[2], err)
+					}
+				case "charset":
+					if err := validateCharset(attr[2]); err != nil {
+						v.problem(file, start, "charset: %v", err)
+					}
+				}
+			}
+		default:
+			v.problem(file, start, "unknown directive %s", directive[0])
+		}
+	}
+}
+
+// checkBlocks matches the if, else and end tags of the expanded source, as
+// blocks may open in one include and close in another
+func (v *templateValidator) checkBlocks() {
+	expanded := v.expanded.String()
+	var open []int
+	for _, tok := range engine.Lex(expanded) {
+		if tok.Kind != engine.CodeToken {
+			continue
+		}
+		keyword, _, ok := engine.ControlTag(tok.Body)
+		if !ok {
+			continue
+		}
+		switch {
+		case keyword == "if":
+			open = append(open, tok.Start)
+		case len(open) == 0:
+			v.problemAt(tok.Start, keyword+" without if")
+		case keyword == "end":
+			open = open[:len(open)-1]
+		}
+	}
+	for _, offset := range open {
+		v.problemAt(offset, "if block without end")
+	}
+}
+
+// problemAt reports a problem at an offset of the expanded source
+func (v *templateValidator) problemAt(offset int, message string) {
+	i := sort.Search(len(v.segments), func(i int) bool { return v.segments[i].start > offset }) - 1
+	if i < 0 {
+		return
+	}
+	seg := v.segments[i]
+	v.problem(seg.file, seg.offset+offset-seg.start, "%s", message)
+}
+
+// logTemplateProblems logs the problems found, reporting whether there
+// were any
+func logTemplateProblems(problems []templateProblem) bool {
+	for _, problem := range problems {
+		renderLog.Error(problem.message, "template", problem.file, "line", problem.line)
+	}
+	return len(problems) > 0
+}
+
+// revalidation runs the validation again once files stop changing, so a
+// save touching several files logs one result
+type revalidation struct {
+	server *server
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	routes *RouteConfig
+}
+
+// follow checks the templates of another route config from now on
+func (r *revalidation) follow(routes *RouteConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = routes
+}
+
+func (r *revalidation) schedule() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	routes := r.routes
+	r.timer = time.AfterFunc(200*time.Millisecond, func() {
+		if !logTemplateProblems(r.server.validateTemplates(routes)) {
+			renderLog.Info("Templates validated")
+		}
+	})
+}
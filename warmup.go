@@ -0,0 +1,155 @@
+package gosp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// warmupState tracks --warmup, which reads the templates ahead of the first
+// requests so they don't all pay for cold file reads
+type warmupState struct {
+	// First, for 64-bit atomic access on 32-bit platforms
+	warmed   int64
+	failed   int64
+	duration int64
+
+	total int
+	done  int32
+}
+
+// warmupTemplates lists the templates of a site --warmup names: all of
+// those under its root, those its routes render, or a comma-separated list
+func warmupTemplates(spec string, s *site) ([]string, error) {
+	switch spec {
+	case "all":
+		var names []string
+		err := s.files.walkRoot(s.root, func(path string, info os.FileInfo, err error) error {
+			// Templates too large to render have nothing to warm
+			if err != nil || info.IsDir() || !s.files.isPageFile(path) || s.files.isStaticFile(path) || !s.largeTemplates.processes(info.Size()) {
+				return err
+			}
+			rel, err := filepath.Rel(s.root, path)
+			if err == nil {
+				names = append(names, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		return names, err
+	case "routes":
+		seen := make(map[string]bool)
+		var names []string
+		for _, route := range s.routes.effectiveRoutes() {
+			if route.File == "" || route.spa != nil || route.static != nil || seen[route.File] {
+				continue
+			}
+			seen[route.File] = true
+			names = append(names, route.File)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	names := splitList(spec)
+	for _, name := range names {
+		if !s.files.templateExists(s.root, name) {
+			return nil, fmt.Errorf("--warmup template %q not found in %s", name, s.root)
+		}
+	}
+	return names, nil
+}
+
+// startWarmup warms the templates in the background, holding readiness
+// back until it's done so instances get traffic once warm
+func startWarmup(s *site, names []string, render bool) {
+	w := &warmupState{total: len(names)}
+	s.health.addCheck("warmup", func() error {
+		if atomic.LoadInt32(&w.done) == 0 {
+			return fmt.Errorf("%d of %d templates warmed", atomic.LoadInt64(&w.warmed), w.total)
+		}
+		return nil
+	})
+	registerWarmupMetrics(w)
+	go w.run(s, names, render)
+}
+
+func (w *warmupState) run(s *site, names []string, render bool) {
+	renderLog.Info("Warming up templates", "count", w.total)
+	start := time.Now()
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+
+	for _, name := range names {
+		if err := warmTemplate(s, name, render); err != nil {
+			atomic.AddInt64(&w.failed, 1)
+			renderLog.Debug("Warm-up failed", "template", name, "err", err)
+		}
+		atomic.AddInt64(&w.warmed, 1)
+
+		select {
+		case <-progress.C:
+			renderLog.Info("Warming up templates", "warmed", atomic.LoadInt64(&w.warmed), "count", w.total)
+		default:
+		}
+	}
+
+	elapsed := time.Since(start)
+	atomic.StoreInt64(&w.duration, int64(elapsed))
+	atomic.StoreInt32(&w.done, 1)
+	renderLog.Info("Warm-up done", "count", w.total, "failed", atomic.LoadInt64(&w.failed), "duration", elapsed.String())
+}
+
+// warmTemplate parses a template of a site and the includes it pulls in
+// into the template cache, and with render renders it once for an empty
+// GET request, its output discarded
+func warmTemplate(s *site, name string, render bool) (err error) {
+	fullPath := filepath.Join(s.root, filepath.FromSlash(name))
+	processor := &TemplateProcessor{roots: []string{s.root}, files: s.files, templates: s.templates, ctx: context.Background()}
+	if _, err := processor.loadTemplate(fullPath, name); err != nil {
+		return err
+	}
+	if !render {
+		return nil
+	}
+
+	// Templates may expect what the request middlewares set, so a panic
+	// fails the warm-up rather than the server
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/"+name, nil), httptest.NewRecorder())
+	c.Set(siteKey, s)
+	if err := renderTemplate(c, name, http.StatusOK); err != nil {
+		return err
+	}
+	if status := c.Response().Status; status >= 400 {
+		return fmt.Errorf("rendered with status %d", status)
+	}
+	return nil
+}
+
+func registerWarmupMetrics(w *warmupState) {
+	registerMetric("gosp_warmup_templates", "gauge", "Templates to warm up at startup", func() float64 {
+		return float64(w.total)
+	})
+	registerMetric("gosp_warmup_warmed", "gauge", "Templates warmed up so far", func() float64 {
+		return float64(atomic.LoadInt64(&w.warmed))
+	})
+	registerMetric("gosp_warmup_failed", "gauge", "Templates that failed to warm up", func() float64 {
+		return float64(atomic.LoadInt64(&w.failed))
+	})
+	registerMetric("gosp_warmup_duration_seconds", "gauge", "Time the warm-up took, 0 until it's done", func() float64 {
+		return time.Duration(atomic.LoadInt64(&w.duration)).Seconds()
+	})
+}
@@ -0,0 +1,70 @@
+package gosp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// parseWatchDirs checks the directories of --watch-dir, leaving out those
+// already watched for being within a root or another of them
+func parseWatchDirs(dirs []string, roots []string) ([]string, error) {
+	var extra []string
+	covered := make([]string, 0, len(roots)+len(dirs))
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(root); err == nil {
+			covered = append(covered, abs)
+		}
+	}
+
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid --watch-dir %q: not a directory", dir)
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --watch-dir %q: %v", dir, err)
+		}
+		within := false
+		for _, root := range covered {
+			if pathWithin(abs, root) {
+				within = true
+				break
+			}
+		}
+		if within {
+			watcherLog.Debug("Already watched", "dir", dir)
+			continue
+		}
+		covered = append(covered, abs)
+		extra = append(extra, dir)
+	}
+	return extra, nil
+}
+
+// watchDirOf returns the --watch-dir holding a path, "" for the roots
+func (fw *FileWatcher) watchDirOf(path string) string {
+	path = filepath.Clean(path)
+	for _, dir := range fw.extraDirs {
+		if pathWithin(path, dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// logOutside logs the changes of files under a --watch-dir that none of
+// the config files nor the API keys files are. Templates can't read them,
+// as they are outside the roots, so there is nothing else to refresh.
+func (fw *FileWatcher) logOutside(event fsnotify.Event, dir string) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	watcherLog.Debug("Changed", "file", event.Name, "op", event.Op.String(), "watch-dir", dir)
+}
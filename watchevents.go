@@ -0,0 +1,210 @@
+package gosp
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ChangeKind is what happened to a file the watcher saw change
+type ChangeKind string
+
+const (
+	ChangeCreated  ChangeKind = "created"
+	ChangeModified ChangeKind = "modified"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeRenamed  ChangeKind = "renamed"
+)
+
+// ChangeEvent is a change of a file under the roots or a --watch-dir,
+// reported once the watcher has flushed what was built from it
+type ChangeEvent struct {
+	// Absolute path of the file or directory
+	Path string
+	Kind ChangeKind
+	Time time.Time
+}
+
+// How many changes a subscriber may fall behind by before the oldest are
+// dropped
+const changeBuffer = 64
+
+// The subscribers of Subscribe, fed by the server of Main
+var changes = &changeFeed{}
+
+// changeFeed hands the changes to the subscribers without waiting on
+// them: one that falls behind loses its oldest changes, counted in dropped
+type changeFeed struct {
+	mu          sync.Mutex
+	subscribers []chan ChangeEvent
+	dropped     atomic.Uint64
+}
+
+// Subscribe returns a channel of the changes the file watcher of Main
+// handles, for a program running the command to invalidate its own caches
+// as templates change. Changes of the route config, which reload the site,
+// and of ignored files aren't sent. The channel holds up to 64 changes; a
+// subscriber falling further behind loses the oldest, which DroppedChanges
+// counts. Subscribe before Main: there is no unsubscribing, and handlers
+// made by New follow their changes with the Watch option.
+func Subscribe() <-chan ChangeEvent {
+	return changes.subscribe()
+}
+
+// DroppedChanges returns how many changes subscribers of Subscribe lost by
+// falling behind
+func DroppedChanges() uint64 {
+	return changes.dropped.Load()
+}
+
+// subscribe adds a subscriber to the feed
+func (feed *changeFeed) subscribe() <-chan ChangeEvent {
+	subscriber := make(chan ChangeEvent, changeBuffer)
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	feed.subscribers = append(feed.subscribers, subscriber)
+	return subscriber
+}
+
+// publish sends a change to every subscriber, making room by dropping
+// the oldest one waiting
+func (feed *changeFeed) publish(change ChangeEvent) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	for _, subscriber := range feed.subscribers {
+		for {
+			select {
+			case subscriber <- change:
+			default:
+				select {
+				case <-subscriber:
+					feed.dropped.Add(1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// kindOf returns the kind of a change from the ops seen during its debounce
+// window, the last state of the file telling a write from a removal
+func kindOf(op fsnotify.Op, name string) (ChangeKind, bool) {
+	_, err := os.Lstat(name)
+	switch {
+	case op&(fsnotify.Remove|fsnotify.Rename) != 0 && os.IsNotExist(err):
+		if op&fsnotify.Rename != 0 {
+			return ChangeRenamed, true
+		}
+		return ChangeRemoved, true
+	case op&fsnotify.Create != 0:
+		return ChangeCreated, true
+	case op&(fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0:
+		return ChangeModified, true
+	}
+	return "", false
+}
+
+// watcherHealth is how the watcher fares, for the admin endpoint and the
+// metrics
+type watcherHealth struct {
+	mu        sync.Mutex
+	lastEvent time.Time
+	lastError string
+	errorTime time.Time
+	errors    uint64
+}
+
+// publish records the changes the watcher handled and sends them to the
+// subscribers
+func (fw *FileWatcher) publish(events []fsnotify.Event) {
+	now := time.Now()
+	fw.health.mu.Lock()
+	fw.health.lastEvent = now
+	fw.health.mu.Unlock()
+
+	for _, event := range events {
+		kind, ok := kindOf(event.Op, event.Name)
+		if !ok {
+			continue
+		}
+		path, err := filepath.Abs(event.Name)
+		if err != nil {
+			path = event.Name
+		}
+		fw.server.changes.publish(ChangeEvent{Path: path, Kind: kind, Time: now})
+	}
+}
+
+// failed records an error of the watcher, which stops seeing some changes
+// until it is fixed: a full watch limit, a directory it can't read
+func (fw *FileWatcher) failed(err error) {
+	watcherLog.Error("Watcher error", "err", err)
+	fw.health.mu.Lock()
+	defer fw.health.mu.Unlock()
+	fw.health.lastError = err.Error()
+	fw.health.errorTime = time.Now()
+	fw.health.errors++
+}
+
+// watchedDirs counts the directories watched, the files of the config
+// aside
+func (fw *FileWatcher) watchedDirs() int {
+	dirs := 0
+	for _, path := range fw.watcher.WatchList() {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dirs++
+		}
+	}
+	return dirs
+}
+
+// status reports the watcher for the admin endpoint
+func (fw *FileWatcher) status() adminWatcher {
+	status := adminWatcher{
+		Enabled: true,
+		Mode:    fw.mode,
+		Roots:   fw.roots,
+		Dirs:    fw.watchedDirs(),
+		Watched: fw.watcher.WatchList(),
+		Dropped: fw.server.changes.dropped.Load(),
+	}
+	fw.health.mu.Lock()
+	defer fw.health.mu.Unlock()
+	if !fw.health.lastEvent.IsZero() {
+		last := fw.health.lastEvent
+		status.LastEvent = &last
+	}
+	if fw.health.errors > 0 {
+		at := fw.health.errorTime
+		status.Errors, status.LastError, status.LastErrorAt = fw.health.errors, fw.health.lastError, &at
+	}
+	return status
+}
+
+func registerWatcherMetrics(fw *FileWatcher) {
+	registerMetric("gosp_watcher_dirs", "gauge", "Directories the file watcher watches", func() float64 {
+		return float64(fw.watchedDirs())
+	})
+	registerMetric("gosp_watcher_last_event_timestamp_seconds", "gauge", "When the file watcher last handled a change, 0 before the first", func() float64 {
+		fw.health.mu.Lock()
+		defer fw.health.mu.Unlock()
+		if fw.health.lastEvent.IsZero() {
+			return 0
+		}
+		return float64(fw.health.lastEvent.UnixNano()) / 1e9
+	})
+	registerMetric("gosp_watcher_errors_total", "counter", "Errors of the file watcher", func() float64 {
+		fw.health.mu.Lock()
+		defer fw.health.mu.Unlock()
+		return float64(fw.health.errors)
+	})
+	registerMetric("gosp_watcher_dropped_changes_total", "counter", "Changes subscribers lost by falling behind", func() float64 {
+		return float64(fw.server.changes.dropped.Load())
+	})
+}
@@ -0,0 +1,40 @@
+package gosp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const defaultWatchIgnore = ".git,node_modules,*.swp,*~,.DS_Store"
+
+// parseWatchIgnore splits --watch-ignore into its patterns
+func parseWatchIgnore(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid --watch-ignore pattern %q: patterns match names, without slashes", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --watch-ignore pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ignores reports whether the watcher leaves a path alone, by its name.
+// Ignored directories aren't watched, so nothing below them is reported.
+func (fw *FileWatcher) ignores(path string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range fw.ignore {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package gosp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Filesystems whose changes don't reach the local notifications: network
+// filesystems and the shared folders of VMs, Docker's on macOS among them
+var unreliableFilesystems = []string{
+	"nfs", "nfs4", "cifs", "smb3", "smbfs", "9p", "vboxsf", "prl_fs", "vmhgfs",
+	"fakeowner", "fuse.grpcfuse", "fuse.osxfs", "fuse.vmhgfs-fuse", "fuse.sshfs",
+}
+
+// checkWatchMode validates --watch-mode and --watch-interval
+func checkWatchMode(options *serverOptions) error {
+	switch options.watchMode {
+	case "auto", "inotify", "poll":
+	default:
+		return fmt.Errorf("invalid --watch-mode %q: use auto, inotify or poll", options.watchMode)
+	}
+	if options.watchInterval <= 0 {
+		return fmt.Errorf("invalid --watch-interval %s: must be positive", options.watchInterval)
+	}
+	return nil
+}
+
+// watchRoots watches the roots and the directories below them in the mode
+// of --watch-mode. Auto uses notifications unless a root is on a
+// filesystem known to lose them, they can't be had, or a file written to
+// the root isn't reported, and polls otherwise.
+func (fw *FileWatcher) watchRoots(roots []string) error {
+	mode := fw.server.options.watchMode
+	poll := mode == "poll"
+	if mode == "auto" {
+		for _, root := range roots {
+			if fsType, unreliable := unreliableMount(root); unreliable {
+				watcherLog.Info("Polling for changes, notifications are unreliable on this filesystem", "root", root, "fs", fsType)
+				poll = true
+				break
+			}
+		}
+	}
+
+	if !poll {
+		err := fw.addRoots(roots, "inotify")
+		switch {
+		case err == nil && mode == "auto" && !probeNotifications(fw.watcher, roots[0]):
+			watcherLog.Warn("File notifications not observed, polling for changes instead", "root", roots[0])
+			fw.watcher.Close()
+		case err == nil:
+			return nil
+		case mode == "auto":
+			watcherLog.Warn("Could not watch with notifications, polling for changes instead", "err", err)
+		default:
+			return err
+		}
+	}
+	return fw.addRoots(roots, "poll")
+}
+
+// addRoots sets up the watcher of a mode and adds the roots to it
+func (fw *FileWatcher) addRoots(roots []string, mode string) error {
+	fw.mode = mode
+	if mode == "poll" {
+		fw.watcher = newPollWatcher(fw.server.options.watchInterval)
+	} else {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		fw.watcher = notifyWatcher{watcher}
+	}
+	for _, root := range roots {
+		if err := fw.addTree(root); err != nil {
+			fw.watcher.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// probeNotifications writes a file to a watched directory and reports
+// whether the watcher saw it, waiting for its removal to be seen as well so
+// the probe leaves no events behind. A root that can't be written to is
+// trusted.
+func probeNotifications(watcher watchBackend, dir string) bool {
+	f, err := os.CreateTemp(dir, ".gosp-watch-probe-*")
+	if err != nil {
+		watcherLog.Debug("Could not write the watch probe, trusting notifications", "dir", dir, "err", err)
+		return true
+	}
+	probe := filepath.Clean(f.Name())
+	f.Close()
+
+	observed := awaitEvent(watcher, probe, fsnotify.Create)
+	os.Remove(probe)
+	if observed {
+		awaitEvent(watcher, probe, fsnotify.Remove)
+	}
+	return observed
+}
+
+// awaitEvent waits a second for an op of a file, dropping the other events
+// seen in the meantime
+func awaitEvent(watcher watchBackend, file string, op fsnotify.Op) bool {
+	timeout := time.NewTimer(time.Second)
+	defer timeout.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.events():
+			if !ok {
+				return false
+			}
+			if filepath.Clean(event.Name) == file && event.Op&op != 0 {
+				return true
+			}
+		case <-watcher.errors():
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+// unreliableMount returns the type of the filesystem holding a path, from
+// the mount table of Linux, and whether it is one of unreliableFilesystems.
+// Elsewhere the type isn't known, leaving the probe to tell.
+func unreliableMount(path string) (string, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	// The last mount of the longest mount point holding the path
+	var fsType, at string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		point := unescapeMountPoint(fields[1])
+		if (pathWithin(path, point) || point == "/") && len(point) >= len(at) {
+			fsType, at = fields[2], point
+		}
+	}
+	for _, unreliable := range unreliableFilesystems {
+		if fsType == unreliable {
+			return fsType, true
+		}
+	}
+	return fsType, false
+}
+
+// unescapeMountPoint decodes the octal escapes of the mount table, \040
+// for a space
+func unescapeMountPoint(point string) string {
+	if !strings.Contains(point, `\`) {
+		return point
+	}
+	var b strings.Builder
+	for i := 0; i < len(point); i++ {
+		if point[i] == '\\' && i+3 < len(point) {
+			if c, err := strconv.ParseUint(point[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(point[i])
+	}
+	return b.String()
+}
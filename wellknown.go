@@ -0,0 +1,123 @@
+package gosp
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Files browsers and crawlers ask for on their own, served as they are
+// from the site root
+var wellKnownFiles = []string{
+	"favicon.ico",
+	"robots.txt",
+	"apple-touch-icon.png",
+	"apple-touch-icon-precomposed.png",
+}
+
+// Prefix of RFC 8615 well-known URIs, served as they are as well
+const wellKnownPrefix = "/.well-known/"
+
+// Set on requests for missing well-known files, which the access log leaves
+// out unless --access-log-missing-well-known
+const wellKnownMissingKey = "gosp.wellKnownMissing"
+
+// Content types of well-known files the mime package gets wrong or doesn't
+// know, by extension or by name for files without one
+var wellKnownTypes = map[string]string{
+	".ico":                       "image/x-icon",
+	".txt":                       "text/plain; charset=utf-8",
+	".json":                      "application/json",
+	"apple-app-site-association": "application/json",
+	"openid-configuration":       "application/json",
+	"oauth-authorization-server": "application/json",
+}
+
+// wellKnownType returns the content type of a well-known file, empty to let
+// it be detected from the content
+func wellKnownType(name string) string {
+	if contentType, ok := wellKnownTypes[path.Ext(name)]; ok {
+		return contentType
+	}
+	if contentType, ok := wellKnownTypes[path.Base(name)]; ok {
+		return contentType
+	}
+	return ""
+}
+
+// setupWellKnown serves the well-known files from dir, bypassing templates
+// and file-based routing. Routes configured for the same paths win, as they
+// are registered later.
+func setupWellKnown(e *echo.Echo, dir, cache string) {
+	cacheControl, _ := cacheControlValue(cache)
+	handler := wellKnownHandler(dir, cacheControl)
+	for _, name := range wellKnownFiles {
+		e.GET("/"+name, handler)
+		e.HEAD("/"+name, handler)
+	}
+	e.GET(wellKnownPrefix+"*", handler)
+	e.HEAD(wellKnownPrefix+"*", handler)
+}
+
+// wellKnownHandler sends a file under dir with its content type and cache
+// policy, or a bare 404 without the error page when there is none
+func wellKnownHandler(dir, cacheControl string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := strings.TrimPrefix(path.Clean("/"+c.Request().URL.Path), "/")
+		dirs := []string{dir}
+		if t := tenantFor(c); t != nil {
+			dirs = []string{t.root, dir}
+		}
+		fullPath, ok := siteOf(c).files.findInRoots(dirs, name)
+		if !ok {
+			c.Set(wellKnownMissingKey, true)
+			return c.NoContent(http.StatusNotFound)
+		}
+
+		header := c.Response().Header()
+		if contentType := wellKnownType(name); contentType != "" {
+			header.Set(echo.HeaderContentType, contentType)
+		}
+		if cacheControl != "" {
+			header.Set(echo.HeaderCacheControl, cacheControl)
+		}
+		return c.File(fullPath)
+	}
+}
+
+// collectWellKnown embeds the well-known files under dir
+func collectWellKnown(site *compiledSite, dir string) error {
+	for _, name := range wellKnownFiles {
+		err := site.readFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		compileLog.Info("Added well-known file", "file", name)
+	}
+
+	base := filepath.Join(dir, filepath.FromSlash(strings.Trim(wellKnownPrefix, "/")))
+	return filepath.Walk(base, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && file == base {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if err := site.readFile(file); err != nil {
+			return err
+		}
+		compileLog.Info("Added well-known file", "file", filepath.ToSlash(rel))
+		return nil
+	})
+}